@@ -0,0 +1,182 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"arisu.land/tsubaki/pkg/search"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io/ioutil"
+	"strings"
+)
+
+// checkResponse closes the response, and returns an error if the request failed.
+func checkResponse(res *esapi.Response, err error) error {
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.IsError() {
+		return fmt.Errorf("elasticsearch returned %s", res.String())
+	}
+
+	return nil
+}
+
+// createIndex creates the physical index `name` with the index's mapping. Refreshing is
+// turned off, since nothing searches it until it's backfilled.
+func createIndex(client *elasticsearch.Client, index search.Index, name string) error {
+	mapping, err := index.Mapping()
+	if err != nil {
+		return err
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(mapping, &body); err != nil {
+		return fmt.Errorf("invalid mapping of %s: %v", index.Alias, err)
+	}
+
+	settings, _ := body["settings"].(map[string]interface{})
+	if settings == nil {
+		settings = map[string]interface{}{}
+		body["settings"] = settings
+	}
+
+	settings["refresh_interval"] = "-1"
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(client.Indices.Create(
+		name,
+		client.Indices.Create.WithBody(bytes.NewReader(data)),
+	))
+}
+
+// finishIndex turns refreshing back on and refreshes the index, so its documents can be searched.
+func finishIndex(client *elasticsearch.Client, name string) error {
+	err := checkResponse(client.Indices.PutSettings(
+		strings.NewReader(`{"index":{"refresh_interval":null}}`),
+		client.Indices.PutSettings.WithIndex(name),
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(client.Indices.Refresh(client.Indices.Refresh.WithIndex(name)))
+}
+
+// indexExists returns if an index with the name exists.
+func indexExists(client *elasticsearch.Client, name string) (bool, error) {
+	res, err := client.Indices.Exists([]string{name})
+	if err != nil {
+		return false, err
+	}
+
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+
+	case 404:
+		return false, nil
+
+	default:
+		return false, fmt.Errorf("elasticsearch returned %s", res.String())
+	}
+}
+
+// deleteIndex deletes the physical index.
+func deleteIndex(client *elasticsearch.Client, name string) error {
+	return checkResponse(client.Indices.Delete([]string{name}))
+}
+
+// aliasTarget returns the physical index the alias points to. `legacy` is true if there
+// is no alias, but an index that was created with the alias' name before indices were
+// versioned. Both are empty if the index was never created.
+func aliasTarget(client *elasticsearch.Client, alias string) (target string, legacy bool, err error) {
+	res, err := client.Indices.GetAlias(client.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return "", false, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode == 404 {
+		exists, err := indexExists(client, alias)
+		return "", exists, err
+	}
+
+	if res.IsError() {
+		return "", false, fmt.Errorf("elasticsearch returned %s", res.String())
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", false, err
+	}
+
+	// The response is keyed by the physical indices the alias points to.
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", false, err
+	}
+
+	for name := range data {
+		return name, false, nil
+	}
+
+	return "", false, nil
+}
+
+// swapAlias points the alias to the `to` index, and away from the `from` index in the
+// same request, so searches never see both or neither. A legacy index with the alias'
+// name is deleted, since an alias can't have the name of an index.
+func swapAlias(client *elasticsearch.Client, alias string, from string, legacy bool, to string) error {
+	actions := make([]interface{}, 0, 2)
+	if legacy {
+		actions = append(actions, map[string]interface{}{
+			"remove_index": map[string]interface{}{"index": alias},
+		})
+	} else if from != "" {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]interface{}{"index": from, "alias": alias},
+		})
+	}
+
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": to, "alias": alias},
+	})
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(client.Indices.UpdateAliases(bytes.NewReader(body)))
+}
@@ -0,0 +1,355 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/prisma/db"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/spf13/cobra"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// document is a document that is waiting to be indexed.
+type document struct {
+	index string
+	id    string
+	body  []byte
+}
+
+// failedDocument is a document that Elasticsearch didn't index.
+type failedDocument struct {
+	document
+
+	// reason is why it failed.
+	reason string
+
+	// retryable is if the request can succeed when it's sent again, i.e, when
+	// the cluster was overloaded, and not when the document is invalid.
+	retryable bool
+}
+
+// bulkIndexer sends documents to Elasticsearch with the `_bulk` API, it keeps
+// count of how many were indexed and which ones failed.
+type bulkIndexer struct {
+	client  *elasticsearch.Client
+	workers int
+
+	// indexed is how many documents were indexed, it's updated while indexing.
+	indexed uint64
+
+	mu       sync.Mutex
+	failures []failedDocument
+}
+
+// index indexes every document from `docs` until it's closed, with a pool of `workers`
+// goroutines. The documents that failed are returned.
+func (b *bulkIndexer) index(docs <-chan document) ([]failedDocument, error) {
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        b.client,
+		NumWorkers:    b.workers,
+		FlushInterval: 5 * time.Second,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.failures = nil
+	for doc := range docs {
+		doc := doc
+		err := indexer.Add(context.TODO(), esutil.BulkIndexerItem{
+			Index:      doc.index,
+			Action:     "index",
+			DocumentID: doc.id,
+			Body:       bytes.NewReader(doc.body),
+			OnSuccess: func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem) {
+				atomic.AddUint64(&b.indexed, 1)
+			},
+			OnFailure: func(_ context.Context, _ esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+				failure := failedDocument{document: doc}
+				if err != nil {
+					failure.reason = err.Error()
+					failure.retryable = true
+				} else {
+					failure.reason = fmt.Sprintf("%s: %s", res.Error.Type, res.Error.Reason)
+					failure.retryable = res.Status == 429 || res.Status >= 500
+				}
+
+				b.mu.Lock()
+				b.failures = append(b.failures, failure)
+				b.mu.Unlock()
+			},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := indexer.Close(context.TODO()); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures, nil
+}
+
+// indexOptions are the flags that tune how documents are indexed.
+type indexOptions struct {
+	workers   int
+	batchSize int
+	retries   int
+}
+
+// addIndexFlags adds the flags of indexOptions to the command.
+func addIndexFlags(cmd *cobra.Command) {
+	cmd.Flags().IntP("workers", "w", runtime.NumCPU(), "how many workers the indexing should use.")
+	cmd.Flags().IntP("batch-size", "b", 500, "how many rows are fetched from PostgreSQL at a time.")
+	cmd.Flags().IntP("retries", "r", 3, "how many times documents that failed to index are retried.")
+}
+
+func getIndexOptions(cmd *cobra.Command) (indexOptions, error) {
+	var opts indexOptions
+	var err error
+
+	if opts.workers, err = cmd.Flags().GetInt("workers"); err != nil {
+		return opts, err
+	}
+
+	if opts.batchSize, err = cmd.Flags().GetInt("batch-size"); err != nil {
+		return opts, err
+	}
+
+	if opts.retries, err = cmd.Flags().GetInt("retries"); err != nil {
+		return opts, err
+	}
+
+	if opts.workers < 1 || opts.batchSize < 1 {
+		return opts, fmt.Errorf("--workers and --batch-size must be at least 1")
+	}
+
+	return opts, nil
+}
+
+// stream sends documents read from PostgreSQL to `docs`.
+type stream func(docs chan<- document) error
+
+// runIndexer indexes the documents from every stream and prints the progress. Documents
+// that failed and can succeed the next time are retried with a growing delay, the ones
+// that still failed are returned.
+func runIndexer(client *elasticsearch.Client, opts indexOptions, total int, streams ...stream) (uint64, []failedDocument, error) {
+	indexer := &bulkIndexer{client: client, workers: opts.workers}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				fmt.Printf("Indexed %d/%d documents...\n", atomic.LoadUint64(&indexer.indexed), total)
+			}
+		}
+	}()
+
+	// PostgreSQL is read while the previous batch is being indexed.
+	docs := make(chan document, opts.batchSize)
+	var streamErr error
+	go func() {
+		defer close(docs)
+		for _, s := range streams {
+			if streamErr = s(docs); streamErr != nil {
+				return
+			}
+		}
+	}()
+
+	failures, err := indexer.index(docs)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if streamErr != nil {
+		return 0, nil, fmt.Errorf("unable to read from PostgreSQL: %v", streamErr)
+	}
+
+	for attempt := 1; attempt <= opts.retries; attempt++ {
+		var retry, permanent []failedDocument
+		for _, failure := range failures {
+			if failure.retryable {
+				retry = append(retry, failure)
+			} else {
+				permanent = append(permanent, failure)
+			}
+		}
+
+		if len(retry) == 0 {
+			break
+		}
+
+		fmt.Printf("Retrying %d documents in %ds (attempt %d/%d)...\n", len(retry), attempt*2, attempt, opts.retries)
+		time.Sleep(time.Duration(attempt*2) * time.Second)
+
+		docs := make(chan document, len(retry))
+		for _, failure := range retry {
+			docs <- failure.document
+		}
+
+		close(docs)
+		failed, err := indexer.index(docs)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		failures = append(permanent, failed...)
+	}
+
+	return atomic.LoadUint64(&indexer.indexed), failures, nil
+}
+
+// printFailures prints the documents that couldn't be indexed.
+func printFailures(failures []failedDocument) {
+	fmt.Printf("%d documents couldn't be indexed:\n", len(failures))
+	for _, failure := range failures {
+		fmt.Printf("  - %s/%s: %s\n", failure.index, failure.id, failure.reason)
+	}
+}
+
+// streamUsers returns a stream of every user as a document of `index`. `batchSize` users
+// are fetched at a time, so the table is never loaded into memory at once. If `since` is
+// set, only the users updated after it are streamed.
+func streamUsers(prisma *db.PrismaClient, index string, since *time.Time, batchSize int) stream {
+	return func(docs chan<- document) error {
+		last := ""
+		for {
+			params := []db.UserWhereParam{db.User.ID.Gt(last)}
+			if since != nil {
+				params = append(params, db.User.UpdatedAt.Gte(*since))
+			}
+
+			users, err := prisma.User.FindMany(params...).OrderBy(
+				db.User.ID.Order(db.SortOrderAsc),
+			).Take(batchSize).Exec(context.TODO())
+
+			if err != nil {
+				return err
+			}
+
+			for _, user := range users {
+				body, err := json.Marshal(pkg.FromDbUserModel(user))
+				if err != nil {
+					return err
+				}
+
+				docs <- document{index, user.ID, body}
+			}
+
+			if len(users) < batchSize {
+				return nil
+			}
+
+			last = users[len(users)-1].ID
+		}
+	}
+}
+
+// streamProjects returns a stream of every project as a document of `index`, like streamUsers.
+func streamProjects(prisma *db.PrismaClient, index string, since *time.Time, batchSize int) stream {
+	return func(docs chan<- document) error {
+		last := ""
+		for {
+			params := []db.ProjectWhereParam{db.Project.ID.Gt(last)}
+			if since != nil {
+				params = append(params, db.Project.UpdatedAt.Gte(*since))
+			}
+
+			projects, err := prisma.Project.FindMany(params...).OrderBy(
+				db.Project.ID.Order(db.SortOrderAsc),
+			).Take(batchSize).Exec(context.TODO())
+
+			if err != nil {
+				return err
+			}
+
+			for _, project := range projects {
+				body, err := json.Marshal(pkg.FromDbProjectModel(project))
+				if err != nil {
+					return err
+				}
+
+				docs <- document{index, project.ID, body}
+			}
+
+			if len(projects) < batchSize {
+				return nil
+			}
+
+			last = projects[len(projects)-1].ID
+		}
+	}
+}
+
+// streamIndex returns the stream of the documents of the index with the alias, which are
+// written into the `target` physical index.
+func streamIndex(prisma *db.PrismaClient, alias string, target string, since *time.Time, batchSize int) stream {
+	if alias == search.UsersIndex {
+		return streamUsers(prisma, target, since, batchSize)
+	}
+
+	return streamProjects(prisma, target, since, batchSize)
+}
+
+// tableOf returns the PostgreSQL table of the documents in the index with the alias.
+func tableOf(alias string) string {
+	if alias == search.UsersIndex {
+		return "users"
+	}
+
+	return "projects"
+}
+
+// countRows returns how many rows the table has.
+func countRows(prisma *db.PrismaClient, table string) (int, error) {
+	var rows []struct {
+		Count int `json:"count"`
+	}
+
+	err := prisma.Prisma.QueryRaw(fmt.Sprintf(`SELECT COUNT(*)::int AS "count" FROM "%s"`, table)).Exec(context.TODO(), &rows)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+
+	return rows[0].Count, nil
+}
@@ -17,15 +17,11 @@
 package elastic
 
 import (
+	"arisu.land/tsubaki/pkg/search"
 	"arisu.land/tsubaki/prisma/db"
-	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
-	"runtime"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -47,7 +43,7 @@ func newIndexCommand() *cobra.Command {
 func newCreateIndexCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:          "create",
-		Short:        "Creates the newly index and update the mapping of it.",
+		Short:        "Creates the indices and their aliases, if they don't exist.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fmt.Println("Creating required indices...")
@@ -58,87 +54,34 @@ func newCreateIndexCommand() *cobra.Command {
 				return fmt.Errorf("unable to connect to elasticsearch: %v", err)
 			}
 
-			projectMappings := `{
-				"mappings": {
-					"_doc": {
-						"properties": {
-							"description": { "type": "text" },
-							"created_at": { "type": "date" },
-							"owner_id": { "type": "text" },
-							"name": { "type": "text" },
-							"id": { "type": "text" }
-						}
-					}
+			for _, index := range search.Indices {
+				target, legacy, err := aliasTarget(client, index.Alias)
+				if err != nil {
+					return err
 				}
-			}`
-
-			// Create the projects index
-			res, err := client.Indices.Create(
-				"tsubaki-projects",
-				client.Indices.Create.WithBody(strings.NewReader(projectMappings)),
-				client.Indices.Create.WithErrorTrace(),
-			)
-
-			if err != nil {
-				return err
-			}
 
-			// unmarshal it from `res`
-			defer func() {
-				_ = res.Body.Close()
-			}()
-
-			var data map[string]interface{}
-			err = json.NewDecoder(res.Body).Decode(&data)
-			if err != nil {
-				return err
-			}
+				switch {
+				case legacy || (target != "" && !upToDate(target, index)):
+					fmt.Printf("The \"%s\" index uses an older mapping, run \"tsubaki elastic reindex %s\" to update it.\n", index.Alias, index.Alias)
 
-			if res.IsError() {
-				return fmt.Errorf("unable to create index \"tsubaki-projects\":\n%v", data)
-			} else {
-				fmt.Println("Created the \"tsubaki-projects\" index!")
-			}
+				case target != "":
+					fmt.Printf("The \"%s\" index is up to date!\n", index.Alias)
 
-			// Create the users index
-			usersMappings := `{
-				"mappings": {
-					"_doc": {
-						"properties": {
-							"description": { "type": "text" },
-							"created_at": { "type": "date" },
-							"name": { "type": "text" },
-							"id": { "type": "text" }
-						}
+				default:
+					if err := createIndex(client, index, index.Name()); err != nil {
+						return fmt.Errorf("unable to create index \"%s\": %v", index.Name(), err)
 					}
-				}
-			}`
 
-			res2, err := client.Indices.Create(
-				"tsubaki-users",
-				client.Indices.Create.WithBody(strings.NewReader(usersMappings)),
-				client.Indices.Create.WithErrorTrace(),
-			)
-
-			if err != nil {
-				return err
-			}
-
-			// unmarshal it from `res`
-			defer func() {
-				_ = res2.Body.Close()
-			}()
+					if err := finishIndex(client, index.Name()); err != nil {
+						return err
+					}
 
-			var data2 map[string]interface{}
-			err = json.NewDecoder(res2.Body).Decode(&data2)
-			if err != nil {
-				return err
-			}
+					if err := swapAlias(client, index.Alias, "", false, index.Name()); err != nil {
+						return err
+					}
 
-			if res.IsError() {
-				return fmt.Errorf("unable to create index \"tsubaki-projects\":\n%v", data2)
-			} else {
-				fmt.Println("Created the \"tsubaki-users\" index!")
+					fmt.Printf("Created the \"%s\" index!\n", index.Name())
+				}
 			}
 
 			fmt.Println("Looks like we are done!")
@@ -155,17 +98,23 @@ func newIndexDataCommand() *cobra.Command {
 		Short:        "Indexes all the data from PostgreSQL",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fmt.Println("Now indexing projects and users!")
-
-			workers, err := strconv.Atoi(cmd.Flag("workers").Value.String())
+			opts, err := getIndexOptions(cmd)
 			if err != nil {
 				return err
 			}
 
-			fmt.Printf("Using %d workers...\n", workers)
+			indices := search.Indices
+			if index != "" {
+				i, ok := search.FindIndex(index)
+				if !ok {
+					return fmt.Errorf("unknown index %q, expected %q or %q", index, search.UsersIndex, search.ProjectsIndex)
+				}
+
+				indices = []search.Index{i}
+			}
 
 			// Create the Elasticsearch client
-			_, err = createElasticClient(cmd)
+			client, err := createElasticClient(cmd)
 			if err != nil {
 				return err
 			}
@@ -176,35 +125,46 @@ func newIndexDataCommand() *cobra.Command {
 				return err
 			}
 
+			defer func() {
+				_ = prisma.Disconnect()
+			}()
+
 			fmt.Println("Connected to PostgreSQL!")
 
-			projects, err := prisma.Project.FindMany().Exec(context.TODO())
-			if err != nil {
-				return err
+			// Documents are written to the aliases, so they end up in the indices that are searched.
+			total := 0
+			var streams []stream
+			names := make([]string, 0, len(indices))
+			for _, i := range indices {
+				count, err := countRows(prisma, tableOf(i.Alias))
+				if err != nil {
+					return err
+				}
+
+				total += count
+				names = append(names, i.Alias)
+				streams = append(streams, streamIndex(prisma, i.Alias, i.Alias, nil, opts.batchSize))
 			}
 
-			_, err = prisma.User.FindMany().Exec(context.TODO())
+			fmt.Printf("Indexing %d documents into %s with %d workers...\n", total, strings.Join(names, ", "), opts.workers)
+
+			started := time.Now()
+			indexed, failures, err := runIndexer(client, opts, total, streams...)
 			if err != nil {
 				return err
 			}
 
-			var wg sync.WaitGroup
-			for i, project := range projects {
-				fmt.Printf("[%d/%d] Indexing project %s (%s)...\n", i+1, len(projects), project.Name, project.ID)
-
-				wg.Add(1)
-				go func(i int, proj db.ProjectModel) {
-					_ = time.Now()
-
-					// Marshal it from JSON
-					_, _ = json.Marshal(&proj.InnerProject)
-				}(i, project)
+			fmt.Println()
+			fmt.Printf("Indexed %d/%d documents in %s.\n", indexed, total, time.Since(started).Round(time.Millisecond))
+			if len(failures) == 0 {
+				return nil
 			}
 
-			return nil
+			printFailures(failures)
+			return fmt.Errorf("%d documents couldn't be indexed", len(failures))
 		},
 	}
 
-	cmd.Flags().IntP("workers", "w", runtime.NumCPU(), "how many workers the indexing should use.")
+	addIndexFlags(cmd)
 	return cmd
 }
@@ -0,0 +1,176 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/prisma/db"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/spf13/cobra"
+	"strings"
+	"time"
+)
+
+func newReindexCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reindex [index...]",
+		Short: "Rebuilds the indices with their current mappings, without downtime.",
+		Long: `The "reindex" command creates a new version of each index with its current mapping, i.e,
+"tsubaki-users-v2", and fills it with the data from PostgreSQL. Searches keep using the old
+version in the meantime. When it's filled, the "tsubaki-users" alias is moved to the new
+version in one request, and the old version is deleted.
+
+Indices that already use their current mapping are skipped, unless --force is used.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := getIndexOptions(cmd)
+			if err != nil {
+				return err
+			}
+
+			force, _ := cmd.Flags().GetBool("force")
+			keepOld, _ := cmd.Flags().GetBool("keep-old")
+
+			indices := search.Indices
+			if len(args) > 0 {
+				indices = nil
+				for _, arg := range args {
+					i, ok := search.FindIndex(arg)
+					if !ok {
+						return fmt.Errorf("unknown index %q, expected %q or %q", arg, search.UsersIndex, search.ProjectsIndex)
+					}
+
+					indices = append(indices, i)
+				}
+			}
+
+			client, err := createElasticClient(cmd)
+			if err != nil {
+				return err
+			}
+
+			prisma := db.NewClient()
+			if err := prisma.Connect(); err != nil {
+				return err
+			}
+
+			defer func() {
+				_ = prisma.Disconnect()
+			}()
+
+			for _, i := range indices {
+				if err := reindex(client, prisma, i, opts, force, keepOld); err != nil {
+					return fmt.Errorf("unable to reindex \"%s\": %v", i.Alias, err)
+				}
+			}
+
+			fmt.Println("Looks like we are done!")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolP("force", "f", false, "reindexes the indices even if they use their current mapping.")
+	cmd.Flags().Bool("keep-old", false, "keeps the old version of the indices instead of deleting them.")
+	addIndexFlags(cmd)
+
+	return cmd
+}
+
+// reindex builds the current version of the index, backfills it from PostgreSQL and
+// swaps the alias to it.
+func reindex(client *elasticsearch.Client, prisma *db.PrismaClient, index search.Index, opts indexOptions, force bool, keepOld bool) error {
+	current, legacy, err := aliasTarget(client, index.Alias)
+	if err != nil {
+		return err
+	}
+
+	name := index.Name()
+	if upToDate(current, index) {
+		if !force {
+			fmt.Printf("The \"%s\" index is up to date!\n", index.Alias)
+			return nil
+		}
+
+		// The version the alias points to can't be rebuilt in place, or searches fail in the meantime.
+		name = fmt.Sprintf("%s-%d", index.Name(), time.Now().Unix())
+	}
+
+	// The index is left over from a reindex that didn't finish, since nothing points to it.
+	exists, err := indexExists(client, name)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		fmt.Printf("Deleting the unfinished \"%s\" index...\n", name)
+		if err := deleteIndex(client, name); err != nil {
+			return err
+		}
+	}
+
+	if err := createIndex(client, index, name); err != nil {
+		return err
+	}
+
+	total, err := countRows(prisma, tableOf(index.Alias))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backfilling %d documents into \"%s\"...\n", total, name)
+	started := time.Now()
+	indexed, failures, err := runIndexer(client, opts, total, streamIndex(prisma, index.Alias, name, nil, opts.batchSize))
+	if err != nil {
+		return err
+	}
+
+	// Rows that changed during the backfill might have been read before they changed.
+	caughtUp, more, err := runIndexer(client, opts, 0, streamIndex(prisma, index.Alias, name, &started, opts.batchSize))
+	if err != nil {
+		return err
+	}
+
+	failures = append(failures, more...)
+	if len(failures) > 0 {
+		printFailures(failures)
+		return fmt.Errorf("%d documents couldn't be indexed, so \"%s\" wasn't swapped to \"%s\"", len(failures), index.Alias, name)
+	}
+
+	if err := finishIndex(client, name); err != nil {
+		return err
+	}
+
+	if err := swapAlias(client, index.Alias, current, legacy, name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Indexed %d documents (%d changed during the backfill) in %s, \"%s\" now points to \"%s\".\n", indexed, caughtUp, time.Since(started).Round(time.Millisecond), index.Alias, name)
+	if current == "" || keepOld {
+		return nil
+	}
+
+	fmt.Printf("Deleting the old \"%s\" index...\n", current)
+	return deleteIndex(client, current)
+}
+
+// upToDate returns if the `current` physical index uses the current version of the
+// index's mapping. Rebuilds of the same version have a timestamp suffix, i.e,
+// `tsubaki-users-v2-1646092800`.
+func upToDate(current string, index search.Index) bool {
+	return current == index.Name() || strings.HasPrefix(current, index.Name()+"-")
+}
@@ -37,6 +37,9 @@ The "index" subcommand, by default, will create the indexes for you, in which yo
 to get information about the newly indexes. Or, it will connect to PostgreSQL and index all the users and projects for
 you.
 
+The "reindex" subcommand rebuilds the indices when their mappings change, while the old ones
+are still searched.
+
 The "settings" subcommand updates the index settings without you writing the settings by hand from Kibana's Development
 Tools page or using cURL.
 `,
@@ -48,6 +51,7 @@ Tools page or using cURL.
 	cmd.AddCommand(
 		newIndexCommand(),
 		newIndexSettingsCommand(),
+		newReindexCommand(),
 	)
 
 	return cmd
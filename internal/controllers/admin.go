@@ -0,0 +1,214 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/firewall"
+	"arisu.land/tsubaki/pkg/lockout"
+	"arisu.land/tsubaki/pkg/result"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminController is the controller for the administration API.
+type AdminController struct{}
+
+func newAdminController() AdminController {
+	return AdminController{}
+}
+
+// Lockouts returns every active login lockout.
+func (AdminController) Lockouts() *result.Result {
+	if pkg.GlobalContainer.Lockout == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "Login lockouts require Redis, which isn't configured.")
+	}
+
+	lockouts, err := pkg.GlobalContainer.Lockout.List(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to list lockouts: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list lockouts, try again later.")
+	}
+
+	return result.Ok(lockouts)
+}
+
+// ClearLockout removes the lockout and failed logins of an account or IP.
+func (AdminController) ClearLockout(kind string, key string) *result.Result {
+	if pkg.GlobalContainer.Lockout == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "Login lockouts require Redis, which isn't configured.")
+	}
+
+	k := lockout.Kind(kind)
+	if k != lockout.Account && k != lockout.IP {
+		return result.Err(406, "INVALID_LOCKOUT_KIND", fmt.Sprintf("Lockout kind %s is not `account` or `ip`.", kind))
+	}
+
+	cleared, err := pkg.GlobalContainer.Lockout.Clear(context.TODO(), k, key)
+	if err != nil {
+		logrus.Errorf("Unable to clear lockout for %s %s: %v", kind, key, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to clear lockout, try again later.")
+	}
+
+	if !cleared {
+		return result.Err(404, "LOCKOUT_NOT_FOUND", fmt.Sprintf("There are no failed logins for %s %s.", kind, key))
+	}
+
+	logrus.Infof("Cleared lockout for %s %s", kind, key)
+	return result.NoContent()
+}
+
+// Firewall returns the firewall's allow and block lists, and every active ban.
+func (AdminController) Firewall() *result.Result {
+	if pkg.GlobalContainer.Firewall == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "The firewall requires Redis, which isn't configured.")
+	}
+
+	lists, err := pkg.GlobalContainer.Firewall.Lists(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to list firewall lists: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the firewall, try again later.")
+	}
+
+	configLists, err := pkg.GlobalContainer.Firewall.ConfigLists(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to list firewall lists: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the firewall, try again later.")
+	}
+
+	bans, err := pkg.GlobalContainer.Firewall.Bans(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to list bans: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the firewall, try again later.")
+	}
+
+	return result.Ok(map[string]interface{}{
+		"allow": lists[firewall.Allow],
+		"block": lists[firewall.Block],
+		"bans":  bans,
+
+		// The entries from the configuration can't be removed with the admin API.
+		"config": map[string]interface{}{
+			"allow": configLists[firewall.Allow],
+			"block": configLists[firewall.Block],
+		},
+	})
+}
+
+// AddFirewallRule adds a CIDR (or a single IP) to the allow or block list.
+func (AdminController) AddFirewallRule(list string, cidr string) *result.Result {
+	if pkg.GlobalContainer.Firewall == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "The firewall requires Redis, which isn't configured.")
+	}
+
+	l := firewall.List(list)
+	if l != firewall.Allow && l != firewall.Block {
+		return result.Err(406, "INVALID_FIREWALL_LIST", fmt.Sprintf("Firewall list %s is not `allow` or `block`.", list))
+	}
+
+	if _, err := firewall.ParseCIDR(cidr); err != nil {
+		return result.Err(406, "INVALID_CIDR", fmt.Sprintf("%q is not a valid IP or CIDR.", cidr))
+	}
+
+	if err := pkg.GlobalContainer.Firewall.Add(context.TODO(), l, cidr); err != nil {
+		logrus.Errorf("Unable to add %s to the %s list: %v", cidr, list, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the firewall, try again later.")
+	}
+
+	logrus.Infof("Added %s to the firewall's %s list", cidr, list)
+	return result.NoContent()
+}
+
+// RemoveFirewallRule removes a CIDR (or a single IP) from the allow or block list.
+func (AdminController) RemoveFirewallRule(list string, cidr string) *result.Result {
+	if pkg.GlobalContainer.Firewall == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "The firewall requires Redis, which isn't configured.")
+	}
+
+	l := firewall.List(list)
+	if l != firewall.Allow && l != firewall.Block {
+		return result.Err(406, "INVALID_FIREWALL_LIST", fmt.Sprintf("Firewall list %s is not `allow` or `block`.", list))
+	}
+
+	if _, err := firewall.ParseCIDR(cidr); err != nil {
+		return result.Err(406, "INVALID_CIDR", fmt.Sprintf("%q is not a valid IP or CIDR.", cidr))
+	}
+
+	removed, err := pkg.GlobalContainer.Firewall.Remove(context.TODO(), l, cidr)
+	if err != nil {
+		logrus.Errorf("Unable to remove %s from the %s list: %v", cidr, list, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the firewall, try again later.")
+	}
+
+	if !removed {
+		return result.Err(404, "FIREWALL_RULE_NOT_FOUND", fmt.Sprintf("%s is not in the %s list.", cidr, list))
+	}
+
+	logrus.Infof("Removed %s from the firewall's %s list", cidr, list)
+	return result.NoContent()
+}
+
+// Ban bans an IP for `duration` seconds.
+func (AdminController) Ban(ip string, duration int, reason string) *result.Result {
+	if pkg.GlobalContainer.Firewall == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "The firewall requires Redis, which isn't configured.")
+	}
+
+	if net.ParseIP(ip) == nil {
+		return result.Err(406, "INVALID_IP", fmt.Sprintf("%q is not a valid IP.", ip))
+	}
+
+	if duration <= 0 {
+		return result.Err(406, "INVALID_DURATION", "The ban duration must be at least one second.")
+	}
+
+	if reason == "" {
+		reason = "Banned by an administrator"
+	}
+
+	ban, err := pkg.GlobalContainer.Firewall.Ban(context.TODO(), ip, time.Duration(duration)*time.Second, reason)
+	if err != nil {
+		logrus.Errorf("Unable to ban %s: %v", ip, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to ban the IP, try again later.")
+	}
+
+	return result.Ok(ban)
+}
+
+// Unban lifts the ban of an IP.
+func (AdminController) Unban(ip string) *result.Result {
+	if pkg.GlobalContainer.Firewall == nil {
+		return result.Err(501, "REDIS_NOT_CONFIGURED", "The firewall requires Redis, which isn't configured.")
+	}
+
+	unbanned, err := pkg.GlobalContainer.Firewall.Unban(context.TODO(), ip)
+	if err != nil {
+		logrus.Errorf("Unable to unban %s: %v", ip, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to unban the IP, try again later.")
+	}
+
+	if !unbanned {
+		return result.Err(404, "BAN_NOT_FOUND", fmt.Sprintf("%s is not banned.", ip))
+	}
+
+	logrus.Infof("Unbanned %s", ip)
+	return result.NoContent()
+}
@@ -0,0 +1,220 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"arisu.land/tsubaki/internal"
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/sessions"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// statsKey is the Redis key the last stats snapshot is cached under, so replicas
+	// that just started don't have to wait for their collector.
+	statsKey = "tsubaki:admin:stats"
+
+	// statsInterval is how often the stats snapshot and the Prometheus gauges are
+	// refreshed. Listing every object in S3 isn't cheap, so it's never done per request.
+	statsInterval = 5 * time.Minute
+
+	// statsTTL is how long the snapshot is cached in Redis, it outlives a missed run.
+	statsTTL = 2 * statsInterval
+
+	// signupDays is how many days of signups are returned, this has to match
+	// the interval in collectStats.
+	signupDays = 30
+)
+
+var (
+	// latestStats is the last snapshot taken by the stats collector.
+	latestStats *Stats
+	statsMutex  sync.RWMutex
+)
+
+// Stats is an overview of the instance for administrators. Locales, strings and
+// translations aren't counted, Tsubaki doesn't store them in PostgreSQL yet.
+type Stats struct {
+	// Users is how many registered users there are.
+	Users int `json:"users"`
+
+	// Projects is how many projects there are.
+	Projects int `json:"projects"`
+
+	// Subprojects is how many subprojects there are.
+	Subprojects int `json:"subprojects"`
+
+	// StorageBytes is how many bytes are stored in the storage provider.
+	StorageBytes int64 `json:"storage_bytes"`
+
+	// ActiveSessions is how many sessions haven't expired yet.
+	ActiveSessions int `json:"active_sessions"`
+
+	// Signups is how many users registered on each of the last 30 days (UTC), oldest first.
+	Signups []Signups `json:"signups"`
+
+	// GeneratedAt is when these stats were computed, since they might be cached.
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// Signups is how many users registered on a day.
+type Signups struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// Stats returns the last snapshot of the instance's stats, which is refreshed every
+// statsInterval by the stats collector.
+func (AdminController) Stats() *result.Result {
+	stats := snapshotStats()
+	if stats == nil {
+		return result.Err(503, "STATS_NOT_READY", "The stats haven't been collected yet, try again later.")
+	}
+
+	return result.Ok(stats)
+}
+
+// snapshotStats returns the stats collector's last snapshot, or the one another replica
+// cached in Redis if this replica hasn't collected any yet. It's nil if neither exists.
+func snapshotStats() *Stats {
+	statsMutex.RLock()
+	stats := latestStats
+	statsMutex.RUnlock()
+
+	if stats != nil || pkg.GlobalContainer.Redis == nil {
+		return stats
+	}
+
+	cached, err := pkg.GlobalContainer.Redis.Get(context.TODO(), statsKey).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logrus.Warnf("Unable to fetch cached stats from Redis: %v", err)
+		}
+
+		return nil
+	}
+
+	var cachedStats Stats
+	if err := json.Unmarshal([]byte(cached), &cachedStats); err != nil {
+		logrus.Warnf("Unable to decode cached stats: %v", err)
+		return nil
+	}
+
+	return &cachedStats
+}
+
+// StartStatsCollector refreshes the stats snapshot and the Prometheus gauges every statsInterval.
+func (AdminController) StartStatsCollector() {
+	go func() {
+		for {
+			if _, err := collectStats(); err != nil {
+				logrus.Errorf("Unable to collect stats: %v", err)
+			}
+
+			time.Sleep(statsInterval)
+		}
+	}()
+}
+
+// collectStats computes the instance stats, updates the snapshot and the Prometheus
+// gauges, and caches them in Redis, if it's configured.
+func collectStats() (*Stats, error) {
+	var counts []struct {
+		Users       int `json:"users"`
+		Projects    int `json:"projects"`
+		Subprojects int `json:"subprojects"`
+	}
+
+	err := pkg.GlobalContainer.Prisma.Prisma.QueryRaw(
+		`SELECT (SELECT COUNT(*) FROM "users")::int AS "users", (SELECT COUNT(*) FROM "projects")::int AS "projects", (SELECT COUNT(*) FROM "subprojects")::int AS "subprojects"`,
+	).Exec(context.TODO(), &counts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signups := make([]Signups, 0, signupDays)
+	err = pkg.GlobalContainer.Prisma.Prisma.QueryRaw(
+		`SELECT to_char("days"."day", 'YYYY-MM-DD') AS "day", COUNT("users"."id")::int AS "count"
+		FROM generate_series(date_trunc('day', NOW() AT TIME ZONE 'UTC') - INTERVAL '29 days', date_trunc('day', NOW() AT TIME ZONE 'UTC'), INTERVAL '1 day') AS "days"("day")
+		LEFT JOIN "users" ON date_trunc('day', "users"."created_at") = "days"."day"
+		GROUP BY "days"."day" ORDER BY "days"."day"`,
+	).Exec(context.TODO(), &signups)
+
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := pkg.GlobalContainer.Storage.Usage()
+	if err != nil {
+		return nil, err
+	}
+
+	active := 0
+	if sessions.Sessions != nil {
+		active, err = sessions.Sessions.Active()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats := &Stats{
+		StorageBytes:   usage,
+		ActiveSessions: active,
+		Signups:        signups,
+		GeneratedAt:    time.Now(),
+	}
+
+	if len(counts) > 0 {
+		stats.Users = counts[0].Users
+		stats.Projects = counts[0].Projects
+		stats.Subprojects = counts[0].Subprojects
+	}
+
+	internal.UsersCountMetric.Set(float64(stats.Users))
+	internal.ProjectsCountMetric.Set(float64(stats.Projects))
+	internal.SubprojectsCountMetric.Set(float64(stats.Subprojects))
+	internal.StorageBytesMetric.Set(float64(stats.StorageBytes))
+	internal.ActiveSessionsMetric.Set(float64(stats.ActiveSessions))
+	if len(signups) > 0 {
+		internal.RecentSignupsMetric.Set(float64(signups[len(signups)-1].Count))
+	}
+
+	statsMutex.Lock()
+	latestStats = stats
+	statsMutex.Unlock()
+
+	if pkg.GlobalContainer.Redis != nil {
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := pkg.GlobalContainer.Redis.Set(context.TODO(), statsKey, data, statsTTL).Err(); err != nil {
+			logrus.Warnf("Unable to cache stats in Redis: %v", err)
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,460 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/sessions"
+	"arisu.land/tsubaki/prisma/db"
+	"arisu.land/tsubaki/util"
+	"github.com/sirupsen/logrus"
+)
+
+// impersonationTTL is how long an impersonation token is valid for.
+const impersonationTTL = time.Hour
+
+// The actions that are recorded in the audit log.
+const (
+	AuditUserDisabled      = "user.disable"
+	AuditUserEnabled       = "user.enable"
+	AuditUserPasswordReset = "user.password_reset"
+	AuditUserFlagsUpdated  = "user.flags"
+	AuditUserImpersonated  = "user.impersonate"
+	AuditImpersonatedWrite = "user.impersonate.write"
+	AuditUserDeleted       = "user.delete"
+)
+
+// AdminUser is a User with the attributes only administrators can see.
+type AdminUser struct {
+	*User
+
+	// Returns the account's email address.
+	Email string `json:"email"`
+}
+
+// UserPage is a page of users from the admin API.
+type UserPage struct {
+	// Users is the users in this page.
+	Users []AdminUser `json:"users"`
+
+	// Page is the page number, starting from 1.
+	Page int `json:"page"`
+
+	// PerPage is how many users are in a page.
+	PerPage int `json:"per_page"`
+
+	// HasMore returns if there is another page after this one.
+	HasMore bool `json:"has_more"`
+}
+
+// AuditLog is an action an administrator took.
+type AuditLog struct {
+	// Returns a RFC3339 timestamp of when the action was taken.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the ID of the administrator that took the action.
+	ActorID string `json:"actor_id"`
+
+	// Returns the ID of the user the action was taken on.
+	TargetID *string `json:"target_id"`
+
+	// Returns what was changed, i.e, the old and new flags.
+	Details *string `json:"details"`
+
+	// Returns the action that was taken, i.e, `user.disable`.
+	Action string `json:"action"`
+
+	// Returns why the administrator took the action.
+	Reason *string `json:"reason"`
+
+	// Returns the IP the administrator took the action from.
+	IP *string `json:"ip"`
+
+	// Returns the audit log entry's ID.
+	ID string `json:"id"`
+}
+
+// Impersonation is a token that lets an administrator act as the user.
+type Impersonation struct {
+	// Returns a RFC3339 timestamp of when the token expires.
+	ExpiresAt string `json:"expires_at"`
+
+	// Token is the JWT token to use in the `Authorization` header.
+	Token string `json:"token"`
+
+	// User is the user that is being impersonated.
+	User *User `json:"user"`
+}
+
+func fromAuditLogModel(log *db.AuditLogModel) AuditLog {
+	return AuditLog{
+		CreatedAt: log.CreatedAt.Format(time.RFC3339),
+		ActorID:   log.ActorID,
+		TargetID:  log.InnerAuditLog.TargetID,
+		Details:   log.InnerAuditLog.Details,
+		Action:    log.Action,
+		Reason:    log.InnerAuditLog.Reason,
+		IP:        log.InnerAuditLog.IP,
+		ID:        log.ID,
+	}
+}
+
+// Users returns a page of users. `query` searches usernames, emails and display names, and
+// `disabled` only returns disabled (or enabled) users if it isn't nil.
+func (AdminController) Users(query string, disabled *bool, page int, perPage int) *result.Result {
+	page, perPage, res := validatePage(page, perPage)
+	if res != nil {
+		return res
+	}
+
+	var params []db.UserWhereParam
+	if query != "" {
+		params = append(params, db.User.Or(
+			db.User.Username.Contains(query),
+			db.User.Email.Contains(query),
+			db.User.Name.Contains(query),
+		))
+	}
+
+	if disabled != nil {
+		params = append(params, db.User.Disabled.Equals(*disabled))
+	}
+
+	// Fetch one more user than needed to know if there is another page.
+	users, err := pkg.GlobalContainer.Prisma.User.FindMany(params...).OrderBy(
+		db.User.CreatedAt.Order(db.SortOrderDesc),
+	).Skip((page - 1) * perPage).Take(perPage + 1).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to list users: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list users, try again later.")
+	}
+
+	data := UserPage{
+		Users:   make([]AdminUser, 0, perPage),
+		Page:    page,
+		PerPage: perPage,
+		HasMore: len(users) > perPage,
+	}
+
+	for i := range users {
+		if i == perPage {
+			break
+		}
+
+		data.Users = append(data.Users, AdminUser{
+			User:  fromUserModel(&users[i]),
+			Email: users[i].Email,
+		})
+	}
+
+	return result.Ok(data)
+}
+
+// DisableUser disables the user, so they can't log in or use the API anymore.
+func (AdminController) DisableUser(actorID string, ip string, id string, reason string) *result.Result {
+	return setDisabled(actorID, ip, id, reason, true)
+}
+
+// EnableUser enables a disabled user.
+func (AdminController) EnableUser(actorID string, ip string, id string, reason string) *result.Result {
+	return setDisabled(actorID, ip, id, reason, false)
+}
+
+// ForcePasswordReset replaces the user's password with a random one, logs them out and
+// sends them a password reset email.
+func (AdminController) ForcePasswordReset(actorID string, ip string, id string, reason string) *result.Result {
+	if pkg.GlobalContainer.Mailer == nil {
+		return result.Err(501, "MAILER_NOT_CONFIGURED", "This instance isn't configured to send emails.")
+	}
+
+	user, res := findTargetUser(actorID, id)
+	if res != nil {
+		return res
+	}
+
+	hash, err := util.GeneratePassword(util.GenerateHash(32))
+	if err != nil {
+		logrus.Errorf("Unable to generate a new password hash for user %s: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to reset the password, try again later.")
+	}
+
+	update := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.Password.Set(hash),
+	).Tx()
+
+	// Revoking the user's tokens logs them out everywhere, until they set a new password.
+	if err := sessions.Revoke(context.TODO(), pkg.GlobalContainer.Prisma, id, update); err != nil {
+		logrus.Errorf("Unable to update users.%s.password: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to reset the password, try again later.")
+	}
+
+	if err := sendPasswordResetEmail(user); err != nil {
+		logrus.Errorf("Unable to send password reset email to user %s: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "The password was reset, but the password reset email couldn't be sent.")
+	}
+
+	recordAudit(actorID, ip, AuditUserPasswordReset, id, reason, nil)
+	return result.NoContent()
+}
+
+// SetUserFlags replaces the user's flags. Administrators can't remove their own admin
+// flag, so an instance can't be left without one by accident.
+func (AdminController) SetUserFlags(actorID string, ip string, id string, userFlags flags.UserFlags, reason string) *result.Result {
+	if userFlags < 0 {
+		return result.Err(406, "INVALID_FLAGS", "`flags` must be a positive number.")
+	}
+
+	if actorID == id && !userFlags.Has(flags.Admin) {
+		return result.Err(406, "CANNOT_MODIFY_SELF", "You can't remove your own admin flag.")
+	}
+
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("User with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user's flags, try again later.")
+	}
+
+	updated, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.Flags.Set(int(userFlags)),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to update users.%s.flags: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user's flags, try again later.")
+	}
+
+	details := fmt.Sprintf("%v -> %v", flags.UserFlags(user.Flags).Names(), userFlags.Names())
+	recordAudit(actorID, ip, AuditUserFlagsUpdated, id, reason, &details)
+
+	return result.Ok(fromUserModel(updated))
+}
+
+// Impersonate creates a token that lets the administrator act as the user for support. A
+// reason is required, and the impersonation is recorded before the token is created.
+func (AdminController) Impersonate(actorID string, ip string, id string, reason string) *result.Result {
+	if reason == "" {
+		return result.Err(406, "MISSING_REASON", "A `reason` is required to impersonate a user.")
+	}
+
+	user, res := findTargetUser(actorID, id)
+	if res != nil {
+		return res
+	}
+
+	if user.Disabled {
+		return result.Err(406, "USER_DISABLED", "Disabled users can't be impersonated.")
+	}
+
+	// Impersonating another administrator would let an admin act with someone else's
+	// admin permissions, and hide behind them in the audit log.
+	if flags.UserFlags(user.Flags).Has(flags.Admin) {
+		return result.Err(403, "CANNOT_IMPERSONATE_ADMIN", "Administrators can't be impersonated.")
+	}
+
+	if err := recordAudit(actorID, ip, AuditUserImpersonated, id, reason, nil); err != nil {
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to record the impersonation, try again later.")
+	}
+
+	token, err := pkg.NewImpersonationToken(id, user.TokenVersion, actorID, impersonationTTL)
+	if err != nil {
+		logrus.Errorf("Unable to create impersonation token for user %s: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to impersonate the user, try again later.")
+	}
+
+	logrus.Warnf("Administrator %s is impersonating user %s: %s", actorID, id, reason)
+	return result.Ok(Impersonation{
+		ExpiresAt: time.Now().Add(impersonationTTL).Format(time.RFC3339),
+		Token:     token,
+		User:      fromUserModel(user),
+	})
+}
+
+// RecordImpersonatedWrite records a request that changes data which an administrator
+// made while impersonating user `id`, i.e, `POST /api/v1/projects`.
+func (AdminController) RecordImpersonatedWrite(actorID string, ip string, id string, method string, path string) error {
+	details := fmt.Sprintf("%s %s", method, path)
+	return recordAudit(actorID, ip, AuditImpersonatedWrite, id, "", &details)
+}
+
+// DeleteUser queues the user to be deleted in the background, their projects are deleted
+// with them.
+func (AdminController) DeleteUser(actorID string, ip string, id string, reason string) *result.Result {
+	if _, res := findTargetUser(actorID, id); res != nil {
+		return res
+	}
+
+	res := scheduleDeletion(id, "")
+	if !res.Success {
+		return res
+	}
+
+	recordAudit(actorID, ip, AuditUserDeleted, id, reason, nil)
+	return res
+}
+
+// AuditLogs returns a page of the audit log, newest first. If `targetID` isn't
+// empty, only actions taken on that user are returned.
+func (AdminController) AuditLogs(targetID string, page int, perPage int) *result.Result {
+	page, perPage, res := validatePage(page, perPage)
+	if res != nil {
+		return res
+	}
+
+	var params []db.AuditLogWhereParam
+	if targetID != "" {
+		params = append(params, db.AuditLog.TargetID.Equals(targetID))
+	}
+
+	logs, err := pkg.GlobalContainer.Prisma.AuditLog.FindMany(params...).OrderBy(
+		db.AuditLog.CreatedAt.Order(db.SortOrderDesc),
+	).Skip((page - 1) * perPage).Take(perPage).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to list audit logs: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the audit log, try again later.")
+	}
+
+	data := make([]AuditLog, 0, len(logs))
+	for i := range logs {
+		data = append(data, fromAuditLogModel(&logs[i]))
+	}
+
+	return result.Ok(data)
+}
+
+func setDisabled(actorID string, ip string, id string, reason string, disabled bool) *result.Result {
+	user, res := findTargetUser(actorID, id)
+	if res != nil {
+		return res
+	}
+
+	if user.Disabled == disabled {
+		if disabled {
+			return result.Err(406, "USER_ALREADY_DISABLED", "This user is already disabled.")
+		}
+
+		return result.Err(406, "USER_NOT_DISABLED", "This user isn't disabled.")
+	}
+
+	update := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.Disabled.Set(disabled),
+	).Tx()
+
+	// Disabling a user also revokes their tokens, so they stay logged out if they're
+	// enabled again later.
+	var err error
+	if disabled {
+		err = sessions.Revoke(context.TODO(), pkg.GlobalContainer.Prisma, id, update)
+	} else {
+		err = pkg.GlobalContainer.Prisma.Prisma.Transaction(update).Exec(context.TODO())
+	}
+
+	if err != nil {
+		logrus.Errorf("Unable to update users.%s.disabled: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user, try again later.")
+	}
+
+	action := AuditUserEnabled
+	if disabled {
+		action = AuditUserDisabled
+	}
+
+	recordAudit(actorID, ip, action, id, reason, nil)
+	return result.Ok(fromUserModel(update.Result()))
+}
+
+// findTargetUser finds the user an administrator is taking an action on. Administrators
+// can't take these actions on themselves.
+func findTargetUser(actorID string, id string) (*db.UserModel, *result.Result) {
+	if actorID == id {
+		return nil, result.Err(406, "CANNOT_MODIFY_SELF", "You can't do this to your own account.")
+	}
+
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("User with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to retrieve the user, try again later.")
+	}
+
+	return user, nil
+}
+
+// recordAudit adds an entry to the audit log. Errors are logged and returned, but most
+// callers have already taken the action, so they only log it.
+func recordAudit(actorID string, ip string, action string, targetID string, reason string, details *string) error {
+	var reasonPtr, ipPtr *string
+	if reason != "" {
+		reasonPtr = &reason
+	}
+
+	if ip != "" {
+		ipPtr = &ip
+	}
+
+	_, err := pkg.GlobalContainer.Prisma.AuditLog.CreateOne(
+		db.AuditLog.ActorID.Set(actorID),
+		db.AuditLog.Action.Set(action),
+		db.AuditLog.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+		db.AuditLog.TargetID.Set(targetID),
+		db.AuditLog.Details.SetOptional(details),
+		db.AuditLog.Reason.SetOptional(reasonPtr),
+		db.AuditLog.IP.SetOptional(ipPtr),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to record %s by %s on %s in the audit log: %v", action, actorID, targetID, err)
+	}
+
+	return err
+}
+
+// validatePage validates the page number and page size, and fills in the defaults.
+func validatePage(page int, perPage int) (int, int, *result.Result) {
+	if page == 0 {
+		page = 1
+	}
+
+	if perPage == 0 {
+		perPage = 25
+	}
+
+	if page < 1 {
+		return 0, 0, result.Err(406, "INVALID_PAGE", "`page` must be at least 1.")
+	}
+
+	if perPage < 1 || perPage > 100 {
+		return 0, 0, result.Err(406, "INVALID_PER_PAGE", "`per_page` must be between 1 and 100.")
+	}
+
+	return page, perPage, nil
+}
@@ -0,0 +1,195 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"arisu.land/tsubaki/internal"
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/sirupsen/logrus"
+)
+
+// BotController handles the requests the GitHub bot sends over Kafka. The bot is
+// trusted like an administrator, since only it can write to the topic.
+type BotController struct{}
+
+func newBotController() BotController {
+	return BotController{}
+}
+
+// BotStatus is the reply to a `bot.report_status` request.
+type BotStatus struct {
+	// Version is the version of Tsubaki.
+	Version string `json:"version"`
+
+	// CommitSHA is the commit Tsubaki was built from.
+	CommitSHA string `json:"commit_sha"`
+
+	// Stats is an overview of the instance.
+	Stats *Stats `json:"stats"`
+
+	// Project is the requested project, if a project ID was given.
+	Project *Project `json:"project,omitempty"`
+}
+
+// botRequest is the data of the GitHub bot's requests. Which fields are required
+// depends on the request.
+type botRequest struct {
+	// ProjectID is the ID of the project the request is about.
+	ProjectID string `json:"project_id"`
+
+	// Repository is the GitHub repository, as `owner/name`.
+	Repository string `json:"repository"`
+
+	// Locale is the locale of the translations, like `ja-JP`.
+	Locale string `json:"locale"`
+}
+
+// Register adds the requests the GitHub bot can send to the consumer.
+func (c BotController) Register(consumer *events.Consumer) {
+	consumer.Handle("bot.report_status", 1, c.ReportStatus)
+	consumer.Handle("bot.sync_translations", 1, c.SyncTranslations)
+	consumer.Handle("bot.open_pull_request", 1, c.OpenPullRequest)
+}
+
+// ReportStatus returns the status of the instance, and of the project if `project_id`
+// is set.
+func (BotController) ReportStatus(request events.Envelope) *result.Result {
+	data, res := decodeBotRequest(request)
+	if res != nil {
+		return res
+	}
+
+	// The bot can ask for this as often as it wants, so it gets the same snapshot as the admin API.
+	stats := snapshotStats()
+	if stats == nil {
+		return result.Err(503, "STATS_NOT_READY", "The stats haven't been collected yet, try again later.")
+	}
+
+	status := BotStatus{
+		Version:   internal.Version,
+		CommitSHA: internal.CommitSHA,
+		Stats:     stats,
+	}
+
+	if data.ProjectID != "" {
+		project, res := findBotProject(data.ProjectID)
+		if res != nil {
+			return res
+		}
+
+		p := fromProjectModel(project)
+		status.Project = &p
+	}
+
+	return result.Ok(status)
+}
+
+// SyncTranslations asks Tsubaki to pull the translations of `locale` from `repository`
+// into the project.
+func (BotController) SyncTranslations(request events.Envelope) *result.Result {
+	data, res := decodeBotRequest(request)
+	if res != nil {
+		return res
+	}
+
+	if res := requireBotFields([2]string{"project_id", data.ProjectID}, [2]string{"repository", data.Repository}); res != nil {
+		return res
+	}
+
+	if _, res := findBotProject(data.ProjectID); res != nil {
+		return res
+	}
+
+	return translationsUnavailable()
+}
+
+// OpenPullRequest asks Tsubaki for the translations of `locale`, which the bot opens
+// a pull request with on `repository`.
+func (BotController) OpenPullRequest(request events.Envelope) *result.Result {
+	data, res := decodeBotRequest(request)
+	if res != nil {
+		return res
+	}
+
+	if res := requireBotFields([2]string{"project_id", data.ProjectID}, [2]string{"repository", data.Repository}, [2]string{"locale", data.Locale}); res != nil {
+		return res
+	}
+
+	if _, res := findBotProject(data.ProjectID); res != nil {
+		return res
+	}
+
+	return translationsUnavailable()
+}
+
+func decodeBotRequest(request events.Envelope) (*botRequest, *result.Result) {
+	var data botRequest
+	if len(request.Data) == 0 {
+		return &data, nil
+	}
+
+	if err := json.Unmarshal(request.Data, &data); err != nil {
+		return nil, result.Err(406, "INVALID_REQUEST", fmt.Sprintf("Unable to decode the data of %s: %v", request.Type, err))
+	}
+
+	return &data, nil
+}
+
+// requireBotFields returns an error result listing every field that is empty. Fields
+// are `[name, value]` pairs.
+func requireBotFields(fields ...[2]string) *result.Result {
+	var errs []result.Error
+	for _, field := range fields {
+		if field[1] == "" {
+			errs = append(errs, result.Error{Code: "MISSING_FIELD", Message: fmt.Sprintf("`%s` is required.", field[0])})
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return result.Errs(406, errs...)
+}
+
+func findBotProject(id string) (*db.ProjectModel, *result.Result) {
+	project, err := pkg.GlobalContainer.Prisma.Project.FindUnique(db.Project.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(404, "PROJECT_NOT_FOUND", fmt.Sprintf("Project %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to find the project, try again later.")
+	}
+
+	return project, nil
+}
+
+// translationsUnavailable is returned by the requests that need translation strings,
+// which Tsubaki doesn't store yet.
+func translationsUnavailable() *result.Result {
+	return result.Err(501, "TRANSLATIONS_UNAVAILABLE", "This instance doesn't store translations yet.")
+}
@@ -20,10 +20,38 @@ package controllers
 type Controller struct {
 	// Users is the controller API for manipulating User objects.
 	Users UserController
+
+	// Login is the controller API for logging in and creating sessions.
+	Login LoginController
+
+	// Invites is the controller API for creating and revoking user invites.
+	Invites UserInviteController
+
+	// Admin is the controller API for the administration API.
+	Admin AdminController
+
+	// Projects is the controller API for transferring projects and checking their permissions.
+	Projects ProjectController
+
+	// Organizations is the controller API for organizations, their members and teams.
+	Organizations OrganizationController
+
+	// Search is the controller API for searching users and projects.
+	Search SearchController
+
+	// Bot is the controller API for the requests of the GitHub bot.
+	Bot BotController
 }
 
 func NewDbController() Controller {
 	return Controller{
-		Users: newUserController(),
+		Users:         newUserController(),
+		Login:         newLoginController(),
+		Invites:       newUserInviteController(),
+		Admin:         newAdminController(),
+		Projects:      newProjectController(),
+		Organizations: newOrganizationController(),
+		Search:        newSearchController(),
+		Bot:           newBotController(),
 	}
 }
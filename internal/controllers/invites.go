@@ -16,11 +16,337 @@
 
 package controllers
 
-import "arisu.land/tsubaki/pkg/result"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/pkg/mailer"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/prisma/db"
+	"arisu.land/tsubaki/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultInviteTTL is how long an invite is valid for if no expiry was given.
+	defaultInviteTTL = 7 * 24 * time.Hour
+
+	// maxInviteUses is the maximum number of uses an invite can have.
+	maxInviteUses = 100
+)
 
 // UserInviteController is the controller for user invites!
 type UserInviteController struct{}
 
-func (UserInviteController) GenerateInvite() *result.Result {
-	return result.Ok(struct{}{})
+func newUserInviteController() UserInviteController {
+	return UserInviteController{}
+}
+
+// Invite is the invite structure that is returned using the Invites API.
+type Invite struct {
+	// Returns a RFC3339 timestamp of when this invite expires, this
+	// can be `nil` if the invite never expires.
+	ExpiresAt *string `json:"expires_at"`
+
+	// Returns a RFC3339 timestamp of when this invite was revoked, this
+	// is `nil` if the invite wasn't revoked.
+	RevokedAt *string `json:"revoked_at"`
+
+	// Returns a RFC3339 timestamp of when this invite was created.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the ID of the user who created this invite.
+	InviterID string `json:"inviter_id"`
+
+	// Returns the maximum number of accounts that can be created with this invite.
+	MaxUses int `json:"max_uses"`
+
+	// Returns the email address this invite is bound to, this can be
+	// `nil` if anyone can use it.
+	Email *string `json:"email"`
+
+	// Returns how many accounts were created with this invite.
+	Uses int `json:"uses"`
+
+	// Returns who used this invite, this is only available when listing invites.
+	UsedBy []InviteUse `json:"used_by,omitempty"`
+
+	// Returns the code that is used to register.
+	Code string `json:"code"`
+
+	// Returns this invite's ID.
+	ID string `json:"id"`
+}
+
+// InviteUse represents an account that was created with an invite.
+type InviteUse struct {
+	// Returns a RFC3339 timestamp of when the account was created.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the ID of the user who used the invite.
+	UserID string `json:"user_id"`
+}
+
+func fromInviteModel(invite *db.InviteModel) *Invite {
+	i := &Invite{
+		CreatedAt: invite.CreatedAt.Format(time.RFC3339),
+		InviterID: invite.InviterID,
+		MaxUses:   invite.MaxUses,
+		Email:     invite.InnerInvite.Email,
+		Uses:      invite.Uses,
+		Code:      invite.Code,
+		ID:        invite.ID,
+	}
+
+	if expiresAt, ok := invite.ExpiresAt(); ok {
+		formatted := expiresAt.Format(time.RFC3339)
+		i.ExpiresAt = &formatted
+	}
+
+	if revokedAt, ok := invite.RevokedAt(); ok {
+		formatted := revokedAt.Format(time.RFC3339)
+		i.RevokedAt = &formatted
+	}
+
+	return i
+}
+
+// Create creates a new invite. If `email` is set, only that email address can use the
+// invite and it is emailed to them. `expiresIn` is in seconds, 0 uses the default of 7 days
+// and -1 never expires.
+func (UserInviteController) Create(inviterID string, email *string, maxUses int, expiresIn int) *result.Result {
+	inviter, res := findCurrentUser(inviterID)
+	if res != nil {
+		return res
+	}
+
+	if !flags.UserFlags(inviter.Flags).HasAny(flags.Admin | flags.Invite) {
+		return result.Err(403, "MISSING_PERMISSIONS", "You are not allowed to create invites.")
+	}
+
+	if maxUses < 1 || maxUses > maxInviteUses {
+		return result.Err(406, "INVALID_MAX_USES", fmt.Sprintf("`max_uses` must be between 1 and %d.", maxInviteUses))
+	}
+
+	if email != nil {
+		if _, err := mail.ParseAddress(*email); err != nil {
+			return result.Err(406, "INVALID_EMAIL_ADDRESS", fmt.Sprintf("Email %s is not a valid email address.", *email))
+		}
+	}
+
+	var expiresAt *db.DateTime
+	switch {
+	case expiresIn == 0:
+		t := time.Now().Add(defaultInviteTTL)
+		expiresAt = &t
+
+	case expiresIn > 0:
+		t := time.Now().Add(time.Duration(expiresIn) * time.Second)
+		expiresAt = &t
+
+	case expiresIn != -1:
+		return result.Err(406, "INVALID_EXPIRY", "`expires_in` must be a positive number of seconds, or -1 to never expire.")
+	}
+
+	invite, err := pkg.GlobalContainer.Prisma.Invite.CreateOne(
+		db.Invite.Inviter.Link(db.User.ID.Equals(inviter.ID)),
+		db.Invite.Code.Set(util.GenerateHash(16)),
+		db.Invite.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+		db.Invite.ExpiresAt.SetOptional(expiresAt),
+		db.Invite.MaxUses.Set(maxUses),
+		db.Invite.Email.SetOptional(email),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to create invite for user %s: %v", inviter.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to create invite, try again later.")
+	}
+
+	if email != nil && pkg.GlobalContainer.Mailer != nil {
+		expires := ""
+		if expiresAt != nil {
+			expires = time.Until(*expiresAt).Round(time.Hour).String()
+		}
+
+		err := pkg.GlobalContainer.Mailer.Send(context.TODO(), *email, "You're invited to Arisu", mailer.InviteTemplate, map[string]interface{}{
+			"Inviter":   inviter.Username,
+			"Link":      pkg.GlobalContainer.Mailer.Link("/register?invite=" + invite.Code),
+			"ExpiresIn": expires,
+		})
+
+		if err != nil {
+			logrus.Errorf("Unable to send invite %s to %s: %v", invite.ID, *email, err)
+		}
+	}
+
+	return result.OkWithStatus(201, fromInviteModel(invite))
+}
+
+// List returns every invite for administrators, or the invites the user created.
+func (UserInviteController) List(uid string) *result.Result {
+	user, res := findCurrentUser(uid)
+	if res != nil {
+		return res
+	}
+
+	var params []db.InviteWhereParam
+	if !flags.UserFlags(user.Flags).Has(flags.Admin) {
+		params = append(params, db.Invite.InviterID.Equals(user.ID))
+	}
+
+	invites, err := pkg.GlobalContainer.Prisma.Invite.FindMany(params...).With(
+		db.Invite.UsedBy.Fetch(),
+	).OrderBy(
+		db.Invite.CreatedAt.Order(db.SortOrderDesc),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to list invites for user %s: %v", user.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list invites, try again later.")
+	}
+
+	data := make([]*Invite, 0, len(invites))
+	for i := range invites {
+		invite := fromInviteModel(&invites[i])
+		invite.UsedBy = make([]InviteUse, 0)
+
+		for _, use := range invites[i].UsedBy() {
+			invite.UsedBy = append(invite.UsedBy, InviteUse{
+				CreatedAt: use.CreatedAt.Format(time.RFC3339),
+				UserID:    use.UserID,
+			})
+		}
+
+		data = append(data, invite)
+	}
+
+	return result.Ok(data)
+}
+
+// Revoke revokes an invite, so it can't be used anymore. Only the user who created
+// the invite or an administrator can revoke it.
+func (UserInviteController) Revoke(uid string, id string) *result.Result {
+	user, res := findCurrentUser(uid)
+	if res != nil {
+		return res
+	}
+
+	invite, err := pkg.GlobalContainer.Prisma.Invite.FindUnique(db.Invite.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "INVITE_NOT_FOUND", fmt.Sprintf("Invite with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to revoke invite, try again later.")
+	}
+
+	// Don't leak that the invite exists to other users.
+	if invite.InviterID != user.ID && !flags.UserFlags(user.Flags).Has(flags.Admin) {
+		return result.Err(404, "INVITE_NOT_FOUND", fmt.Sprintf("Invite with id %s was not found.", id))
+	}
+
+	if _, ok := invite.RevokedAt(); ok {
+		return result.Err(406, "INVITE_ALREADY_REVOKED", "This invite was already revoked.")
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.Invite.FindUnique(db.Invite.ID.Equals(id)).Update(
+		db.Invite.RevokedAt.Set(time.Now()),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to update invites.%s.revoked_at: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to revoke invite, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+func findCurrentUser(uid string) (*db.UserModel, *result.Result) {
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(uid)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", uid))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to retrieve the current user, try again later.")
+	}
+
+	return user, nil
+}
+
+// useInvite checks if the invite `code` can be used to register with `email`, and
+// claims one of its uses. The use is claimed with a conditional UPDATE, so
+// concurrent registrations can't go over the invite's maximum uses.
+func useInvite(code string, email string) (*db.InviteModel, *result.Result) {
+	invite, err := pkg.GlobalContainer.Prisma.Invite.FindUnique(db.Invite.Code.Equals(code)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(403, "INVALID_INVITE", "The invite code is invalid.")
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to check the invite code, try again later.")
+	}
+
+	if _, ok := invite.RevokedAt(); ok {
+		return nil, result.Err(403, "INVITE_REVOKED", "This invite was revoked.")
+	}
+
+	if expiresAt, ok := invite.ExpiresAt(); ok && expiresAt.Before(time.Now()) {
+		return nil, result.Err(403, "INVITE_EXPIRED", "This invite has expired.")
+	}
+
+	if bound, ok := invite.Email(); ok && !strings.EqualFold(bound, email) {
+		return nil, result.Err(403, "INVITE_EMAIL_MISMATCH", "This invite was created for a different email address.")
+	}
+
+	claimed, err := pkg.GlobalContainer.Prisma.Prisma.ExecuteRaw(
+		`UPDATE "invites" SET "uses" = "uses" + 1 WHERE "id" = $1 AND "revoked_at" IS NULL AND "uses" < "max_uses" AND ("expires_at" IS NULL OR "expires_at" > (NOW() AT TIME ZONE 'UTC'))`,
+		invite.ID,
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to claim invite %s: %v", invite.ID, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to check the invite code, try again later.")
+	}
+
+	if claimed.Count == 0 {
+		return nil, result.Err(403, "INVITE_USED_UP", "This invite has already been used.")
+	}
+
+	return invite, nil
+}
+
+// releaseInvite gives back the use that was claimed by useInvite, if the
+// user couldn't be created.
+func releaseInvite(invite *db.InviteModel) {
+	_, err := pkg.GlobalContainer.Prisma.Prisma.ExecuteRaw(
+		`UPDATE "invites" SET "uses" = "uses" - 1 WHERE "id" = $1 AND "uses" > 0`,
+		invite.ID,
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to release use of invite %s: %v", invite.ID, err)
+	}
+}
+
+// recordInviteUse records that `user` registered with the invite.
+func recordInviteUse(invite *db.InviteModel, user *db.UserModel) {
+	_, err := pkg.GlobalContainer.Prisma.InviteUse.CreateOne(
+		db.InviteUse.Invite.Link(db.Invite.ID.Equals(invite.ID)),
+		db.InviteUse.User.Link(db.User.ID.Equals(user.ID)),
+		db.InviteUse.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to record that user %s used invite %s: %v", user.ID, invite.ID, err)
+	}
 }
@@ -15,3 +15,469 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/internal"
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/auth"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/pkg/sessions"
+	"arisu.land/tsubaki/prisma/db"
+	"arisu.land/tsubaki/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// oidcProvider is the provider name that is stored in the `identities` table
+	// for accounts linked with OpenID Connect.
+	oidcProvider = "oidc"
+
+	// ldapProvider is the provider name that is stored in the `identities` table
+	// for accounts linked with an LDAP directory.
+	ldapProvider = "ldap"
+)
+
+var invalidUsernameRegex = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// LoginController is the controller for logging in users and creating
+// their sessions.
+type LoginController struct{}
+
+func newLoginController() LoginController {
+	return LoginController{}
+}
+
+// Login is the response when a user has successfully logged in.
+type Login struct {
+	// Returns a RFC3339 timestamp of when the session will expire.
+	ExpiresIn string `json:"expires_in"`
+
+	// Returns the session token to use in the `Authorization` header
+	// as `Bearer <token>`.
+	Token string `json:"token"`
+
+	// Returns the user that has logged in.
+	User *User `json:"user"`
+}
+
+// externalUser represents a user that was resolved from an external
+// identity provider.
+type externalUser struct {
+	EmailVerified bool
+	Provider      string
+	Subject       string
+	Username      string
+	Email         string
+	Name          string
+	Invite        string
+
+	// Managed is true if the account is managed by the administrators (i.e, in a
+	// directory), so `registrations` and `invite_only` don't apply to it.
+	Managed bool
+}
+
+// Login authenticates the user with the LDAP directory (if it is configured) and their
+// local password, and creates their session. `username` can also be the user's email address,
+// and `ip` is the IP the request came from, which is used for lockouts.
+func (LoginController) Login(username string, password string, ip string) *result.Result {
+	// Lockouts are kept in Redis, so they're disabled on single-node installs without it.
+	lockouts := pkg.GlobalContainer.Lockout
+	if lockouts != nil {
+		locked, err := lockouts.Check(context.TODO(), username, ip)
+		if err != nil {
+			logrus.Errorf("Unable to check lockouts for %s from %s: %v", username, ip, err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+		}
+
+		if locked != nil {
+			internal.LoginFailuresMetric.WithLabelValues("locked").Inc()
+			return result.Err(429, "LOGIN_LOCKED", fmt.Sprintf("Too many failed logins, try again in %s.", locked.RetryAfter().String()))
+		}
+	}
+
+	user, res := authenticate(username, password)
+	if res != nil {
+		return res
+	}
+
+	if user == nil {
+		if lockouts == nil {
+			internal.LoginFailuresMetric.WithLabelValues("invalid_credentials").Inc()
+		} else if err := lockouts.Fail(context.TODO(), username, ip); err != nil {
+			logrus.Errorf("Unable to record failed login for %s from %s: %v", username, ip, err)
+		}
+
+		return result.Err(401, "INVALID_CREDENTIALS", "Invalid username or password.")
+	}
+
+	if lockouts != nil {
+		if err := lockouts.Succeed(context.TODO(), username); err != nil {
+			logrus.Errorf("Unable to reset failed logins for %s: %v", username, err)
+		}
+	}
+
+	return newLogin(user)
+}
+
+// OIDCAuthorize returns the URL to redirect the user to so they can log in
+// with the configured identity provider, and the `state` parameter of it.
+func (LoginController) OIDCAuthorize(invite string) (string, string, *result.Result) {
+	if pkg.GlobalContainer.OIDC == nil {
+		return "", "", result.Err(404, "OIDC_NOT_ENABLED", "OpenID Connect login is not enabled on this instance.")
+	}
+
+	url, state, err := pkg.GlobalContainer.OIDC.AuthorizeURL(context.TODO(), invite)
+	if err != nil {
+		logrus.Errorf("Unable to create OpenID Connect authorization request: %v", err)
+		return "", "", result.Err(500, "UNKNOWN_ERROR", "Unable to start the login flow, try again later.")
+	}
+
+	return url, state, nil
+}
+
+// OIDCCallback finishes the login flow, links or provisions the user and creates
+// their session.
+func (LoginController) OIDCCallback(state string, code string) *result.Result {
+	if pkg.GlobalContainer.OIDC == nil {
+		return result.Err(404, "OIDC_NOT_ENABLED", "OpenID Connect login is not enabled on this instance.")
+	}
+
+	identity, err := pkg.GlobalContainer.OIDC.Exchange(context.TODO(), state, code)
+	if err != nil {
+		if errors.Is(err, auth.InvalidStateError) {
+			return result.Err(400, "INVALID_OIDC_STATE", "The login request has expired or was already used, try again.")
+		}
+
+		logrus.Errorf("Unable to exchange OpenID Connect authorization code: %v", err)
+		return result.Err(401, "OIDC_EXCHANGE_FAILED", "Unable to verify the login with the identity provider.")
+	}
+
+	user, res := linkOrProvisionUser(externalUser{
+		EmailVerified: identity.EmailVerified,
+		Provider:      oidcProvider,
+		Subject:       identity.Subject,
+		Username:      identity.Username,
+		Email:         identity.Email,
+		Name:          identity.Name,
+		Invite:        identity.Invite,
+	})
+
+	if res != nil {
+		return res
+	}
+
+	return newLogin(user)
+}
+
+// syncDirectoryUser links or provisions the user from the directory, and syncs the
+// user's name, email and admin flag with the directory's attributes.
+func syncDirectoryUser(dirUser *auth.DirectoryUser) (*db.UserModel, *result.Result) {
+	if dirUser.Email == "" {
+		return nil, result.Err(403, "LDAP_MISSING_EMAIL", "Your directory account doesn't have an email address, ask your administrators to add one.")
+	}
+
+	subject := dirUser.Username
+	if subject == "" {
+		subject = dirUser.DN
+	}
+
+	user, res := linkOrProvisionUser(externalUser{
+		EmailVerified: true,
+		Managed:       true,
+		Provider:      ldapProvider,
+		Subject:       subject,
+		Username:      dirUser.Username,
+		Email:         dirUser.Email,
+		Name:          dirUser.Name,
+	})
+
+	if res != nil {
+		return nil, res
+	}
+
+	var params []db.UserSetParam
+	if name, _ := user.Name(); dirUser.Name != "" && name != dirUser.Name {
+		params = append(params, db.User.Name.Set(dirUser.Name))
+	}
+
+	if user.Email != dirUser.Email {
+		_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Email.Equals(dirUser.Email)).Exec(context.TODO())
+		if errors.Is(err, db.ErrNotFound) {
+			params = append(params, db.User.Email.Set(dirUser.Email))
+		} else {
+			logrus.Warnf("Unable to sync email for user %s since %s is taken by another account.", user.ID, dirUser.Email)
+		}
+	}
+
+	toggledAdmin := false
+	if pkg.GlobalContainer.LDAP.ManagesAdmins() && flags.UserFlags(user.Flags).Has(flags.Admin) != dirUser.Admin {
+		if _, err := toggleUserFlag(user.ID, flags.Admin, dirUser.Admin).Exec(context.TODO()); err != nil {
+			logrus.Errorf("Unable to sync the admin flag of user %s with the directory: %v", user.ID, err)
+			return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+		}
+
+		toggledAdmin = true
+	}
+
+	if len(params) == 0 && !toggledAdmin {
+		return user, nil
+	}
+
+	// The flags were changed by their own query, so the user is fetched again for them.
+	var updated *db.UserModel
+	var err error
+	if len(params) > 0 {
+		updated, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(user.ID)).Update(params...).Exec(context.TODO())
+	} else {
+		updated, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(user.ID)).Exec(context.TODO())
+	}
+
+	if err != nil {
+		logrus.Errorf("Unable to sync user %s with the directory: %v", user.ID, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+	}
+
+	search.UserChanged(user.ID)
+	return updated, nil
+}
+
+// authenticate checks the user's credentials with the LDAP directory (if it is configured)
+// and their local password. It returns a nil user and result if the credentials are invalid.
+func authenticate(username string, password string) (*db.UserModel, *result.Result) {
+	if directory := pkg.GlobalContainer.LDAP; directory != nil {
+		dirUser, err := directory.Authenticate(username, password)
+		if err == nil {
+			return syncDirectoryUser(dirUser)
+		}
+
+		if !errors.Is(err, auth.InvalidCredentialsError) {
+			logrus.Errorf("Unable to authenticate user %s with LDAP: %v", username, err)
+			if directory.Exclusive() {
+				return nil, result.Err(503, "LDAP_UNAVAILABLE", "Unable to reach the directory server, try again later.")
+			}
+		}
+
+		if directory.Exclusive() {
+			return nil, nil
+		}
+	}
+
+	user, err := pkg.GlobalContainer.Prisma.User.FindFirst(
+		db.User.Or(
+			db.User.Username.Equals(username),
+			db.User.Email.Equals(username),
+		),
+	).Exec(context.TODO())
+
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+	}
+
+	valid, err := util.VerifyPassword(password, user.Password)
+	if err != nil {
+		logrus.Errorf("Unable to verify password for user %s: %v", user.ID, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+	}
+
+	if !valid {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+// newLogin creates a session for the user and returns it as a Result.
+func newLogin(user *db.UserModel) *result.Result {
+	if user.Disabled {
+		return result.Err(403, "USER_DISABLED", "This account has been disabled by the administrators.")
+	}
+
+	session := sessions.Sessions.New(user.ID)
+	if session == nil {
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to create a session, try again later.")
+	}
+
+	return result.Ok(Login{
+		ExpiresIn: session.ExpiresIn.Format(time.RFC3339),
+		Token:     session.Token,
+		User:      fromUserModel(user),
+	})
+}
+
+// linkOrProvisionUser finds the user that was linked with the external identity. If none
+// was linked, it will link the user with the same email address or create a new one if
+// the instance's registration rules allow it.
+func linkOrProvisionUser(ext externalUser) (*db.UserModel, *result.Result) {
+	prisma := pkg.GlobalContainer.Prisma
+	identity, err := prisma.Identity.FindFirst(
+		db.Identity.Provider.Equals(ext.Provider),
+		db.Identity.Subject.Equals(ext.Subject),
+	).With(db.Identity.Owner.Fetch()).Exec(context.TODO())
+
+	if err == nil {
+		return identity.Owner(), nil
+	}
+
+	if !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to find identity %s/%s: %v", ext.Provider, ext.Subject, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+	}
+
+	// Link the identity to the user with the same email address
+	user, err := prisma.User.FindUnique(db.User.Email.Equals(ext.Email)).Exec(context.TODO())
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+	}
+
+	// Don't let anyone take over an existing account by claiming
+	// an email address that the identity provider never verified.
+	if user != nil && !ext.EmailVerified {
+		return nil, result.Err(409, "EMAIL_NOT_VERIFIED", fmt.Sprintf("Email %s is already used by another account and was not verified by the identity provider.", ext.Email))
+	}
+
+	if user == nil {
+		var invite *db.InviteModel
+		if !ext.Managed {
+			var res *result.Result
+			if invite, res = canRegister(ext.Invite, ext.Email); res != nil {
+				return nil, res
+			}
+		}
+
+		user, err = createExternalUser(ext)
+		if err != nil {
+			if invite != nil {
+				releaseInvite(invite)
+			}
+
+			logrus.Errorf("Unable to provision user from %s identity %s: %v", ext.Provider, ext.Subject, err)
+			return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to create user, try again later.")
+		}
+
+		if invite != nil {
+			recordInviteUse(invite, user)
+		}
+
+		logrus.Infof("Provisioned user %s (%s) from %s identity %s", user.Username, user.ID, ext.Provider, ext.Subject)
+	}
+
+	_, err = prisma.Identity.CreateOne(
+		db.Identity.Provider.Set(ext.Provider),
+		db.Identity.Subject.Set(ext.Subject),
+		db.Identity.Owner.Link(db.User.ID.Equals(user.ID)),
+		db.Identity.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to link %s identity %s to user %s: %v", ext.Provider, ext.Subject, user.ID, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to log in, try again later.")
+	}
+
+	return user, nil
+}
+
+// canRegister checks if new accounts can be created on this instance. On invite-only
+// instances, it claims a use of the invite and returns it.
+func canRegister(invite string, email string) (*db.InviteModel, *result.Result) {
+	if !pkg.GlobalContainer.Config.Registrations {
+		return nil, result.Err(403, "REGISTRATIONS_DISABLED", "Registrations are disabled on this instance, ask the administrators to create you an account!")
+	}
+
+	if !pkg.GlobalContainer.Config.InviteOnly {
+		return nil, nil
+	}
+
+	if invite == "" {
+		return nil, result.Err(403, "INSTANCE_INVITE_ONLY", "This instance is invite-only, ask the administrators to create you an invite!")
+	}
+
+	return useInvite(invite, email)
+}
+
+// createExternalUser creates a new user from an external identity. The user has
+// a random password, so they can only log in with their identity provider.
+func createExternalUser(ext externalUser) (*db.UserModel, error) {
+	username, err := availableUsername(ext.Username, ext.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := util.GeneratePassword(util.GenerateHash(32))
+	if err != nil {
+		return nil, err
+	}
+
+	var name *string
+	if ext.Name != "" {
+		name = &ext.Name
+	}
+
+	var userFlags flags.UserFlags
+	if ext.EmailVerified {
+		userFlags = userFlags.Add(flags.VerifiedEmail)
+	}
+
+	id := pkg.GlobalContainer.Snowflake.Generate().String()
+	create := pkg.GlobalContainer.Prisma.User.CreateOne(
+		db.User.Username.Set(username),
+		db.User.Password.Set(hash),
+		db.User.Email.Set(ext.Email),
+		db.User.ID.Set(id),
+		db.User.Name.SetOptional(name),
+		db.User.Flags.Set(int(userFlags)),
+	).Tx()
+
+	created := events.Record(&id, events.UserCreated{Username: username, ID: id})
+	if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(create, created).Exec(context.TODO()); err != nil {
+		return nil, err
+	}
+
+	search.UserChanged(id)
+	return create.Result(), nil
+}
+
+// availableUsername returns a username that isn't taken, based off the
+// preferred username or the email address's local part.
+func availableUsername(preferred string, email string) (string, error) {
+	base := invalidUsernameRegex.ReplaceAllString(preferred, "")
+	if base == "" {
+		base = invalidUsernameRegex.ReplaceAllString(strings.Split(email, "@")[0], "")
+	}
+
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Username.Equals(candidate)).Exec(context.TODO())
+		if errors.Is(err, db.ErrNotFound) {
+			return candidate, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		candidate = fmt.Sprintf("%s%04d", base, rand.Intn(10000))
+	}
+
+	return "", fmt.Errorf("unable to find an available username for %s", base)
+}
@@ -0,0 +1,821 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"arisu.land/tsubaki/internal/types"
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/acl"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/sirupsen/logrus"
+)
+
+// organizationNameRegex is what organization and team names are allowed to look like.
+var organizationNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,32}$`)
+
+// OrganizationController is the controller for the Organizations API.
+type OrganizationController struct{}
+
+func newOrganizationController() OrganizationController {
+	return OrganizationController{}
+}
+
+// Organization is the organization structure that is returned using the Organizations API.
+type Organization struct {
+	// Returns the organization's description, can be `nil`
+	// if no description was provided.
+	Description *string `json:"description"`
+
+	// The organization's display name, this can be `nil` if none
+	// was set.
+	DisplayName *string `json:"display_name"`
+
+	// Returns the default ACL of the organization's projects in HCL, this is
+	// `nil` if every member can write to them.
+	DefaultACL *string `json:"default_acl"`
+
+	// Returns a RFC3339 timestamp of when this organization's
+	// metadata has been updated.
+	UpdatedAt string `json:"updated_at"`
+
+	// Returns a RFC3339 timestamp of when this organization was created.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the organization's unique name.
+	Name string `json:"name"`
+
+	// Returns this organization's ID.
+	ID string `json:"id"`
+}
+
+// OrganizationMember is a member of an organization.
+type OrganizationMember struct {
+	// Returns a RFC3339 timestamp of when they joined the organization.
+	CreatedAt string `json:"created_at"`
+
+	// Returns their role, which is `OWNER`, `ADMIN` or `MEMBER`.
+	Role db.OrganizationRole `json:"role"`
+
+	// Returns the user.
+	User *User `json:"user"`
+}
+
+// Team is a group of members in an organization.
+type Team struct {
+	// Returns the team's description, can be `nil`
+	// if no description was provided.
+	Description *string `json:"description"`
+
+	// Returns a RFC3339 timestamp of when this team was created.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the team's name, which is unique in the organization.
+	Name string `json:"name"`
+
+	// Returns this team's ID, which is used as `team:<id>` in ACLs.
+	ID string `json:"id"`
+}
+
+// TeamMember is a member of a team.
+type TeamMember struct {
+	// Returns their role, which is `MAINTAINER` or `MEMBER`.
+	Role db.TeamRole `json:"role"`
+
+	// Returns the user.
+	User *User `json:"user"`
+}
+
+func fromOrganizationModel(org *db.OrganizationModel) *Organization {
+	return &Organization{
+		Description: org.InnerOrganization.Description,
+		DisplayName: org.InnerOrganization.DisplayName,
+		DefaultACL:  org.InnerOrganization.DefaultACL,
+		UpdatedAt:   org.UpdatedAt.Format(time.RFC3339),
+		CreatedAt:   org.CreatedAt.Format(time.RFC3339),
+		Name:        org.Name,
+		ID:          org.ID,
+	}
+}
+
+func fromTeamModel(team *db.TeamModel) *Team {
+	return &Team{
+		Description: team.InnerTeam.Description,
+		CreatedAt:   team.CreatedAt.Format(time.RFC3339),
+		Name:        team.Name,
+		ID:          team.ID,
+	}
+}
+
+// organizationSchema is every field of an organization that can be updated with an UpdateQuery.
+var organizationSchema = types.Schema{
+	"display_name": {
+		Type:     types.StringField,
+		Nullable: true,
+		Validate: func(value interface{}) *result.Error {
+			if utf8.RuneCountInString(value.(string)) > 64 {
+				e := result.NewError("DISPLAY_NAME_TOO_LONG", "Display names cannot go over 64 characters.")
+				return &e
+			}
+
+			return nil
+		},
+	},
+
+	"description": {
+		Type:     types.StringField,
+		Nullable: true,
+		Validate: func(value interface{}) *result.Error {
+			if utf8.RuneCountInString(value.(string)) > 160 {
+				e := result.NewError("ORGANIZATION_DESCRIPTION_TOO_LONG", "Organization descriptions cannot go over 160 characters.")
+				return &e
+			}
+
+			return nil
+		},
+	},
+
+	"default_acl": {
+		Type:     types.StringField,
+		Nullable: true,
+		Validate: func(value interface{}) *result.Error {
+			object, err := acl.DecodeFromSource(value.(string))
+			if err == nil {
+				err = object.Validate()
+			}
+
+			if err != nil {
+				e := result.NewError("INVALID_ACL", fmt.Sprintf("The default ACL is not valid: %v", err))
+				return &e
+			}
+
+			return nil
+		},
+	},
+}
+
+// Create creates an organization, the user who created it is its first owner.
+func (OrganizationController) Create(actorID string, name string, displayName *string, description *string) *result.Result {
+	if !organizationNameRegex.MatchString(name) {
+		return result.Err(406, "INVALID_ORGANIZATION_NAME", "Organization names can only have letters, numbers, `_`, `.` and `-`, and be 32 characters at most.")
+	}
+
+	existing, err := pkg.GlobalContainer.Prisma.Organization.FindUnique(db.Organization.Name.Equals(name)).Exec(context.TODO())
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to create the organization, try again later.")
+	}
+
+	if existing != nil {
+		return result.Err(409, "ORGANIZATION_NAME_TAKEN", fmt.Sprintf("Organization %s already exists.", name))
+	}
+
+	id := pkg.GlobalContainer.Snowflake.Generate().String()
+	createOrg := pkg.GlobalContainer.Prisma.Organization.CreateOne(
+		db.Organization.Name.Set(name),
+		db.Organization.ID.Set(id),
+		db.Organization.DisplayName.SetOptional(displayName),
+		db.Organization.Description.SetOptional(description),
+	).Tx()
+
+	createOwner := pkg.GlobalContainer.Prisma.OrganizationMember.CreateOne(
+		db.OrganizationMember.Organization.Link(db.Organization.ID.Equals(id)),
+		db.OrganizationMember.User.Link(db.User.ID.Equals(actorID)),
+		db.OrganizationMember.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+		db.OrganizationMember.Role.Set(db.OrganizationRoleOWNER),
+	).Tx()
+
+	created := events.Record(&actorID, events.OrganizationCreated{Name: name, ID: id})
+	if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(createOrg, createOwner, created).Exec(context.TODO()); err != nil {
+		logrus.Errorf("Unable to create organization %s: %v", name, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to create the organization, try again later.")
+	}
+
+	return result.OkWithStatus(201, fromOrganizationModel(createOrg.Result()))
+}
+
+// Get returns the organization with the name.
+func (OrganizationController) Get(name string) *result.Result {
+	org, res := findOrganization(name)
+	if res != nil {
+		return res
+	}
+
+	return result.Ok(fromOrganizationModel(org))
+}
+
+// Update applies the UpdateQuery to the organization, only its owners and admins can update it.
+func (OrganizationController) Update(viewer Viewer, name string, query types.UpdateQuery) *result.Result {
+	org, res := findManagedOrganization(viewer, name, db.OrganizationRoleADMIN)
+	if res != nil {
+		return res
+	}
+
+	changes, errs := query.Validate(organizationSchema)
+	if len(errs) > 0 {
+		return result.Errs(406, errs...)
+	}
+
+	params := make([]db.OrganizationSetParam, 0, len(changes))
+	for field, value := range changes {
+		switch field {
+		case "display_name":
+			params = append(params, db.Organization.DisplayName.SetOptional(optionalString(value)))
+
+		case "description":
+			params = append(params, db.Organization.Description.SetOptional(optionalString(value)))
+
+		case "default_acl":
+			params = append(params, db.Organization.DefaultACL.SetOptional(optionalString(value)))
+		}
+	}
+
+	_, err := pkg.GlobalContainer.Prisma.Organization.FindUnique(db.Organization.ID.Equals(org.ID)).Update(params...).Exec(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to update organization %s: %v", org.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the organization, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// Delete deletes the organization, only its owners can delete it. Its projects have to
+// be transferred or deleted first.
+func (OrganizationController) Delete(viewer Viewer, name string) *result.Result {
+	org, res := findManagedOrganization(viewer, name, db.OrganizationRoleOWNER)
+	if res != nil {
+		return res
+	}
+
+	projects, err := pkg.GlobalContainer.Prisma.Project.FindMany(db.Project.OrganizationID.Equals(org.ID)).Take(1).Exec(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the organization, try again later.")
+	}
+
+	if len(projects) > 0 {
+		return result.Err(409, "ORGANIZATION_HAS_PROJECTS", "Transfer or delete the organization's projects before deleting it.")
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.Organization.FindUnique(db.Organization.ID.Equals(org.ID)).Delete().Exec(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to delete organization %s: %v", org.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the organization, try again later.")
+	}
+
+	logrus.Warnf("Organization %s was deleted by %s.", org.Name, viewer.ID)
+	return result.NoContent()
+}
+
+// Projects returns a page of the organization's projects that are visible to the viewer.
+func (OrganizationController) Projects(viewer Viewer, name string, cursor string, limit int) *result.Result {
+	org, res := findOrganization(name)
+	if res != nil {
+		return res
+	}
+
+	return listProjects(viewer, func(arg func(value interface{}) string) string {
+		return `"p"."organization_id" = ` + arg(org.ID)
+	}, cursor, limit)
+}
+
+// Members returns the members of the organization.
+func (OrganizationController) Members(name string) *result.Result {
+	org, res := findOrganization(name)
+	if res != nil {
+		return res
+	}
+
+	members, err := pkg.GlobalContainer.Prisma.OrganizationMember.FindMany(
+		db.OrganizationMember.OrganizationID.Equals(org.ID),
+	).With(db.OrganizationMember.User.Fetch()).OrderBy(
+		db.OrganizationMember.CreatedAt.Order(db.SortOrderAsc),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the members, try again later.")
+	}
+
+	data := make([]OrganizationMember, 0, len(members))
+	for _, member := range members {
+		data = append(data, OrganizationMember{
+			CreatedAt: member.CreatedAt.Format(time.RFC3339),
+			Role:      member.Role,
+			User:      fromUserModel(member.User()),
+		})
+	}
+
+	return result.Ok(data)
+}
+
+// SetMember adds the user to the organization or changes their role. Owners and admins
+// can manage members, but only owners can make someone an owner or change an owner's role,
+// and the last owner can't be demoted.
+func (OrganizationController) SetMember(viewer Viewer, name string, userID string, role db.OrganizationRole) *result.Result {
+	if role != db.OrganizationRoleOWNER && role != db.OrganizationRoleADMIN && role != db.OrganizationRoleMEMBER {
+		return result.Err(406, "INVALID_ROLE", fmt.Sprintf("Role %s is not `OWNER`, `ADMIN` or `MEMBER`.", role))
+	}
+
+	org, actor, res := findOrganizationAs(viewer, name, db.OrganizationRoleADMIN)
+	if res != nil {
+		return res
+	}
+
+	user, err := findUser(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", userID))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the member, try again later.")
+	}
+
+	if user.Disabled {
+		return result.Err(406, "USER_DISABLED", fmt.Sprintf("User %s is disabled.", user.Username))
+	}
+
+	membership, err := organizationMembership(org.ID, user.ID)
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the member, try again later.")
+	}
+
+	changesOwner := role == db.OrganizationRoleOWNER || (membership != nil && membership.Role == db.OrganizationRoleOWNER)
+	if changesOwner && !isOrganizationRole(viewer, actor, db.OrganizationRoleOWNER) {
+		return result.Err(403, "MISSING_PERMISSIONS", "Only owners can add or change the role of an owner.")
+	}
+
+	if membership != nil && membership.Role == db.OrganizationRoleOWNER && role != db.OrganizationRoleOWNER {
+		if res := ensureAnotherOwner(org.ID, user.ID); res != nil {
+			return res
+		}
+	}
+
+	if membership == nil {
+		_, err = pkg.GlobalContainer.Prisma.OrganizationMember.CreateOne(
+			db.OrganizationMember.Organization.Link(db.Organization.ID.Equals(org.ID)),
+			db.OrganizationMember.User.Link(db.User.ID.Equals(user.ID)),
+			db.OrganizationMember.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+			db.OrganizationMember.Role.Set(role),
+		).Exec(context.TODO())
+	} else {
+		_, err = pkg.GlobalContainer.Prisma.OrganizationMember.FindUnique(
+			db.OrganizationMember.ID.Equals(membership.ID),
+		).Update(db.OrganizationMember.Role.Set(role)).Exec(context.TODO())
+	}
+
+	if err != nil {
+		logrus.Errorf("Unable to update member %s of organization %s: %v", user.ID, org.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the member, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// RemoveMember removes the user from the organization and its teams. Members can remove
+// themselves, owners and admins can remove others, but only owners can remove an owner.
+func (OrganizationController) RemoveMember(viewer Viewer, name string, userID string) *result.Result {
+	org, res := findOrganization(name)
+	if res != nil {
+		return res
+	}
+
+	user, err := findUser(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", userID))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to remove the member, try again later.")
+	}
+
+	membership, err := organizationMembership(org.ID, user.ID)
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to remove the member, try again later.")
+	}
+
+	if membership == nil {
+		return result.Err(404, "MEMBER_NOT_FOUND", fmt.Sprintf("User %s is not a member of %s.", user.Username, org.Name))
+	}
+
+	if user.ID != viewer.ID {
+		actor, err := organizationMembership(org.ID, viewer.ID)
+		if err != nil {
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to remove the member, try again later.")
+		}
+
+		required := db.OrganizationRoleADMIN
+		if membership.Role == db.OrganizationRoleOWNER {
+			required = db.OrganizationRoleOWNER
+		}
+
+		if !isOrganizationRole(viewer, actor, required) {
+			return result.Err(403, "MISSING_PERMISSIONS", "You don't have permission to remove this member.")
+		}
+	}
+
+	if membership.Role == db.OrganizationRoleOWNER {
+		if res := ensureAnotherOwner(org.ID, user.ID); res != nil {
+			return res
+		}
+	}
+
+	removeTeams := pkg.GlobalContainer.Prisma.TeamMember.FindMany(
+		db.TeamMember.UserID.Equals(user.ID),
+		db.TeamMember.Team.Where(db.Team.OrganizationID.Equals(org.ID)),
+	).Delete().Tx()
+
+	removeMember := pkg.GlobalContainer.Prisma.OrganizationMember.FindUnique(
+		db.OrganizationMember.ID.Equals(membership.ID),
+	).Delete().Tx()
+
+	if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(removeTeams, removeMember).Exec(context.TODO()); err != nil {
+		logrus.Errorf("Unable to remove member %s of organization %s: %v", user.ID, org.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to remove the member, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// Teams returns the teams of the organization.
+func (OrganizationController) Teams(name string) *result.Result {
+	org, res := findOrganization(name)
+	if res != nil {
+		return res
+	}
+
+	teams, err := pkg.GlobalContainer.Prisma.Team.FindMany(
+		db.Team.OrganizationID.Equals(org.ID),
+	).OrderBy(db.Team.Name.Order(db.SortOrderAsc)).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the teams, try again later.")
+	}
+
+	data := make([]*Team, 0, len(teams))
+	for i := range teams {
+		data = append(data, fromTeamModel(&teams[i]))
+	}
+
+	return result.Ok(data)
+}
+
+// CreateTeam creates a team in the organization, only its owners and admins can create teams.
+func (OrganizationController) CreateTeam(viewer Viewer, name string, teamName string, description *string) *result.Result {
+	if !organizationNameRegex.MatchString(teamName) {
+		return result.Err(406, "INVALID_TEAM_NAME", "Team names can only have letters, numbers, `_`, `.` and `-`, and be 32 characters at most.")
+	}
+
+	org, res := findManagedOrganization(viewer, name, db.OrganizationRoleADMIN)
+	if res != nil {
+		return res
+	}
+
+	existing, err := pkg.GlobalContainer.Prisma.Team.FindUnique(
+		db.Team.OrganizationIDName(db.Team.OrganizationID.Equals(org.ID), db.Team.Name.Equals(teamName)),
+	).Exec(context.TODO())
+
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to create the team, try again later.")
+	}
+
+	if existing != nil {
+		return result.Err(409, "TEAM_NAME_TAKEN", fmt.Sprintf("Team %s already exists in %s.", teamName, org.Name))
+	}
+
+	team, err := pkg.GlobalContainer.Prisma.Team.CreateOne(
+		db.Team.Organization.Link(db.Organization.ID.Equals(org.ID)),
+		db.Team.Name.Set(teamName),
+		db.Team.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+		db.Team.Description.SetOptional(description),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to create team %s in organization %s: %v", teamName, org.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to create the team, try again later.")
+	}
+
+	return result.OkWithStatus(201, fromTeamModel(team))
+}
+
+// DeleteTeam deletes a team of the organization, only its owners and admins can delete teams.
+func (OrganizationController) DeleteTeam(viewer Viewer, name string, teamName string) *result.Result {
+	org, res := findManagedOrganization(viewer, name, db.OrganizationRoleADMIN)
+	if res != nil {
+		return res
+	}
+
+	team, res := findTeam(org, teamName)
+	if res != nil {
+		return res
+	}
+
+	_, err := pkg.GlobalContainer.Prisma.Team.FindUnique(db.Team.ID.Equals(team.ID)).Delete().Exec(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to delete team %s: %v", team.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the team, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// TeamMembers returns the members of a team.
+func (OrganizationController) TeamMembers(name string, teamName string) *result.Result {
+	org, res := findOrganization(name)
+	if res != nil {
+		return res
+	}
+
+	team, res := findTeam(org, teamName)
+	if res != nil {
+		return res
+	}
+
+	members, err := pkg.GlobalContainer.Prisma.TeamMember.FindMany(
+		db.TeamMember.TeamID.Equals(team.ID),
+	).With(db.TeamMember.User.Fetch()).OrderBy(
+		db.TeamMember.CreatedAt.Order(db.SortOrderAsc),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list the team members, try again later.")
+	}
+
+	data := make([]TeamMember, 0, len(members))
+	for _, member := range members {
+		data = append(data, TeamMember{
+			Role: member.Role,
+			User: fromUserModel(member.User()),
+		})
+	}
+
+	return result.Ok(data)
+}
+
+// SetTeamMember adds a member of the organization to the team or changes their role. The
+// organization's owners and admins, and the team's maintainers, can manage its members.
+func (OrganizationController) SetTeamMember(viewer Viewer, name string, teamName string, userID string, role db.TeamRole) *result.Result {
+	if role != db.TeamRoleMAINTAINER && role != db.TeamRoleMEMBER {
+		return result.Err(406, "INVALID_ROLE", fmt.Sprintf("Role %s is not `MAINTAINER` or `MEMBER`.", role))
+	}
+
+	org, team, res := findMaintainedTeam(viewer, name, teamName)
+	if res != nil {
+		return res
+	}
+
+	user, err := findUser(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", userID))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the team member, try again later.")
+	}
+
+	membership, err := organizationMembership(org.ID, user.ID)
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the team member, try again later.")
+	}
+
+	if membership == nil {
+		return result.Err(406, "NOT_ORGANIZATION_MEMBER", fmt.Sprintf("User %s has to be a member of %s to join its teams.", user.Username, org.Name))
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.TeamMember.UpsertOne(
+		db.TeamMember.TeamIDUserID(db.TeamMember.TeamID.Equals(team.ID), db.TeamMember.UserID.Equals(user.ID)),
+	).Create(
+		db.TeamMember.Team.Link(db.Team.ID.Equals(team.ID)),
+		db.TeamMember.User.Link(db.User.ID.Equals(user.ID)),
+		db.TeamMember.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+		db.TeamMember.Role.Set(role),
+	).Update(
+		db.TeamMember.Role.Set(role),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to update member %s of team %s: %v", user.ID, team.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the team member, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// RemoveTeamMember removes the user from the team. Members can leave a team themselves.
+func (OrganizationController) RemoveTeamMember(viewer Viewer, name string, teamName string, userID string) *result.Result {
+	user, err := findUser(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", userID))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to remove the team member, try again later.")
+	}
+
+	var team *db.TeamModel
+	if user.ID == viewer.ID {
+		org, res := findOrganization(name)
+		if res != nil {
+			return res
+		}
+
+		if team, res = findTeam(org, teamName); res != nil {
+			return res
+		}
+	} else {
+		var res *result.Result
+		if _, team, res = findMaintainedTeam(viewer, name, teamName); res != nil {
+			return res
+		}
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.TeamMember.FindUnique(
+		db.TeamMember.TeamIDUserID(db.TeamMember.TeamID.Equals(team.ID), db.TeamMember.UserID.Equals(user.ID)),
+	).Delete().Exec(context.TODO())
+
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "MEMBER_NOT_FOUND", fmt.Sprintf("User %s is not a member of %s.", user.Username, team.Name))
+		}
+
+		logrus.Errorf("Unable to remove member %s of team %s: %v", user.ID, team.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to remove the team member, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// findOrganization returns the organization with the name.
+func findOrganization(name string) (*db.OrganizationModel, *result.Result) {
+	org, err := pkg.GlobalContainer.Prisma.Organization.FindUnique(db.Organization.Name.Equals(name)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(404, "ORGANIZATION_NOT_FOUND", fmt.Sprintf("Organization %s was not found.", name))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the organization, try again later.")
+	}
+
+	return org, nil
+}
+
+// findOrganizationAs returns the organization with the name and the viewer's membership,
+// if the viewer has at least the `required` role or is an administrator.
+func findOrganizationAs(viewer Viewer, name string, required db.OrganizationRole) (*db.OrganizationModel, *db.OrganizationMemberModel, *result.Result) {
+	org, res := findOrganization(name)
+	if res != nil {
+		return nil, nil, res
+	}
+
+	membership, err := organizationMembership(org.ID, viewer.ID)
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, nil, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the organization, try again later.")
+	}
+
+	if !isOrganizationRole(viewer, membership, required) {
+		return nil, nil, result.Err(403, "MISSING_PERMISSIONS", fmt.Sprintf("You don't have permission to manage %s.", org.Name))
+	}
+
+	return org, membership, nil
+}
+
+// findManagedOrganization is findOrganizationAs, for when the membership isn't needed.
+func findManagedOrganization(viewer Viewer, name string, required db.OrganizationRole) (*db.OrganizationModel, *result.Result) {
+	org, _, res := findOrganizationAs(viewer, name, required)
+	return org, res
+}
+
+// findTeam returns the organization's team with the name.
+func findTeam(org *db.OrganizationModel, name string) (*db.TeamModel, *result.Result) {
+	team, err := pkg.GlobalContainer.Prisma.Team.FindUnique(
+		db.Team.OrganizationIDName(db.Team.OrganizationID.Equals(org.ID), db.Team.Name.Equals(name)),
+	).Exec(context.TODO())
+
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(404, "TEAM_NOT_FOUND", fmt.Sprintf("Team %s was not found in %s.", name, org.Name))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the team, try again later.")
+	}
+
+	return team, nil
+}
+
+// findMaintainedTeam returns the organization and its team, if the viewer can manage the
+// team's members.
+func findMaintainedTeam(viewer Viewer, name string, teamName string) (*db.OrganizationModel, *db.TeamModel, *result.Result) {
+	org, res := findOrganization(name)
+	if res != nil {
+		return nil, nil, res
+	}
+
+	team, res := findTeam(org, teamName)
+	if res != nil {
+		return nil, nil, res
+	}
+
+	membership, err := organizationMembership(org.ID, viewer.ID)
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, nil, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the team, try again later.")
+	}
+
+	if isOrganizationRole(viewer, membership, db.OrganizationRoleADMIN) {
+		return org, team, nil
+	}
+
+	maintainer, err := pkg.GlobalContainer.Prisma.TeamMember.FindUnique(
+		db.TeamMember.TeamIDUserID(db.TeamMember.TeamID.Equals(team.ID), db.TeamMember.UserID.Equals(viewer.ID)),
+	).Exec(context.TODO())
+
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, nil, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the team, try again later.")
+	}
+
+	if maintainer == nil || maintainer.Role != db.TeamRoleMAINTAINER {
+		return nil, nil, result.Err(403, "MISSING_PERMISSIONS", fmt.Sprintf("You don't have permission to manage %s.", team.Name))
+	}
+
+	return org, team, nil
+}
+
+// isOrganizationRole returns if the membership has at least the `required` role. Administrators
+// always do.
+func isOrganizationRole(viewer Viewer, membership *db.OrganizationMemberModel, required db.OrganizationRole) bool {
+	if viewer.Admin {
+		return true
+	}
+
+	if membership == nil {
+		return false
+	}
+
+	switch required {
+	case db.OrganizationRoleOWNER:
+		return membership.Role == db.OrganizationRoleOWNER
+
+	case db.OrganizationRoleADMIN:
+		return membership.Role == db.OrganizationRoleOWNER || membership.Role == db.OrganizationRoleADMIN
+
+	default:
+		return true
+	}
+}
+
+// ensureAnotherOwner returns an error if the user is the organization's only owner.
+func ensureAnotherOwner(orgID string, userID string) *result.Result {
+	owners, err := pkg.GlobalContainer.Prisma.OrganizationMember.FindMany(
+		db.OrganizationMember.OrganizationID.Equals(orgID),
+		db.OrganizationMember.Role.Equals(db.OrganizationRoleOWNER),
+		db.OrganizationMember.UserID.Not(userID),
+	).Take(1).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the member, try again later.")
+	}
+
+	if len(owners) == 0 {
+		return result.Err(409, "SOLE_ORGANIZATION_OWNER", "Organizations need at least one owner, add another owner first.")
+	}
+
+	return nil
+}
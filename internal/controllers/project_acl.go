@@ -15,3 +15,171 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package controllers
+
+import (
+	"context"
+	"errors"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/acl"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultOrganizationACL is used for organizations that haven't set a default ACL,
+// it lets every member write to the organization's projects.
+var defaultOrganizationACL = &acl.Object{
+	FormatVersion: acl.Version1,
+	Members: map[string]acl.Member{
+		acl.RoleSubject("member"): {
+			Allow: []acl.Permission{acl.WRITE},
+			Deny:  []acl.Permission{},
+		},
+	},
+}
+
+// projectAccess is what a viewer can do with a project.
+type projectAccess struct {
+	// Visible is if the viewer can see the project.
+	Visible bool
+
+	// Manage is if the viewer can transfer or delete the project.
+	Manage bool
+
+	// Permissions are the ACL permissions the viewer has.
+	Permissions []acl.Permission
+}
+
+// Has returns if the viewer has the permission.
+func (a projectAccess) Has(permission acl.Permission) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessProject evaluates what the viewer can do with the project.
+//
+//   - Administrators and the owner of a user's project can do everything.
+//   - Owners and admins of the organization that owns a project can do everything.
+//   - Other members of the organization get the permissions its default ACL gives to
+//     their user, their teams and the `role:member` role.
+//   - Members of a project can write to it.
+func accessProject(viewer Viewer, project *db.ProjectModel) (projectAccess, error) {
+	access := projectAccess{
+		Visible:     !flags.ProjectFlags(project.Flags).Has(flags.Private),
+		Permissions: []acl.Permission{},
+	}
+
+	if viewer.ID == "" {
+		return access, nil
+	}
+
+	if ownerID, ok := project.OwnerID(); viewer.Admin || (ok && ownerID == viewer.ID) {
+		return projectAccess{Visible: true, Manage: true, Permissions: acl.Permissions}, nil
+	}
+
+	_, err := pkg.GlobalContainer.Prisma.ProjectMember.FindUnique(
+		db.ProjectMember.ProjectIDUserID(db.ProjectMember.ProjectID.Equals(project.ID), db.ProjectMember.UserID.Equals(viewer.ID)),
+	).Exec(context.TODO())
+
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return access, err
+	}
+
+	if err == nil {
+		access.Visible = true
+		access.Permissions = append(access.Permissions, acl.WRITE)
+	}
+
+	orgID, ok := project.OrganizationID()
+	if !ok {
+		return access, nil
+	}
+
+	membership, err := organizationMembership(orgID, viewer.ID)
+	if err != nil || membership == nil {
+		return access, err
+	}
+
+	access.Visible = true
+	if membership.Role == db.OrganizationRoleOWNER || membership.Role == db.OrganizationRoleADMIN {
+		access.Manage = true
+		access.Permissions = acl.Permissions
+		return access, nil
+	}
+
+	object, err := organizationACL(orgID)
+	if err != nil {
+		return access, err
+	}
+
+	subjects := []string{acl.UserSubject(viewer.ID), acl.RoleSubject("member")}
+	teams, err := pkg.GlobalContainer.Prisma.TeamMember.FindMany(
+		db.TeamMember.UserID.Equals(viewer.ID),
+		db.TeamMember.Team.Where(db.Team.OrganizationID.Equals(orgID)),
+	).Exec(context.TODO())
+
+	if err != nil {
+		return access, err
+	}
+
+	for _, team := range teams {
+		subjects = append(subjects, acl.TeamSubject(team.TeamID))
+	}
+
+	permissions := make([]acl.Permission, 0, len(acl.Permissions))
+	for _, permission := range acl.Permissions {
+		if object.Allowed(permission, subjects...) || (access.Has(permission) && !object.Denied(permission, subjects...)) {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	access.Permissions = permissions
+	return access, nil
+}
+
+// organizationMembership returns the user's membership of the organization, or
+// nil if they aren't a member.
+func organizationMembership(orgID string, userID string) (*db.OrganizationMemberModel, error) {
+	membership, err := pkg.GlobalContainer.Prisma.OrganizationMember.FindUnique(
+		db.OrganizationMember.OrganizationIDUserID(db.OrganizationMember.OrganizationID.Equals(orgID), db.OrganizationMember.UserID.Equals(userID)),
+	).Exec(context.TODO())
+
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return membership, nil
+}
+
+// organizationACL returns the organization's default ACL, or defaultOrganizationACL
+// if it hasn't set one.
+func organizationACL(orgID string) (*acl.Object, error) {
+	org, err := pkg.GlobalContainer.Prisma.Organization.FindUnique(db.Organization.ID.Equals(orgID)).Exec(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	source, ok := org.DefaultACL()
+	if !ok {
+		return defaultOrganizationACL, nil
+	}
+
+	object, err := acl.DecodeFromSource(source)
+	if err != nil {
+		// The ACL is validated when it's saved, so this shouldn't happen.
+		logrus.Errorf("Unable to decode the default ACL of organization %s: %v", orgID, err)
+		return nil, err
+	}
+
+	return object, nil
+}
@@ -15,3 +15,455 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/acl"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/sirupsen/logrus"
+)
+
+// ProjectFilter is which of a user's projects are listed.
+type ProjectFilter string
+
+var (
+	// OwnedProjects are the projects the user owns.
+	OwnedProjects ProjectFilter = "owned"
+
+	// MemberProjects are the projects the user is a member of.
+	MemberProjects ProjectFilter = "member"
+
+	// StarredProjects are the projects the user has starred.
+	StarredProjects ProjectFilter = "starred"
+)
+
+// Viewer is who is looking at a project, it decides if private projects are
+// visible. The ID is empty if the request isn't authenticated.
+type Viewer = acl.Viewer
+
+// Project is the underlying Project structure that is returned using the API.
+type Project struct {
+	// Returns the project's description, can be `nil`
+	// if no description was provided.
+	Description *string `json:"description"`
+
+	// Returns a RFC3339 timestamp of when this project's
+	// metadata has been updated.
+	UpdatedAt string `json:"updated_at"`
+
+	// Returns a RFC3339 timestamp of when this project
+	// was created.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the ID of the user that owns this project, or `nil` if
+	// it's owned by an organization.
+	OwnerID *string `json:"owner_id"`
+
+	// Returns the ID of the organization that owns this project, or `nil`
+	// if it's owned by a user.
+	OrganizationID *string `json:"organization_id"`
+
+	// Returns the names of the project's flags (i.e, `["private"]`).
+	Flags flags.ProjectFlags `json:"flags"`
+
+	// Returns the project's name.
+	Name string `json:"name"`
+
+	// Returns this project's ID that can be queried from the API.
+	ID string `json:"id"`
+}
+
+// ProjectPage is a page of projects, ordered by newest first.
+type ProjectPage struct {
+	Projects []Project `json:"projects"`
+
+	// NextCursor is the `cursor` to request the next page with, it is `nil`
+	// if this is the last page.
+	NextCursor *string `json:"next_cursor"`
+}
+
+// projectRow is a project that was queried with raw SQL.
+type projectRow struct {
+	Description    *string   `json:"description"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	CreatedAt      time.Time `json:"created_at"`
+	OwnerID        *string   `json:"owner_id"`
+	OrganizationID *string   `json:"organization_id"`
+	Flags          int       `json:"flags"`
+	Name           string    `json:"name"`
+	ID             string    `json:"id"`
+}
+
+func (p projectRow) toProject() Project {
+	return Project{
+		Description:    p.Description,
+		UpdatedAt:      p.UpdatedAt.Format(time.RFC3339),
+		CreatedAt:      p.CreatedAt.Format(time.RFC3339),
+		OwnerID:        p.OwnerID,
+		OrganizationID: p.OrganizationID,
+		Flags:          flags.ProjectFlags(p.Flags),
+		Name:           p.Name,
+		ID:             p.ID,
+	}
+}
+
+func fromProjectModel(project *db.ProjectModel) Project {
+	return Project{
+		Description:    project.InnerProject.Description,
+		UpdatedAt:      project.UpdatedAt.Format(time.RFC3339),
+		CreatedAt:      project.CreatedAt.Format(time.RFC3339),
+		OwnerID:        project.InnerProject.OwnerID,
+		OrganizationID: project.InnerProject.OrganizationID,
+		Flags:          flags.ProjectFlags(project.Flags),
+		Name:           project.Name,
+		ID:             project.ID,
+	}
+}
+
+// Projects returns a page of the user's projects, which can be looked up by username with an `@`.
+// Private projects are left out unless the viewer owns them, or is a member of them or their
+// organization. `cursor` is the `next_cursor` of the previous page, or empty for the first page.
+func (UserController) Projects(viewer Viewer, id string, filter ProjectFilter, cursor string, limit int) *result.Result {
+	user, err := findUser(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to retrieve user %s from the database: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list projects, try again later.")
+	}
+
+	var clause func(arg func(value interface{}) string) string
+	switch filter {
+	case OwnedProjects, "":
+		clause = func(arg func(value interface{}) string) string {
+			return `"p"."owner_id" = ` + arg(user.ID)
+		}
+
+	case MemberProjects:
+		clause = func(arg func(value interface{}) string) string {
+			return `EXISTS (SELECT 1 FROM "project_members" "m" WHERE "m"."project_id" = "p"."id" AND "m"."user_id" = ` + arg(user.ID) + `)`
+		}
+
+	case StarredProjects:
+		clause = func(arg func(value interface{}) string) string {
+			return `EXISTS (SELECT 1 FROM "project_stars" "s" WHERE "s"."project_id" = "p"."id" AND "s"."user_id" = ` + arg(user.ID) + `)`
+		}
+
+	default:
+		return result.Err(406, "INVALID_PROJECT_FILTER", fmt.Sprintf("Project filter %s is not `owned`, `member` or `starred`.", filter))
+	}
+
+	return listProjects(viewer, clause, cursor, limit)
+}
+
+// listProjects returns a page of the projects in `"p"` that match the condition from `clause`
+// and are visible to the viewer. `clause` is given `arg`, which adds a query parameter and
+// returns its placeholder.
+func listProjects(viewer Viewer, clause func(arg func(value interface{}) string) string, cursor string, limit int) *result.Result {
+	if limit == 0 {
+		limit = 25
+	}
+
+	if limit < 1 || limit > 100 {
+		return result.Err(406, "INVALID_LIMIT", "`limit` must be between 1 and 100.")
+	}
+
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{clause(arg)}
+	if visible := acl.VisibleProjects(viewer, arg); visible != "" {
+		where = append(where, visible)
+	}
+
+	if cursor != "" {
+		createdAt, projectID, ok := decodeProjectCursor(cursor)
+		if !ok {
+			return result.Err(406, "INVALID_CURSOR", "`cursor` is not a valid cursor.")
+		}
+
+		where = append(where, `("p"."created_at", "p"."id") < (`+arg(createdAt.UTC().Format("2006-01-02 15:04:05.000"))+`::timestamp, `+arg(projectID)+`)`)
+	}
+
+	// Fetch one more than the limit to know if there is a next page.
+	var rows []projectRow
+	err := pkg.GlobalContainer.Prisma.Prisma.QueryRaw(
+		`SELECT "p"."description", "p"."updated_at", "p"."created_at", "p"."owner_id", "p"."organization_id", "p"."flags", "p"."name", "p"."id" FROM "projects" "p"
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY "p"."created_at" DESC, "p"."id" DESC LIMIT `+arg(limit+1),
+		args...,
+	).Exec(context.TODO(), &rows)
+
+	if err != nil {
+		logrus.Errorf("Unable to list projects: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to list projects, try again later.")
+	}
+
+	page := ProjectPage{Projects: make([]Project, 0, len(rows))}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		next := encodeProjectCursor(rows[limit-1])
+		page.NextCursor = &next
+	}
+
+	for _, row := range rows {
+		page.Projects = append(page.Projects, row.toProject())
+	}
+
+	return result.Ok(page)
+}
+
+// encodeProjectCursor returns the cursor that continues after `row`.
+func encodeProjectCursor(row projectRow) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", row.CreatedAt.UnixMilli(), row.ID)))
+}
+
+// decodeProjectCursor returns the creation date and ID of the project the cursor continues after.
+func decodeProjectCursor(cursor string) (time.Time, string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return time.Time{}, "", false
+	}
+
+	millis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	return time.UnixMilli(millis), parts[1], true
+}
+
+// ProjectController is the controller for the Projects API.
+type ProjectController struct{}
+
+func newProjectController() ProjectController {
+	return ProjectController{}
+}
+
+// ProjectPermissions is what the viewer can do with a project.
+type ProjectPermissions struct {
+	// Returns if the viewer can transfer or delete the project.
+	Manage bool `json:"manage"`
+
+	// Returns the ACL permissions the viewer has, i.e, `["WRITE"]`.
+	Permissions []acl.Permission `json:"permissions"`
+}
+
+// Permissions returns what the viewer can do with the project.
+func (ProjectController) Permissions(viewer Viewer, id string) *result.Result {
+	_, access, res := findVisibleProject(viewer, id)
+	if res != nil {
+		return res
+	}
+
+	return result.Ok(ProjectPermissions{
+		Manage:      access.Manage,
+		Permissions: access.Permissions,
+	})
+}
+
+// Transfer gives the project to the user with the `username`, or the organization with the
+// `organization` name. Only the owner of the project, or the owners and admins of its
+// organization, can transfer it, and only into organizations they are an owner or admin of.
+func (ProjectController) Transfer(viewer Viewer, id string, username string, organization string) *result.Result {
+	if (username == "") == (organization == "") {
+		return result.Err(406, "INVALID_TRANSFER_TARGET", "Exactly one of `user` or `organization` is required.")
+	}
+
+	project, access, res := findVisibleProject(viewer, id)
+	if res != nil {
+		return res
+	}
+
+	if !access.Manage {
+		return result.Err(403, "MISSING_PERMISSIONS", "You don't have permission to transfer this project.")
+	}
+
+	var ownerID, organizationID *string
+	if username != "" {
+		user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Username.Equals(username)).Exec(context.TODO())
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("User %s was not found.", username))
+			}
+
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+		}
+
+		if user.Disabled {
+			return result.Err(406, "INVALID_TRANSFER_TARGET", fmt.Sprintf("Projects can't be transferred to %s.", username))
+		}
+
+		ownerID = &user.ID
+	} else {
+		org, err := pkg.GlobalContainer.Prisma.Organization.FindUnique(db.Organization.Name.Equals(organization)).Exec(context.TODO())
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return result.Err(404, "ORGANIZATION_NOT_FOUND", fmt.Sprintf("Organization %s was not found.", organization))
+			}
+
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+		}
+
+		if !viewer.Admin {
+			membership, err := organizationMembership(org.ID, viewer.ID)
+			if err != nil {
+				logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+				return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+			}
+
+			if membership == nil || membership.Role == db.OrganizationRoleMEMBER {
+				return result.Err(403, "MISSING_PERMISSIONS", fmt.Sprintf("You have to be an owner or admin of %s to transfer projects into it.", organization))
+			}
+		}
+
+		organizationID = &org.ID
+	}
+
+	target := ownerID
+	if target == nil {
+		target = organizationID
+	}
+
+	if current := projectOwner(project); current == *target {
+		return result.Err(406, "INVALID_TRANSFER_TARGET", "The project is already owned by them.")
+	}
+
+	existing, err := pkg.GlobalContainer.Prisma.Project.FindFirst(
+		db.Project.Or(db.Project.OwnerID.Equals(*target), db.Project.OrganizationID.Equals(*target)),
+		db.Project.Name.Equals(project.Name),
+	).Exec(context.TODO())
+
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+	}
+
+	if existing != nil {
+		return result.Err(409, "PROJECT_NAME_TAKEN", fmt.Sprintf("They already have a project named %s.", project.Name))
+	}
+
+	from := projectOwner(project) + "/" + project.Name
+	to := *target + "/" + project.Name
+	if err := moveTree(from, to); err != nil {
+		logrus.Errorf("Unable to move the files of project %s: %v", project.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+	}
+
+	// Both owners have to change in one statement, or the single owner check fails.
+	update := pkg.GlobalContainer.Prisma.Prisma.ExecuteRaw(
+		`UPDATE "projects" SET "owner_id" = $1, "organization_id" = $2, "updated_at" = (NOW() AT TIME ZONE 'UTC') WHERE "id" = $3`,
+		ownerID,
+		organizationID,
+		project.ID,
+	).Tx()
+
+	transferred := events.Record(&viewer.ID, events.ProjectTransferred{
+		From: eventOwner(project),
+		To:   newEventOwner(ownerID, organizationID),
+		Name: project.Name,
+		ID:   project.ID,
+	})
+
+	// The project still belongs to its old owner, so its files have to go back to where it
+	// looks for them.
+	if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(update, transferred).Exec(context.TODO()); err != nil {
+		logrus.Errorf("Unable to transfer project %s: %v", project.ID, err)
+		if err := moveTree(to, from); err != nil {
+			logrus.Errorf("Unable to move the files of project %s back to %s, they are left in %s: %v", project.ID, from, to, err)
+		}
+
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+	}
+
+	updated, err := pkg.GlobalContainer.Prisma.Project.FindUnique(db.Project.ID.Equals(project.ID)).Exec(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to transfer the project, try again later.")
+	}
+
+	search.ProjectChanged(project.ID)
+	logrus.Infof("Transferred project %s from %s to %s", project.ID, projectOwner(project), *target)
+	return result.Ok(fromProjectModel(updated))
+}
+
+// findVisibleProject returns the project and what the viewer can do with it. Projects the
+// viewer can't see are reported as not found, so private projects can't be discovered.
+func findVisibleProject(viewer Viewer, id string) (*db.ProjectModel, projectAccess, *result.Result) {
+	project, err := pkg.GlobalContainer.Prisma.Project.FindUnique(db.Project.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, projectAccess{}, result.Err(404, "PROJECT_NOT_FOUND", fmt.Sprintf("project with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, projectAccess{}, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the project, try again later.")
+	}
+
+	access, err := accessProject(viewer, project)
+	if err != nil {
+		logrus.Errorf("Unable to evaluate access to project %s: %v", id, err)
+		return nil, projectAccess{}, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch the project, try again later.")
+	}
+
+	if !access.Visible {
+		return nil, projectAccess{}, result.Err(404, "PROJECT_NOT_FOUND", fmt.Sprintf("project with id %s was not found.", id))
+	}
+
+	return project, access, nil
+}
+
+// projectOwner returns the ID of the user or organization that owns the project, which is
+// also where its files are in the storage provider.
+func projectOwner(project *db.ProjectModel) string {
+	if ownerID, ok := project.OwnerID(); ok {
+		return ownerID
+	}
+
+	orgID, _ := project.OrganizationID()
+	return orgID
+}
+
+// eventOwner returns who owns the project, as it's described in events.
+func eventOwner(project *db.ProjectModel) events.Owner {
+	if ownerID, ok := project.OwnerID(); ok {
+		return events.Owner{Type: "user", ID: ownerID}
+	}
+
+	orgID, _ := project.OrganizationID()
+	return events.Owner{Type: "organization", ID: orgID}
+}
+
+// newEventOwner returns the events.Owner of a project owned by the user `ownerID`, or
+// by the organization `orgID` if the user is nil.
+func newEventOwner(ownerID *string, orgID *string) events.Owner {
+	if ownerID != nil {
+		return events.Owner{Type: "user", ID: *ownerID}
+	}
+
+	return events.Owner{Type: "organization", ID: *orgID}
+}
@@ -0,0 +1,80 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/search"
+	"github.com/sirupsen/logrus"
+)
+
+// SearchController is the controller for the Search API.
+type SearchController struct {
+	backend search.Backend
+}
+
+// newSearchController uses Elasticsearch if it was configured, otherwise PostgreSQL.
+func newSearchController() SearchController {
+	backend := search.New(pkg.GlobalContainer.ElasticSearch, pkg.GlobalContainer.Prisma)
+	logrus.Infof("Using %s for search.", backend.Name())
+
+	return SearchController{backend}
+}
+
+// Search searches users and projects for `query`. Private projects are left out unless
+// the viewer can see them. `cursor` is the `next_cursor` of the previous page, or empty
+// for the first page.
+func (c SearchController) Search(viewer Viewer, query string, searchType search.Type, cursor string, limit int) *result.Result {
+	if query == "" {
+		return result.Err(406, "MISSING_QUERY", "Missing the `q` query parameter.")
+	}
+
+	if limit == 0 {
+		limit = 20
+	}
+
+	if limit < 1 || limit > 50 {
+		return result.Err(406, "INVALID_LIMIT", "`limit` must be between 1 and 50.")
+	}
+
+	if searchType != search.All && searchType != search.Users && searchType != search.Projects {
+		return result.Err(406, "INVALID_SEARCH_TYPE", fmt.Sprintf("Search type %s is not `users` or `projects`.", searchType))
+	}
+
+	results, err := c.backend.Search(search.Query{
+		Text:   query,
+		Type:   searchType,
+		Viewer: viewer,
+		Cursor: cursor,
+		Limit:  limit,
+	})
+
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidCursor) {
+			return result.Err(406, "INVALID_CURSOR", "The cursor is not valid.")
+		}
+
+		logrus.Errorf("Unable to search with %s: %v", c.backend.Name(), err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to search, try again later.")
+	}
+
+	return result.Ok(results)
+}
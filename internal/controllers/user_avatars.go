@@ -0,0 +1,175 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/avatars"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/storage"
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/sirupsen/logrus"
+)
+
+// avatarPathRegex matches the user ID and hash of an avatar, so they can't be
+// used to escape the avatars directory.
+var avatarPathRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// SetAvatar resizes the uploaded image and stores it as the user's avatar. This also
+// turns off `use_gravatar`, since the user wants to use the avatar they uploaded.
+func (UserController) SetAvatar(id string, data []byte) *result.Result {
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to upload avatar, try again later.")
+	}
+
+	avatar, err := avatars.Process(data)
+	if err != nil {
+		switch err {
+		case avatars.ErrUnsupportedFormat:
+			return result.Err(415, "UNSUPPORTED_AVATAR_FORMAT", "Avatars must be a PNG, JPEG, WebP or GIF image.")
+
+		case avatars.ErrTooLarge:
+			return result.Err(413, "AVATAR_TOO_LARGE", fmt.Sprintf("Avatars can't be wider or taller than %d pixels.", avatars.MaxDimension))
+
+		default:
+			return result.Err(406, "INVALID_AVATAR", "Unable to decode the avatar, is it a valid image?")
+		}
+	}
+
+	for size, image := range avatar.Images {
+		if err := pkg.GlobalContainer.Storage.Put(avatarPath(id, avatar.Hash, size), "image/png", image); err != nil {
+			logrus.Errorf("Unable to store avatar for user %s: %v", id, err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to upload avatar, try again later.")
+		}
+	}
+
+	url := fmt.Sprintf("/avatars/%s/%s", id, avatar.Hash)
+	updated, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.AvatarURL.Set(url),
+		db.User.UseGravatar.Set(false),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to update users.%s.avatar_url: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to upload avatar, try again later.")
+	}
+
+	// Remove the previous avatar, unless the same image was uploaded again.
+	if previous, ok := user.AvatarURL(); ok && previous != url {
+		deleteAvatar(previous)
+	}
+
+	return result.Ok(fromUserModel(updated))
+}
+
+// DeleteAvatar removes the user's uploaded avatar.
+func (UserController) DeleteAvatar(id string) *result.Result {
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete avatar, try again later.")
+	}
+
+	previous, ok := user.AvatarURL()
+	if !ok {
+		return result.Err(404, "AVATAR_NOT_FOUND", "You haven't uploaded an avatar.")
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.AvatarURL.SetOptional(nil),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to update users.%s.avatar_url: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete avatar, try again later.")
+	}
+
+	deleteAvatar(previous)
+	return result.NoContent()
+}
+
+// Avatar opens the PNG image of an avatar. The caller has to close it.
+func (UserController) Avatar(id string, hash string, size int) (io.ReadCloser, *result.Result) {
+	if !avatarPathRegex.MatchString(id) || !avatarPathRegex.MatchString(hash) {
+		return nil, result.Err(404, "AVATAR_NOT_FOUND", "Avatar was not found.")
+	}
+
+	if !avatars.ValidSize(size) {
+		return nil, result.Err(406, "INVALID_AVATAR_SIZE", fmt.Sprintf("Avatar size must be one of %v.", avatars.Sizes))
+	}
+
+	image, err := pkg.GlobalContainer.Storage.Open(avatarPath(id, hash, size))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, result.Err(404, "AVATAR_NOT_FOUND", "Avatar was not found.")
+		}
+
+		logrus.Errorf("Unable to open avatar %s/%s: %v", id, hash, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to fetch avatar, try again later.")
+	}
+
+	return image, nil
+}
+
+// avatarURL returns the Gravatar URL if the user opted to use Gravatar, otherwise
+// the path to their uploaded avatar.
+func avatarURL(user *db.UserModel) *string {
+	if !user.UseGravatar {
+		return user.InnerUser.AvatarURL
+	}
+
+	email := user.Email
+	if gravatarEmail, ok := user.GravatarEmail(); ok {
+		email = gravatarEmail
+	}
+
+	hash := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	url := fmt.Sprintf("https://www.gravatar.com/avatar/%s?d=identicon", hex.EncodeToString(hash[:]))
+	return &url
+}
+
+// avatarPath returns where an avatar of `size` is kept in the storage provider.
+func avatarPath(id string, hash string, size int) string {
+	return fmt.Sprintf("avatars/%s/%s/%d.png", id, hash, size)
+}
+
+// deleteAvatar removes every size of the avatar at `url` from the storage provider.
+func deleteAvatar(url string) {
+	path := strings.TrimPrefix(url, "/")
+	if err := pkg.GlobalContainer.Storage.Delete(path); err != nil {
+		logrus.Errorf("Unable to delete avatar %s: %v", path, err)
+	}
+}
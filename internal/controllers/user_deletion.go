@@ -0,0 +1,478 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/auth"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/pkg/sessions"
+	"arisu.land/tsubaki/prisma/db"
+	"arisu.land/tsubaki/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// deletionInterval is how often queued account deletions are processed.
+	deletionInterval = 30 * time.Second
+
+	// deletionBatchSize is how many account deletions are processed at once.
+	deletionBatchSize = 25
+
+	// reauthenticationWindow is how old a session can be to delete the account without
+	// a password, for users that log in with OpenID Connect and never had one.
+	reauthenticationWindow = 5 * time.Minute
+
+	// deletionClaimTTL is how long a replica has to delete an account it claimed, before
+	// another replica can claim it. Deletions can be run again, so that is safe. Failed
+	// deletions keep their claim, so they are retried after it expires.
+	deletionClaimTTL = 10 * time.Minute
+)
+
+// AccountDeletion is an account deletion that is waiting to be processed.
+type AccountDeletion struct {
+	// Returns a RFC3339 timestamp of when the deletion was requested.
+	CreatedAt string `json:"created_at"`
+
+	// Returns the ID of the user the projects will be transferred to, or
+	// `nil` if they will be deleted.
+	TransferTo *string `json:"transfer_to"`
+
+	// Returns the ID of the user that will be deleted.
+	UserID string `json:"user_id"`
+
+	// Returns the account deletion's ID.
+	ID string `json:"id"`
+}
+
+// RequestDeletion queues the user's account to be deleted in the background, after
+// confirming it's them so a stolen token can't delete it. They confirm with their
+// `password`, which is checked against the directory for LDAP users, or by logging in
+// again right before, i.e, with OpenID Connect. `loggedInAt` is when the session was
+// created. They are disabled and logged out right away. If `transferTo` is a username,
+// their projects are transferred to that user instead of being deleted.
+func (UserController) RequestDeletion(id string, password string, loggedInAt time.Time, transferTo string) *result.Result {
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the user, try again later.")
+	}
+
+	if password == "" {
+		if loggedInAt.IsZero() || time.Since(loggedInAt) > reauthenticationWindow {
+			return result.Err(403, "REAUTHENTICATION_REQUIRED", fmt.Sprintf("Confirm with your `password`, or log in again and delete your account within %s.", reauthenticationWindow.String()))
+		}
+
+		return scheduleDeletion(id, transferTo)
+	}
+
+	valid, res := confirmPassword(user, password)
+	if res != nil {
+		return res
+	}
+
+	if !valid {
+		return result.Err(403, "INVALID_PASSWORD", "The password is incorrect.")
+	}
+
+	return scheduleDeletion(id, transferTo)
+}
+
+// confirmPassword checks the password of a user that is already logged in. Users that
+// are linked with the LDAP directory are checked against it, since their local password
+// is a random one they never saw.
+func confirmPassword(user *db.UserModel, password string) (bool, *result.Result) {
+	if directory := pkg.GlobalContainer.LDAP; directory != nil {
+		identity, err := pkg.GlobalContainer.Prisma.Identity.FindFirst(
+			db.Identity.OwnerID.Equals(user.ID),
+			db.Identity.Provider.Equals(ldapProvider),
+		).Exec(context.TODO())
+
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return false, result.Err(500, "UNKNOWN_ERROR", "Unable to verify the password, try again later.")
+		}
+
+		if identity != nil {
+			dirUser, err := directory.Authenticate(identity.Subject, password)
+			if err != nil {
+				if errors.Is(err, auth.InvalidCredentialsError) {
+					return false, nil
+				}
+
+				logrus.Errorf("Unable to authenticate user %s with LDAP: %v", user.ID, err)
+				return false, result.Err(503, "LDAP_UNAVAILABLE", "Unable to reach the directory server, try again later.")
+			}
+
+			// The subject is the directory username, so it has to be the same entry.
+			return dirUser.Username == identity.Subject, nil
+		}
+	}
+
+	valid, err := util.VerifyPassword(password, user.Password)
+	if err != nil {
+		logrus.Errorf("Unable to verify password for user %s: %v", user.ID, err)
+		return false, result.Err(500, "UNKNOWN_ERROR", "Unable to verify the password, try again later.")
+	}
+
+	return valid, nil
+}
+
+// StartDeletionWorker processes the queued account deletions every deletionInterval.
+// The queue is kept in PostgreSQL, so deletions that didn't finish are picked back
+// up after a restart.
+func (UserController) StartDeletionWorker() {
+	go func() {
+		for {
+			processDeletions()
+			time.Sleep(deletionInterval)
+		}
+	}()
+}
+
+// scheduleDeletion queues the account deletion, disables the user and revokes
+// their sessions and access tokens.
+func scheduleDeletion(id string, transferTo string) *result.Result {
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the user, try again later.")
+	}
+
+	// Organizations can't be left without an owner, someone else has to be made one first.
+	owned, err := pkg.GlobalContainer.Prisma.OrganizationMember.FindMany(
+		db.OrganizationMember.UserID.Equals(id),
+		db.OrganizationMember.Role.Equals(db.OrganizationRoleOWNER),
+	).With(db.OrganizationMember.Organization.Fetch()).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the user, try again later.")
+	}
+
+	for _, membership := range owned {
+		if res := ensureAnotherOwner(membership.OrganizationID, id); res != nil {
+			if res.StatusCode == 409 {
+				return result.Err(409, "SOLE_ORGANIZATION_OWNER", fmt.Sprintf("You are the only owner of %s, add another owner or delete it first.", membership.Organization().Name))
+			}
+
+			return res
+		}
+	}
+
+	var target *string
+	if transferTo != "" {
+		t, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Username.Equals(transferTo)).Exec(context.TODO())
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return result.Err(406, "TRANSFER_USER_NOT_FOUND", fmt.Sprintf("User %s was not found.", transferTo))
+			}
+
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the user, try again later.")
+		}
+
+		if t.ID == user.ID || t.Disabled {
+			return result.Err(406, "INVALID_TRANSFER_USER", fmt.Sprintf("Projects can't be transferred to %s.", transferTo))
+		}
+
+		target = &t.ID
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.AccountDeletion.FindUnique(db.AccountDeletion.UserID.Equals(id)).Exec(context.TODO())
+	if err == nil {
+		return result.Err(409, "ACCOUNT_DELETION_PENDING", "This account is already going to be deleted.")
+	}
+
+	if !errors.Is(err, db.ErrNotFound) {
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the user, try again later.")
+	}
+
+	deletion, err := pkg.GlobalContainer.Prisma.AccountDeletion.CreateOne(
+		db.AccountDeletion.UserID.Set(id),
+		db.AccountDeletion.ID.Set(pkg.GlobalContainer.Snowflake.Generate().String()),
+		db.AccountDeletion.TransferTo.SetOptional(target),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to queue deletion of user %s: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the user, try again later.")
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.Disabled.Set(true),
+	).Exec(context.TODO())
+
+	if err != nil {
+		logrus.Errorf("Unable to update users.%s.disabled: %v", id, err)
+	}
+
+	if err := revokeCredentials(id); err != nil {
+		logrus.Errorf("Unable to revoke the access token of user %s: %v", id, err)
+	}
+
+	logrus.Warnf("User %s was queued to be deleted.", id)
+	return result.OkWithStatus(202, AccountDeletion{
+		CreatedAt:  deletion.CreatedAt.Format(time.RFC3339),
+		TransferTo: deletion.InnerAccountDeletion.TransferTo,
+		UserID:     deletion.UserID,
+		ID:         deletion.ID,
+	})
+}
+
+// processDeletions claims and deletes the queued accounts. Deletions that failed are
+// retried once their claim expires, after the ones that haven't been tried as often.
+func processDeletions() {
+	for i := 0; i < deletionBatchSize; i++ {
+		deletion, err := claimDeletion()
+		if err != nil {
+			logrus.Errorf("Unable to claim an account deletion: %v", err)
+			return
+		}
+
+		if deletion == nil {
+			return
+		}
+
+		if err := deleteAccount(deletion); err != nil {
+			logrus.Errorf("Unable to delete user %s (attempt %d): %v", deletion.UserID, deletion.Attempts+1, err)
+
+			_, err = pkg.GlobalContainer.Prisma.Prisma.ExecuteRaw(
+				`UPDATE "account_deletions" SET "attempts" = "attempts" + 1, "last_error" = $1 WHERE "id" = $2`,
+				err.Error(),
+				deletion.ID,
+			).Exec(context.TODO())
+
+			if err != nil {
+				logrus.Errorf("Unable to update account deletion %s: %v", deletion.ID, err)
+			}
+
+			continue
+		}
+
+		logrus.Infof("Deleted user %s!", deletion.UserID)
+	}
+}
+
+// claimDeletion claims the next account deletion that no replica is working on, or
+// returns nil if there is none. Rows locked by another replica's claim are skipped
+// instead of waited on, so two replicas never claim the same deletion.
+func claimDeletion() (*db.AccountDeletionModel, error) {
+	var claimed []struct {
+		ID string `json:"id"`
+	}
+
+	err := pkg.GlobalContainer.Prisma.Prisma.QueryRaw(
+		`UPDATE "account_deletions" SET "claimed_until" = (NOW() AT TIME ZONE 'UTC') + $1::integer * INTERVAL '1 second'
+		WHERE "id" = (
+			SELECT "id" FROM "account_deletions"
+			WHERE "claimed_until" IS NULL OR "claimed_until" < (NOW() AT TIME ZONE 'UTC')
+			ORDER BY "attempts", "created_at"
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING "id"`,
+		int(deletionClaimTTL.Seconds()),
+	).Exec(context.TODO(), &claimed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(claimed) == 0 {
+		return nil, nil
+	}
+
+	return pkg.GlobalContainer.Prisma.AccountDeletion.FindUnique(db.AccountDeletion.ID.Equals(claimed[0].ID)).Exec(context.TODO())
+}
+
+// deleteAccount removes everything the user owns, then the user. Every step can be
+// run again, so a deletion that failed halfway is finished when it's retried.
+func deleteAccount(deletion *db.AccountDeletionModel) error {
+	id := deletion.UserID
+	if err := revokeCredentials(id); err != nil {
+		return err
+	}
+
+	projects, err := pkg.GlobalContainer.Prisma.Project.FindMany(db.Project.OwnerID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	if target, ok := deletion.TransferTo(); ok {
+		err = transferProjects(id, target, projects)
+	} else {
+		err = deleteProjects(projects)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Transferred projects were already moved out of the user's storage tree.
+	if err := pkg.GlobalContainer.Storage.Delete(id); err != nil {
+		return err
+	}
+
+	if err := pkg.GlobalContainer.Storage.Delete("avatars/" + id); err != nil {
+		return err
+	}
+
+	// The user, the queued deletion and the event are removed together, so the event
+	// is only recorded once.
+	deleteUser := pkg.GlobalContainer.Prisma.User.FindMany(db.User.ID.Equals(id)).Delete().Tx()
+	deleteQueued := pkg.GlobalContainer.Prisma.AccountDeletion.FindMany(db.AccountDeletion.ID.Equals(deletion.ID)).Delete().Tx()
+	deleted := events.Record(nil, events.UserDeleted{ID: id})
+	if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(deleteUser, deleteQueued, deleted).Exec(context.TODO()); err != nil {
+		return err
+	}
+
+	search.UserChanged(id)
+	return nil
+}
+
+// revokeCredentials logs the user out everywhere and deletes their access token.
+func revokeCredentials(id string) error {
+	deleteTokens := pkg.GlobalContainer.Prisma.AccessToken.FindMany(db.AccessToken.OwnerID.Equals(id)).Delete().Tx()
+	return sessions.Revoke(context.TODO(), pkg.GlobalContainer.Prisma, id, deleteTokens)
+}
+
+// transferProjects gives the projects to `target` and moves their files into the target's
+// storage tree. If the target already has a project with the same name, the project's ID
+// is appended to its name.
+func transferProjects(id string, target string, projects []db.ProjectModel) error {
+	if _, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(target)).Exec(context.TODO()); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("user %s to transfer projects to no longer exists", target)
+		}
+
+		return err
+	}
+
+	for _, project := range projects {
+		name := project.Name
+		_, err := pkg.GlobalContainer.Prisma.Project.FindFirst(
+			db.Project.OwnerID.Equals(target),
+			db.Project.Name.Equals(name),
+		).Exec(context.TODO())
+
+		if err == nil {
+			name = fmt.Sprintf("%s-%s", name, project.ID)
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+
+		if err := moveTree(id+"/"+project.Name, target+"/"+name); err != nil {
+			return err
+		}
+
+		update := pkg.GlobalContainer.Prisma.Project.FindUnique(db.Project.ID.Equals(project.ID)).Update(
+			db.Project.Owner.Link(db.User.ID.Equals(target)),
+			db.Project.Name.Set(name),
+		).Tx()
+
+		transferred := events.Record(nil, events.ProjectTransferred{
+			From: events.Owner{Type: "user", ID: id},
+			To:   events.Owner{Type: "user", ID: target},
+			Name: name,
+			ID:   project.ID,
+		})
+
+		if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(update, transferred).Exec(context.TODO()); err != nil {
+			return err
+		}
+
+		search.ProjectChanged(project.ID)
+		logrus.Infof("Transferred project %s from user %s to %s", project.ID, id, target)
+	}
+
+	return nil
+}
+
+// deleteProjects deletes the projects, their subprojects and their search documents.
+// The files are removed with the rest of the owner's storage tree.
+func deleteProjects(projects []db.ProjectModel) error {
+	for _, project := range projects {
+		_, err := pkg.GlobalContainer.Prisma.Subproject.FindMany(db.Subproject.ParentID.Equals(project.ID)).Delete().Exec(context.TODO())
+		if err != nil {
+			return err
+		}
+
+		deleteProject := pkg.GlobalContainer.Prisma.Project.FindMany(db.Project.ID.Equals(project.ID)).Delete().Tx()
+		deleted := events.Record(nil, events.ProjectDeleted{ID: project.ID})
+		if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(deleteProject, deleted).Exec(context.TODO()); err != nil {
+			return err
+		}
+
+		search.ProjectChanged(project.ID)
+	}
+
+	return nil
+}
+
+// moveTree copies every file under `from` to `to` in the storage provider, then
+// removes `from`.
+func moveTree(from string, to string) error {
+	files, err := pkg.GlobalContainer.Storage.List(from)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		reader, err := pkg.GlobalContainer.Storage.Open(file)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			return err
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(file))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		if err := pkg.GlobalContainer.Storage.Put(to+strings.TrimPrefix(file, from), contentType, data); err != nil {
+			return err
+		}
+	}
+
+	return pkg.GlobalContainer.Storage.Delete(from)
+}
@@ -0,0 +1,266 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/pkg/mailer"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/sessions"
+	"arisu.land/tsubaki/prisma/db"
+	"arisu.land/tsubaki/util"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// passwordResetTTL is how long a password reset link is valid for.
+	passwordResetTTL = time.Hour
+
+	// passwordResetCooldown is how long a user has to wait before requesting
+	// another password reset email.
+	passwordResetCooldown = time.Minute
+
+	// verificationTTL is how long an email verification link is valid for.
+	verificationTTL = 24 * time.Hour
+)
+
+// emailVerification is what is stored in Redis for a verification token, the email is
+// kept so a token can't verify an address the user has since changed.
+type emailVerification struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// SendVerificationEmail sends a new verification email to the user.
+func (UserController) SendVerificationEmail(id string) *result.Result {
+	if pkg.GlobalContainer.Mailer == nil {
+		return result.Err(501, "MAILER_NOT_CONFIGURED", "This instance isn't configured to send emails.")
+	}
+
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(404, "USER_NOT_FOUND", "User was not found.")
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to send verification email, try again later.")
+	}
+
+	if flags.UserFlags(user.Flags).Has(flags.VerifiedEmail) {
+		return result.Err(406, "EMAIL_ALREADY_VERIFIED", "Your email address is already verified.")
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		logrus.Errorf("Unable to send verification email to user %s: %v", user.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to send verification email, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// VerifyEmail verifies the user's email address with the token from the verification email.
+func (UserController) VerifyEmail(token string) *result.Result {
+	if pkg.GlobalContainer.Mailer == nil {
+		return result.Err(501, "MAILER_NOT_CONFIGURED", "This instance isn't configured to send emails.")
+	}
+
+	raw, err := pkg.GlobalContainer.Redis.GetDel(context.TODO(), tokenKey("email_verification", token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return result.Err(400, "INVALID_TOKEN", "The verification link is invalid or has expired.")
+		}
+
+		logrus.Errorf("Unable to fetch email verification token from Redis: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to verify email address, try again later.")
+	}
+
+	var verification emailVerification
+	if err := json.Unmarshal([]byte(raw), &verification); err != nil {
+		logrus.Errorf("Unable to unmarshal email verification: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to verify email address, try again later.")
+	}
+
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(verification.UserID)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(400, "INVALID_TOKEN", "The verification link is invalid or has expired.")
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to verify email address, try again later.")
+	}
+
+	if user.Email != verification.Email {
+		return result.Err(400, "INVALID_TOKEN", "The verification link is invalid or has expired.")
+	}
+
+	if _, err := toggleUserFlag(user.ID, flags.VerifiedEmail, true).Exec(context.TODO()); err != nil {
+		logrus.Errorf("Unable to update users.%s.flags: %v", user.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to verify email address, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// RequestPasswordReset sends a password reset email if a user with the email exists. It
+// succeeds either way, so it can't be used to find out who has an account.
+func (UserController) RequestPasswordReset(email string) *result.Result {
+	if pkg.GlobalContainer.Mailer == nil {
+		return result.Err(501, "MAILER_NOT_CONFIGURED", "This instance isn't configured to send emails.")
+	}
+
+	if pkg.GlobalContainer.LDAP != nil && pkg.GlobalContainer.LDAP.Exclusive() {
+		return result.Err(403, "LOCAL_PASSWORDS_DISABLED", "Passwords are managed by your directory, ask your administrators to reset it.")
+	}
+
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Email.Equals(email)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.NoContent()
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to send password reset email, try again later.")
+	}
+
+	// Only send one email per cooldown, so this can't be used to flood someone's inbox.
+	ok, err := pkg.GlobalContainer.Redis.SetNX(context.TODO(), "tsubaki:password_reset:cooldown:"+user.ID, "1", passwordResetCooldown).Result()
+	if err != nil {
+		logrus.Errorf("Unable to set password reset cooldown for user %s: %v", user.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to send password reset email, try again later.")
+	}
+
+	if !ok {
+		return result.NoContent()
+	}
+
+	if err := sendPasswordResetEmail(user); err != nil {
+		logrus.Errorf("Unable to send password reset email to user %s: %v", user.ID, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to send password reset email, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// ResetPassword sets the user's new password with the token from the password reset
+// email, and logs them out of their current session.
+func (UserController) ResetPassword(token string, password string) *result.Result {
+	if pkg.GlobalContainer.Mailer == nil {
+		return result.Err(501, "MAILER_NOT_CONFIGURED", "This instance isn't configured to send emails.")
+	}
+
+	if password == "" {
+		return result.Err(406, "MISSING_PASSWORD", "The new password can't be empty.")
+	}
+
+	id, err := pkg.GlobalContainer.Redis.GetDel(context.TODO(), tokenKey("password_reset", token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return result.Err(400, "INVALID_TOKEN", "The password reset link is invalid or has expired.")
+		}
+
+		logrus.Errorf("Unable to fetch password reset token from Redis: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to reset password, try again later.")
+	}
+
+	_, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return result.Err(400, "INVALID_TOKEN", "The password reset link is invalid or has expired.")
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to reset password, try again later.")
+	}
+
+	hash, err := util.GeneratePassword(password)
+	if err != nil {
+		logrus.Errorf("Unable to generate a new password hash for user %s: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to reset password, try again later.")
+	}
+
+	// Opening the reset link proves the user owns the email address, so it's verified too.
+	update := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
+		db.User.Password.Set(hash),
+	).Tx()
+
+	verify := toggleUserFlag(id, flags.VerifiedEmail, true).Tx()
+
+	// Every token issued before the reset is revoked, whoever had the old password is logged out.
+	if err := sessions.Revoke(context.TODO(), pkg.GlobalContainer.Prisma, id, update, verify); err != nil {
+		logrus.Errorf("Unable to update users.%s.password: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to reset password, try again later.")
+	}
+
+	return result.NoContent()
+}
+
+// sendPasswordResetEmail creates a password reset token for the user and queues
+// the password reset email.
+func sendPasswordResetEmail(user *db.UserModel) error {
+	token := util.GenerateHash(32)
+	if err := pkg.GlobalContainer.Redis.Set(context.TODO(), tokenKey("password_reset", token), user.ID, passwordResetTTL).Err(); err != nil {
+		return err
+	}
+
+	return pkg.GlobalContainer.Mailer.Send(context.TODO(), user.Email, "Reset your Arisu password", mailer.PasswordResetTemplate, map[string]interface{}{
+		"Username":  user.Username,
+		"Link":      pkg.GlobalContainer.Mailer.Link("/reset-password?token=" + token),
+		"ExpiresIn": "1 hour",
+	})
+}
+
+// sendVerificationEmail creates a verification token for the user's current
+// email address and queues the verification email.
+func sendVerificationEmail(user *db.UserModel) error {
+	data, err := json.Marshal(&emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	token := util.GenerateHash(32)
+	if err := pkg.GlobalContainer.Redis.Set(context.TODO(), tokenKey("email_verification", token), string(data), verificationTTL).Err(); err != nil {
+		return err
+	}
+
+	return pkg.GlobalContainer.Mailer.Send(context.TODO(), user.Email, "Verify your email address", mailer.VerifyEmailTemplate, map[string]interface{}{
+		"Username":  user.Username,
+		"Link":      pkg.GlobalContainer.Mailer.Link("/verify-email?token=" + token),
+		"ExpiresIn": "24 hours",
+	})
+}
+
+// tokenKey returns the Redis key for a token. Only the SHA-256 hash of the token
+// is stored, so the tokens can't be read back out of Redis.
+func tokenKey(kind string, token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "tsubaki:" + kind + ":" + hex.EncodeToString(hash[:])
+}
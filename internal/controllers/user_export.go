@@ -0,0 +1,265 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/sirupsen/logrus"
+)
+
+// Export is all the data Tsubaki keeps about a user, which is written as a ZIP
+// file with Export.WriteTo.
+type Export struct {
+	documents map[string]interface{}
+	files     []string
+	userID    string
+}
+
+// exportedProject is a project in a user's data export.
+type exportedProject struct {
+	Description *string              `json:"description"`
+	Subprojects []exportedSubproject `json:"subprojects"`
+	UpdatedAt   string               `json:"updated_at"`
+	CreatedAt   string               `json:"created_at"`
+	Flags       int                  `json:"flags"`
+	Name        string               `json:"name"`
+	ID          string               `json:"id"`
+}
+
+// exportedSubproject is a subproject in a user's data export.
+type exportedSubproject struct {
+	Description *string `json:"description"`
+	UpdatedAt   string  `json:"updated_at"`
+	CreatedAt   string  `json:"created_at"`
+	Name        string  `json:"name"`
+	ID          string  `json:"id"`
+}
+
+// Export collects all of the user's data: their account, projects, linked identities,
+// access token, invites, organizations, the administrator actions taken on them, and their files.
+// Password hashes and access token secrets are left out.
+func (UserController) Export(id string) (*Export, *result.Result) {
+	ctx := context.TODO()
+	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(ctx)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
+		}
+
+		logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	projects, err := pkg.GlobalContainer.Prisma.Project.FindMany(db.Project.OwnerID.Equals(id)).With(
+		db.Project.Subprojects.Fetch(),
+	).Exec(ctx)
+
+	if err != nil {
+		logrus.Errorf("Unable to query projects of user %s: %v", id, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	identities, err := pkg.GlobalContainer.Prisma.Identity.FindMany(db.Identity.OwnerID.Equals(id)).Exec(ctx)
+	if err != nil {
+		logrus.Errorf("Unable to query identities of user %s: %v", id, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	tokens, err := pkg.GlobalContainer.Prisma.AccessToken.FindMany(db.AccessToken.OwnerID.Equals(id)).Exec(ctx)
+	if err != nil {
+		logrus.Errorf("Unable to query access tokens of user %s: %v", id, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	invites, err := pkg.GlobalContainer.Prisma.Invite.FindMany(db.Invite.InviterID.Equals(id)).Exec(ctx)
+	if err != nil {
+		logrus.Errorf("Unable to query invites of user %s: %v", id, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	memberships, err := pkg.GlobalContainer.Prisma.OrganizationMember.FindMany(db.OrganizationMember.UserID.Equals(id)).With(
+		db.OrganizationMember.Organization.Fetch(),
+	).Exec(ctx)
+
+	if err != nil {
+		logrus.Errorf("Unable to query organizations of user %s: %v", id, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	logs, err := pkg.GlobalContainer.Prisma.AuditLog.FindMany(db.AuditLog.TargetID.Equals(id)).OrderBy(
+		db.AuditLog.CreatedAt.Order(db.SortOrderAsc),
+	).Exec(ctx)
+
+	if err != nil {
+		logrus.Errorf("Unable to query audit logs of user %s: %v", id, err)
+		return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+	}
+
+	var files []string
+	for _, dir := range []string{id, "avatars/" + id} {
+		f, err := pkg.GlobalContainer.Storage.List(dir)
+		if err != nil {
+			logrus.Errorf("Unable to list files under %s: %v", dir, err)
+			return nil, result.Err(500, "UNKNOWN_ERROR", "Unable to export your data, try again later.")
+		}
+
+		files = append(files, f...)
+	}
+
+	exportedProjects := make([]exportedProject, 0, len(projects))
+	for _, project := range projects {
+		subprojects := make([]exportedSubproject, 0)
+		for _, subproject := range project.Subprojects() {
+			subprojects = append(subprojects, exportedSubproject{
+				Description: subproject.InnerSubproject.Description,
+				UpdatedAt:   subproject.UpdatedAt.Format(time.RFC3339),
+				CreatedAt:   subproject.CreatedAt.Format(time.RFC3339),
+				Name:        subproject.Name,
+				ID:          subproject.ID,
+			})
+		}
+
+		exportedProjects = append(exportedProjects, exportedProject{
+			Description: project.InnerProject.Description,
+			Subprojects: subprojects,
+			UpdatedAt:   project.UpdatedAt.Format(time.RFC3339),
+			CreatedAt:   project.CreatedAt.Format(time.RFC3339),
+			Flags:       project.Flags,
+			Name:        project.Name,
+			ID:          project.ID,
+		})
+	}
+
+	exportedIdentities := make([]map[string]interface{}, 0, len(identities))
+	for _, identity := range identities {
+		exportedIdentities = append(exportedIdentities, map[string]interface{}{
+			"created_at": identity.CreatedAt.Format(time.RFC3339),
+			"provider":   identity.Provider,
+			"subject":    identity.Subject,
+			"id":         identity.ID,
+		})
+	}
+
+	exportedTokens := make([]map[string]interface{}, 0, len(tokens))
+	for _, token := range tokens {
+		var expiresIn *string
+		if e, ok := token.ExpiresIn(); ok {
+			formatted := e.Format(time.RFC3339)
+			expiresIn = &formatted
+		}
+
+		exportedTokens = append(exportedTokens, map[string]interface{}{
+			"expires_in": expiresIn,
+			"scopes":     token.Scopes,
+			"id":         token.ID,
+		})
+	}
+
+	exportedInvites := make([]*Invite, 0, len(invites))
+	for _, invite := range invites {
+		exportedInvites = append(exportedInvites, fromInviteModel(&invite))
+	}
+
+	exportedOrganizations := make([]map[string]interface{}, 0, len(memberships))
+	for _, membership := range memberships {
+		exportedOrganizations = append(exportedOrganizations, map[string]interface{}{
+			"joined_at": membership.CreatedAt.Format(time.RFC3339),
+			"role":      membership.Role,
+			"name":      membership.Organization().Name,
+			"id":        membership.OrganizationID,
+		})
+	}
+
+	exportedLogs := make([]AuditLog, 0, len(logs))
+	for _, log := range logs {
+		exportedLogs = append(exportedLogs, fromAuditLogModel(&log))
+	}
+
+	return &Export{
+		documents: map[string]interface{}{
+			"account.json": AdminUser{
+				User:  fromUserModel(user),
+				Email: user.Email,
+			},
+			"projects.json":      exportedProjects,
+			"identities.json":    exportedIdentities,
+			"access_tokens.json": exportedTokens,
+			"invites.json":       exportedInvites,
+			"organizations.json": exportedOrganizations,
+			"audit_log.json":     exportedLogs,
+		},
+		files:  files,
+		userID: id,
+	}, nil
+}
+
+// WriteTo writes the export as a ZIP file into `w`. The JSON documents are at the root,
+// and the user's files are under `files/`.
+func (e *Export) WriteTo(w io.Writer) error {
+	archive := zip.NewWriter(w)
+	for name, document := range e.documents {
+		file, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(document); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range e.files {
+		file, err := archive.Create("files/" + path)
+		if err != nil {
+			return err
+		}
+
+		reader, err := pkg.GlobalContainer.Storage.Open(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, reader)
+		_ = reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	if err := events.Publish(&e.userID, events.ExportCompleted{UserID: e.userID, Files: len(e.files)}); err != nil {
+		logrus.Errorf("Unable to record the data export of user %s: %v", e.userID, err)
+	}
+
+	return nil
+}
@@ -17,18 +17,24 @@
 package controllers
 
 import (
+	"arisu.land/tsubaki/internal/types"
 	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/events"
+	"arisu.land/tsubaki/pkg/flags"
 	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/pkg/sessions"
 	"arisu.land/tsubaki/prisma/db"
 	"arisu.land/tsubaki/util"
 	"context"
 	"errors"
 	"fmt"
+	"github.com/prisma/prisma-client-go/runtime/raw"
 	"github.com/sirupsen/logrus"
-	"net/http"
 	"net/mail"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type UserController struct{}
@@ -48,7 +54,9 @@ type User struct {
 	// If this account has opted to use Gravatar for their avatar.
 	UseGravatar bool `json:"use_gravatar"`
 
-	// The account's avatar URL from the unified storage. (NOT AVAILABLE)
+	// The account's avatar URL. This is the Gravatar URL if `use_gravatar`
+	// is set, otherwise the path to the uploaded avatar under `/avatars`, or
+	// `nil` if no avatar was uploaded.
 	AvatarUrl *string `json:"avatar_url"`
 
 	// Returns the account's description, can be `nil`
@@ -71,9 +79,9 @@ type User struct {
 	// disabled by the administrators or not.
 	Disabled bool `json:"disabled"`
 
-	// Returns the account public flags that represented
-	// their permissions (i.e, admin).
-	Flags int `json:"flags"`
+	// Returns the names of the account's public flags that represent
+	// their permissions (i.e, `["admin"]`).
+	Flags flags.UserFlags `json:"flags"`
 
 	// The user's display name, this can be `nil` if none
 	// was set.
@@ -87,22 +95,21 @@ func fromUserModel(user *db.UserModel) *User {
 	return &User{
 		GravatarEmail: user.InnerUser.GravatarEmail,
 		UseGravatar:   user.UseGravatar,
-		AvatarUrl:     user.InnerUser.AvatarURL,
+		AvatarUrl:     avatarURL(user),
 		Description:   user.InnerUser.Description,
 		UpdatedAt:     user.InnerUser.UpdatedAt.Format(time.RFC3339),
 		CreatedAt:     user.InnerUser.CreatedAt.Format(time.RFC3339),
 		Username:      user.InnerUser.Username,
 		Disabled:      user.InnerUser.Disabled,
-		Flags:         user.InnerUser.Flags,
+		Flags:         flags.UserFlags(user.InnerUser.Flags),
 		Name:          user.InnerUser.Name,
 		ID:            user.InnerUser.ID,
 	}
 }
 
+// Get returns the user with the ID, or the username if `id` starts with an `@`, i.e, `@noel`.
 func (UserController) Get(id string) *result.Result {
-	user, err := pkg.GlobalContainer.Prisma.User.FindUnique(
-		db.User.ID.Equals(id)).Exec(context.TODO())
-
+	user, err := findUser(id)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
 			return result.Err(404, "USER_NOT_FOUND", fmt.Sprintf("user with id %s was not found.", id))
@@ -115,9 +122,20 @@ func (UserController) Get(id string) *result.Result {
 	return result.Ok(fromUserModel(user))
 }
 
-func (UserController) Create(username string, password string, email string) *result.Result {
+// findUser finds a user by their ID, or by their username if `id` starts with an `@`.
+func findUser(id string) (*db.UserModel, error) {
+	if strings.HasPrefix(id, "@") {
+		return pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Username.Equals(strings.TrimPrefix(id, "@"))).Exec(context.TODO())
+	}
+
+	return pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+}
+
+// Create creates a new user. `invite` is the invite code, which is only required
+// if this instance is invite-only.
+func (UserController) Create(username string, password string, email string, invite string) *result.Result {
 	// Check if this instance is invite only
-	if pkg.GlobalContainer.Config.InviteOnly {
+	if pkg.GlobalContainer.Config.InviteOnly && invite == "" {
 		return result.Err(403, "INSTANCE_INVITE_ONLY", "This instance is invite-only, ask the administrators to create you an invite!")
 	}
 
@@ -155,195 +173,231 @@ func (UserController) Create(username string, password string, email string) *re
 		return result.Err(500, "UNKNOWN_ERROR", "Unable to create user, try again later.")
 	}
 
+	var inv *db.InviteModel
+	if pkg.GlobalContainer.Config.InviteOnly {
+		var res *result.Result
+		if inv, res = useInvite(invite, email); res != nil {
+			return res
+		}
+	}
+
 	// Generate a user ID
 	id := pkg.GlobalContainer.Snowflake.Generate().String()
-	user, err := pkg.GlobalContainer.Prisma.User.CreateOne(
+	create := pkg.GlobalContainer.Prisma.User.CreateOne(
 		db.User.Username.Set(username),
 		db.User.Password.Set(hash),
 		db.User.Email.Set(email),
 		db.User.ID.Set(id),
-		db.User.Projects.Link()).Exec(context.TODO())
+		db.User.Projects.Link()).Tx()
+
+	created := events.Record(&id, events.UserCreated{Username: username, ID: id})
+	if err := pkg.GlobalContainer.Prisma.Prisma.Transaction(create, created).Exec(context.TODO()); err != nil {
+		if inv != nil {
+			releaseInvite(inv)
+		}
 
-	if err != nil {
 		logrus.Errorf("Unable to create user in database: %v", err)
 		return result.Err(500, "UNKNOWN_ERROR", "Unable to create user, try again later.")
 	}
 
+	user := create.Result()
+	if inv != nil {
+		recordInviteUse(inv, user)
+	}
+
+	search.UserChanged(user.ID)
+
+	// The account is usable without verifying, so don't fail registration
+	// if the email couldn't be queued.
+	if pkg.GlobalContainer.Mailer != nil {
+		if err := sendVerificationEmail(user); err != nil {
+			logrus.Errorf("Unable to send verification email to user %s: %v", user.ID, err)
+		}
+	}
+
 	return result.OkWithStatus(201, fromUserModel(user))
 }
 
-func (UserController) Update(id string, set map[string]interface{}) *result.Result {
-	if len(set) == 0 {
-		return result.Err(406, "REQUIRE_UPDATE_PAYLOAD", "You are required to provide a object to update!")
+// userSchema is every field of a user that can be updated with an UpdateQuery.
+var userSchema = types.Schema{
+	"gravatar_email": {
+		Type:     types.StringField,
+		Nullable: true,
+		Validate: func(value interface{}) *result.Error {
+			if _, err := mail.ParseAddress(value.(string)); err != nil {
+				e := result.NewError("INVALID_EMAIL_ADDRESS", fmt.Sprintf("Email %s is not a valid email address.", value))
+				return &e
+			}
+
+			return nil
+		},
+	},
+
+	"use_gravatar": {
+		Type: types.BoolField,
+	},
+
+	"avatar_url": {
+		Type: types.StringField,
+		Validate: func(interface{}) *result.Error {
+			e := result.NewError("AVATAR_URL_READ_ONLY", "Avatars have to be uploaded with `PUT /api/v1/users/@me/avatar`.")
+			return &e
+		},
+	},
+
+	"description": {
+		Type:     types.StringField,
+		Nullable: true,
+		Validate: func(value interface{}) *result.Error {
+			if utf8.RuneCountInString(value.(string)) > 160 {
+				e := result.NewError("USER_DESCRIPTION_TOO_LONG", "User descriptions cannot go over 160 characters.")
+				return &e
+			}
+
+			return nil
+		},
+	},
+
+	"password": {
+		Type: types.StringField,
+		Validate: func(value interface{}) *result.Error {
+			if value.(string) == "" {
+				e := result.NewError("MISSING_PASSWORD", "The new password can't be empty.")
+				return &e
+			}
+
+			return nil
+		},
+	},
+
+	"username": {
+		Type: types.StringField,
+		Validate: func(value interface{}) *result.Error {
+			if value.(string) == "" {
+				e := result.NewError("MISSING_USERNAME", "The username can't be empty.")
+				return &e
+			}
+
+			return nil
+		},
+	},
+}
+
+// Update applies the UpdateQuery to the user. Every field is validated first and all
+// errors are returned at once, then the changes are committed in one transaction.
+//
+// Changing the password requires the `currentPassword` and logs out every session, the
+// caller gets a new session in the response instead.
+func (UserController) Update(id string, query types.UpdateQuery, currentPassword string) *result.Result {
+	changes, errs := query.Validate(userSchema)
+	if len(errs) > 0 {
+		return result.Errs(406, errs...)
 	}
 
-	// TODO: make the update mutation become a prisma transaction
+	_, changesPassword := changes["password"]
+	if changesPassword {
+		if currentPassword == "" {
+			return result.Err(406, "MISSING_CURRENT_PASSWORD", "`current_password` is required to change the password.")
+		}
 
-	// Check if we need to update the gravatar email
-	gravatarEmail, ok := set["gravatar_email"].(string)
-	if ok {
-		// Check if it is a valid email address
-		_, err := mail.ParseAddress(gravatarEmail)
+		user, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
 		if err != nil {
-			return result.Err(406, "INVALID_EMAIL_ADDRESS", fmt.Sprintf("Email %s is not a valid email address.", gravatarEmail))
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user, try again later.")
 		}
 
-		// Now, we can update it!
-		_, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
-			db.User.GravatarEmail.Set(gravatarEmail),
-		).Exec(context.TODO())
-
+		valid, err := util.VerifyPassword(currentPassword, user.Password)
 		if err != nil {
-			logrus.Errorf("Unable to update users.%s.gravatar_email = '%s': %v", id, gravatarEmail, err)
-			return result.Err(500, "UNKNOWN_ERROR", "Unable to update the gravatar email for this user.")
+			logrus.Errorf("Unable to verify password for user %s: %v", id, err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user, try again later.")
 		}
-	}
-
-	useGravatar, ok := set["use_gravatar"].(bool)
-	if ok {
-		_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
-			db.User.UseGravatar.Set(useGravatar),
-		).Exec(context.TODO())
 
-		if err != nil {
-			logrus.Errorf("Unable to update users.%s.use_gravatar = '%v': %v", id, useGravatar, err)
-			return result.Err(500, "UNKNOWN_ERROR", "Unable to update the state of this user.")
+		if !valid {
+			return result.Err(403, "INVALID_PASSWORD", "The current password is incorrect.")
 		}
 	}
 
-	_, ok = set["avatar_url"].(string)
-	if ok {
-		return result.Err(406, "COMING_SOON", "Custom avatar URIs are a coming soon feature.")
+	// Check if the username is already taken, by someone else.
+	if username, ok := changes["username"].(string); ok {
+		existing, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Username.Equals(username)).Exec(context.TODO())
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			logrus.Errorf("Unable to query from PostgreSQL: %v", err)
+			return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user, try again later.")
+		}
+
+		if existing != nil && existing.ID != id {
+			return result.Err(406, "USERNAME_ALREADY_TAKEN", "Username is already taken.")
+		}
 	}
 
-	desc, ok := set["description"].(*string)
-	if ok {
-		// Check if `desc` is null, if it is, it means the description
-		// should be blank.
-		if desc == nil {
-			// Now, we can update it!
-			_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
-				db.User.Description.SetOptional(nil),
-			).Exec(context.TODO())
+	params := make([]db.UserSetParam, 0, len(changes))
+	for field, value := range changes {
+		switch field {
+		case "gravatar_email":
+			params = append(params, db.User.GravatarEmail.SetOptional(optionalString(value)))
 
-			if err != nil {
-				logrus.Errorf("Unable to update users.%s.description = nil: %v", id, err)
-				return result.Err(500, "UNKNOWN_ERROR", "Unable to update the description of this user.")
-			}
-		} else {
-			d := *desc
+		case "use_gravatar":
+			params = append(params, db.User.UseGravatar.Set(value.(bool)))
 
-			// Check if the description is over 160 chars
-			if len(d) > 160 {
-				return result.Err(406, "USER_DESCRIPTION_TOO_LONG", "User descriptions cannot go over 160 characters.")
-			}
+		case "description":
+			params = append(params, db.User.Description.SetOptional(optionalString(value)))
 
-			// Now, we can update it!
-			_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
-				db.User.Description.SetOptional(nil),
-			).Exec(context.TODO())
+		case "username":
+			params = append(params, db.User.Username.Set(value.(string)))
 
+		case "password":
+			hash, err := util.GeneratePassword(value.(string))
 			if err != nil {
-				logrus.Errorf("Unable to update users.%s.description: %v", id, err)
-				return result.Err(500, "UNKNOWN_ERROR", "Unable to update the description of this user.")
+				logrus.Errorf("Unable to generate a new password hash for user %s: %v", id, err)
+				return result.Err(500, "UNKNOWN_ERROR", "Unable to generate user password.")
 			}
-		}
-	}
 
-	// Check if the user's password should change
-	pass, ok := set["password"].(string)
-	if ok {
-		hash, err := util.GeneratePassword(pass)
-		if err != nil {
-			logrus.Errorf("Unable to generate a new password hash for user %s: %v", id, err)
-			return result.Err(500, "UNKNOWN_ERROR", "Unable to generate user password.")
+			params = append(params, db.User.Password.Set(hash))
 		}
+	}
 
-		_, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
-			db.User.Password.Set(hash),
-		).Exec(context.TODO())
+	update := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(params...).Tx()
 
-		if err != nil {
-			logrus.Errorf("Unable to update users.%s.password: %v", id, err)
-			return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user password.")
-		}
+	// A new password revokes every token in the same transaction, so whoever had the
+	// old one is logged out.
+	var err error
+	if changesPassword {
+		err = sessions.Revoke(context.TODO(), pkg.GlobalContainer.Prisma, id, update)
+	} else {
+		err = pkg.GlobalContainer.Prisma.Prisma.Transaction(update).Exec(context.TODO())
 	}
 
-	// Maybe the user wants their username to be changed?
-	username, ok := set["username"].(string)
-	if ok {
-		// Check if the username is already taken
-		_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.Username.Equals(username)).Exec(context.TODO())
-		if err != nil {
-			// If the username wasn't found, it's best to assume that
-			// it's available!
-			if errors.Is(err, db.ErrNotFound) {
-				_, err = pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(id)).Update(
-					db.User.Username.Set(username),
-				).Exec(context.TODO())
-
-				if err != nil {
-					logrus.Errorf("Unable to update users.%s.username: %v", id, err)
-					return result.Err(500, "UNKNOWN_ERROR", "Unable to update the username.")
-				}
-
-				return result.NoContent()
-			} else {
-				logrus.Errorf("Unable to update users.%s.username: %v", id, err)
-				return result.Err(500, "UNKNOWN_ERROR", "Unable to update the username.")
-			}
-		}
+	if err != nil {
+		logrus.Errorf("Unable to update user %s: %v", id, err)
+		return result.Err(500, "UNKNOWN_ERROR", "Unable to update the user, try again later.")
+	}
 
-		// Well, the username is taken. :(
-		return result.Err(406, "USERNAME_ALREADY_TAKEN", "Username is already taken.")
+	search.UserChanged(id)
+	if changesPassword {
+		return newLogin(update.Result())
 	}
 
 	return result.NoContent()
 }
 
-func (UserController) DeleteUser(uid string) *result.Result {
-	_, err := pkg.GlobalContainer.Prisma.User.FindUnique(db.User.ID.Equals(uid)).Delete().Exec(context.TODO())
-	if err != nil {
-		logrus.Errorf("Unable to delete user %s: %v", uid, err)
-		return result.Err(500, "UNKNOWN_ERROR", "Unable to delete the current user.")
+// optionalString returns `value` as a *string, or nil if it was unset.
+func optionalString(value interface{}) *string {
+	if value == nil {
+		return nil
 	}
 
-	// Delete the indices in Elasticsearch if the client exists
-	if pkg.GlobalContainer.ElasticSearch != nil {
-		// Delete the document index from Elasticsearch
-		//
-		// I have to do this myself since I cannot find a way
-		// from the official client. Thanks Elasticsearch.
-		method := "DELETE"
-		var (
-			path   strings.Builder
-			params map[string]string
-		)
-
-		// yes this is from the source code itself
-		// https://github.com/elastic/go-elasticsearch/blob/main/esapi/api.index.go#L79-L212
-		path.Grow(7 + 1 + len("tsubaki-users") + 1 + len("_doc") + len(uid))
-		path.WriteString("http://")
-		path.WriteString("/")
-		path.WriteString("tsubaki-users")
-		path.WriteString("/")
-		path.WriteString("_doc")
-		path.WriteString("/")
-		path.WriteString(uid)
-
-		params = make(map[string]string)
-		params["pretty"] = "true"
-
-		req, err := http.NewRequest(method, path.String(), nil)
-		if err != nil {
-			logrus.Errorf("Unable to create request to delete the document from Elasticsearch. You will have to manually do it yourself")
-		} else {
-			_, err := pkg.GlobalContainer.ElasticSearch.Perform(req)
-			if err != nil {
-				logrus.Errorf("Unable to send out the request to Elasticsearch. You will have to manually do it yourself.")
-			}
-		}
+	s := value.(string)
+	return &s
+}
+
+// toggleUserFlag returns the query that adds `flag` to the user's flags, or removes it
+// if `enabled` is false. It's a single statement, so a concurrent change to another
+// flag isn't overwritten with a stale copy.
+func toggleUserFlag(id string, flag flags.UserFlags, enabled bool) raw.ExecuteExec {
+	query := `UPDATE "users" SET "flags" = "flags" | $1, "updated_at" = (NOW() AT TIME ZONE 'UTC') WHERE "id" = $2`
+	if !enabled {
+		query = `UPDATE "users" SET "flags" = "flags" & ~$1::int, "updated_at" = (NOW() AT TIME ZONE 'UTC') WHERE "id" = $2`
 	}
 
-	return result.Success()
+	return pkg.GlobalContainer.Prisma.Prisma.ExecuteRaw(query, int(flag), id)
 }
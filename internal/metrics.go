@@ -41,12 +41,65 @@ var (
 		Name: "tsubaki_users_count",
 		Help: "Returns how many registered users are in the database.",
 	})
+
+	ProjectsCountMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tsubaki_projects_count",
+		Help: "Returns how many projects are in the database.",
+	})
+
+	SubprojectsCountMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tsubaki_subprojects_count",
+		Help: "Returns how many subprojects are in the database.",
+	})
+
+	ActiveSessionsMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tsubaki_active_sessions",
+		Help: "Returns how many sessions haven't expired yet.",
+	})
+
+	StorageBytesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tsubaki_storage_bytes",
+		Help: "Returns how many bytes are stored in the storage provider.",
+	})
+
+	RecentSignupsMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tsubaki_recent_signups",
+		Help: "Returns how many users have registered today (UTC).",
+	})
+
+	LoginFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsubaki_login_failures",
+		Help: "How many logins have failed, partitioned by the reason (invalid_credentials or locked).",
+	}, []string{"reason"})
+
+	LockoutsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsubaki_lockouts",
+		Help: "How many temporary lockouts were started, partitioned by what was locked (account or ip).",
+	}, []string{"kind"})
+
+	FirewallRejectionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsubaki_firewall_rejections",
+		Help: "How many requests were rejected by the firewall, partitioned by the reason (blocked or banned).",
+	}, []string{"reason"})
 )
 
 // RegisterMetrics registers all counters and histograms
 func RegisterMetrics() {
 	logrus.Debug("Creating metrics...")
-	prometheus.MustRegister(RequestLatencyMetric, RequestMetric, GQLLatencyMetric, UsersCountMetric)
+	prometheus.MustRegister(
+		RequestLatencyMetric,
+		RequestMetric,
+		GQLLatencyMetric,
+		UsersCountMetric,
+		ProjectsCountMetric,
+		SubprojectsCountMetric,
+		ActiveSessionsMetric,
+		StorageBytesMetric,
+		RecentSignupsMetric,
+		LoginFailuresMetric,
+		LockoutsMetric,
+		FirewallRejectionsMetric,
+	)
 
 	logrus.Debug("Metrics have been established.")
 }
@@ -16,6 +16,14 @@
 
 package types
 
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"arisu.land/tsubaki/pkg/result"
+)
+
 // UpdateQuery represents the update query to use to PATCH
 // any Tsubaki object.
 //
@@ -24,8 +32,166 @@ package types
 // {
 //     "$set": {
 //        "name": "noel"
+//     },
+//     "$unset": {
+//        "description": ""
 //     }
 // }
+//
+// The values in `$unset` are ignored, setting a field to `null` in `$set`
+// is the same as unsetting it.
 type UpdateQuery struct {
-	Set map[string]interface{} `json:"$set"`
+	Set   map[string]interface{} `json:"$set"`
+	Unset map[string]interface{} `json:"$unset"`
+}
+
+// FieldType is the JSON type the value of a Field has to be.
+type FieldType string
+
+var (
+	// StringField is a field that has to be a JSON string.
+	StringField FieldType = "string"
+
+	// BoolField is a field that has to be a JSON boolean.
+	BoolField FieldType = "boolean"
+
+	// IntField is a field that has to be a JSON number without a fraction.
+	IntField FieldType = "integer"
+)
+
+// Field is a field of a model that can be updated with an UpdateQuery.
+type Field struct {
+	// Type is the JSON type the value has to be.
+	Type FieldType
+
+	// Nullable is if the field can be removed with `$unset`.
+	Nullable bool
+
+	// Validate is an optional check that runs after the type was checked, it
+	// returns nil if the value is valid. It isn't called for unset fields.
+	Validate func(value interface{}) *result.Error
+}
+
+// Schema is every field of a model that can be updated, keyed by its JSON name.
+type Schema map[string]Field
+
+// Validate checks every field in the query against the schema. It returns the
+// changes keyed by field, where unset fields have a nil value, and every error
+// that was found so they can be reported at once.
+//
+// Integers are returned as an int, since JSON numbers are decoded as a float64.
+func (q UpdateQuery) Validate(schema Schema) (map[string]interface{}, []result.Error) {
+	changes := make(map[string]interface{})
+	errors := make([]result.Error, 0)
+
+	if len(q.Set) == 0 && len(q.Unset) == 0 {
+		errors = append(errors, result.NewError("REQUIRE_UPDATE_PAYLOAD", "You are required to provide a `$set` or `$unset` object to update!"))
+		return changes, errors
+	}
+
+	for _, key := range sortedKeys(q.Unset) {
+		if _, ok := q.Set[key]; ok {
+			errors = append(errors, result.NewError("CONFLICTING_FIELD", fmt.Sprintf("Field `%s` can't be in both `$set` and `$unset`.", key)))
+			continue
+		}
+
+		if err := unset(schema, key); err != nil {
+			errors = append(errors, *err)
+			continue
+		}
+
+		changes[key] = nil
+	}
+
+	for _, key := range sortedKeys(q.Set) {
+		value := q.Set[key]
+		if value == nil {
+			if err := unset(schema, key); err != nil {
+				errors = append(errors, *err)
+				continue
+			}
+
+			changes[key] = nil
+			continue
+		}
+
+		field, ok := schema[key]
+		if !ok {
+			errors = append(errors, unknownField(key))
+			continue
+		}
+
+		value, err := field.Type.check(key, value)
+		if err != nil {
+			errors = append(errors, *err)
+			continue
+		}
+
+		if field.Validate != nil {
+			if err := field.Validate(value); err != nil {
+				errors = append(errors, *err)
+				continue
+			}
+		}
+
+		changes[key] = value
+	}
+
+	return changes, errors
+}
+
+// check returns the value converted to this FieldType, or an error if it's
+// the wrong type.
+func (t FieldType) check(key string, value interface{}) (interface{}, *result.Error) {
+	switch t {
+	case StringField:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+
+	case BoolField:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+
+	case IntField:
+		if f, ok := value.(float64); ok && f == math.Trunc(f) && math.Abs(f) <= math.MaxInt32 {
+			return int(f), nil
+		}
+	}
+
+	err := result.NewError("INVALID_FIELD_TYPE", fmt.Sprintf("Field `%s` must be a %s.", key, t))
+	return nil, &err
+}
+
+// unset returns an error if the field doesn't exist or can't be unset.
+func unset(schema Schema, key string) *result.Error {
+	field, ok := schema[key]
+	if !ok {
+		err := unknownField(key)
+		return &err
+	}
+
+	if !field.Nullable {
+		err := result.NewError("FIELD_NOT_NULLABLE", fmt.Sprintf("Field `%s` can't be unset.", key))
+		return &err
+	}
+
+	return nil
+}
+
+func unknownField(key string) result.Error {
+	return result.NewError("UNKNOWN_FIELD", fmt.Sprintf("Field `%s` doesn't exist or can't be updated.", key))
+}
+
+// sortedKeys returns the keys of `m` in order, so errors are always reported
+// in the same order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
 }
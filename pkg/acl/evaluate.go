@@ -0,0 +1,99 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package acl
+
+import "fmt"
+
+// Permissions is every Permission that can be granted.
+var Permissions = []Permission{REPO_UPDATE, WRITE}
+
+// UserSubject returns the key of a user in Object.Members, i.e, `user:1234`.
+func UserSubject(id string) string {
+	return "user:" + id
+}
+
+// TeamSubject returns the key of a team in Object.Members, i.e, `team:1234`.
+func TeamSubject(id string) string {
+	return "team:" + id
+}
+
+// RoleSubject returns the key of an organization role in Object.Members, i.e, `role:member`.
+func RoleSubject(role string) string {
+	return "role:" + role
+}
+
+// Allowed returns if any of the subjects are allowed the permission. A deny always
+// wins over an allow, so a team can be denied something its members' role allows.
+func (o *Object) Allowed(permission Permission, subjects ...string) bool {
+	if o == nil || o.Denied(permission, subjects...) {
+		return false
+	}
+
+	for _, subject := range subjects {
+		for _, p := range o.Members[subject].Allow {
+			if p == permission {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Denied returns if any of the subjects are denied the permission.
+func (o *Object) Denied(permission Permission, subjects ...string) bool {
+	if o == nil {
+		return false
+	}
+
+	for _, subject := range subjects {
+		for _, p := range o.Members[subject].Deny {
+			if p == permission {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Validate returns an error if the Object uses an unknown format version or permission.
+func (o *Object) Validate() error {
+	if o.FormatVersion.Int() == -1 {
+		return fmt.Errorf("unknown format version %d", o.FormatVersion)
+	}
+
+	for subject, member := range o.Members {
+		for _, p := range append(append([]Permission{}, member.Allow...), member.Deny...) {
+			if !p.valid() {
+				return fmt.Errorf("unknown permission %s for %s", p, subject)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p Permission) valid() bool {
+	for _, permission := range Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
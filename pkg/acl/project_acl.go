@@ -66,19 +66,19 @@ var (
 // Role is the role a Member can inherit permissions from.
 type Role struct {
 	// List of Permission objects that a Member can inherit from to grant actions.
-	Allow []Permission `hcl:"allow"`
+	Allow []Permission `hcl:"allow" cty:"allow"`
 
 	// List of Permission objects that a Member can inherit from to prohibit actions.
-	Deny []Permission `hcl:"deny"`
+	Deny []Permission `hcl:"deny" cty:"deny"`
 }
 
 // Member is a member object that is structured to grant or deny permissions.
 type Member struct {
 	// List of Permission objects that a Member can inherit from to grant actions.
-	Allow []Permission `hcl:"allow"`
+	Allow []Permission `hcl:"allow" cty:"allow"`
 
 	// List of Permission objects that a Member can inherit from to prohibit actions.
-	Deny []Permission `hcl:"deny"`
+	Deny []Permission `hcl:"deny" cty:"deny"`
 }
 
 // Object is the HCL structure for the project's ACL.
@@ -95,7 +95,7 @@ func DecodeFromSource(contents string) (*Object, error) {
 	var object Object
 	err := hclsimple.Decode("permissions.hcl", []byte(contents), nil, &object)
 	if err != nil {
-		logrus.Fatalf("Unable to load project ACL: %v", err)
+		logrus.Errorf("Unable to load project ACL: %v", err)
 		return nil, err
 	}
 
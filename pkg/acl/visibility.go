@@ -0,0 +1,49 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package acl
+
+import "arisu.land/tsubaki/pkg/flags"
+
+// Viewer is who is looking at projects, it decides if private projects are
+// visible.
+type Viewer struct {
+	// ID is the logged in user's ID, or empty if the request isn't authenticated.
+	ID string
+
+	// Admin is if the logged in user is an administrator, who can see every project.
+	Admin bool
+}
+
+// VisibleProjects returns the SQL condition for the projects in `"p"` the viewer can
+// see, or an empty string if they can see every project. `arg` adds a query parameter
+// and returns its placeholder.
+func VisibleProjects(viewer Viewer, arg func(value interface{}) string) string {
+	if viewer.Admin {
+		return ""
+	}
+
+	public := `("p"."flags" & ` + arg(int(flags.Private)) + `) = 0`
+	if viewer.ID == "" {
+		return public
+	}
+
+	// Every member of an organization can see its private projects.
+	id := arg(viewer.ID)
+	return `(` + public + ` OR "p"."owner_id" = ` + id +
+		` OR EXISTS (SELECT 1 FROM "project_members" "vm" WHERE "vm"."project_id" = "p"."id" AND "vm"."user_id" = ` + id + `)` +
+		` OR EXISTS (SELECT 1 FROM "organization_members" "vo" WHERE "vo"."organization_id" = "p"."organization_id" AND "vo"."user_id" = ` + id + `))`
+}
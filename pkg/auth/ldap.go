@@ -0,0 +1,296 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// InvalidCredentialsError is a error if the user wasn't found in the directory
+// or the password didn't match.
+var InvalidCredentialsError = errors.New("ldap: invalid credentials")
+
+// LDAPConfig is the configuration for authenticating users against an LDAP
+// directory, like OpenLDAP or Active Directory.
+//
+// Prefix: TSUBAKI_LDAP_*
+type LDAPConfig struct {
+	// URL is the URL of the directory server, `ldap://` and `ldaps://` are supported.
+	//
+	// Variable: TSUBAKI_LDAP_URL
+	URL string `yaml:"url"`
+
+	// BindDN is the DN of the service account that is used to search for users.
+	//
+	// Variable: TSUBAKI_LDAP_BIND_DN
+	BindDN string `yaml:"bind_dn"`
+
+	// BindPassword is the password of the service account.
+	//
+	// Variable: TSUBAKI_LDAP_BIND_PASSWORD
+	BindPassword string `yaml:"bind_password"`
+
+	// BaseDN is the DN to start searching for users from.
+	//
+	// Variable: TSUBAKI_LDAP_BASE_DN
+	BaseDN string `yaml:"base_dn"`
+
+	// UserFilter is the search filter to find a user, `%s` is replaced
+	// with the escaped username that was used to log in.
+	//
+	// Default: "(uid=%s)" | Variable: TSUBAKI_LDAP_USER_FILTER
+	UserFilter string `yaml:"user_filter"`
+
+	// StartTLS upgrades a `ldap://` connection with StartTLS before binding.
+	//
+	// Default: false | Variable: TSUBAKI_LDAP_START_TLS
+	StartTLS bool `yaml:"start_tls"`
+
+	// InsecureSkipVerify skips verifying the directory server's certificate, this
+	// should only be used for testing!
+	//
+	// Default: false | Variable: TSUBAKI_LDAP_INSECURE_SKIP_VERIFY
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+
+	// Exclusive disables local passwords, so users can only log in with
+	// the directory.
+	//
+	// Default: false | Variable: TSUBAKI_LDAP_EXCLUSIVE
+	Exclusive bool `yaml:"exclusive"`
+
+	// AdminGroups is a list of group DNs, members of these groups are
+	// administrators of this instance.
+	//
+	// Default: nil | Variable: TSUBAKI_LDAP_ADMIN_GROUPS
+	AdminGroups []string `yaml:"admin_groups"`
+
+	// Attributes maps the directory's attributes to the user's attributes.
+	Attributes LDAPAttributeMapping `yaml:"attributes"`
+}
+
+// LDAPAttributeMapping maps the directory attributes to the attributes of a Tsubaki user.
+type LDAPAttributeMapping struct {
+	// Username is the attribute to use for the user's username.
+	//
+	// Default: "uid" | Variable: TSUBAKI_LDAP_ATTRIBUTES_USERNAME
+	Username string `yaml:"username"`
+
+	// Email is the attribute to use for the user's email address.
+	//
+	// Default: "mail" | Variable: TSUBAKI_LDAP_ATTRIBUTES_EMAIL
+	Email string `yaml:"email"`
+
+	// Name is the attribute to use for the user's display name.
+	//
+	// Default: "cn" | Variable: TSUBAKI_LDAP_ATTRIBUTES_NAME
+	Name string `yaml:"name"`
+
+	// Groups is the attribute that lists the groups the user is a member of.
+	//
+	// Default: "memberOf" | Variable: TSUBAKI_LDAP_ATTRIBUTES_GROUPS
+	Groups string `yaml:"groups"`
+}
+
+// DirectoryUser is a user that was authenticated with the directory.
+type DirectoryUser struct {
+	// DN is the distinguished name of the user's entry.
+	DN string
+
+	// Username is the value of the username attribute.
+	Username string
+
+	// Email is the value of the email attribute.
+	Email string
+
+	// Name is the value of the name attribute, this can be empty.
+	Name string
+
+	// Admin returns if the user is a member of any of the admin groups.
+	Admin bool
+}
+
+// LDAPProvider authenticates users against the configured directory.
+type LDAPProvider struct {
+	config *LDAPConfig
+}
+
+// NewLDAPProvider creates a new LDAPProvider and checks if the service account
+// can bind to the directory.
+func NewLDAPProvider(config *LDAPConfig) (*LDAPProvider, error) {
+	c := *config
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+
+	if c.Attributes.Username == "" {
+		c.Attributes.Username = "uid"
+	}
+
+	if c.Attributes.Email == "" {
+		c.Attributes.Email = "mail"
+	}
+
+	if c.Attributes.Name == "" {
+		c.Attributes.Name = "cn"
+	}
+
+	if c.Attributes.Groups == "" {
+		c.Attributes.Groups = "memberOf"
+	}
+
+	provider := &LDAPProvider{config: &c}
+	logrus.Debugf("Checking if we can bind to LDAP server %s...", c.URL)
+
+	conn, err := provider.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	logrus.Debug("Bound to LDAP server successfully!")
+
+	return provider, nil
+}
+
+// Exclusive returns if local passwords are disabled.
+func (p *LDAPProvider) Exclusive() bool {
+	return p.config.Exclusive
+}
+
+// Authenticate searches for the user in the directory and binds as the user with
+// the password. It returns InvalidCredentialsError if the user doesn't exist or the
+// password is wrong.
+func (p *LDAPProvider) Authenticate(username string, password string) (*DirectoryUser, error) {
+	// An empty password would be an unauthenticated bind, which most
+	// directories will happily accept.
+	if username == "" || password == "" {
+		return nil, InvalidCredentialsError
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	attributes := p.config.Attributes
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		10,
+		false,
+		fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", attributes.Username, attributes.Email, attributes.Name, attributes.Groups},
+		nil,
+	))
+
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			logrus.Warnf("LDAP filter for user %s matched more than one entry, refusing to log in.", username)
+			return nil, InvalidCredentialsError
+		}
+
+		return nil, err
+	}
+
+	if len(res.Entries) != 1 {
+		return nil, InvalidCredentialsError
+	}
+
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, InvalidCredentialsError
+		}
+
+		return nil, err
+	}
+
+	user := &DirectoryUser{
+		DN:       entry.DN,
+		Username: entry.GetAttributeValue(attributes.Username),
+		Email:    entry.GetAttributeValue(attributes.Email),
+		Name:     entry.GetAttributeValue(attributes.Name),
+	}
+
+	for _, group := range entry.GetAttributeValues(attributes.Groups) {
+		for _, admin := range p.config.AdminGroups {
+			if strings.EqualFold(group, admin) {
+				user.Admin = true
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// ManagesAdmins returns if admin groups were configured, if not, the admin
+// flag of users is left alone.
+func (p *LDAPProvider) ManagesAdmins() bool {
+	return len(p.config.AdminGroups) > 0
+}
+
+// connect dials the directory server and binds as the service account.
+func (p *LDAPProvider) connect() (*ldap.Conn, error) {
+	uri, err := url.Parse(p.config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: p.config.InsecureSkipVerify,
+		ServerName:         uri.Hostname(),
+	}
+
+	conn, err := ldap.DialURL(
+		p.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if p.config.BindDN != "" {
+		if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,253 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testDirectory is a throwaway organizational unit with two users, `alice` and
+// `bob`, where only `bob` is a member of the admin group.
+type testDirectory struct {
+	config   LDAPConfig
+	adminDN  string
+	password string
+}
+
+// newTestDirectory connects to the LDAP server at `TSUBAKI_TEST_LDAP_URL` as
+// `TSUBAKI_TEST_LDAP_BIND_DN`, and creates the test entries under
+// `TSUBAKI_TEST_LDAP_BASE_DN`. The server needs the memberOf overlay and StartTLS,
+// which the `osixia/openldap` image has by default:
+//
+//	docker run -p 389:389 osixia/openldap
+//	TSUBAKI_TEST_LDAP_URL=ldap://localhost:389 \
+//	TSUBAKI_TEST_LDAP_BIND_DN=cn=admin,dc=example,dc=org \
+//	TSUBAKI_TEST_LDAP_BIND_PASSWORD=admin \
+//	TSUBAKI_TEST_LDAP_BASE_DN=dc=example,dc=org go test ./pkg/auth
+func newTestDirectory(t *testing.T) *testDirectory {
+	uri := os.Getenv("TSUBAKI_TEST_LDAP_URL")
+	baseDN := os.Getenv("TSUBAKI_TEST_LDAP_BASE_DN")
+	if uri == "" || baseDN == "" {
+		t.Skip("TSUBAKI_TEST_LDAP_URL and TSUBAKI_TEST_LDAP_BASE_DN aren't set")
+	}
+
+	ou := fmt.Sprintf("ou=tsubaki-test-%d,%s", time.Now().UnixNano(), baseDN)
+	dir := &testDirectory{
+		adminDN:  "cn=admins," + ou,
+		password: "correct horse battery staple",
+		config: LDAPConfig{
+			URL:          uri,
+			BindDN:       os.Getenv("TSUBAKI_TEST_LDAP_BIND_DN"),
+			BindPassword: os.Getenv("TSUBAKI_TEST_LDAP_BIND_PASSWORD"),
+			BaseDN:       ou,
+		},
+	}
+
+	conn, err := ldap.DialURL(uri)
+	if err != nil {
+		t.Fatalf("unable to connect to ldap at %s: %v", uri, err)
+	}
+
+	defer conn.Close()
+	if err := conn.Bind(dir.config.BindDN, dir.config.BindPassword); err != nil {
+		t.Fatalf("unable to bind as %s: %v", dir.config.BindDN, err)
+	}
+
+	var created []string
+	add := func(dn string, attributes map[string][]string) {
+		req := ldap.NewAddRequest(dn, nil)
+		for name, values := range attributes {
+			req.Attribute(name, values)
+		}
+
+		if err := conn.Add(req); err != nil {
+			t.Fatalf("unable to add %s: %v", dn, err)
+		}
+
+		created = append(created, dn)
+	}
+
+	// Delete the entries in reverse, children have to be deleted before the unit.
+	t.Cleanup(func() {
+		conn, err := ldap.DialURL(uri)
+		if err != nil {
+			t.Logf("unable to connect to ldap to clean up: %v", err)
+			return
+		}
+
+		defer conn.Close()
+		if err := conn.Bind(dir.config.BindDN, dir.config.BindPassword); err != nil {
+			t.Logf("unable to bind to clean up: %v", err)
+			return
+		}
+
+		for i := len(created) - 1; i >= 0; i-- {
+			if err := conn.Del(ldap.NewDelRequest(created[i], nil)); err != nil {
+				t.Logf("unable to delete %s: %v", created[i], err)
+			}
+		}
+	})
+
+	add(ou, map[string][]string{
+		"objectClass": {"organizationalUnit"},
+	})
+
+	for _, uid := range []string{"alice", "bob"} {
+		add("uid="+uid+","+ou, map[string][]string{
+			"objectClass":  {"inetOrgPerson"},
+			"uid":          {uid},
+			"cn":           {strings.ToUpper(uid[:1]) + uid[1:]},
+			"sn":           {uid},
+			"mail":         {uid + "@arisu.land"},
+			"userPassword": {dir.password},
+		})
+	}
+
+	add(dir.adminDN, map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"member":      {"uid=bob," + ou},
+	})
+
+	return dir
+}
+
+// provider creates a LDAPProvider for the test directory, `configure` can change
+// the configuration first.
+func (d *testDirectory) provider(t *testing.T, configure func(*LDAPConfig)) *LDAPProvider {
+	config := d.config
+	if configure != nil {
+		configure(&config)
+	}
+
+	provider, err := NewLDAPProvider(&config)
+	if err != nil {
+		t.Fatalf("unable to create ldap provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	dir := newTestDirectory(t)
+	provider := dir.provider(t, nil)
+
+	user, err := provider.Authenticate("alice", dir.password)
+	if err != nil {
+		t.Fatalf("expected alice to log in, got %v", err)
+	}
+
+	if user.Username != "alice" || user.Email != "alice@arisu.land" || user.Name != "Alice" {
+		t.Fatalf("unexpected attributes for alice: %+v", user)
+	}
+
+	if !strings.HasPrefix(user.DN, "uid=alice,") {
+		t.Fatalf("expected the dn of alice, got %q", user.DN)
+	}
+
+	if _, err := provider.Authenticate("alice", "wrong password"); !errors.Is(err, InvalidCredentialsError) {
+		t.Fatalf("expected a wrong password to fail with InvalidCredentialsError, got %v", err)
+	}
+
+	if _, err := provider.Authenticate("carol", dir.password); !errors.Is(err, InvalidCredentialsError) {
+		t.Fatalf("expected an unknown user to fail with InvalidCredentialsError, got %v", err)
+	}
+}
+
+func TestLDAPAuthenticateEscapesFilter(t *testing.T) {
+	dir := newTestDirectory(t)
+	provider := dir.provider(t, nil)
+
+	// Unescaped, these would match alice and bind with her password.
+	for _, username := range []string{"ali*", "alice)(uid=*", "*)(|(uid=alice"} {
+		if _, err := provider.Authenticate(username, dir.password); !errors.Is(err, InvalidCredentialsError) {
+			t.Fatalf("expected %q to fail with InvalidCredentialsError, got %v", username, err)
+		}
+	}
+}
+
+func TestLDAPAuthenticateEmptyPassword(t *testing.T) {
+	dir := newTestDirectory(t)
+	provider := dir.provider(t, nil)
+
+	// The directory would accept this as an unauthenticated bind.
+	if _, err := provider.Authenticate("alice", ""); !errors.Is(err, InvalidCredentialsError) {
+		t.Fatalf("expected an empty password to fail with InvalidCredentialsError, got %v", err)
+	}
+}
+
+func TestLDAPAdminGroups(t *testing.T) {
+	dir := newTestDirectory(t)
+	provider := dir.provider(t, func(config *LDAPConfig) {
+		// Group DNs are compared case-insensitively.
+		config.AdminGroups = []string{strings.ToUpper(dir.adminDN)}
+	})
+
+	if !provider.ManagesAdmins() {
+		t.Fatal("expected the provider to manage admins")
+	}
+
+	alice, err := provider.Authenticate("alice", dir.password)
+	if err != nil {
+		t.Fatalf("expected alice to log in, got %v", err)
+	}
+
+	if alice.Admin {
+		t.Fatal("expected alice to not be an admin")
+	}
+
+	bob, err := provider.Authenticate("bob", dir.password)
+	if err != nil {
+		t.Fatalf("expected bob to log in, got %v", err)
+	}
+
+	if !bob.Admin {
+		t.Fatal("expected bob to be an admin, is the memberOf overlay enabled?")
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	dir := newTestDirectory(t)
+	if !strings.HasPrefix(dir.config.URL, "ldap://") {
+		t.Skip("StartTLS is only used with ldap:// urls")
+	}
+
+	provider := dir.provider(t, func(config *LDAPConfig) {
+		config.StartTLS = true
+		config.InsecureSkipVerify = true
+	})
+
+	conn, err := provider.connect()
+	if err != nil {
+		t.Fatalf("unable to connect with StartTLS: %v", err)
+	}
+
+	defer conn.Close()
+	if _, ok := conn.TLSConnectionState(); !ok {
+		t.Fatal("expected the connection to be upgraded to TLS")
+	}
+
+	if _, err := provider.Authenticate("alice", dir.password); err != nil {
+		t.Fatalf("expected alice to log in over StartTLS, got %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// InvalidStateError is a error if the `state` parameter in the callback
+	// was never issued by Tsubaki or has already expired.
+	InvalidStateError = errors.New("oidc: unknown or expired state")
+
+	// MissingIDTokenError is a error if the identity provider didn't return
+	// a `id_token` in the token response.
+	MissingIDTokenError = errors.New("oidc: token response didn't include an id_token")
+)
+
+// stateTTL is how long a pending authorization request is kept in Redis
+// before the user has to restart the flow.
+const stateTTL = 10 * time.Minute
+
+// stateCookie is the cookie that holds a hash of the `state` parameter, so a callback
+// is only accepted in the browser that started the flow.
+const stateCookie = "tsubaki_oidc_state"
+
+// OIDCConfig is the configuration for logging in with an OpenID Connect
+// identity provider instead of a separate Arisu password.
+//
+// Prefix: TSUBAKI_OIDC_*
+type OIDCConfig struct {
+	// Issuer is the issuer URL of your identity provider. Tsubaki will discover
+	// the endpoints using `<issuer>/.well-known/openid-configuration`.
+	//
+	// Variable: TSUBAKI_OIDC_ISSUER
+	Issuer string `yaml:"issuer"`
+
+	// ClientID is the client ID that was registered with the identity provider.
+	//
+	// Variable: TSUBAKI_OIDC_CLIENT_ID
+	ClientID string `yaml:"client_id"`
+
+	// ClientSecret is the client secret that was registered with the identity provider,
+	// this can be empty if the client is a public client (since PKCE is always used).
+	//
+	// Variable: TSUBAKI_OIDC_CLIENT_SECRET
+	ClientSecret string `yaml:"client_secret"`
+
+	// RedirectURL is the URL the identity provider redirects back to, this is usually
+	// `<host>/api/v1/login/oidc/callback` or a Fubuki page that forwards the parameters.
+	//
+	// Variable: TSUBAKI_OIDC_REDIRECT_URL
+	RedirectURL string `yaml:"redirect_url"`
+
+	// Scopes is the list of scopes to request, `openid` is always requested.
+	//
+	// Default: []string{"openid", "profile", "email"} | Variable: TSUBAKI_OIDC_SCOPES
+	Scopes []string `yaml:"scopes"`
+
+	// Claims configures which ID token claims map to the user's attributes.
+	Claims OIDCClaimMapping `yaml:"claims"`
+}
+
+// OIDCClaimMapping maps ID token claims to the attributes of a Tsubaki user.
+type OIDCClaimMapping struct {
+	// Username is the claim to use for the user's username.
+	//
+	// Default: "preferred_username" | Variable: TSUBAKI_OIDC_CLAIMS_USERNAME
+	Username string `yaml:"username"`
+
+	// Email is the claim to use for the user's email address.
+	//
+	// Default: "email" | Variable: TSUBAKI_OIDC_CLAIMS_EMAIL
+	Email string `yaml:"email"`
+
+	// Name is the claim to use for the user's display name.
+	//
+	// Default: "name" | Variable: TSUBAKI_OIDC_CLAIMS_NAME
+	Name string `yaml:"name"`
+}
+
+// Identity is the user information that was resolved from a verified ID token.
+type Identity struct {
+	// Subject is the `sub` claim, which is unique per identity provider.
+	Subject string
+
+	// Username is the resolved username claim, this can be empty.
+	Username string
+
+	// Email is the resolved email claim.
+	Email string
+
+	// Name is the resolved display name claim, this can be empty.
+	Name string
+
+	// EmailVerified returns if the identity provider verified the email address.
+	EmailVerified bool
+
+	// Invite is the invite code that was passed in when the flow was started.
+	Invite string
+}
+
+// pendingAuthorization is what is stored in Redis between the authorize and
+// callback steps.
+type pendingAuthorization struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Invite   string `json:"invite,omitempty"`
+}
+
+// OIDCProvider handles the authorization code flow (with PKCE) against the
+// configured identity provider.
+type OIDCProvider struct {
+	verifier *oidc.IDTokenVerifier
+	oauth    *oauth2.Config
+	claims   OIDCClaimMapping
+	redis    *redis.Client
+}
+
+// NewOIDCProvider discovers the identity provider's endpoints and creates a new OIDCProvider.
+func NewOIDCProvider(config *OIDCConfig, redis *redis.Client) (*OIDCProvider, error) {
+	logrus.Debugf("Discovering OpenID Connect endpoints from issuer %s...", config.Issuer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range config.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	claims := config.Claims
+	if claims.Username == "" {
+		claims.Username = "preferred_username"
+	}
+
+	if claims.Email == "" {
+		claims.Email = "email"
+	}
+
+	if claims.Name == "" {
+		claims.Name = "name"
+	}
+
+	logrus.Debug("Discovered OpenID Connect endpoints!")
+	return &OIDCProvider{
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		claims:   claims,
+		redis:    redis,
+		oauth: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+	}, nil
+}
+
+// AuthorizeURL creates a new pending authorization and returns the URL to redirect
+// the user to, and the `state` parameter of it. The `invite` code is carried over to the
+// callback, so invite-only instances can provision new accounts.
+func (p *OIDCProvider) AuthorizeURL(ctx context.Context, invite string) (string, string, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier, err := randomString(64)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	data, err := json.Marshal(&pendingAuthorization{
+		Verifier: verifier,
+		Nonce:    nonce,
+		Invite:   invite,
+	})
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := p.redis.Set(ctx, stateKey(state), string(data), stateTTL).Err(); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	return p.oauth.AuthCodeURL(
+		state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), state, nil
+}
+
+// StateCookie returns the cookie to set when redirecting to the identity provider. It
+// binds the `state` to the browser, so an attacker can't log a victim into the attacker's
+// account by sending them their own callback URL.
+func StateCookie(state string) *http.Cookie {
+	return &http.Cookie{
+		Name:     stateCookie,
+		Value:    hashState(state),
+		Path:     "/",
+		MaxAge:   int(stateTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ClearStateCookie returns a cookie that removes the one from StateCookie.
+func ClearStateCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     stateCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// VerifyStateCookie checks if the request has the cookie from StateCookie for the
+// given `state`.
+func VerifyStateCookie(req *http.Request, state string) bool {
+	cookie, err := req.Cookie(stateCookie)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashState(state))) == 1
+}
+
+// Exchange validates the `state` parameter, exchanges the authorization code for tokens
+// and returns the Identity from the verified ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, state string, code string) (*Identity, error) {
+	// GETDEL makes sure that a state can only be used once.
+	raw, err := p.redis.GetDel(ctx, stateKey(state)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, InvalidStateError
+		}
+
+		return nil, err
+	}
+
+	var pending pendingAuthorization
+	if err := json.Unmarshal([]byte(raw), &pending); err != nil {
+		return nil, err
+	}
+
+	token, err := p.oauth.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", pending.Verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, MissingIDTokenError
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != pending.Nonce {
+		return nil, errors.New("oidc: nonce in id_token didn't match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	email, _ := claims[p.claims.Email].(string)
+	if email == "" {
+		return nil, fmt.Errorf("oidc: id_token is missing the %q claim", p.claims.Email)
+	}
+
+	username, _ := claims[p.claims.Username].(string)
+	name, _ := claims[p.claims.Name].(string)
+	verified, _ := claims["email_verified"].(bool)
+
+	return &Identity{
+		EmailVerified: verified,
+		Username:      username,
+		Subject:       idToken.Subject,
+		Invite:        pending.Invite,
+		Email:         email,
+		Name:          name,
+	}, nil
+}
+
+func hashState(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(hash[:])
+}
+
+func stateKey(state string) string {
+	return "tsubaki:oidc:state:" + state
+}
+
+func randomString(length int) (string, error) {
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,299 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testClientID = "tsubaki"
+	testKeyID    = "test-key"
+)
+
+// mockIssuer is an OpenID Connect identity provider that serves the discovery document,
+// its JWKS and a token endpoint, which returns an ID token for the last authorization.
+type mockIssuer struct {
+	*httptest.Server
+
+	// key is the key the JWKS advertises.
+	key *rsa.PrivateKey
+
+	// signingKey is the key ID tokens are signed with, which is `key` unless a
+	// test wants a bad signature.
+	signingKey *rsa.PrivateKey
+
+	// claims are added to the ID token.
+	claims jwt.MapClaims
+
+	// challenge and nonce are from the authorization URL, the token endpoint checks
+	// the PKCE verifier against the challenge and returns the nonce in the ID token.
+	challenge string
+	nonce     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate rsa key: %v", err)
+	}
+
+	issuer := &mockIssuer{key: key, signingKey: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		writeTestJson(w, 200, map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		writeTestJson(w, 200, map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"alg": "RS256",
+					"use": "sig",
+					"kid": testKeyID,
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			writeTestJson(w, 400, map[string]string{"error": "invalid_request"})
+			return
+		}
+
+		verifier := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+		if req.PostForm.Get("code") != "test-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != issuer.challenge {
+			writeTestJson(w, 400, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":   issuer.URL,
+			"aud":   testClientID,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": issuer.nonce,
+		}
+
+		for key, value := range issuer.claims {
+			claims[key] = value
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = testKeyID
+		idToken, err := token.SignedString(issuer.signingKey)
+		if err != nil {
+			writeTestJson(w, 500, map[string]string{"error": "server_error"})
+			return
+		}
+
+		writeTestJson(w, 200, map[string]interface{}{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// authorize starts the flow like Fubuki would, and returns the state the identity
+// provider redirects back with.
+func (i *mockIssuer) authorize(t *testing.T, provider *OIDCProvider, invite string) string {
+	raw, state, err := provider.AuthorizeURL(context.TODO(), invite)
+	if err != nil {
+		t.Fatalf("unable to create authorization url: %v", err)
+	}
+
+	authorizeURL, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("unable to parse authorization url: %v", err)
+	}
+
+	query := authorizeURL.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("expected a S256 code challenge, got %q", query.Get("code_challenge_method"))
+	}
+
+	if query.Get("state") != state {
+		t.Fatalf("expected the url to have state %q, got %q", state, query.Get("state"))
+	}
+
+	i.challenge = query.Get("code_challenge")
+	i.nonce = query.Get("nonce")
+	return state
+}
+
+func newTestOIDCProvider(t *testing.T, issuer *mockIssuer) *OIDCProvider {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	provider, err := NewOIDCProvider(&OIDCConfig{
+		Issuer:      issuer.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/api/v1/login/oidc/callback",
+	}, client)
+
+	if err != nil {
+		t.Fatalf("unable to create oidc provider: %v", err)
+	}
+
+	return provider
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = jwt.MapClaims{
+		"sub":                "user-1",
+		"email":              "noel@arisu.land",
+		"email_verified":     true,
+		"preferred_username": "noel",
+		"name":               "Noel",
+	}
+
+	provider := newTestOIDCProvider(t, issuer)
+	state := issuer.authorize(t, provider, "invite-code")
+
+	identity, err := provider.Exchange(context.TODO(), state, "test-code")
+	if err != nil {
+		t.Fatalf("unable to exchange the code: %v", err)
+	}
+
+	// These are what the login controller links the identity to an account with.
+	expected := Identity{
+		Subject:       "user-1",
+		Username:      "noel",
+		Email:         "noel@arisu.land",
+		Name:          "Noel",
+		EmailVerified: true,
+		Invite:        "invite-code",
+	}
+
+	if *identity != expected {
+		t.Fatalf("expected identity %+v, got %+v", expected, *identity)
+	}
+
+	// A state can only be used once.
+	if _, err := provider.Exchange(context.TODO(), state, "test-code"); !errors.Is(err, InvalidStateError) {
+		t.Fatalf("expected reusing the state to fail with InvalidStateError, got %v", err)
+	}
+}
+
+func TestOIDCExchangeStateMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = jwt.MapClaims{"sub": "user-1", "email": "noel@arisu.land"}
+
+	provider := newTestOIDCProvider(t, issuer)
+	issuer.authorize(t, provider, "")
+
+	identity, err := provider.Exchange(context.TODO(), "not-the-state", "test-code")
+	if !errors.Is(err, InvalidStateError) {
+		t.Fatalf("expected InvalidStateError, got %v", err)
+	}
+
+	if identity != nil {
+		t.Fatalf("expected no identity, got %+v", *identity)
+	}
+}
+
+func TestOIDCExchangeBadSignature(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = jwt.MapClaims{"sub": "user-1", "email": "noel@arisu.land"}
+
+	// The ID token claims to be signed with the advertised key, but isn't.
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate rsa key: %v", err)
+	}
+
+	issuer.signingKey = other
+	provider := newTestOIDCProvider(t, issuer)
+	state := issuer.authorize(t, provider, "")
+
+	identity, err := provider.Exchange(context.TODO(), state, "test-code")
+	if err == nil {
+		t.Fatalf("expected an ID token with a bad signature to be rejected, got %+v", *identity)
+	}
+
+	if !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+}
+
+func writeTestJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	cookie := StateCookie("the-state")
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected a HttpOnly, SameSite=Lax cookie, got %+v", cookie)
+	}
+
+	if cookie.Value == "the-state" {
+		t.Fatal("expected the cookie to hold a hash of the state, not the state itself")
+	}
+
+	req := httptest.NewRequest("GET", "/api/login/oidc/callback", nil)
+	if VerifyStateCookie(req, "the-state") {
+		t.Fatal("expected a request without the cookie to fail")
+	}
+
+	req.AddCookie(cookie)
+	if !VerifyStateCookie(req, "the-state") {
+		t.Fatal("expected the cookie to match the state it was created for")
+	}
+
+	if VerifyStateCookie(req, "attacker-state") {
+		t.Fatal("expected the cookie to not match another state")
+	}
+}
@@ -0,0 +1,142 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package avatars
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+
+	// Register the decoders for every format avatars can be uploaded in.
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// MaxFileSize is how big an uploaded avatar can be, in bytes.
+	MaxFileSize = 8 << 20
+
+	// MaxDimension is how wide or tall an uploaded avatar can be, in pixels. This
+	// is checked before decoding, so small files can't decode into huge images.
+	MaxDimension = 4096
+
+	// DefaultSize is the size that is served if no size was requested.
+	DefaultSize = 256
+)
+
+var (
+	// Sizes are the sizes (in pixels) every avatar is resized to.
+	Sizes = []int{32, 64, 128, 256, 512}
+
+	// ErrUnsupportedFormat is returned if the avatar isn't a PNG, JPEG, WebP or GIF image.
+	ErrUnsupportedFormat = errors.New("avatar must be a png, jpeg, webp or gif image")
+
+	// ErrTooLarge is returned if the avatar is wider or taller than MaxDimension.
+	ErrTooLarge = errors.New("avatar is too large")
+)
+
+var formats = map[string]bool{
+	"png":  true,
+	"jpeg": true,
+	"webp": true,
+	"gif":  true,
+}
+
+// Avatar is an uploaded avatar that was resized to every size in Sizes.
+type Avatar struct {
+	// Hash is derived from the uploaded image, so it changes whenever the
+	// avatar does and can be cached forever.
+	Hash string
+
+	// Images are the PNG encoded images, keyed by their size.
+	Images map[int][]byte
+}
+
+// Process validates and decodes the uploaded image, crops it to a square from the
+// center and resizes it to every size in Sizes. Only the first frame of a GIF is used.
+func Process(data []byte) (*Avatar, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, ErrUnsupportedFormat
+		}
+
+		return nil, err
+	}
+
+	if !formats[format] {
+		return nil, ErrUnsupportedFormat
+	}
+
+	if config.Width > MaxDimension || config.Height > MaxDimension {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	crop := square(img.Bounds())
+	images := make(map[int][]byte, len(Sizes))
+	for _, size := range Sizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, err
+		}
+
+		images[size] = buf.Bytes()
+	}
+
+	hash := sha256.Sum256(data)
+	return &Avatar{
+		Hash:   hex.EncodeToString(hash[:8]),
+		Images: images,
+	}, nil
+}
+
+// ValidSize returns if `size` is one of the Sizes avatars are resized to.
+func ValidSize(size int) bool {
+	for _, s := range Sizes {
+		if s == size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// square returns the biggest square in the center of `bounds`.
+func square(bounds image.Rectangle) image.Rectangle {
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > height {
+		offset := (width - height) / 2
+		return image.Rect(bounds.Min.X+offset, bounds.Min.Y, bounds.Min.X+offset+height, bounds.Max.Y)
+	}
+
+	offset := (height - width) / 2
+	return image.Rect(bounds.Min.X, bounds.Min.Y+offset, bounds.Max.X, bounds.Min.Y+offset+width)
+}
@@ -0,0 +1,194 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// contextKey is the key the resolved IP is stored under in the request context.
+type contextKey struct{}
+
+// Resolver resolves the client IP of requests.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a new Resolver that trusts forwarded headers from proxies in
+// `trustedProxies`, which is a list of CIDRs or single IPs.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	trusted := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		trusted = append(trusted, cidr)
+	}
+
+	return &Resolver{trusted: trusted}, nil
+}
+
+// Middleware resolves the client IP once and stores it in the request context,
+// so it can be retrieved with FromRequest.
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), contextKey{}, r.Resolve(req))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// FromRequest returns the IP that was resolved by Resolver.Middleware, or the
+// remote address if the middleware wasn't used.
+func FromRequest(req *http.Request) string {
+	if ip, ok := req.Context().Value(contextKey{}).(string); ok {
+		return ip
+	}
+
+	return remoteIP(req)
+}
+
+// Resolve returns the client IP of the request. Forwarded headers are only used if the
+// request came from a trusted proxy, and the hops are walked from the right, so the
+// first hop that isn't a trusted proxy is used.
+func (r *Resolver) Resolve(req *http.Request) string {
+	remote := remoteIP(req)
+	if !r.isTrusted(net.ParseIP(remote)) {
+		return remote
+	}
+
+	if hops := forwardedFor(req.Header.Values("Forwarded")); len(hops) > 0 {
+		return r.walk(remote, hops)
+	}
+
+	if hops := splitList(req.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return r.walk(remote, hops)
+	}
+
+	for _, header := range []string{"X-Real-IP", "True-Client-IP"} {
+		if ip := parseIP(req.Header.Get(header)); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return remote
+}
+
+// walk returns the first hop from the right that isn't a trusted proxy. If a hop
+// can't be parsed, the last hop that could be is used, since everything to the
+// left of it can be spoofed.
+func (r *Resolver) walk(remote string, hops []string) string {
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseIP(hops[i])
+		if ip == nil {
+			return client
+		}
+
+		client = ip.String()
+		if !r.isTrusted(ip) {
+			return client
+		}
+	}
+
+	return client
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range r.trusted {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the `for` parameters of RFC 7239 `Forwarded` headers, in order.
+func forwardedFor(headers []string) []string {
+	hops := make([]string, 0)
+	for _, element := range splitList(headers) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+
+	return hops
+}
+
+// splitList splits comma-separated header values.
+func splitList(headers []string) []string {
+	values := make([]string, 0)
+	for _, header := range headers {
+		for _, value := range strings.Split(header, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+
+	return values
+}
+
+// parseIP parses an IP that can have a port, and IPv6 addresses can be
+// in brackets (i.e, `[::1]:8080`).
+func parseIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+
+	return net.ParseIP(strings.Trim(value, "[]"))
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// cut is strings.Cut, which isn't available in Go 1.17.
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
+}
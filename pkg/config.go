@@ -17,6 +17,10 @@
 package pkg
 
 import (
+	"arisu.land/tsubaki/pkg/auth"
+	"arisu.land/tsubaki/pkg/firewall"
+	"arisu.land/tsubaki/pkg/mailer"
+	"arisu.land/tsubaki/pkg/ratelimit"
 	"arisu.land/tsubaki/pkg/storage"
 	"arisu.land/tsubaki/util"
 	"errors"
@@ -31,6 +35,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Environment is a type to determine the current Tsubaki environment.
@@ -41,6 +46,15 @@ var (
 	Production  Environment = "production"
 )
 
+// Backend is where sessions and ratelimits are stored.
+type Backend string
+
+var (
+	RedisBackend  Backend = "redis"
+	MemoryBackend Backend = "memory"
+	BoltBackend   Backend = "bolt"
+)
+
 func (e Environment) String() string {
 	switch {
 	case e == Development:
@@ -65,6 +79,10 @@ var (
 	// InvalidEnvironmentError is a error if the `environment` config option
 	// is not a valid environment.
 	InvalidEnvironmentError = errors.New("environment option was not `development` or `production`")
+
+	// InvalidBackendError is a error if the `backend` config option is not
+	// a valid backend.
+	InvalidBackendError = errors.New("backend option was not `redis`, `memory` or `bolt`")
 )
 
 // Config is the structure of the `config.yml` file. Any environment variable
@@ -118,6 +136,9 @@ type Config struct {
 	// required to get a email from the server admins that you
 	// can join this instance and create projects and what-not.
 	//
+	// Invites are created with `POST /api/v1/invites` by administrators,
+	// or users that were given the invite flag.
+	//
 	// Default: false | Environment Variable: TSUBAKI_INVITE_ONLY
 	InviteOnly bool `yaml:"invite_only"`
 
@@ -161,6 +182,19 @@ type Config struct {
 	// Default: nil | Prefix: TSUBAKI_KAFKA
 	Kafka *KafkaConfig `yaml:"kafka,omitempty"`
 
+	// Returns the backend that sessions and ratelimits are stored in. Only `redis` can
+	// be shared between replicas, `memory` and `bolt` are meant for single-node installs
+	// and don't require Redis. Features that need Redis (OpenID Connect, the mailer, login
+	// lockouts and the firewall) are only enabled with them if `redis` is configured.
+	//
+	// Default: "redis" | Environment Variable: TSUBAKI_BACKEND
+	Backend Backend `yaml:"backend"`
+
+	// Returns the path of the BoltDB file that the `bolt` backend uses.
+	//
+	// Default: "./.arisu/tsubaki.db" | Environment Variable: TSUBAKI_BOLT_PATH
+	BoltPath string `yaml:"bolt_path"`
+
 	// Returns the configuration for using Redis to cache user sessions.
 	// Sentinel and Standalone are supported.
 	//
@@ -177,6 +211,46 @@ type Config struct {
 	//
 	// Default: nil | Prefix: TSUBAKI_ELASTIC_*
 	ElasticSearch *ElasticsearchConfig `yaml:"elasticsearch,omitempty"`
+
+	// Returns the configuration to log in with an OpenID Connect identity provider
+	// instead of a separate Arisu password. Users are linked by their email address
+	// on the first login, or created if `registrations` allows it.
+	//
+	// Default: nil | Prefix: TSUBAKI_OIDC_*
+	OIDC *auth.OIDCConfig `yaml:"oidc,omitempty"`
+
+	// Returns the configuration to authenticate users against an LDAP directory,
+	// like OpenLDAP or Active Directory. The directory is tried before local
+	// passwords, or instead of them if `exclusive` is set.
+	//
+	// Default: nil | Prefix: TSUBAKI_LDAP_*
+	LDAP *auth.LDAPConfig `yaml:"ldap,omitempty"`
+
+	// Returns the configuration to send emails over SMTP, which is required for
+	// password resets and email verification.
+	//
+	// Default: nil | Prefix: TSUBAKI_MAILER_*
+	Mailer *mailer.Config `yaml:"mailer,omitempty"`
+
+	// Returns the ratelimit policies, which can be overridden per route. If this
+	// is not set, every IP gets 1200 requests per hour and 10 logins per minute.
+	//
+	// Default: nil | Prefix: TSUBAKI_RATELIMITS_*
+	Ratelimits *ratelimit.Config `yaml:"ratelimits,omitempty"`
+
+	// Returns the list of CIDRs (or single IPs) of the reverse proxies in front of Tsubaki.
+	// The `Forwarded`, `X-Forwarded-For`, `X-Real-IP` and `True-Client-IP` headers are only
+	// trusted if the request came from one of these proxies.
+	//
+	// Default: [] | Environment Variable: TSUBAKI_TRUSTED_PROXIES
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+
+	// Returns the firewall configuration, which has the CIDRs that are allowed (exempt
+	// from ratelimits) or blocked, and when IPs are banned for hitting ratelimits. The
+	// lists are stored in Redis and can be edited with the admin API.
+	//
+	// Default: nil | Prefix: TSUBAKI_FIREWALL_*
+	Firewall *firewall.Config `yaml:"firewall,omitempty"`
 }
 
 // KafkaConfig is the configuration options for configuring the Kafka Producer.
@@ -201,6 +275,29 @@ type KafkaConfig struct {
 	//
 	// Default: "arisu:tsubaki" | Variable: TSUBAKI_KAFKA_TOPIC
 	Topic string `yaml:"topic"`
+
+	// The topic Tsubaki acknowledges the GitHub bot's requests on.
+	//
+	// Default: "<topic>-replies" | Variable: TSUBAKI_KAFKA_REPLY_TOPIC
+	ReplyTopic string `yaml:"reply_topic"`
+
+	// The consumer group Tsubaki reads the GitHub bot's requests with. Replicas use the
+	// same group, so every request is only handled once.
+	//
+	// Default: "tsubaki" | Variable: TSUBAKI_KAFKA_GROUP_ID
+	GroupID string `yaml:"group_id"`
+
+	// How many partitions the topics are created with, if `auto_create_topics` is enabled.
+	// Events are ordered per key within a partition, so more partitions only add throughput.
+	//
+	// Default: 1 | Variable: TSUBAKI_KAFKA_PARTITIONS
+	Partitions int `yaml:"partitions"`
+
+	// How many brokers every partition of the topics is replicated to, if `auto_create_topics`
+	// is enabled. This can't be more than the number of brokers in the cluster.
+	//
+	// Default: 1 | Variable: TSUBAKI_KAFKA_REPLICATION_FACTOR
+	ReplicationFactor int `yaml:"replication_factor"`
 }
 
 // RedisConfig represents the configuration for using Redis as a cache.
@@ -355,20 +452,34 @@ func fallbackToString(value string, fallback string) string {
 	}
 }
 
-func getKafkaConfigFromEnv() *KafkaConfig {
+func getKafkaConfigFromEnv() (*KafkaConfig, error) {
 	logrus.Debug("Finding Kafka configuration from system environment variables...")
 	disabled := os.Getenv("TSUBAKI_KAFKA_BROKERS") == ""
 	if disabled {
 		logrus.Debug("Kafka producer will not be initialized due to `TSUBAKI_KAFKA_BROKERS` not existing.")
-		return nil
+		return nil, nil
+	}
+
+	partitions, err := convertToInt(os.Getenv("TSUBAKI_KAFKA_PARTITIONS"), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	replicationFactor, err := convertToInt(os.Getenv("TSUBAKI_KAFKA_REPLICATION_FACTOR"), 1)
+	if err != nil {
+		return nil, err
 	}
 
 	logrus.Debug("Found Kafka configuration from system environment variables!")
 	return &KafkaConfig{
-		AutoCreateTopics: convertToBool(os.Getenv("TSUBAKI_KAFKA_AUTO_CREATE_TOPICS"), true),
-		Brokers:          strings.Split(os.Getenv("TSUBAKI_KAFKA_BROKERS"), ","),
-		Topic:            fallbackToString(os.Getenv("TSUBAKI_KAFKA_TOPIC"), "tsubaki"),
-	}
+		AutoCreateTopics:  convertToBool(os.Getenv("TSUBAKI_KAFKA_AUTO_CREATE_TOPICS"), true),
+		ReplicationFactor: replicationFactor,
+		Partitions:        partitions,
+		Brokers:           strings.Split(os.Getenv("TSUBAKI_KAFKA_BROKERS"), ","),
+		Topic:             fallbackToString(os.Getenv("TSUBAKI_KAFKA_TOPIC"), "tsubaki"),
+		ReplyTopic:        os.Getenv("TSUBAKI_KAFKA_REPLY_TOPIC"),
+		GroupID:           os.Getenv("TSUBAKI_KAFKA_GROUP_ID"),
+	}, nil
 }
 
 func getRedisConfigFromEnv() (*RedisConfig, error) {
@@ -417,12 +528,18 @@ func getRedisConfigFromEnv() (*RedisConfig, error) {
 		return nil, err
 	}
 
+	// Single-node backends don't need Redis, so it is only used if the host is set.
+	host := os.Getenv("TSUBAKI_REDIS_HOST")
+	if Backend(fallbackToString(os.Getenv("TSUBAKI_BACKEND"), "redis")) == RedisBackend {
+		host = fallbackToString(host, "localhost")
+	}
+
 	return &RedisConfig{
 		Sentinels:  nil,
 		Password:   password,
 		MasterName: nil,
 		DbIndex:    index,
-		Host:       fallbackToString(os.Getenv("TSUBAKI_REDIS_HOST"), "localhost"),
+		Host:       host,
 		Port:       redisPort,
 	}, nil
 }
@@ -556,6 +673,226 @@ func getElasticsearchConfigFromEnv() *ElasticsearchConfig {
 	}
 }
 
+func getOIDCConfigFromEnv() *auth.OIDCConfig {
+	logrus.Debug("Now loading OpenID Connect configuration from system environment variables...")
+
+	issuer, enabled := os.LookupEnv("TSUBAKI_OIDC_ISSUER")
+	if !enabled {
+		logrus.Debug("OpenID Connect login will not be enabled due to `TSUBAKI_OIDC_ISSUER` not existing.")
+		return nil
+	}
+
+	scopes := []string{"openid", "profile", "email"}
+	if value, ok := os.LookupEnv("TSUBAKI_OIDC_SCOPES"); ok {
+		scopes = strings.Split(value, ",")
+	}
+
+	return &auth.OIDCConfig{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("TSUBAKI_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("TSUBAKI_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("TSUBAKI_OIDC_REDIRECT_URL"),
+		Scopes:       scopes,
+		Claims: auth.OIDCClaimMapping{
+			Username: fallbackToString(os.Getenv("TSUBAKI_OIDC_CLAIMS_USERNAME"), "preferred_username"),
+			Email:    fallbackToString(os.Getenv("TSUBAKI_OIDC_CLAIMS_EMAIL"), "email"),
+			Name:     fallbackToString(os.Getenv("TSUBAKI_OIDC_CLAIMS_NAME"), "name"),
+		},
+	}
+}
+
+func getLDAPConfigFromEnv() *auth.LDAPConfig {
+	logrus.Debug("Now loading LDAP configuration from system environment variables...")
+
+	uri, enabled := os.LookupEnv("TSUBAKI_LDAP_URL")
+	if !enabled {
+		logrus.Debug("LDAP authentication will not be enabled due to `TSUBAKI_LDAP_URL` not existing.")
+		return nil
+	}
+
+	var adminGroups []string
+	if value, ok := os.LookupEnv("TSUBAKI_LDAP_ADMIN_GROUPS"); ok {
+		// group DNs contain commas, so they are split with `;` instead.
+		adminGroups = strings.Split(value, ";")
+	}
+
+	return &auth.LDAPConfig{
+		URL:                uri,
+		BindDN:             os.Getenv("TSUBAKI_LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("TSUBAKI_LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("TSUBAKI_LDAP_BASE_DN"),
+		UserFilter:         fallbackToString(os.Getenv("TSUBAKI_LDAP_USER_FILTER"), "(uid=%s)"),
+		StartTLS:           convertToBool(os.Getenv("TSUBAKI_LDAP_START_TLS"), false),
+		InsecureSkipVerify: convertToBool(os.Getenv("TSUBAKI_LDAP_INSECURE_SKIP_VERIFY"), false),
+		Exclusive:          convertToBool(os.Getenv("TSUBAKI_LDAP_EXCLUSIVE"), false),
+		AdminGroups:        adminGroups,
+		Attributes: auth.LDAPAttributeMapping{
+			Username: fallbackToString(os.Getenv("TSUBAKI_LDAP_ATTRIBUTES_USERNAME"), "uid"),
+			Email:    fallbackToString(os.Getenv("TSUBAKI_LDAP_ATTRIBUTES_EMAIL"), "mail"),
+			Name:     fallbackToString(os.Getenv("TSUBAKI_LDAP_ATTRIBUTES_NAME"), "cn"),
+			Groups:   fallbackToString(os.Getenv("TSUBAKI_LDAP_ATTRIBUTES_GROUPS"), "memberOf"),
+		},
+	}
+}
+
+func getMailerConfigFromEnv() (*mailer.Config, error) {
+	logrus.Debug("Now loading mailer configuration from system environment variables...")
+
+	host, enabled := os.LookupEnv("TSUBAKI_MAILER_HOST")
+	if !enabled {
+		logrus.Debug("Emails will not be sent due to `TSUBAKI_MAILER_HOST` not existing.")
+		return nil, nil
+	}
+
+	port, err := convertToInt(os.Getenv("TSUBAKI_MAILER_PORT"), 587)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts, err := convertToInt(os.Getenv("TSUBAKI_MAILER_MAX_ATTEMPTS"), 5)
+	if err != nil {
+		return nil, err
+	}
+
+	var username *string
+	if value, ok := os.LookupEnv("TSUBAKI_MAILER_USERNAME"); ok {
+		username = &value
+	}
+
+	var password *string
+	if value, ok := os.LookupEnv("TSUBAKI_MAILER_PASSWORD"); ok {
+		password = &value
+	}
+
+	return &mailer.Config{
+		Host:        host,
+		Port:        port,
+		Username:    username,
+		Password:    password,
+		From:        os.Getenv("TSUBAKI_MAILER_FROM"),
+		TLS:         convertToBool(os.Getenv("TSUBAKI_MAILER_TLS"), false),
+		BaseURL:     os.Getenv("TSUBAKI_MAILER_BASE_URL"),
+		MaxAttempts: maxAttempts,
+	}, nil
+}
+
+// getRatelimitsConfigFromEnv only loads the default policy, routes can only
+// be overridden in the `config.yml` file.
+func getRatelimitsConfigFromEnv() (*ratelimit.Config, error) {
+	logrus.Debug("Now loading ratelimit configuration from system environment variables...")
+
+	config := ratelimit.DefaultConfig()
+	found := false
+
+	if value, ok := os.LookupEnv("TSUBAKI_RATELIMITS_DEFAULT_LIMIT"); ok {
+		limit, err := convertToInt(value, config.Default.Limit)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Default.Limit = limit
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_RATELIMITS_DEFAULT_WINDOW"); ok {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Default.Window = window
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_RATELIMITS_DEFAULT_KEY_BY"); ok {
+		config.Default.KeyBy = ratelimit.KeyType(value)
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_RATELIMITS_DEFAULT_COST"); ok {
+		cost, err := convertToInt(value, config.Default.Cost)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Default.Cost = cost
+		found = true
+	}
+
+	if !found {
+		logrus.Debug("Using the default ratelimit policies since no `TSUBAKI_RATELIMITS_DEFAULT_*` variables exist.")
+		return nil, nil
+	}
+
+	return config, nil
+}
+
+func getFirewallConfigFromEnv() (*firewall.Config, error) {
+	logrus.Debug("Now loading firewall configuration from system environment variables...")
+
+	config := &firewall.Config{}
+	found := false
+
+	if value, ok := os.LookupEnv("TSUBAKI_FIREWALL_ALLOW"); ok {
+		config.Allow = strings.Split(value, ",")
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_FIREWALL_BLOCK"); ok {
+		config.Block = strings.Split(value, ",")
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_FIREWALL_BANS_THRESHOLD"); ok {
+		threshold, err := convertToInt(value, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Bans.Threshold = threshold
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_FIREWALL_BANS_WINDOW"); ok {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Bans.Window = window
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_FIREWALL_BANS_DURATIONS"); ok {
+		for _, item := range strings.Split(value, ",") {
+			duration, err := time.ParseDuration(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+
+			config.Bans.Durations = append(config.Bans.Durations, duration)
+		}
+
+		found = true
+	}
+
+	if value, ok := os.LookupEnv("TSUBAKI_FIREWALL_BANS_MEMORY"); ok {
+		memory, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Bans.Memory = memory
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return config, nil
+}
+
 ///////////////////////////////////////////////////////////
 /////////////// ✨ LOADER FUNCTIONS :D ✨ /////////////////
 //////////////////////////////////////////////////////////
@@ -671,6 +1008,14 @@ func loadConfigFromPath(path string) (*Config, error) {
 		config.SecretKeyBase = hash
 	}
 
+	if config.Backend == "" {
+		config.Backend = RedisBackend
+	}
+
+	if config.BoltPath == "" {
+		config.BoltPath = "./.arisu/tsubaki.db"
+	}
+
 	return &config, nil
 }
 
@@ -740,14 +1085,40 @@ func LoadFromEnv() (*Config, error) {
 		port = h
 	}
 
-	kafkaConfig := getKafkaConfigFromEnv()
 	elasticConfig := getElasticsearchConfigFromEnv()
+	oidcConfig := getOIDCConfigFromEnv()
+	ldapConfig := getLDAPConfigFromEnv()
 	redisConfig, err := getRedisConfigFromEnv()
 
 	if err != nil {
 		return nil, err
 	}
 
+	kafkaConfig, err := getKafkaConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	mailerConfig, err := getMailerConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ratelimitsConfig, err := getRatelimitsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	firewallConfig, err := getFirewallConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var trustedProxies []string
+	if value, ok := os.LookupEnv("TSUBAKI_TRUSTED_PROXIES"); ok {
+		trustedProxies = strings.Split(value, ",")
+	}
+
 	storageConfig := getStorageConfigFromEnv()
 
 	// check if we can enable basic auth
@@ -766,18 +1137,26 @@ func LoadFromEnv() (*Config, error) {
 
 	logrus.Debug("Loaded configuration from system environment variables!")
 	return &Config{
-		SecretKeyBase: os.Getenv("TSUBAKI_SECRET_KEY_BASE"),
-		ElasticSearch: elasticConfig,
-		Registrations: convertToBool(os.Getenv("TSUBAKI_REGISTRATIONS_ENABLED"), true),
-		InviteOnly:    convertToBool(os.Getenv("TSUBAKI_INVITE_ONLY"), false),
-		Telemetry:     telemetryEnabled,
-		SentryDSN:     actualDsn,
-		Username:      username,
-		Password:      password,
-		Storage:       storageConfig,
-		Kafka:         kafkaConfig,
-		Redis:         *redisConfig,
-		Port:          &port,
-		Host:          &host,
+		SecretKeyBase:  os.Getenv("TSUBAKI_SECRET_KEY_BASE"),
+		ElasticSearch:  elasticConfig,
+		Registrations:  convertToBool(os.Getenv("TSUBAKI_REGISTRATIONS_ENABLED"), true),
+		InviteOnly:     convertToBool(os.Getenv("TSUBAKI_INVITE_ONLY"), false),
+		Telemetry:      telemetryEnabled,
+		SentryDSN:      actualDsn,
+		Username:       username,
+		Password:       password,
+		Storage:        storageConfig,
+		Kafka:          kafkaConfig,
+		Redis:          *redisConfig,
+		OIDC:           oidcConfig,
+		LDAP:           ldapConfig,
+		Mailer:         mailerConfig,
+		Ratelimits:     ratelimitsConfig,
+		TrustedProxies: trustedProxies,
+		Firewall:       firewallConfig,
+		Backend:        Backend(fallbackToString(os.Getenv("TSUBAKI_BACKEND"), "redis")),
+		BoltPath:       fallbackToString(os.Getenv("TSUBAKI_BOLT_PATH"), "./.arisu/tsubaki.db"),
+		Port:           &port,
+		Host:           &host,
 	}, nil
 }
@@ -22,9 +22,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"arisu.land/tsubaki/internal"
+	"arisu.land/tsubaki/pkg/auth"
+	"arisu.land/tsubaki/pkg/firewall"
+	"arisu.land/tsubaki/pkg/lockout"
+	"arisu.land/tsubaki/pkg/mailer"
 	"arisu.land/tsubaki/pkg/storage"
 	"arisu.land/tsubaki/prisma/db"
 	"github.com/bwmarrin/snowflake"
@@ -33,6 +38,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
 	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 )
 
 // GlobalContainer represents the global Container instance
@@ -45,11 +51,17 @@ type Container struct {
 	ElasticSearch *es.Client
 	Snowflake     *snowflake.Node
 	Storage       storage.BaseStorageProvider
+	OIDC          *auth.OIDCProvider
+	LDAP          *auth.LDAPProvider
+	Mailer        *mailer.Mailer
+	Lockout       *lockout.Manager
+	Firewall      *firewall.Firewall
 	Prisma        *db.PrismaClient
 	Sentry        *sentry.Client
 	Config        *Config
 	Redis         *redis.Client
 	Kafka         *kafka.Writer
+	Bolt          *bolt.DB
 }
 
 func NewContainer(path string) error {
@@ -96,49 +108,93 @@ func NewContainer(path string) error {
 
 	internal.UsersCountMetric.Set(float64(len(users)))
 
-	// Create Redis client
-	logrus.Debug("Now connecting to Redis...")
-
-	password := ""
-	if config.Redis.Password != nil {
-		password = *config.Redis.Password
+	switch config.Backend {
+	case RedisBackend, MemoryBackend, BoltBackend:
+	default:
+		return InvalidBackendError
 	}
 
+	// Single-node backends don't need Redis, so we only connect if it was configured.
 	var re *redis.Client
-	if config.Redis.Sentinels != nil && len(*config.Redis.Sentinels) > 0 {
-		masterName := ""
-		if config.Redis.MasterName == nil {
-			return errors.New("config option 'redis.master_name' needs to be defined to use a sentinel connection")
-		} else {
-			masterName = *config.Redis.MasterName
+	if config.Backend == RedisBackend || config.Redis.Host != "" || config.Redis.Sentinels != nil {
+		re, err = newRedisClient(config.Redis)
+		if err != nil {
+			return err
 		}
-
-		re = redis.NewFailoverClient(&redis.FailoverOptions{
-			SentinelAddrs: *config.Redis.Sentinels,
-			MasterName:    masterName,
-			Password:      password,
-			DB:            config.Redis.DbIndex,
-			DialTimeout:   10 * time.Second,
-			ReadTimeout:   15 * time.Second,
-			WriteTimeout:  15 * time.Second,
-		})
 	} else {
-		re = redis.NewClient(&redis.Options{
-			Password:     password,
-			Addr:         fmt.Sprintf("%s:%d", config.Redis.Host, config.Redis.Port),
-			DB:           config.Redis.DbIndex,
-			DialTimeout:  10 * time.Second,
-			ReadTimeout:  15 * time.Second,
-			WriteTimeout: 15 * time.Second,
-		})
+		logrus.Warn("Redis isn't configured, so OpenID Connect, the mailer, login lockouts and the firewall are disabled.")
 	}
 
-	logrus.Debug("Created Redis client, checking connection...")
-	if err := re.Ping(context.TODO()).Err(); err != nil {
-		return err
+	var boltDB *bolt.DB
+	if config.Backend == BoltBackend {
+		logrus.Debugf("Opening BoltDB file %s...", config.BoltPath)
+		if err := os.MkdirAll(filepath.Dir(config.BoltPath), 0o755); err != nil {
+			return err
+		}
+
+		boltDB, err = bolt.Open(config.BoltPath, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return err
+		}
+
+		logrus.Debug("Opened BoltDB file!")
 	}
 
-	logrus.Debug("Connected to Redis!")
+	var oidcProvider *auth.OIDCProvider
+	if config.OIDC != nil {
+		if re == nil {
+			return errors.New("config option 'oidc' requires Redis to be configured")
+		}
+
+		logrus.Debug("Creating OpenID Connect provider...")
+		oidcProvider, err = auth.NewOIDCProvider(config.OIDC, re)
+		if err != nil {
+			return err
+		}
+
+		logrus.Debug("Created OpenID Connect provider!")
+	}
+
+	var ldapProvider *auth.LDAPProvider
+	if config.LDAP != nil {
+		logrus.Debug("Creating LDAP provider...")
+		ldapProvider, err = auth.NewLDAPProvider(config.LDAP)
+		if err != nil {
+			return err
+		}
+
+		logrus.Debug("Created LDAP provider!")
+	}
+
+	var m *mailer.Mailer
+	if config.Mailer != nil {
+		if re == nil {
+			return errors.New("config option 'mailer' requires Redis to be configured")
+		}
+
+		logrus.Debug("Creating mailer...")
+		m, err = mailer.NewMailer(config.Mailer, re)
+		if err != nil {
+			return err
+		}
+
+		logrus.Debug("Created mailer!")
+	}
+
+	var fw *firewall.Firewall
+	var lockouts *lockout.Manager
+	if re != nil {
+		logrus.Debug("Loading firewall lists...")
+		fw, err = firewall.NewFirewall(config.Firewall, re)
+		if err != nil {
+			return err
+		}
+
+		logrus.Debug("Loaded firewall lists!")
+		lockouts = lockout.NewManager(re)
+	} else if config.Firewall != nil {
+		logrus.Warn("Config option 'firewall' is ignored since Redis isn't configured.")
+	}
 
 	// create storage provider
 	logrus.Info("Now creating storage provider...")
@@ -162,10 +218,12 @@ func NewContainer(path string) error {
 
 	if config.Kafka != nil {
 		logrus.Debug("Creating Kafka producer...")
+
+		// Events with the same key have to end up in the same partition to stay in order.
 		writer = &kafka.Writer{
 			Addr:     kafka.TCP(config.Kafka.Brokers...),
 			Topic:    config.Kafka.Topic,
-			Balancer: &kafka.LeastBytes{},
+			Balancer: &kafka.Hash{},
 		}
 	}
 
@@ -242,24 +300,97 @@ func NewContainer(path string) error {
 		ElasticSearch: e,
 		Snowflake:     node,
 		Storage:       provider,
+		OIDC:          oidcProvider,
+		LDAP:          ldapProvider,
+		Mailer:        m,
+		Lockout:       lockouts,
+		Firewall:      fw,
 		Prisma:        prisma,
 		Sentry:        sc,
 		Config:        config,
 		Redis:         re,
 		Kafka:         writer,
+		Bolt:          boltDB,
 	}
 
 	GlobalContainer = container
 	return nil
 }
 
+// newRedisClient connects to the Redis server or sentinels from `config`.
+func newRedisClient(config RedisConfig) (*redis.Client, error) {
+	logrus.Debug("Now connecting to Redis...")
+
+	password := ""
+	if config.Password != nil {
+		password = *config.Password
+	}
+
+	var re *redis.Client
+	if config.Sentinels != nil && len(*config.Sentinels) > 0 {
+		masterName := ""
+		if config.MasterName == nil {
+			return nil, errors.New("config option 'redis.master_name' needs to be defined to use a sentinel connection")
+		} else {
+			masterName = *config.MasterName
+		}
+
+		re = redis.NewFailoverClient(&redis.FailoverOptions{
+			SentinelAddrs: *config.Sentinels,
+			MasterName:    masterName,
+			Password:      password,
+			DB:            config.DbIndex,
+			DialTimeout:   10 * time.Second,
+			ReadTimeout:   15 * time.Second,
+			WriteTimeout:  15 * time.Second,
+		})
+	} else {
+		re = redis.NewClient(&redis.Options{
+			Password:     password,
+			Addr:         fmt.Sprintf("%s:%d", config.Host, config.Port),
+			DB:           config.DbIndex,
+			DialTimeout:  10 * time.Second,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+		})
+	}
+
+	logrus.Debug("Created Redis client, checking connection...")
+	if err := re.Ping(context.TODO()).Err(); err != nil {
+		return nil, err
+	}
+
+	logrus.Debug("Connected to Redis!")
+	return re, nil
+}
+
 func (c *Container) Close() error {
+	if c.Mailer != nil {
+		logrus.Warn("Stopping mailer queue...")
+		c.Mailer.Close()
+	}
+
+	if c.Firewall != nil {
+		c.Firewall.Close()
+	}
+
 	s := time.Now()
-	if err := c.Redis.Close(); err != nil {
-		return err
+	if c.Redis != nil {
+		if err := c.Redis.Close(); err != nil {
+			return err
+		}
+
+		logrus.Warnf("Disconnected from Redis in %s!", time.Since(s).String())
+	}
+
+	if c.Bolt != nil {
+		if err := c.Bolt.Close(); err != nil {
+			return err
+		}
+
+		logrus.Warn("Closed BoltDB file!")
 	}
 
-	logrus.Warnf("Disconnected from Redis in %s!", time.Since(s).String())
 	s = time.Now()
 	if err := c.Prisma.Disconnect(); err != nil {
 		return err
@@ -286,6 +417,10 @@ func (c *Container) DbPing() int64 {
 }
 
 func (c *Container) RedisPing() int64 {
+	if c.Redis == nil {
+		return -1
+	}
+
 	t := time.Now()
 	if err := c.Redis.Ping(context.TODO()).Err(); err != nil {
 		return -1
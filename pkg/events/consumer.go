@@ -0,0 +1,349 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/result"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxHandleAttempts is how many times a request is handled before its failed result
+	// is sent back to the GitHub bot.
+	maxHandleAttempts = 5
+
+	// maxConsumerBackoff is the longest the consumer waits before trying again.
+	maxConsumerBackoff = 30 * time.Second
+)
+
+// Handler handles a request from the GitHub bot. The result is sent back as the reply;
+// results with a 500 or 503 status are retried a few times first, since they are
+// usually caused by PostgreSQL or the storage provider being unavailable.
+type Handler func(request Envelope) *result.Result
+
+// Reply acknowledges a request from the GitHub bot, it's published on the reply topic
+// with the same key as the request.
+type Reply struct {
+	*result.Result
+
+	// ID is the unique ID of the reply.
+	ID string `json:"id"`
+
+	// RequestID is the ID of the request this is replying to.
+	RequestID string `json:"request_id"`
+
+	// Type is the type of the request.
+	Type string `json:"type"`
+
+	// Status is the HTTP-like status code of the result.
+	Status int `json:"status"`
+
+	// Timestamp is when the request was handled, in RFC3339.
+	Timestamp string `json:"timestamp"`
+}
+
+// handler is a registered Handler and the newest version of the request it understands.
+type handler struct {
+	version int
+	handle  Handler
+}
+
+// Consumer reads the GitHub bot's requests from the topic in a consumer group. The
+// offset of a request is only committed after its reply was published, so a request
+// is handled at least once: the bot should skip replies to requests it already got.
+type Consumer struct {
+	config   *pkg.KafkaConfig
+	reader   *kafka.Reader
+	replies  *kafka.Writer
+	handlers map[string]handler
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewConsumer creates a Consumer, requests are only read once it's started.
+func NewConsumer(config *pkg.KafkaConfig) *Consumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Consumer{
+		config: config,
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: config.Brokers,
+			GroupID: groupID(config),
+			Topic:   config.Topic,
+		}),
+		replies: &kafka.Writer{
+			Addr:     kafka.TCP(config.Brokers...),
+			Topic:    replyTopic(config),
+			Balancer: &kafka.Hash{},
+		},
+		handlers: map[string]handler{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Handle registers the handler of the `requestType` requests. Requests with a newer
+// version than `version` are refused, since their data might mean something else.
+func (c *Consumer) Handle(requestType string, version int, handle Handler) {
+	c.handlers[requestType] = handler{version, handle}
+}
+
+// Start makes sure the topics exist, then consumes the requests in the background.
+func (c *Consumer) Start() error {
+	if err := ensureTopics(c.config, c.config.Topic, replyTopic(c.config)); err != nil {
+		return err
+	}
+
+	logrus.Infof("Consuming GitHub bot requests from %s as group %s!", c.config.Topic, groupID(c.config))
+	go c.consume()
+	return nil
+}
+
+// Close stops consuming and leaves the consumer group.
+func (c *Consumer) Close() error {
+	c.cancel()
+	if err := c.reader.Close(); err != nil {
+		return err
+	}
+
+	return c.replies.Close()
+}
+
+func (c *Consumer) consume() {
+	for {
+		message, err := c.reader.FetchMessage(c.ctx)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+
+			logrus.Errorf("Unable to fetch GitHub bot request: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		c.retry("publish the reply", func() error {
+			return c.process(message)
+		})
+
+		c.retry("commit the request", func() error {
+			return c.reader.CommitMessages(c.ctx, message)
+		})
+	}
+}
+
+// process handles the message and publishes the reply. Messages that aren't requests
+// Tsubaki handles, like the events Tsubaki publishes on the same topic, are skipped.
+func (c *Consumer) process(message kafka.Message) error {
+	var request Envelope
+	if err := json.Unmarshal(message.Value, &request); err != nil {
+		logrus.Warnf("Skipping malformed message at %s[%d]@%d: %v", message.Topic, message.Partition, message.Offset, err)
+		return nil
+	}
+
+	h, ok := c.handlers[request.Type]
+	if !ok {
+		return nil
+	}
+
+	var res *result.Result
+	if request.Version > h.version {
+		res = result.Err(406, "UNSUPPORTED_VERSION", fmt.Sprintf("Version %d of %s isn't supported, the newest is %d.", request.Version, request.Type, h.version))
+	} else {
+		res = c.handle(h.handle, request)
+	}
+
+	reply, _ := json.Marshal(Reply{
+		Result:    res,
+		ID:        pkg.GlobalContainer.Snowflake.Generate().String(),
+		RequestID: request.ID,
+		Type:      request.Type,
+		Status:    res.StatusCode,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+
+	return c.replies.WriteMessages(c.ctx, kafka.Message{
+		Key:   message.Key,
+		Value: reply,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(request.Type)},
+			{Key: "request-id", Value: []byte(request.ID)},
+		},
+	})
+}
+
+// handle runs the handler, retrying it while it returns a 500 or 503 result.
+func (c *Consumer) handle(handle Handler, request Envelope) (res *result.Result) {
+	for attempt := 1; ; attempt++ {
+		res = safeHandle(handle, request)
+		if (res.StatusCode != 500 && res.StatusCode != 503) || attempt == maxHandleAttempts || c.ctx.Err() != nil {
+			return res
+		}
+
+		logrus.Warnf("Request %s (%s) failed with status %d (attempt %d), retrying...", request.ID, request.Type, res.StatusCode, attempt)
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// safeHandle runs the handler, turning a panic into a 500 result so one bad request
+// doesn't stop the consumer.
+func safeHandle(handle Handler, request Envelope) (res *result.Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Handler of %s panicked on request %s: %v", request.Type, request.ID, r)
+			res = result.Err(500, "UNKNOWN_ERROR", "Unable to handle the request.")
+		}
+	}()
+
+	return handle(request)
+}
+
+// retry runs `fn` until it succeeds or the consumer is closed.
+func (c *Consumer) retry(action string, fn func() error) {
+	for attempt := 1; c.ctx.Err() == nil; attempt++ {
+		err := fn()
+		if err == nil || c.ctx.Err() != nil {
+			return
+		}
+
+		wait := backoff(attempt)
+		logrus.Errorf("Unable to %s, retrying in %s: %v", action, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	return time.Duration(math.Min(math.Pow(2, float64(attempt)), maxConsumerBackoff.Seconds())) * time.Second
+}
+
+// ensureTopics creates the topics if `auto_create_topics` is enabled, otherwise it
+// checks that they exist.
+func ensureTopics(config *pkg.KafkaConfig, topics ...string) error {
+	conn, err := dialAny(config.Brokers)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if !config.AutoCreateTopics {
+		partitions, err := conn.ReadPartitions()
+		if err != nil {
+			return err
+		}
+
+		existing := map[string]bool{}
+		for _, partition := range partitions {
+			existing[partition.Topic] = true
+		}
+
+		for _, topic := range topics {
+			if !existing[topic] {
+				return fmt.Errorf("kafka topic %s doesn't exist and `auto_create_topics` is disabled", topic)
+			}
+		}
+
+		return nil
+	}
+
+	// Topics can only be created through the cluster's controller.
+	broker, err := conn.Controller()
+	if err != nil {
+		return err
+	}
+
+	controller, err := kafka.Dial("tcp", net.JoinHostPort(broker.Host, strconv.Itoa(broker.Port)))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = controller.Close()
+	}()
+
+	configs := make([]kafka.TopicConfig, 0, len(topics))
+	for _, topic := range topics {
+		configs = append(configs, kafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     numPartitions(config),
+			ReplicationFactor: replicationFactor(config),
+		})
+	}
+
+	return controller.CreateTopics(configs...)
+}
+
+// dialAny connects to the first broker that is reachable.
+func dialAny(brokers []string) (*kafka.Conn, error) {
+	err := errors.New("no kafka brokers are configured")
+	for _, broker := range brokers {
+		var conn *kafka.Conn
+		if conn, err = kafka.Dial("tcp", broker); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// replyTopic returns the topic replies are published on.
+func replyTopic(config *pkg.KafkaConfig) string {
+	if config.ReplyTopic != "" {
+		return config.ReplyTopic
+	}
+
+	return config.Topic + "-replies"
+}
+
+// numPartitions returns how many partitions topics are created with.
+func numPartitions(config *pkg.KafkaConfig) int {
+	if config.Partitions > 0 {
+		return config.Partitions
+	}
+
+	return 1
+}
+
+// replicationFactor returns how many brokers the partitions of new topics are replicated to.
+func replicationFactor(config *pkg.KafkaConfig) int {
+	if config.ReplicationFactor > 0 {
+		return config.ReplicationFactor
+	}
+
+	return 1
+}
+
+// groupID returns the consumer group requests are read with.
+func groupID(config *pkg.KafkaConfig) string {
+	if config.GroupID != "" {
+		return config.GroupID
+	}
+
+	return "tsubaki"
+}
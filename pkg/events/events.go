@@ -0,0 +1,100 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/prisma/db"
+)
+
+// Event is something that happened in Tsubaki that other services, like the GitHub
+// bot, can react to.
+type Event interface {
+	// Type returns the name of the event, like `user.created`.
+	Type() string
+
+	// Version returns the version of the event's schema. It's bumped when a field is
+	// removed or changes meaning, adding a field doesn't bump it.
+	Version() int
+
+	// Key returns the ID of what the event is about. Events with the same key are
+	// published to the same partition, so they are consumed in order.
+	Key() string
+}
+
+// Envelope is how an event is published. Consumers should use `type` and `version`
+// to decode `data`, and `id` to skip events they already handled, since an event
+// can be published more than once.
+type Envelope struct {
+	// ID is the unique ID of the event.
+	ID string `json:"id"`
+
+	// Type is the name of the event, like `user.created`.
+	Type string `json:"type"`
+
+	// Version is the version of the event's schema.
+	Version int `json:"version"`
+
+	// Timestamp is when the event happened, in RFC3339.
+	Timestamp string `json:"timestamp"`
+
+	// Actor is the ID of the user who caused the event, or nil if Tsubaki did.
+	Actor *string `json:"actor"`
+
+	// Data is the event itself.
+	Data json.RawMessage `json:"data"`
+}
+
+// Record returns the outbox row of the event, which has to be run in the same
+// transaction as the change the event describes:
+//
+//	create := pkg.GlobalContainer.Prisma.User.CreateOne(...).Tx()
+//	event := events.Record(&actorID, events.UserCreated{...})
+//	err := pkg.GlobalContainer.Prisma.Prisma.Transaction(create, event).Exec(ctx)
+func Record(actor *string, event Event) db.OutboxEventUniqueTxResult {
+	envelope := newEnvelope(actor, event)
+	payload, _ := json.Marshal(envelope)
+
+	return pkg.GlobalContainer.Prisma.OutboxEvent.CreateOne(
+		db.OutboxEvent.Payload.Set(string(payload)),
+		db.OutboxEvent.Type.Set(envelope.Type),
+		db.OutboxEvent.Key.Set(event.Key()),
+		db.OutboxEvent.ID.Set(envelope.ID),
+	).Tx()
+}
+
+// Publish writes the event to the outbox by itself, for events that don't describe
+// a change in PostgreSQL.
+func Publish(actor *string, event Event) error {
+	return pkg.GlobalContainer.Prisma.Prisma.Transaction(Record(actor, event)).Exec(context.TODO())
+}
+
+func newEnvelope(actor *string, event Event) Envelope {
+	data, _ := json.Marshal(event)
+	return Envelope{
+		ID:        pkg.GlobalContainer.Snowflake.Generate().String(),
+		Type:      event.Type(),
+		Version:   event.Version(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Actor:     actor,
+		Data:      data,
+	}
+}
@@ -0,0 +1,254 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// relayInterval is how often the outbox is checked for new events.
+	relayInterval = time.Second
+
+	// relayBatchSize is how many events are published at once.
+	relayBatchSize = 100
+
+	// maxRelayBackoff is the longest the relay waits after Kafka couldn't be reached.
+	maxRelayBackoff = time.Minute
+
+	// cleanupInterval is how often old events are removed from the outbox.
+	cleanupInterval = time.Hour
+
+	// relayLockKey holds the replica that is publishing the outbox, so events are
+	// only published once and in order when running more than one replica.
+	relayLockKey = "tsubaki:events:relay"
+
+	// relayLockTTL is how long the lock is held without being renewed. A batch has
+	// to be published within it, otherwise another replica can publish it again.
+	relayLockTTL = 30 * time.Second
+)
+
+// renewLock extends the relay lock, but only if this replica still holds it.
+var renewLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+
+return 0
+`)
+
+// Relay publishes the events in the outbox to Kafka, oldest first. Events are only
+// marked as published once Kafka acknowledged them, so they can be published more
+// than once, but never lost.
+//
+// Only the replica holding the relay lock in Redis publishes. Without Redis, every
+// replica publishes the same events, so it's required when running more than one.
+type Relay struct {
+	prisma *db.PrismaClient
+	writer *kafka.Writer
+	redis  *redis.Client
+	owner  string
+
+	// prefix only publishes the events whose ID starts with it, so tests don't
+	// touch the rest of the outbox. It's empty outside of tests.
+	prefix string
+}
+
+// outboxRow is an event in the outbox that wasn't published yet.
+type outboxRow struct {
+	Payload string `json:"payload"`
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	ID      string `json:"id"`
+}
+
+// NewRelay creates a Relay, `writer` is nil if Kafka isn't configured. The outbox is
+// still cleaned up then, so it doesn't grow forever. `redis` can be nil.
+func NewRelay(prisma *db.PrismaClient, writer *kafka.Writer, redis *redis.Client) *Relay {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &Relay{
+		prisma: prisma,
+		writer: writer,
+		redis:  redis,
+		owner:  fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}
+}
+
+// Start publishes the outbox in the background.
+func (r *Relay) Start() {
+	go func() {
+		for {
+			r.cleanup()
+			time.Sleep(cleanupInterval)
+		}
+	}()
+
+	if r.writer == nil {
+		return
+	}
+
+	go func() {
+		failures := 0
+		for {
+			if !r.lock() {
+				time.Sleep(relayInterval)
+				continue
+			}
+
+			published, err := r.publish()
+			if err != nil {
+				failures++
+				backoff := time.Duration(math.Min(math.Pow(2, float64(failures)), maxRelayBackoff.Seconds())) * time.Second
+				logrus.Errorf("Unable to publish events to Kafka, retrying in %s: %v", backoff, err)
+				time.Sleep(backoff)
+				continue
+			}
+
+			failures = 0
+			if published < relayBatchSize {
+				time.Sleep(relayInterval)
+			}
+		}
+	}()
+}
+
+// lock returns if this replica holds the relay lock, it's acquired when no replica
+// holds it and renewed when this replica does.
+func (r *Relay) lock() bool {
+	if r.redis == nil {
+		return true
+	}
+
+	ok, err := r.redis.SetNX(context.TODO(), relayLockKey, r.owner, relayLockTTL).Result()
+	if err != nil {
+		logrus.Errorf("Unable to acquire the event relay lock: %v", err)
+		return false
+	}
+
+	if ok {
+		logrus.Info("Acquired the event relay lock, publishing events from this replica.")
+		return true
+	}
+
+	renewed, err := renewLock.Run(context.TODO(), r.redis, []string{relayLockKey}, r.owner, relayLockTTL.Milliseconds()).Int()
+	if err != nil {
+		logrus.Errorf("Unable to renew the event relay lock: %v", err)
+		return false
+	}
+
+	return renewed == 1
+}
+
+// publish publishes the next batch of events and returns how many were published.
+func (r *Relay) publish() (int, error) {
+	query := `SELECT "payload", "type", "key", "id" FROM "outbox_events" WHERE "published_at" IS NULL`
+	args := []interface{}{relayBatchSize}
+	if r.prefix != "" {
+		query += ` AND starts_with("id", $2)`
+		args = append(args, r.prefix)
+	}
+
+	var rows []outboxRow
+	err := r.prisma.Prisma.QueryRaw(query+` ORDER BY "created_at", "id" LIMIT $1`, args...).Exec(context.TODO(), &rows)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, 0, len(rows))
+	messages := make([]kafka.Message, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+		messages = append(messages, kafka.Message{
+			Key:   []byte(row.Key),
+			Value: []byte(row.Payload),
+			Headers: []kafka.Header{
+				{Key: "type", Value: []byte(row.Type)},
+				{Key: "id", Value: []byte(row.ID)},
+			},
+		})
+	}
+
+	// Give up on the batch before the lock expires, so another replica can't publish it
+	// at the same time.
+	ctx, cancel := context.WithTimeout(context.TODO(), relayLockTTL/2)
+	defer cancel()
+
+	if err := r.writer.WriteMessages(ctx, messages...); err != nil {
+		for _, id := range ids {
+			_, uerr := r.prisma.Prisma.ExecuteRaw(
+				`UPDATE "outbox_events" SET "attempts" = "attempts" + 1, "last_error" = $1 WHERE "id" = $2`,
+				err.Error(),
+				id,
+			).Exec(context.TODO())
+
+			if uerr != nil {
+				logrus.Errorf("Unable to update outbox event %s: %v", id, uerr)
+			}
+		}
+
+		return 0, err
+	}
+
+	// If this fails, the batch is published again the next time.
+	_, err = r.prisma.OutboxEvent.FindMany(db.OutboxEvent.ID.In(ids)).Update(
+		db.OutboxEvent.PublishedAt.Set(time.Now()),
+	).Exec(context.TODO())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(rows), nil
+}
+
+// cleanup removes the events that were published more than a week ago. Without Kafka,
+// every event older than a week is removed, so enabling Kafka later only publishes the
+// last week of events.
+func (r *Relay) cleanup() {
+	query := `DELETE FROM "outbox_events" WHERE "published_at" < (NOW() AT TIME ZONE 'UTC') - INTERVAL '7 days'`
+	if r.writer == nil {
+		query = `DELETE FROM "outbox_events" WHERE "created_at" < (NOW() AT TIME ZONE 'UTC') - INTERVAL '7 days'`
+	}
+
+	count, err := r.prisma.Prisma.ExecuteRaw(query).Exec(context.TODO())
+	if err != nil {
+		logrus.Errorf("Unable to clean up the event outbox: %v", err)
+		return
+	}
+
+	if count.Count > 0 {
+		logrus.Debugf("Removed %d old events from the outbox.", count.Count)
+	}
+}
@@ -0,0 +1,249 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"arisu.land/tsubaki/prisma/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+)
+
+// TestRelayPublishesOnce runs two relays against a Kafka (or Redpanda) broker at
+// `TSUBAKI_TEST_KAFKA`, like `localhost:9092`, and the PostgreSQL database at
+// `TSUBAKI_TEST_DATABASE_URL`. The relays only publish the events this test created,
+// the rest of the outbox is left alone.
+func TestRelayPublishesOnce(t *testing.T) {
+	broker := os.Getenv("TSUBAKI_TEST_KAFKA")
+	databaseURL := os.Getenv("TSUBAKI_TEST_DATABASE_URL")
+	if broker == "" || databaseURL == "" {
+		t.Skip("TSUBAKI_TEST_KAFKA and TSUBAKI_TEST_DATABASE_URL aren't set")
+	}
+
+	t.Setenv("DATABASE_URL", databaseURL)
+	prisma := db.NewClient()
+	if err := prisma.Connect(); err != nil {
+		t.Fatalf("unable to connect to postgres: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = prisma.Disconnect()
+	})
+
+	ctx := context.TODO()
+	topic := fmt.Sprintf("tsubaki-relay-test-%d", time.Now().UnixNano())
+	createTestTopic(t, broker, topic, 3)
+
+	keys := []string{"1", "2", "3"}
+	ids := make([]string, 0, 30)
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("%s-%03d", topic, i)
+		_, err := prisma.OutboxEvent.CreateOne(
+			db.OutboxEvent.Payload.Set(fmt.Sprintf(`{"id":"%s"}`, id)),
+			db.OutboxEvent.Type.Set("test.event"),
+			db.OutboxEvent.Key.Set(keys[i%len(keys)]),
+			db.OutboxEvent.ID.Set(id),
+		).Exec(ctx)
+
+		if err != nil {
+			t.Fatalf("unable to create outbox event: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	t.Cleanup(func() {
+		if _, err := prisma.OutboxEvent.FindMany(db.OutboxEvent.ID.In(ids)).Delete().Exec(ctx); err != nil {
+			t.Logf("unable to delete the test events: %v", err)
+		}
+	})
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+	})
+
+	relays := make([]*Relay, 0, 2)
+	for i := 0; i < 2; i++ {
+		writer := &kafka.Writer{
+			Addr:     kafka.TCP(broker),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		}
+
+		t.Cleanup(func() {
+			_ = writer.Close()
+		})
+
+		relay := NewRelay(prisma, writer, rdb)
+		relay.owner = fmt.Sprintf("replica-%d", i)
+		relay.prefix = topic + "-"
+		relays = append(relays, relay)
+	}
+
+	// Both replicas try to publish, like they would in Start, until the outbox is empty.
+	holders := map[string]bool{}
+	for published := 0; published < len(ids); {
+		before := published
+		for _, relay := range relays {
+			if !relay.lock() {
+				continue
+			}
+
+			holders[relay.owner] = true
+			n, err := relay.publish()
+			if err != nil {
+				t.Fatalf("unable to publish events: %v", err)
+			}
+
+			published += n
+		}
+
+		if published == before {
+			t.Fatalf("relays stopped publishing after %d of %d events", published, len(ids))
+		}
+	}
+
+	if len(holders) != 1 {
+		t.Fatalf("expected one replica to publish, but %d did", len(holders))
+	}
+
+	// Every event has to be published exactly once, and the events of a key in the
+	// order they were recorded, in the same partition.
+	seen := map[string]bool{}
+	last := map[string]string{}
+	partitionOf := map[string]int{}
+	for _, message := range readTestTopic(t, broker, topic, 3, len(ids)) {
+		id := header(message, "id")
+		if seen[id] {
+			t.Fatalf("event %s was published more than once", id)
+		}
+
+		key := string(message.Key)
+		if id <= last[key] {
+			t.Fatalf("event %s of key %s was published after %s", id, key, last[key])
+		}
+
+		if partition, ok := partitionOf[key]; ok && partition != message.Partition {
+			t.Fatalf("events of key %s were published to partitions %d and %d", key, partition, message.Partition)
+		}
+
+		seen[id] = true
+		last[key] = id
+		partitionOf[key] = message.Partition
+	}
+
+	if len(seen) != len(ids) {
+		t.Fatalf("expected %d events, got %d", len(ids), len(seen))
+	}
+
+	remaining, err := prisma.OutboxEvent.FindMany(
+		db.OutboxEvent.ID.In(ids),
+		db.OutboxEvent.PublishedAt.IsNull(),
+	).Exec(ctx)
+
+	if err != nil {
+		t.Fatalf("unable to query the outbox: %v", err)
+	}
+
+	if len(remaining) != 0 {
+		t.Fatalf("expected every event to be marked as published, %d weren't", len(remaining))
+	}
+}
+
+func createTestTopic(t *testing.T, broker string, topic string, partitions int) {
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		t.Fatalf("unable to connect to kafka: %v", err)
+	}
+
+	defer conn.Close()
+	leader, err := conn.Controller()
+	if err != nil {
+		t.Fatalf("unable to find the kafka controller: %v", err)
+	}
+
+	controller, err := kafka.Dial("tcp", net.JoinHostPort(leader.Host, strconv.Itoa(leader.Port)))
+	if err != nil {
+		t.Fatalf("unable to connect to the kafka controller: %v", err)
+	}
+
+	defer controller.Close()
+	err = controller.CreateTopics(kafka.TopicConfig{
+		Topic:             topic,
+		NumPartitions:     partitions,
+		ReplicationFactor: 1,
+	})
+
+	if err != nil {
+		t.Fatalf("unable to create topic %s: %v", topic, err)
+	}
+}
+
+// readTestTopic reads `count` messages from every partition of `topic`, in the order
+// of each partition.
+func readTestTopic(t *testing.T, broker string, topic string, partitions int, count int) []kafka.Message {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+
+	messages := make([]kafka.Message, 0, count)
+	for partition := 0; partition < partitions; partition++ {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   []string{broker},
+			Topic:     topic,
+			Partition: partition,
+		})
+
+		// Partitions without messages would block forever, so stop at the high watermark.
+		lag, err := reader.ReadLag(ctx)
+		if err != nil {
+			t.Fatalf("unable to read the lag of partition %d: %v", partition, err)
+		}
+
+		for i := int64(0); i < lag; i++ {
+			message, err := reader.ReadMessage(ctx)
+			if err != nil {
+				t.Fatalf("unable to read from partition %d: %v", partition, err)
+			}
+
+			messages = append(messages, message)
+		}
+
+		_ = reader.Close()
+	}
+
+	return messages
+}
+
+func header(message kafka.Message, key string) string {
+	for _, h := range message.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
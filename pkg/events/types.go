@@ -0,0 +1,99 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package events
+
+// Owner is who owns a project.
+type Owner struct {
+	// Type is `user` or `organization`.
+	Type string `json:"type"`
+
+	// ID is the ID of the user or organization.
+	ID string `json:"id"`
+}
+
+// UserCreated is published when a user registers, or logs in with an external
+// identity for the first time.
+type UserCreated struct {
+	Username string `json:"username"`
+	ID       string `json:"id"`
+}
+
+func (UserCreated) Type() string  { return "user.created" }
+func (UserCreated) Version() int  { return 1 }
+func (e UserCreated) Key() string { return e.ID }
+
+// UserDeleted is published when a queued account deletion was processed.
+type UserDeleted struct {
+	ID string `json:"id"`
+}
+
+func (UserDeleted) Type() string  { return "user.deleted" }
+func (UserDeleted) Version() int  { return 1 }
+func (e UserDeleted) Key() string { return e.ID }
+
+// ProjectCreated is published when a project is created.
+type ProjectCreated struct {
+	Owner Owner  `json:"owner"`
+	Name  string `json:"name"`
+	ID    string `json:"id"`
+}
+
+func (ProjectCreated) Type() string  { return "project.created" }
+func (ProjectCreated) Version() int  { return 1 }
+func (e ProjectCreated) Key() string { return e.ID }
+
+// ProjectTransferred is published when a project is given to another user or
+// organization, including when its owner's account is deleted.
+type ProjectTransferred struct {
+	From Owner  `json:"from"`
+	To   Owner  `json:"to"`
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+func (ProjectTransferred) Type() string  { return "project.transferred" }
+func (ProjectTransferred) Version() int  { return 1 }
+func (e ProjectTransferred) Key() string { return e.ID }
+
+// ProjectDeleted is published when a project is deleted.
+type ProjectDeleted struct {
+	ID string `json:"id"`
+}
+
+func (ProjectDeleted) Type() string  { return "project.deleted" }
+func (ProjectDeleted) Version() int  { return 1 }
+func (e ProjectDeleted) Key() string { return e.ID }
+
+// OrganizationCreated is published when an organization is created.
+type OrganizationCreated struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+func (OrganizationCreated) Type() string  { return "organization.created" }
+func (OrganizationCreated) Version() int  { return 1 }
+func (e OrganizationCreated) Key() string { return e.ID }
+
+// ExportCompleted is published when a user downloaded their data export.
+type ExportCompleted struct {
+	UserID string `json:"user_id"`
+	Files  int    `json:"files"`
+}
+
+func (ExportCompleted) Type() string  { return "export.completed" }
+func (ExportCompleted) Version() int  { return 1 }
+func (e ExportCompleted) Key() string { return e.UserID }
@@ -0,0 +1,513 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// List is a list of CIDRs that is stored in Redis.
+type List string
+
+const (
+	// Allow is the list of CIDRs that are exempt from ratelimits and bans.
+	Allow List = "allow"
+
+	// Block is the list of CIDRs that can't use the API at all.
+	Block List = "block"
+)
+
+// refreshInterval is how often the lists are reloaded from Redis, so changes
+// from other replicas are picked up.
+const refreshInterval = 10 * time.Second
+
+// InvalidListError is a error if a list other than Allow or Block was used.
+var InvalidListError = errors.New("firewall: list must be `allow` or `block`")
+
+// Config is the configuration for the firewall.
+//
+// Prefix: TSUBAKI_FIREWALL_*
+type Config struct {
+	// Allow is the list of CIDRs (or single IPs) that are exempt from ratelimits
+	// and bans, i.e, internal services.
+	//
+	// Default: [] | Variable: TSUBAKI_FIREWALL_ALLOW
+	Allow []string `yaml:"allow"`
+
+	// Block is the list of CIDRs (or single IPs) that can't use the API at all.
+	//
+	// Default: [] | Variable: TSUBAKI_FIREWALL_BLOCK
+	Block []string `yaml:"block"`
+
+	// Bans configures the automatic bans of IPs that keep hitting ratelimits.
+	Bans BanConfig `yaml:"bans"`
+}
+
+// BanConfig configures when IPs are banned automatically.
+type BanConfig struct {
+	// Threshold is how many ratelimited requests are allowed within Window
+	// before the IP is banned, a negative number disables automatic bans.
+	//
+	// Default: 10 | Variable: TSUBAKI_FIREWALL_BANS_THRESHOLD
+	Threshold int `yaml:"threshold"`
+
+	// Window is how long ratelimited requests are counted for.
+	//
+	// Default: 10m | Variable: TSUBAKI_FIREWALL_BANS_WINDOW
+	Window time.Duration `yaml:"window"`
+
+	// Durations is how long each ban lasts. The first ban uses the first duration, the second
+	// ban uses the second, and so on. Once the list runs out, the last duration is used.
+	//
+	// Default: [5m, 1h, 24h] | Variable: TSUBAKI_FIREWALL_BANS_DURATIONS
+	Durations []time.Duration `yaml:"durations"`
+
+	// Memory is how long an IP's previous bans are remembered for escalation.
+	//
+	// Default: 168h | Variable: TSUBAKI_FIREWALL_BANS_MEMORY
+	Memory time.Duration `yaml:"memory"`
+}
+
+// Ban is a temporary ban of an IP.
+type Ban struct {
+	// BannedUntil is when the ban is over.
+	BannedUntil time.Time `json:"banned_until"`
+
+	// Reason is why the IP was banned.
+	Reason string `json:"reason"`
+
+	// Level is how many times the IP has been banned.
+	Level int64 `json:"level"`
+
+	// IP is the banned IP.
+	IP string `json:"ip"`
+}
+
+// Firewall checks IPs against the allow and block lists and bans, which are
+// shared between replicas through Redis.
+type Firewall struct {
+	config *Config
+	redis  *redis.Client
+	mutex  sync.RWMutex
+	allow  []*net.IPNet
+	block  []*net.IPNet
+	cancel context.CancelFunc
+}
+
+// NewFirewall creates a new Firewall, replaces the lists from the last `config` in
+// Redis with the current ones and starts reloading them in the background. Entries
+// added at runtime are kept in their own lists, so they survive restarts.
+func NewFirewall(config *Config, redis *redis.Client) (*Firewall, error) {
+	c := Config{}
+	if config != nil {
+		c = *config
+	}
+
+	if c.Bans.Threshold == 0 {
+		c.Bans.Threshold = 10
+	}
+
+	if c.Bans.Window <= 0 {
+		c.Bans.Window = 10 * time.Minute
+	}
+
+	if len(c.Bans.Durations) == 0 {
+		c.Bans.Durations = []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+	}
+
+	if c.Bans.Memory <= 0 {
+		c.Bans.Memory = 7 * 24 * time.Hour
+	}
+
+	f := &Firewall{config: &c, redis: redis}
+	if err := f.replaceConfigLists(context.TODO()); err != nil {
+		return nil, err
+	}
+
+	if err := f.reload(context.TODO()); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+
+	go f.refresh(ctx)
+	return f, nil
+}
+
+// Close stops reloading the lists.
+func (f *Firewall) Close() {
+	f.cancel()
+}
+
+// Allowed returns if the IP is in the allow list.
+func (f *Firewall) Allowed(ip string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return contains(f.allow, net.ParseIP(ip))
+}
+
+// Blocked returns if the IP is in the block list.
+func (f *Firewall) Blocked(ip string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return contains(f.block, net.ParseIP(ip))
+}
+
+// Lists returns the CIDRs that were added to the allow and block lists at runtime.
+func (f *Firewall) Lists(ctx context.Context) (map[List][]string, error) {
+	return f.members(ctx, listKey)
+}
+
+// ConfigLists returns the CIDRs in the allow and block lists from the configuration,
+// which can only be removed by changing it.
+func (f *Firewall) ConfigLists(ctx context.Context) (map[List][]string, error) {
+	return f.members(ctx, configListKey)
+}
+
+func (f *Firewall) members(ctx context.Context, key func(List) string) (map[List][]string, error) {
+	lists := make(map[List][]string)
+	for _, list := range []List{Allow, Block} {
+		members, err := f.redis.SMembers(ctx, key(list)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		lists[list] = members
+	}
+
+	return lists, nil
+}
+
+// replaceConfigLists replaces the configuration's lists in Redis, so entries that were
+// removed from it are removed from the firewall too. Older versions added them to the
+// runtime lists, so they are removed from those.
+func (f *Firewall) replaceConfigLists(ctx context.Context) error {
+	pipe := f.redis.TxPipeline()
+	for list, cidrs := range map[List][]string{Allow: f.config.Allow, Block: f.config.Block} {
+		members := make([]interface{}, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			network, err := ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("firewall: invalid %s entry %q: %v", list, cidr, err)
+			}
+
+			members = append(members, network.String())
+		}
+
+		pipe.Del(ctx, configListKey(list))
+		if len(members) > 0 {
+			pipe.SAdd(ctx, configListKey(list), members...)
+			pipe.SRem(ctx, listKey(list), members...)
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Add adds a CIDR (or a single IP) to a list.
+func (f *Firewall) Add(ctx context.Context, list List, cidr string) error {
+	if list != Allow && list != Block {
+		return InvalidListError
+	}
+
+	network, err := ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	if err := f.redis.SAdd(ctx, listKey(list), network.String()).Err(); err != nil {
+		return err
+	}
+
+	return f.reload(ctx)
+}
+
+// Remove removes a CIDR (or a single IP) from a list, it returns false if
+// it wasn't in the list.
+func (f *Firewall) Remove(ctx context.Context, list List, cidr string) (bool, error) {
+	if list != Allow && list != Block {
+		return false, InvalidListError
+	}
+
+	network, err := ParseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := f.redis.SRem(ctx, listKey(list), network.String()).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return removed > 0, f.reload(ctx)
+}
+
+// Banned returns the IP's ban, or nil if it isn't banned.
+func (f *Firewall) Banned(ctx context.Context, ip string) (*Ban, error) {
+	raw, err := f.redis.Get(ctx, banKey(ip)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var ban Ban
+	if err := json.Unmarshal([]byte(raw), &ban); err != nil {
+		return nil, err
+	}
+
+	return &ban, nil
+}
+
+// Bans returns every active ban.
+func (f *Firewall) Bans(ctx context.Context) ([]Ban, error) {
+	bans := make([]Ban, 0)
+	iter := f.redis.Scan(ctx, 0, "tsubaki:firewall:bans:*", 100).Iterator()
+
+	for iter.Next(ctx) {
+		raw, err := f.redis.Get(ctx, iter.Val()).Result()
+		if err != nil {
+			// the ban expired between SCAN and GET
+			if err == redis.Nil {
+				continue
+			}
+
+			return nil, err
+		}
+
+		var ban Ban
+		if err := json.Unmarshal([]byte(raw), &ban); err != nil {
+			logrus.Warnf("Unable to unmarshal ban %s: %v", iter.Val(), err)
+			continue
+		}
+
+		bans = append(bans, ban)
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return bans, nil
+}
+
+// Ban bans the IP for `duration`.
+func (f *Firewall) Ban(ctx context.Context, ip string, duration time.Duration, reason string) (*Ban, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("firewall: %q is not a valid IP", ip)
+	}
+
+	level, err := f.redis.Incr(ctx, levelKey(parsed.String())).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ban := &Ban{
+		BannedUntil: time.Now().Add(duration),
+		Reason:      reason,
+		Level:       level,
+		IP:          parsed.String(),
+	}
+
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := f.redis.TxPipeline()
+	pipe.Expire(ctx, levelKey(ban.IP), f.config.Bans.Memory)
+	pipe.Set(ctx, banKey(ban.IP), string(data), duration)
+	pipe.Del(ctx, violationsKey(ban.IP))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	logrus.Warnf("Banned IP %s for %s: %s", ban.IP, duration.String(), reason)
+	return ban, nil
+}
+
+// Unban lifts the IP's ban and forgets its previous bans, it returns false
+// if the IP wasn't banned.
+func (f *Firewall) Unban(ctx context.Context, ip string) (bool, error) {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	deleted, err := f.redis.Del(ctx, banKey(ip), levelKey(ip), violationsKey(ip)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+// Violation records that the IP was ratelimited, and bans it if it went over the
+// threshold. Each ban of the same IP lasts longer, following `bans.durations`.
+func (f *Firewall) Violation(ctx context.Context, ip string) error {
+	bans := f.config.Bans
+	if bans.Threshold <= 0 || f.Allowed(ip) {
+		return nil
+	}
+
+	pipe := f.redis.TxPipeline()
+	incr := pipe.Incr(ctx, violationsKey(ip))
+	pipe.Expire(ctx, violationsKey(ip), bans.Window)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	if incr.Val() < int64(bans.Threshold) {
+		return nil
+	}
+
+	level, err := f.redis.Get(ctx, levelKey(ip)).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	duration := bans.Durations[len(bans.Durations)-1]
+	if int(level) < len(bans.Durations) {
+		duration = bans.Durations[level]
+	}
+
+	_, err = f.Ban(ctx, ip, duration, fmt.Sprintf("Ratelimited %d times within %s", incr.Val(), bans.Window.String()))
+	return err
+}
+
+func (f *Firewall) refresh(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := f.reload(ctx); err != nil && ctx.Err() == nil {
+				logrus.Errorf("Unable to reload firewall lists: %v", err)
+			}
+		}
+	}
+}
+
+func (f *Firewall) reload(ctx context.Context) error {
+	lists, err := f.Lists(ctx)
+	if err != nil {
+		return err
+	}
+
+	configLists, err := f.ConfigLists(ctx)
+	if err != nil {
+		return err
+	}
+
+	networks := make(map[List][]*net.IPNet)
+	for _, l := range []map[List][]string{configLists, lists} {
+		for list, cidrs := range l {
+			for _, cidr := range cidrs {
+				network, err := ParseCIDR(cidr)
+				if err != nil {
+					logrus.Warnf("Skipping invalid %s entry %q: %v", list, cidr, err)
+					continue
+				}
+
+				networks[list] = append(networks[list], network)
+			}
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.allow = networks[Allow]
+	f.block = networks[Block]
+	return nil
+}
+
+// ParseCIDR parses a CIDR, or a single IP as a /32 or /128.
+func ParseCIDR(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a valid IP or CIDR", cidr)
+		}
+
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func listKey(list List) string {
+	return "tsubaki:firewall:" + string(list)
+}
+
+func configListKey(list List) string {
+	return "tsubaki:firewall:config:" + string(list)
+}
+
+func banKey(ip string) string {
+	return "tsubaki:firewall:bans:" + ip
+}
+
+func levelKey(ip string) string {
+	return "tsubaki:firewall:ban_level:" + ip
+}
+
+func violationsKey(ip string) string {
+	return "tsubaki:firewall:violations:" + ip
+}
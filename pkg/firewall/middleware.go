@@ -0,0 +1,103 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"arisu.land/tsubaki/internal"
+	"arisu.land/tsubaki/pkg/clientip"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// exemptKey is the key that is set in the request context if the client IP is
+// in the allow list.
+type exemptKey struct{}
+
+type rejectedResponse struct {
+	Message    string `json:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+}
+
+// Middleware rejects requests from blocked or banned IPs, and counts ratelimited
+// responses towards a ban. IPs in the allow list are let through and marked as
+// exempt, so the ratelimiter can skip them with Exempt.
+func (f *Firewall) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := clientip.FromRequest(req)
+		if f.Allowed(ip) {
+			ctx := context.WithValue(req.Context(), exemptKey{}, true)
+			next.ServeHTTP(w, req.WithContext(ctx))
+			return
+		}
+
+		if f.Blocked(ip) {
+			internal.FirewallRejectionsMetric.WithLabelValues("blocked").Inc()
+			reject(w, &rejectedResponse{Message: "Your network has been blocked from using this instance."})
+			return
+		}
+
+		ban, err := f.Banned(req.Context(), ip)
+
+		// Like the ratelimiter, don't take the whole API down if Redis is unavailable.
+		if err != nil {
+			logrus.Errorf("Unable to check if %s is banned: %v", ip, err)
+		}
+
+		if ban != nil {
+			// Retry-After is in whole seconds, so round up to not retry too early.
+			retryAfter := int64(math.Ceil(time.Until(ban.BannedUntil).Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+
+			internal.FirewallRejectionsMetric.WithLabelValues("banned").Inc()
+			reject(w, &rejectedResponse{
+				Message:    "You have been temporarily banned, try again later.",
+				RetryAfter: retryAfter,
+			})
+
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+		next.ServeHTTP(ww, req)
+
+		if ww.Status() == http.StatusTooManyRequests {
+			if err := f.Violation(req.Context(), ip); err != nil {
+				logrus.Errorf("Unable to record ratelimit violation for %s: %v", ip, err)
+			}
+		}
+	})
+}
+
+// Exempt returns if the request came from an IP in the allow list, this is only
+// set if Firewall.Middleware was used.
+func Exempt(req *http.Request) bool {
+	exempt, ok := req.Context().Value(exemptKey{}).(bool)
+	return ok && exempt
+}
+
+func reject(w http.ResponseWriter, res *rejectedResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,251 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package flags
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// UserFlags is the bitfield that is stored in User.Flags.
+type UserFlags int
+
+// ProjectFlags is the bitfield that is stored in Project.Flags.
+type ProjectFlags int
+
+const (
+	// Admin marks the user as an administrator of this instance.
+	Admin UserFlags = 1 << 0
+
+	// VerifiedEmail marks the user's email address as verified.
+	VerifiedEmail UserFlags = 1 << 1
+
+	// Invite allows a user that isn't an administrator to create invites.
+	Invite UserFlags = 1 << 2
+
+	// TwoFactor marks that the user has two-factor authentication enabled.
+	TwoFactor UserFlags = 1 << 3
+
+	// Staff marks the user as a member of the team running this instance.
+	Staff UserFlags = 1 << 4
+
+	// Bot marks the account as a bot account.
+	Bot UserFlags = 1 << 5
+)
+
+const (
+	// Private hides the project from everyone but its owner and members.
+	Private ProjectFlags = 1 << 0
+
+	// Archived makes the project read-only, it can be unarchived by its owner.
+	Archived ProjectFlags = 1 << 1
+
+	// Locked makes the project read-only, only administrators can unlock it.
+	Locked ProjectFlags = 1 << 2
+)
+
+var userFlagNames = map[string]int{
+	"admin":          int(Admin),
+	"verified_email": int(VerifiedEmail),
+	"invite":         int(Invite),
+	"two_factor":     int(TwoFactor),
+	"staff":          int(Staff),
+	"bot":            int(Bot),
+}
+
+var projectFlagNames = map[string]int{
+	"private":  int(Private),
+	"archived": int(Archived),
+	"locked":   int(Locked),
+}
+
+// Has returns if every bit in `flag` is set.
+func (f UserFlags) Has(flag UserFlags) bool {
+	return f&flag == flag
+}
+
+// HasAny returns if any bit in `flag` is set.
+func (f UserFlags) HasAny(flag UserFlags) bool {
+	return f&flag != 0
+}
+
+// Add returns the flags with the bits in `flags` set.
+func (f UserFlags) Add(flags ...UserFlags) UserFlags {
+	for _, flag := range flags {
+		f |= flag
+	}
+
+	return f
+}
+
+// Remove returns the flags with the bits in `flags` cleared.
+func (f UserFlags) Remove(flags ...UserFlags) UserFlags {
+	for _, flag := range flags {
+		f &^= flag
+	}
+
+	return f
+}
+
+// Toggle returns the flags with `flag` set if `enabled` is true, or cleared if it's false.
+func (f UserFlags) Toggle(flag UserFlags, enabled bool) UserFlags {
+	if enabled {
+		return f.Add(flag)
+	}
+
+	return f.Remove(flag)
+}
+
+// Names returns the names of the bits that are set, i.e, `["admin", "verified_email"]`.
+func (f UserFlags) Names() []string {
+	return names(int(f), userFlagNames)
+}
+
+// MarshalJSON serializes the flags as a list of names.
+func (f UserFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.Names())
+}
+
+// UnmarshalJSON deserializes the flags from a list of names, or the raw bitfield.
+func (f *UserFlags) UnmarshalJSON(data []byte) error {
+	value, err := unmarshal(data, userFlagNames)
+	if err != nil {
+		return err
+	}
+
+	*f = UserFlags(value)
+	return nil
+}
+
+// ParseUserFlags returns the flags from a list of names.
+func ParseUserFlags(list []string) (UserFlags, error) {
+	value, err := parse(list, userFlagNames)
+	return UserFlags(value), err
+}
+
+// Has returns if every bit in `flag` is set.
+func (f ProjectFlags) Has(flag ProjectFlags) bool {
+	return f&flag == flag
+}
+
+// HasAny returns if any bit in `flag` is set.
+func (f ProjectFlags) HasAny(flag ProjectFlags) bool {
+	return f&flag != 0
+}
+
+// Add returns the flags with the bits in `flags` set.
+func (f ProjectFlags) Add(flags ...ProjectFlags) ProjectFlags {
+	for _, flag := range flags {
+		f |= flag
+	}
+
+	return f
+}
+
+// Remove returns the flags with the bits in `flags` cleared.
+func (f ProjectFlags) Remove(flags ...ProjectFlags) ProjectFlags {
+	for _, flag := range flags {
+		f &^= flag
+	}
+
+	return f
+}
+
+// Toggle returns the flags with `flag` set if `enabled` is true, or cleared if it's false.
+func (f ProjectFlags) Toggle(flag ProjectFlags, enabled bool) ProjectFlags {
+	if enabled {
+		return f.Add(flag)
+	}
+
+	return f.Remove(flag)
+}
+
+// Names returns the names of the bits that are set, i.e, `["private"]`.
+func (f ProjectFlags) Names() []string {
+	return names(int(f), projectFlagNames)
+}
+
+// MarshalJSON serializes the flags as a list of names.
+func (f ProjectFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.Names())
+}
+
+// UnmarshalJSON deserializes the flags from a list of names, or the raw bitfield.
+func (f *ProjectFlags) UnmarshalJSON(data []byte) error {
+	value, err := unmarshal(data, projectFlagNames)
+	if err != nil {
+		return err
+	}
+
+	*f = ProjectFlags(value)
+	return nil
+}
+
+// ParseProjectFlags returns the flags from a list of names.
+func ParseProjectFlags(list []string) (ProjectFlags, error) {
+	value, err := parse(list, projectFlagNames)
+	return ProjectFlags(value), err
+}
+
+// names returns the names of the bits in `value`, ordered by bit. Unknown bits are left out.
+func names(value int, table map[string]int) []string {
+	list := make([]string, 0, len(table))
+	for name, bit := range table {
+		if value&bit == bit {
+			list = append(list, name)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return table[list[i]] < table[list[j]]
+	})
+
+	return list
+}
+
+func parse(list []string, table map[string]int) (int, error) {
+	value := 0
+	for _, name := range list {
+		bit, ok := table[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown flag %q", name)
+		}
+
+		value |= bit
+	}
+
+	return value, nil
+}
+
+func unmarshal(data []byte, table map[string]int) (int, error) {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		return parse(list, table)
+	}
+
+	var value int
+	if err := json.Unmarshal(data, &value); err != nil {
+		return 0, fmt.Errorf("flags must be a list of names or a number")
+	}
+
+	if value < 0 {
+		return 0, fmt.Errorf("flags must be a positive number")
+	}
+
+	return value, nil
+}
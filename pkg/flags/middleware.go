@@ -0,0 +1,62 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package flags
+
+import (
+	"context"
+	"net/http"
+
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/util"
+)
+
+// contextKey is the key the user's flags are stored under in the request context.
+type contextKey struct{}
+
+// NewContext returns a copy of `ctx` with the flags of the logged in user, which
+// is done by the session middleware.
+func NewContext(ctx context.Context, f UserFlags) context.Context {
+	return context.WithValue(ctx, contextKey{}, f)
+}
+
+// FromRequest returns the flags of the logged in user, and false if the request
+// isn't authenticated.
+func FromRequest(req *http.Request) (UserFlags, bool) {
+	f, ok := req.Context().Value(contextKey{}).(UserFlags)
+	return f, ok
+}
+
+// RequireFlag is a middleware that only lets users with every bit in `flag` through,
+// i.e, `r.Use(flags.RequireFlag(flags.Admin))`.
+func RequireFlag(flag UserFlags) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			f, ok := FromRequest(req)
+			if !ok {
+				util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+				return
+			}
+
+			if !f.Has(flag) {
+				util.WriteJson(w, 403, result.Err(403, "MISSING_PERMISSIONS", "You don't have permission to do this."))
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
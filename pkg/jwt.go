@@ -20,12 +20,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
+	"time"
 )
 
-// NewToken creates a new JWT token with the user's ID as the mapped claims.
-func NewToken(uid string) (string, error) {
+// NewToken creates a new JWT token with the user's ID and token version as the mapped claims,
+// the token stops working once the user's token version is bumped.
+func NewToken(uid string, version int) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"user_id": uid,
+		"token_version": version,
+		"user_id":       uid,
+		"iat":           time.Now().Unix(),
 	})
 
 	signed, err := token.SignedString([]byte(GlobalContainer.Config.SecretKeyBase))
@@ -36,6 +40,19 @@ func NewToken(uid string) (string, error) {
 	return signed, nil
 }
 
+// NewImpersonationToken creates a new JWT token that lets an administrator (`impersonatorID`)
+// act as the user for support, it expires after `expiresIn`.
+func NewImpersonationToken(uid string, version int, impersonatorID string, expiresIn time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
+		"impersonator_id": impersonatorID,
+		"token_version":   version,
+		"user_id":         uid,
+		"exp":             time.Now().Add(expiresIn).Unix(),
+	})
+
+	return token.SignedString([]byte(GlobalContainer.Config.SecretKeyBase))
+}
+
 func ValidateToken(token string) (bool, error) {
 	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -56,6 +73,28 @@ func ValidateToken(token string) (bool, error) {
 	return false, errors.New("unknown error has occurred")
 }
 
+// TokenVersion returns the `token_version` claim of decoded token claims, tokens
+// that were created before the claim existed are treated as version 0.
+func TokenVersion(claims jwt.MapClaims) int {
+	version, ok := claims["token_version"].(float64)
+	if !ok {
+		return 0
+	}
+
+	return int(version)
+}
+
+// IssuedAt returns when the token of the decoded claims was created, or the zero
+// time if it doesn't say, like impersonation tokens.
+func IssuedAt(claims jwt.MapClaims) time.Time {
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(iat), 0)
+}
+
 func DecodeToken(token string) (jwt.MapClaims, error) {
 	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -0,0 +1,240 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lockout
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/internal"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Kind is what a lockout applies to.
+type Kind string
+
+const (
+	// Account is a lockout for a username or email address.
+	Account Kind = "account"
+
+	// IP is a lockout for the IP address the logins came from.
+	IP Kind = "ip"
+)
+
+// failureWindow is how long failed attempts are remembered after the last
+// failure, so the backoff keeps growing while an attack is ongoing.
+const failureWindow = 24 * time.Hour
+
+// policy is when a Kind gets locked, and for how long.
+type policy struct {
+	// threshold is how many failed attempts are allowed before locking.
+	threshold int64
+
+	// base is how long the first lockout lasts, it doubles every failure after.
+	base time.Duration
+
+	// max is the longest a lockout can last.
+	max time.Duration
+}
+
+// IPs get a higher threshold, since a lot of users can share one
+// IP (i.e, behind a NAT).
+var policies = map[Kind]policy{
+	Account: {threshold: 5, base: 30 * time.Second, max: time.Hour},
+	IP:      {threshold: 20, base: 30 * time.Second, max: time.Hour},
+}
+
+// Lockout is a temporary lockout of an account or an IP.
+type Lockout struct {
+	// LockedUntil is when the lockout is over.
+	LockedUntil time.Time `json:"locked_until"`
+
+	// Failures is how many failed attempts caused this lockout.
+	Failures int64 `json:"failures"`
+
+	// Kind is what is locked.
+	Kind Kind `json:"kind"`
+
+	// Key is the username, email address or IP that is locked.
+	Key string `json:"key"`
+}
+
+// RetryAfter returns how long until the lockout is over.
+func (l *Lockout) RetryAfter() time.Duration {
+	return time.Until(l.LockedUntil).Round(time.Second)
+}
+
+// Manager keeps track of failed logins in Redis and locks accounts and IPs
+// with exponential backoff.
+type Manager struct {
+	redis *redis.Client
+}
+
+// NewManager creates a new Manager.
+func NewManager(redis *redis.Client) *Manager {
+	return &Manager{redis: redis}
+}
+
+// Check returns the lockout that is blocking a login of `account` from `ip`, or
+// nil if neither is locked. If both are locked, the longest lockout is returned.
+func (m *Manager) Check(ctx context.Context, account string, ip string) (*Lockout, error) {
+	values, err := m.redis.MGet(ctx, lockedKey(Account, normalize(account)), lockedKey(IP, ip)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var longest *Lockout
+	for _, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var lockout Lockout
+		if err := json.Unmarshal([]byte(raw), &lockout); err != nil {
+			logrus.Warnf("Unable to unmarshal lockout: %v", err)
+			continue
+		}
+
+		if longest == nil || lockout.LockedUntil.After(longest.LockedUntil) {
+			longest = &lockout
+		}
+	}
+
+	return longest, nil
+}
+
+// Fail records a failed login of `account` from `ip`, and locks them if they went
+// over their threshold.
+func (m *Manager) Fail(ctx context.Context, account string, ip string) error {
+	internal.LoginFailuresMetric.WithLabelValues("invalid_credentials").Inc()
+
+	if err := m.fail(ctx, Account, normalize(account)); err != nil {
+		return err
+	}
+
+	return m.fail(ctx, IP, ip)
+}
+
+// Succeed forgets the failed logins of `account`. The IP's failures are kept, so
+// logging into one account can't be used to keep guessing the passwords of others.
+func (m *Manager) Succeed(ctx context.Context, account string) error {
+	return m.redis.Del(ctx, failuresKey(Account, normalize(account))).Err()
+}
+
+// List returns every active lockout.
+func (m *Manager) List(ctx context.Context) ([]Lockout, error) {
+	lockouts := make([]Lockout, 0)
+	iter := m.redis.Scan(ctx, 0, "tsubaki:lockout:*:locked:*", 100).Iterator()
+
+	for iter.Next(ctx) {
+		raw, err := m.redis.Get(ctx, iter.Val()).Result()
+		if err != nil {
+			// the lockout expired between SCAN and GET
+			if err == redis.Nil {
+				continue
+			}
+
+			return nil, err
+		}
+
+		var lockout Lockout
+		if err := json.Unmarshal([]byte(raw), &lockout); err != nil {
+			logrus.Warnf("Unable to unmarshal lockout %s: %v", iter.Val(), err)
+			continue
+		}
+
+		lockouts = append(lockouts, lockout)
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return lockouts, nil
+}
+
+// Clear removes the lockout and failed logins of `key`, it returns false
+// if there was nothing to clear.
+func (m *Manager) Clear(ctx context.Context, kind Kind, key string) (bool, error) {
+	if kind == Account {
+		key = normalize(key)
+	}
+
+	deleted, err := m.redis.Del(ctx, lockedKey(kind, key), failuresKey(kind, key)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+func (m *Manager) fail(ctx context.Context, kind Kind, key string) error {
+	pipe := m.redis.TxPipeline()
+	incr := pipe.Incr(ctx, failuresKey(kind, key))
+	pipe.Expire(ctx, failuresKey(kind, key), failureWindow)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	p := policies[kind]
+	failures := incr.Val()
+	if failures < p.threshold {
+		return nil
+	}
+
+	// the exponent is capped, so the shift can't overflow
+	duration := p.max
+	if exponent := failures - p.threshold; exponent < 16 {
+		if backoff := p.base << exponent; backoff < p.max {
+			duration = backoff
+		}
+	}
+
+	data, err := json.Marshal(&Lockout{
+		LockedUntil: time.Now().Add(duration),
+		Failures:    failures,
+		Kind:        kind,
+		Key:         key,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	logrus.Warnf("Locking %s %s for %s after %d failed logins.", kind, key, duration.String(), failures)
+	internal.LockoutsMetric.WithLabelValues(string(kind)).Inc()
+
+	return m.redis.Set(ctx, lockedKey(kind, key), string(data), duration).Err()
+}
+
+// normalize makes `Noel` and `noel` the same account.
+func normalize(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+func failuresKey(kind Kind, key string) string {
+	return "tsubaki:lockout:" + string(kind) + ":failures:" + key
+}
+
+func lockedKey(kind Kind, key string) string {
+	return "tsubaki:lockout:" + string(kind) + ":locked:" + key
+}
@@ -0,0 +1,324 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"arisu.land/tsubaki/util"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed templates
+var templates embed.FS
+
+const (
+	// PasswordResetTemplate is the template that is sent when a user
+	// requests to reset their password.
+	PasswordResetTemplate = "password_reset"
+
+	// VerifyEmailTemplate is the template that is sent when a user registers,
+	// so they can verify their email address.
+	VerifyEmailTemplate = "verify_email"
+
+	// InviteTemplate is the template that is sent when an invite is bound
+	// to an email address.
+	InviteTemplate = "invite"
+)
+
+const (
+	queueKey = "tsubaki:mailer:queue"
+	retryKey = "tsubaki:mailer:retry"
+	deadKey  = "tsubaki:mailer:dead"
+
+	// deadLetterLimit is how many failed messages are kept in the dead-letter list.
+	deadLetterLimit = 1000
+)
+
+// Config is the configuration for sending emails over SMTP, like password
+// resets and email verification.
+//
+// Prefix: TSUBAKI_MAILER_*
+type Config struct {
+	// Host is the host of the SMTP server.
+	//
+	// Variable: TSUBAKI_MAILER_HOST
+	Host string `yaml:"host"`
+
+	// Port is the port of the SMTP server.
+	//
+	// Default: 587 | Variable: TSUBAKI_MAILER_PORT
+	Port int `yaml:"port"`
+
+	// Username is the username to authenticate with, authentication is skipped
+	// if this is nil.
+	//
+	// Default: nil | Variable: TSUBAKI_MAILER_USERNAME
+	Username *string `yaml:"username,omitempty"`
+
+	// Password is the password to authenticate with.
+	//
+	// Default: nil | Variable: TSUBAKI_MAILER_PASSWORD
+	Password *string `yaml:"password,omitempty"`
+
+	// From is the address emails are sent from, i.e, `Arisu <noreply@arisu.land>`.
+	//
+	// Variable: TSUBAKI_MAILER_FROM
+	From string `yaml:"from"`
+
+	// TLS connects to the SMTP server with implicit TLS (usually port 465). If this
+	// is false, the connection is still upgraded with STARTTLS if the server supports it.
+	//
+	// Default: false | Variable: TSUBAKI_MAILER_TLS
+	TLS bool `yaml:"tls"`
+
+	// BaseURL is the URL of Fubuki, which is used to build the links in emails.
+	//
+	// Variable: TSUBAKI_MAILER_BASE_URL
+	BaseURL string `yaml:"base_url"`
+
+	// MaxAttempts is how many times a message is tried before it is moved
+	// to the dead-letter list.
+	//
+	// Default: 5 | Variable: TSUBAKI_MAILER_MAX_ATTEMPTS
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// Message is a rendered email that is stored in the send queue.
+type Message struct {
+	// ID is a random ID, so identical messages are still unique in the retry set.
+	ID string `json:"id"`
+
+	// To is the recipient's email address.
+	To string `json:"to"`
+
+	// Subject is the subject line of the email.
+	Subject string `json:"subject"`
+
+	// Text is the plain-text body of the email.
+	Text string `json:"text"`
+
+	// HTML is the HTML body of the email.
+	HTML string `json:"html"`
+
+	// Attempts is how many times sending this message has failed.
+	Attempts int `json:"attempts"`
+}
+
+// Mailer renders emails and sends them from a Redis-backed queue, so requests
+// don't have to wait on the SMTP server.
+type Mailer struct {
+	config *Config
+	redis  *redis.Client
+	html   *htmltemplate.Template
+	text   *texttemplate.Template
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewMailer parses the email templates and creates a new Mailer. The queue isn't
+// processed until Mailer.Start is called.
+func NewMailer(config *Config, redis *redis.Client) (*Mailer, error) {
+	c := *config
+	if c.Port == 0 {
+		c.Port = 587
+	}
+
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+
+	if c.From == "" {
+		return nil, errors.New("config option 'mailer.from' needs to be defined to send emails")
+	}
+
+	html, err := htmltemplate.ParseFS(templates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := texttemplate.ParseFS(templates, "templates/*.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mailer{
+		config: &c,
+		redis:  redis,
+		html:   html,
+		text:   text,
+	}, nil
+}
+
+// Link returns the absolute URL to `path` in Fubuki.
+func (m *Mailer) Link(path string) string {
+	return strings.TrimSuffix(m.config.BaseURL, "/") + path
+}
+
+// Send renders the `template` with `data` and pushes it onto the send queue.
+func (m *Mailer) Send(ctx context.Context, to string, subject string, template string, data map[string]interface{}) error {
+	var html bytes.Buffer
+	if err := m.html.ExecuteTemplate(&html, template+".html", data); err != nil {
+		return err
+	}
+
+	var text bytes.Buffer
+	if err := m.text.ExecuteTemplate(&text, template+".txt", data); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(&Message{
+		ID:      util.GenerateHash(8),
+		To:      to,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return m.redis.LPush(ctx, queueKey, string(raw)).Err()
+}
+
+// Start starts processing the send queue in the background.
+func (m *Mailer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+
+	logrus.Debug("Started processing the mailer queue!")
+	go m.process(ctx)
+}
+
+// Close stops processing the send queue and waits for the current message to finish.
+func (m *Mailer) Close() {
+	if m.cancel == nil {
+		return
+	}
+
+	m.cancel()
+	<-m.done
+}
+
+func (m *Mailer) process(ctx context.Context) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			m.requeueRetries(ctx)
+
+		default:
+		}
+
+		res, err := m.redis.BRPop(ctx, 5*time.Second, queueKey).Result()
+		if err != nil {
+			if err != redis.Nil && ctx.Err() == nil {
+				logrus.Errorf("Unable to pop message from the mailer queue: %v", err)
+				time.Sleep(time.Second)
+			}
+
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal([]byte(res[1]), &msg); err != nil {
+			logrus.Errorf("Unable to unmarshal message from the mailer queue, dropping it: %v", err)
+			continue
+		}
+
+		if err := m.deliver(&msg); err != nil {
+			m.fail(ctx, &msg, err)
+			continue
+		}
+
+		logrus.Debugf("Sent email %s to %s!", msg.ID, msg.To)
+	}
+}
+
+// fail schedules a retry with exponential backoff, or moves the message to
+// the dead-letter list if it ran out of attempts.
+func (m *Mailer) fail(ctx context.Context, msg *Message, err error) {
+	msg.Attempts++
+
+	raw, _ := json.Marshal(msg)
+	if msg.Attempts >= m.config.MaxAttempts {
+		logrus.Errorf("Unable to send email %s to %s after %d attempts, moving it to the dead-letter list: %v", msg.ID, msg.To, msg.Attempts, err)
+
+		pipe := m.redis.TxPipeline()
+		pipe.LPush(ctx, deadKey, string(raw))
+		pipe.LTrim(ctx, deadKey, 0, deadLetterLimit-1)
+		if _, err := pipe.Exec(ctx); err != nil {
+			logrus.Errorf("Unable to push email %s to the dead-letter list: %v", msg.ID, err)
+		}
+
+		return
+	}
+
+	backoff := time.Duration(1<<msg.Attempts) * 30 * time.Second
+	logrus.Warnf("Unable to send email %s to %s, retrying in %s: %v", msg.ID, msg.To, backoff.String(), err)
+
+	if err := m.redis.ZAdd(ctx, retryKey, &redis.Z{
+		Score:  float64(time.Now().Add(backoff).Unix()),
+		Member: string(raw),
+	}).Err(); err != nil {
+		logrus.Errorf("Unable to schedule retry for email %s: %v", msg.ID, err)
+	}
+}
+
+// requeueRetries moves the messages that are due for a retry back onto the send queue.
+func (m *Mailer) requeueRetries(ctx context.Context) {
+	due, err := m.redis.ZRangeByScore(ctx, retryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+
+	if err != nil {
+		logrus.Errorf("Unable to fetch emails to retry: %v", err)
+		return
+	}
+
+	for _, raw := range due {
+		// ZREM claims the message, so only one instance re-queues it.
+		removed, err := m.redis.ZRem(ctx, retryKey, raw).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+
+		if err := m.redis.LPush(ctx, queueKey, raw).Err(); err != nil {
+			logrus.Errorf("Unable to re-queue email: %v", err)
+		}
+	}
+}
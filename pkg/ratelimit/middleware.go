@@ -19,63 +19,53 @@ package ratelimit
 import (
 	"encoding/json"
 	"fmt"
-	"net"
+	"math"
 	"net/http"
 	"strconv"
-	"strings"
-	"time"
-)
 
-// https://github.com/go-chi/httprate/blob/master/httprate.go#L25-L47
+	"arisu.land/tsubaki/pkg/firewall"
+	"github.com/sirupsen/logrus"
+)
 
-func RealIP(req *http.Request) string {
-	var ip string
-	if tcip := req.Header.Get("True-Client-IP"); tcip != "" {
-		ip = tcip
-	} else if xrip := req.Header.Get("X-Real-IP"); xrip != "" {
-		ip = xrip
-	} else if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
-		idx := strings.Index(xff, ", ")
-		if idx == -1 {
-			idx = len(xff)
+func (rl Ratelimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Internal services in the firewall's allow list aren't ratelimited.
+		if firewall.Exempt(req) {
+			next.ServeHTTP(w, req)
+			return
 		}
 
-		// python moment
-		ip = xff[:idx]
-	} else {
-		var err error
+		b := rl.config.bucketFor(req)
+		key := b.keyFor(req)
+		limit, err := rl.Take(req.Context(), key, b.limit, b.window, b.cost)
 
-		ip, _, err = net.SplitHostPort(req.RemoteAddr)
+		// Don't take the whole API down if Redis is unavailable.
 		if err != nil {
-			ip = req.RemoteAddr
+			logrus.Errorf("Unable to take ratelimit for %s: %v", key, err)
+			next.ServeHTTP(w, req)
+			return
 		}
-	}
-
-	return ip
-}
 
-func (rl Ratelimiter) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		limit := rl.Get(RealIP(req))
 		headers := w.Header()
+		headers.Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+		headers.Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+		headers.Set("X-RateLimit-Reset", strconv.FormatInt(limit.ResetTime.Unix()*1000, 10))
 
 		if limit.Exceeded() {
-			retry := strconv.FormatInt(time.Now().Sub(limit.ResetTime).Milliseconds(), 10)
-			headers.Set("Retry-After", retry)
+			// Retry-After is in whole seconds, so round up to not retry too early.
+			retryAfter := int64(math.Ceil(limit.RetryAfter.Seconds()))
+			headers.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			headers.Set("Content-Type", "application/json; charset=utf-8")
 
 			w.WriteHeader(429)
 			_ = json.NewEncoder(w).Encode(&ratelimitedResponse{
-				Message:    fmt.Sprintf("Current IP %s has exceeded all ratelimits, try again later >:3", req.RemoteAddr),
-				RetryAfter: time.Now().Sub(limit.ResetTime).Milliseconds() / 1000,
+				Message:    fmt.Sprintf("You have exceeded the %s ratelimit, try again later >:3", b.name),
+				RetryAfter: retryAfter,
 			})
 
 			return
 		}
 
-		headers.Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
-		headers.Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
-		headers.Set("X-RateLimit-Reset", strconv.FormatInt(limit.ResetTime.Unix()*1000, 10))
-
 		next.ServeHTTP(w, req)
 	})
 }
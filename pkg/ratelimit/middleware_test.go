@@ -0,0 +1,168 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBolt(t *testing.T, path string) *bolt.DB {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("unable to open boltdb: %v", err)
+	}
+
+	return db
+}
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	db := openTestBolt(t, filepath.Join(t.TempDir(), "tsubaki.db"))
+	store, err := NewBoltStore(db)
+	if err != nil {
+		t.Fatalf("unable to create bolt store: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = store.Close()
+		_ = db.Close()
+	})
+
+	return store
+}
+
+var testConfig = &Config{
+	Default: Policy{Limit: 3, Window: time.Minute, KeyBy: KeyByIP, Cost: 1},
+	Routes: []RoutePolicy{
+		{
+			Name:     "login",
+			Method:   http.MethodPost,
+			Patterns: []string{"/api/v1/login"},
+			Policy:   Policy{Limit: 1, Window: time.Minute},
+		},
+	},
+}
+
+// serve runs a request from `ip` through the ratelimiter.
+func serve(handler http.Handler, method string, path string, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":1234"
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestMiddleware(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(*testing.T) Store { return NewMemoryStore() },
+		"bolt":   func(t *testing.T) Store { return newTestBoltStore(t) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			rl := NewRatelimiter(newStore(t), testConfig)
+			handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			for i := 0; i < 3; i++ {
+				if res := serve(handler, http.MethodGet, "/api/v1/users/@me", "192.0.2.1"); res.Code != http.StatusNoContent {
+					t.Fatalf("request %d: expected 204, got %d", i, res.Code)
+				}
+			}
+
+			res := serve(handler, http.MethodGet, "/api/v1/users/@me", "192.0.2.1")
+			if res.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected 429 after the limit, got %d", res.Code)
+			}
+
+			if res.Header().Get("Retry-After") != "20" {
+				t.Errorf("expected Retry-After 20, got %q", res.Header().Get("Retry-After"))
+			}
+
+			if res.Header().Get("X-RateLimit-Remaining") != "0" {
+				t.Errorf("expected no remaining requests, got %q", res.Header().Get("X-RateLimit-Remaining"))
+			}
+
+			// Other IPs and routes with their own policy have their own buckets.
+			if res := serve(handler, http.MethodGet, "/api/v1/users/@me", "192.0.2.2"); res.Code != http.StatusNoContent {
+				t.Errorf("expected another IP to be allowed, got %d", res.Code)
+			}
+
+			if res := serve(handler, http.MethodPost, "/api/v1/login", "192.0.2.1"); res.Code != http.StatusNoContent {
+				t.Errorf("expected the login bucket to be separate, got %d", res.Code)
+			}
+
+			if res := serve(handler, http.MethodPost, "/api/v1/login", "192.0.2.1"); res.Code != http.StatusTooManyRequests {
+				t.Errorf("expected the second login to be ratelimited, got %d", res.Code)
+			}
+		})
+	}
+}
+
+func TestBoltStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tsubaki.db")
+	db := openTestBolt(t, path)
+	store, err := NewBoltStore(db)
+	if err != nil {
+		t.Fatalf("unable to create bolt store: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := store.Take(context.TODO(), "key", 2, time.Minute, 1); err != nil {
+			t.Fatalf("unable to take: %v", err)
+		}
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("unable to close the store: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("unable to close boltdb: %v", err)
+	}
+
+	db = openTestBolt(t, path)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	store, err = NewBoltStore(db)
+	if err != nil {
+		t.Fatalf("unable to reopen bolt store: %v", err)
+	}
+
+	defer func() {
+		_ = store.Close()
+	}()
+
+	ratelimit, err := store.Take(context.TODO(), "key", 2, time.Minute, 1)
+	if err != nil {
+		t.Fatalf("unable to take: %v", err)
+	}
+
+	if !ratelimit.Exceeded() {
+		t.Errorf("expected the bucket to still be empty after a restart, %d remaining", ratelimit.Remaining)
+	}
+}
@@ -0,0 +1,256 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/pkg/clientip"
+)
+
+// KeyType is what a bucket is keyed by.
+type KeyType string
+
+const (
+	// KeyByIP gives every IP its own bucket.
+	KeyByIP KeyType = "ip"
+
+	// KeyByUser gives every logged in user their own bucket, requests
+	// without a session are keyed by IP.
+	KeyByUser KeyType = "user"
+
+	// KeyByToken gives every access token its own bucket, requests
+	// without a token are keyed by IP.
+	KeyByToken KeyType = "token"
+)
+
+// Config is the configuration for the ratelimiter's policies.
+//
+// Prefix: TSUBAKI_RATELIMITS_*
+type Config struct {
+	// Default is the policy that is used for every route that isn't
+	// overridden in Routes.
+	Default Policy `yaml:"default"`
+
+	// Routes overrides the policy for routes that match a pattern, the first
+	// route that matches is used.
+	Routes []RoutePolicy `yaml:"routes"`
+}
+
+// Policy is the bucket that requests take tokens from.
+type Policy struct {
+	// Limit is how many tokens the bucket can hold.
+	//
+	// Default: 1200 | Variable: TSUBAKI_RATELIMITS_DEFAULT_LIMIT
+	Limit int `yaml:"limit"`
+
+	// Window is how long it takes for an empty bucket to be full again.
+	//
+	// Default: 1h | Variable: TSUBAKI_RATELIMITS_DEFAULT_WINDOW
+	Window time.Duration `yaml:"window"`
+
+	// KeyBy is what the bucket is keyed by, `ip`, `user` or `token`.
+	//
+	// Default: "ip" | Variable: TSUBAKI_RATELIMITS_DEFAULT_KEY_BY
+	KeyBy KeyType `yaml:"key_by"`
+
+	// Cost is how many tokens a request takes.
+	//
+	// Default: 1 | Variable: TSUBAKI_RATELIMITS_DEFAULT_COST
+	Cost int `yaml:"cost"`
+}
+
+// RoutePolicy overrides the policy for routes that match one of its patterns. If
+// Limit isn't set, the route takes Cost tokens from the default bucket instead
+// of having its own.
+type RoutePolicy struct {
+	// Name is the name of the bucket, routes with the same name share a bucket.
+	Name string `yaml:"name"`
+
+	// Method only matches requests with this HTTP method, every method is
+	// matched if this is empty.
+	Method string `yaml:"method,omitempty"`
+
+	// Patterns are the paths to match, `{param}` matches a single segment
+	// and a trailing `*` matches the rest of the path.
+	Patterns []string `yaml:"patterns"`
+
+	Policy `yaml:",inline"`
+}
+
+// DefaultConfig returns the policies that are used if `ratelimits` isn't configured.
+func DefaultConfig() *Config {
+	return &Config{
+		Default: Policy{
+			Limit:  1200,
+			Window: time.Hour,
+			KeyBy:  KeyByIP,
+			Cost:   1,
+		},
+		Routes: []RoutePolicy{
+			{
+				Name:     "login",
+				Method:   http.MethodPost,
+				Patterns: []string{"/api/login", "/api/v1/login"},
+				Policy: Policy{
+					Limit:  10,
+					Window: time.Minute,
+					KeyBy:  KeyByIP,
+					Cost:   1,
+				},
+			},
+		},
+	}
+}
+
+// bucket is a resolved policy for a request.
+type bucket struct {
+	name   string
+	limit  int
+	window time.Duration
+	keyBy  KeyType
+	cost   int
+}
+
+// withDefaults fills in the unset options of the policies.
+func (c *Config) withDefaults() *Config {
+	defaults := DefaultConfig().Default
+	config := &Config{Default: c.Default.or(defaults)}
+
+	for _, route := range c.Routes {
+		if route.Name == "" && len(route.Patterns) > 0 {
+			route.Name = route.Patterns[0]
+		}
+
+		if route.Limit > 0 {
+			route.Policy = route.Policy.or(defaults)
+		} else if route.Cost <= 0 {
+			route.Cost = 1
+		}
+
+		config.Routes = append(config.Routes, route)
+	}
+
+	return config
+}
+
+func (p Policy) or(defaults Policy) Policy {
+	if p.Limit <= 0 {
+		p.Limit = defaults.Limit
+	}
+
+	if p.Window <= 0 {
+		p.Window = defaults.Window
+	}
+
+	if p.KeyBy == "" {
+		p.KeyBy = defaults.KeyBy
+	}
+
+	if p.Cost <= 0 {
+		p.Cost = defaults.Cost
+	}
+
+	return p
+}
+
+// bucketFor returns the bucket that the request takes tokens from.
+func (c *Config) bucketFor(req *http.Request) bucket {
+	global := bucket{
+		name:   "global",
+		limit:  c.Default.Limit,
+		window: c.Default.Window,
+		keyBy:  c.Default.KeyBy,
+		cost:   c.Default.Cost,
+	}
+
+	for _, route := range c.Routes {
+		if route.Method != "" && !strings.EqualFold(route.Method, req.Method) {
+			continue
+		}
+
+		for _, pattern := range route.Patterns {
+			if !matchPattern(pattern, req.URL.Path) {
+				continue
+			}
+
+			if route.Limit <= 0 {
+				global.cost = route.Cost
+				return global
+			}
+
+			return bucket{
+				name:   route.Name,
+				limit:  route.Limit,
+				window: route.Window,
+				keyBy:  route.KeyBy,
+				cost:   route.Cost,
+			}
+		}
+	}
+
+	return global
+}
+
+// keyFor returns the key of the request's bucket.
+func (b bucket) keyFor(req *http.Request) string {
+	switch b.keyBy {
+	case KeyByUser:
+		if uid, ok := req.Context().Value("userId").(string); ok {
+			return b.name + ":user:" + uid
+		}
+
+	case KeyByToken:
+		if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer") {
+			// Tokens are hashed, so they aren't readable from Redis.
+			hash := sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer"))))
+			return b.name + ":token:" + hex.EncodeToString(hash[:])
+		}
+	}
+
+	return b.name + ":ip:" + clientip.FromRequest(req)
+}
+
+// matchPattern checks if `path` matches `pattern`.
+func matchPattern(pattern string, path string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, segment := range patternSegments {
+		if segment == "*" && i == len(patternSegments)-1 {
+			return true
+		}
+
+		if i >= len(pathSegments) {
+			return false
+		}
+
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			continue
+		}
+
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(pathSegments)
+}
@@ -18,11 +18,7 @@ package ratelimit
 
 import (
 	"context"
-	"encoding/json"
 	"time"
-
-	"github.com/go-redis/redis/v8"
-	"github.com/sirupsen/logrus"
 )
 
 type ratelimitedResponse struct {
@@ -30,160 +26,48 @@ type ratelimitedResponse struct {
 	RetryAfter int64  `json:"retry_after"`
 }
 
+// Ratelimit is the state of a bucket after taking tokens from it.
 type Ratelimit struct {
-	Remaining int       `json:"remaining"`
-	ResetTime time.Time `json:"reset_time"`
-	Limit     int       `json:"limit"`
-}
+	// RetryAfter is how long until enough tokens are available, this is
+	// 0 if the tokens were taken.
+	RetryAfter time.Duration `json:"retry_after"`
 
-func newRatelimit() Ratelimit {
-	return Ratelimit{
-		ResetTime: time.Now().Add(1 * time.Hour),
-		Remaining: 1200,
-		Limit:     1200,
-	}
-}
+	// ResetTime is when the bucket will be full again.
+	ResetTime time.Time `json:"reset_time"`
 
-func (r Ratelimit) Consume() *Ratelimit {
-	r.Remaining = r.Remaining - 1
-	return &r
-}
+	// Remaining is how many tokens are left in the bucket.
+	Remaining int `json:"remaining"`
 
-func (r Ratelimit) Exceeded() bool {
-	return !r.Expired() && r.Remaining == 0
+	// Limit is how many tokens the bucket can hold.
+	Limit int `json:"limit"`
 }
 
-func (r Ratelimit) Expired() bool {
-	return r.ResetTime.UnixNano() < time.Now().UnixNano()
+// Exceeded returns if there weren't enough tokens in the bucket.
+func (r *Ratelimit) Exceeded() bool {
+	return r.RetryAfter > 0
 }
 
+// Ratelimiter is a token bucket ratelimiter that keeps its buckets in a Store.
 type Ratelimiter struct {
-	ratelimits map[string]*Ratelimit
-	redis      *redis.Client
-}
-
-func NewRatelimiter(redis *redis.Client) Ratelimiter {
-	s := time.Now()
-	rl := Ratelimiter{
-		ratelimits: make(map[string]*Ratelimit),
-		redis:      redis,
-	}
-
-	count := redis.HLen(context.TODO(), "tsubaki:ratelimits").Val()
-	logrus.Debugf("Took %s to get %d ratelimits", time.Since(s).String(), count)
-
-	s = time.Now()
-	result, err := redis.HGetAll(context.TODO(), "tsubaki:ratelimits").Result()
-	if err != nil {
-		logrus.Warnf("Unable to retrieve all ratelimits: %v", err)
-	} else {
-		for key, value := range result {
-			r := &Ratelimit{}
-			err := json.Unmarshal([]byte(value), r)
-			if err != nil {
-				logrus.Warnf("Unable to decode ratelimit for ip %s:\n%v", key, err)
-				continue
-			}
-
-			rl.ratelimits[key] = r
-		}
-	}
-
-	logrus.Debugf(
-		"Took %s to re-implement all ratelimits (%d/%d ratelimits)",
-		time.Now().Sub(s).String(),
-		len(rl.ratelimits),
-		count,
-	)
-
-	// Get all the expired ratelimits
-	expired := make([]string, 0)
-	for ip, value := range rl.ratelimits {
-		if value.Expired() {
-			expired = append(expired, ip)
-		}
-	}
-
-	logrus.Debugf("Found %d ratelimits to expire!", len(expired))
-	for _, r := range expired {
-		_, err := redis.HDel(context.TODO(), "tsubaki:sessions", r).Result()
-		if err != nil {
-			logrus.Warnf("Unable to delete expired ratelimit:\n%v", err)
-			continue
-		}
-
-		logrus.Infof("Deleted expired ratelimit for IP %s", r)
-	}
-
-	go rl.resetExpired()
-	return rl
+	config *Config
+	store  Store
 }
 
-func (rl Ratelimiter) resetExpired() {
-	for ip, value := range rl.ratelimits {
-		select {
-		case <-time.After(time.Duration(value.ResetTime.UnixNano())):
-			{
-				logrus.Warnf("Ratelimit for IP %s has been expired.", ip)
-				_, err := rl.redis.HDel(context.TODO(), "tsubaki:timeouts", ip).Result()
-				if err != nil {
-					logrus.Warnf("Unable to remove ratelimit packet for %s:\n%v", ip, err)
-					continue
-				}
-			}
-		}
+// NewRatelimiter creates a new Ratelimiter that keeps its buckets in `store`, with the policies
+// from `config`, or the default policies if it is nil.
+func NewRatelimiter(store Store, config *Config) Ratelimiter {
+	if config == nil {
+		config = DefaultConfig()
 	}
-}
 
-func (rl Ratelimiter) cache(ip string, ratelimit *Ratelimit) {
-	data, _ := json.Marshal(&ratelimit)
-	rl.redis.HMSet(context.TODO(), "tsubaki:ratelimits", ip, string(data))
-}
-
-func (rl Ratelimiter) Get(ip string) *Ratelimit {
-	res, err := rl.redis.HGet(context.TODO(), "tsubaki:ratelimits", ip).Result()
-	if err != nil {
-		if err == redis.Nil {
-			r := newRatelimit()
-			rl.cache(ip, &r)
-			return &r
-		}
-
-		return nil
+	return Ratelimiter{
+		config: config.withDefaults(),
+		store:  store,
 	}
-
-	var ratelimit *Ratelimit
-	err = json.Unmarshal([]byte(res), &ratelimit)
-	if err != nil {
-		logrus.Warnf("Unable to unmarshal ratelimit; using new ratelimit packet")
-
-		l := newRatelimit()
-		ratelimit = &l
-	}
-
-	newRl := ratelimit.Consume()
-	rl.cache(ip, newRl)
-	rl.ratelimits[ip] = newRl
-
-	return newRl
 }
 
-func (rl Ratelimiter) Close() error {
-	logrus.Info("Storing cached ratelimits in Redis!")
-
-	for ip, value := range rl.ratelimits {
-		// Check if it exists
-		b, err := rl.redis.HExists(context.TODO(), "tsubaki:ratelimits", ip).Result()
-		if err != nil {
-			logrus.Fatalf("Unable to check if IP '%s' existed in ratelimit map: %v", ip, err)
-			continue
-		}
-
-		if !b {
-			rl.cache(ip, value)
-		}
-	}
-
-	logrus.Info("Cached in-memory ratelimits in Redis!")
-	return nil
+// Take takes `cost` tokens from the bucket of `key`, which holds `limit` tokens
+// and refills over `window`.
+func (rl Ratelimiter) Take(ctx context.Context, key string, limit int, window time.Duration, cost int) (*Ratelimit, error) {
+	return rl.store.Take(ctx, key, limit, window, cost)
 }
@@ -0,0 +1,387 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// sweepInterval is how often the in-process stores delete buckets that are full again.
+	sweepInterval = time.Minute
+
+	// boltFlushInterval is how often the BoltStore writes the buckets that changed to disk.
+	boltFlushInterval = 5 * time.Second
+)
+
+// Store is where the token buckets are kept.
+type Store interface {
+	// Take takes `cost` tokens from the bucket of `key`, which holds `limit` tokens
+	// and refills over `window`.
+	Take(ctx context.Context, key string, limit int, window time.Duration, cost int) (*Ratelimit, error)
+}
+
+// tokenBucket is a Lua script that takes `cost` tokens from the bucket at KEYS[1]. Buckets
+// hold `capacity` tokens and refill completely over `window` milliseconds. Since the whole
+// script runs atomically and uses the Redis server's clock, it is safe to run from multiple
+// Tsubaki replicas at once.
+//
+// It returns {allowed, remaining, retry_after_ms, reset_ms}.
+var tokenBucket = redis.NewScript(`
+redis.replicate_commands()
+
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local rate = capacity / window
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+
+if tokens == nil or updated == nil then
+  tokens = capacity
+  updated = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+
+local allowed = 0
+local retry_after = 0
+
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+else
+  retry_after = math.ceil((cost - tokens) / rate)
+end
+
+local reset = math.ceil((capacity - tokens) / rate)
+
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'updated', now)
+redis.call('PEXPIRE', KEYS[1], reset + 1000)
+
+return {allowed, math.floor(tokens), retry_after, reset}
+`)
+
+// RedisStore keeps buckets in Redis, so they are shared between replicas.
+type RedisStore struct {
+	redis *redis.Client
+}
+
+// NewRedisStore creates a new RedisStore.
+func NewRedisStore(redis *redis.Client) *RedisStore {
+	// Ratelimits used to be stored in this hash, which is never read anymore.
+	if err := redis.Del(context.TODO(), "tsubaki:ratelimits").Err(); err != nil {
+		logrus.Warnf("Unable to delete legacy ratelimits: %v", err)
+	}
+
+	return &RedisStore{redis: redis}
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, limit int, window time.Duration, cost int) (*Ratelimit, error) {
+	res, err := tokenBucket.Run(
+		ctx,
+		s.redis,
+		[]string{"tsubaki:ratelimits:" + key},
+		limit,
+		window.Milliseconds(),
+		cost,
+	).Int64Slice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ratelimit{
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+		ResetTime:  time.Now().Add(time.Duration(res[3]) * time.Millisecond),
+		Remaining:  int(res[1]),
+		Limit:      limit,
+	}, nil
+}
+
+// localBucket is a token bucket that is kept in process, it works the same way as
+// the tokenBucket script.
+type localBucket struct {
+	// Tokens is how many tokens are in the bucket.
+	Tokens float64 `json:"tokens"`
+
+	// Updated is when the bucket was last refilled.
+	Updated time.Time `json:"updated"`
+
+	// Expires is when the bucket is full again, so it can be deleted.
+	Expires time.Time `json:"expires"`
+}
+
+// take refills the bucket since it was last updated and takes `cost` tokens from it.
+func (b *localBucket) take(now time.Time, limit int, window time.Duration, cost int) *Ratelimit {
+	capacity := float64(limit)
+	rate := capacity / float64(window.Milliseconds())
+
+	if b.Updated.IsZero() {
+		b.Tokens = capacity
+		b.Updated = now
+	}
+
+	elapsed := math.Max(0, float64(now.Sub(b.Updated).Milliseconds()))
+	b.Tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+	b.Updated = now
+
+	retryAfter := 0.0
+	if b.Tokens >= float64(cost) {
+		b.Tokens -= float64(cost)
+	} else {
+		retryAfter = math.Ceil((float64(cost) - b.Tokens) / rate)
+	}
+
+	reset := time.Duration(math.Ceil((capacity-b.Tokens)/rate)) * time.Millisecond
+	b.Expires = now.Add(reset)
+
+	return &Ratelimit{
+		RetryAfter: time.Duration(retryAfter) * time.Millisecond,
+		ResetTime:  b.Expires,
+		Remaining:  int(math.Floor(b.Tokens)),
+		Limit:      limit,
+	}
+}
+
+// MemoryStore keeps buckets in memory, so it can't be shared between replicas. This
+// is only meant for single-node installs and tests.
+type MemoryStore struct {
+	buckets map[string]*localBucket
+	mutex   sync.Mutex
+	swept   time.Time
+}
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*localBucket),
+		swept:   time.Now(),
+	}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit int, window time.Duration, cost int) (*Ratelimit, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.take(time.Now(), key, limit, window, cost), nil
+}
+
+// take takes tokens from the bucket of `key`, the mutex has to be held.
+func (s *MemoryStore) take(now time.Time, key string, limit int, window time.Duration, cost int) *Ratelimit {
+	if now.Sub(s.swept) >= sweepInterval {
+		for k, b := range s.buckets {
+			if now.After(b.Expires) {
+				delete(s.buckets, k)
+			}
+		}
+
+		s.swept = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &localBucket{}
+		s.buckets[key] = b
+	}
+
+	return b.take(now, limit, window, cost)
+}
+
+// boltBucket is the BoltDB bucket that ratelimits are stored in.
+var boltBucket = []byte("ratelimits")
+
+// BoltStore keeps buckets in memory and writes the ones that changed to a BoltDB file
+// every boltFlushInterval, so ratelimits survive restarts on single-node installs
+// without writing to disk on every request. A crash loses the last few seconds of
+// ratelimits.
+type BoltStore struct {
+	*MemoryStore
+	db        *bolt.DB
+	dirty     map[string]bool
+	fileSwept time.Time
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+// NewBoltStore creates a new BoltStore, creates the ratelimits bucket if it doesn't
+// exist and loads the buckets that aren't full yet.
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	s := &BoltStore{
+		MemoryStore: NewMemoryStore(),
+		db:          db,
+		dirty:       make(map[string]bool),
+		fileSwept:   time.Now(),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	now := time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		buckets, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+
+		if err := sweep(buckets, now); err != nil {
+			return err
+		}
+
+		return buckets.ForEach(func(key, value []byte) error {
+			var b localBucket
+			if err := json.Unmarshal(value, &b); err != nil {
+				return err
+			}
+
+			s.buckets[string(key)] = &b
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	go s.flushLoop()
+	return s, nil
+}
+
+func (s *BoltStore) Take(_ context.Context, key string, limit int, window time.Duration, cost int) (*Ratelimit, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dirty[key] = true
+	return s.take(time.Now(), key, limit, window, cost), nil
+}
+
+// Close writes the buckets that changed since the last flush and stops flushing.
+func (s *BoltStore) Close() error {
+	close(s.closed)
+	<-s.done
+	return s.flush()
+}
+
+func (s *BoltStore) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(boltFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				logrus.Errorf("Unable to write ratelimits to BoltDB: %v", err)
+			}
+		}
+	}
+}
+
+// flush writes the buckets that changed since the last flush in one transaction, and
+// deletes the ones that are full again.
+func (s *BoltStore) flush() error {
+	s.mutex.Lock()
+	changed := make(map[string][]byte, len(s.dirty))
+	for key := range s.dirty {
+		// Buckets that were swept from memory are deleted from the file too.
+		var data []byte
+		if b, ok := s.buckets[key]; ok {
+			encoded, err := json.Marshal(b)
+			if err != nil {
+				s.mutex.Unlock()
+				return err
+			}
+
+			data = encoded
+		}
+
+		changed[key] = data
+	}
+
+	s.dirty = make(map[string]bool)
+	s.mutex.Unlock()
+
+	now := time.Now()
+	shouldSweep := now.Sub(s.fileSwept) >= sweepInterval
+	if len(changed) == 0 && !shouldSweep {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		buckets := tx.Bucket(boltBucket)
+		for key, data := range changed {
+			var err error
+			if data == nil {
+				err = buckets.Delete([]byte(key))
+			} else {
+				err = buckets.Put([]byte(key), data)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if !shouldSweep {
+			return nil
+		}
+
+		s.fileSwept = now
+		return sweep(buckets, now)
+	})
+}
+
+// sweep deletes the buckets that are full again.
+func sweep(buckets *bolt.Bucket, now time.Time) error {
+	expired := make([][]byte, 0)
+	err := buckets.ForEach(func(key, value []byte) error {
+		var b localBucket
+		if err := json.Unmarshal(value, &b); err != nil || now.After(b.Expires) {
+			expired = append(expired, append([]byte(nil), key...))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		if err := buckets.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedis connects to the Redis server at `TSUBAKI_TEST_REDIS` (like `localhost:6379`),
+// or starts an in-process one if it isn't set.
+func newTestRedis(t *testing.T) *redis.Client {
+	addr := os.Getenv("TSUBAKI_TEST_REDIS")
+	if addr == "" {
+		server := miniredis.RunT(t)
+		addr = server.Addr()
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	if err := client.Ping(context.TODO()).Err(); err != nil {
+		t.Fatalf("unable to connect to redis at %s: %v", addr, err)
+	}
+
+	return client
+}
+
+// testKey returns a key that isn't shared with other tests or runs, since a real
+// Redis server might be reused.
+func testKey(t *testing.T) string {
+	return fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestRedisStoreTakeConcurrently(t *testing.T) {
+	store := NewRedisStore(newTestRedis(t))
+	key := testKey(t)
+
+	const limit = 10
+	const requests = 50
+
+	var wg sync.WaitGroup
+	results := make(chan *Ratelimit, requests)
+	errs := make(chan error, requests)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ratelimit, err := store.Take(context.TODO(), key, limit, time.Minute, 1)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			results <- ratelimit
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unable to take from the bucket: %v", err)
+	}
+
+	allowed := 0
+	for ratelimit := range results {
+		if ratelimit.Remaining < 0 {
+			t.Errorf("remaining is negative: %d", ratelimit.Remaining)
+		}
+
+		if ratelimit.Limit != limit {
+			t.Errorf("expected limit %d, got %d", limit, ratelimit.Limit)
+		}
+
+		if !ratelimit.Exceeded() {
+			allowed++
+			continue
+		}
+
+		// One token refills every 6 seconds.
+		if ratelimit.RetryAfter <= 0 || ratelimit.RetryAfter > 6*time.Second {
+			t.Errorf("expected a retry after between 0 and 6s, got %s", ratelimit.RetryAfter)
+		}
+	}
+
+	if allowed != limit {
+		t.Errorf("expected %d requests to be allowed, got %d", limit, allowed)
+	}
+}
+
+func TestRedisStoreRetryAfterHeader(t *testing.T) {
+	rl := NewRatelimiter(NewRedisStore(newTestRedis(t)), &Config{
+		Default: Policy{
+			Limit:  5,
+			Window: time.Minute,
+			KeyBy:  KeyByIP,
+			Cost:   1,
+		},
+	})
+
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// Every run gets its own IP, so runs against a real Redis server don't share a bucket.
+	ip := fmt.Sprintf("192.0.2.%d:1234", time.Now().UnixNano()%250+1)
+
+	const requests = 20
+	var wg sync.WaitGroup
+	responses := make(chan *httptest.ResponseRecorder, requests)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/users/@me", nil)
+			req.RemoteAddr = ip
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			responses <- recorder
+		}()
+	}
+
+	wg.Wait()
+	close(responses)
+
+	allowed := 0
+	for recorder := range responses {
+		remaining, err := strconv.Atoi(recorder.Header().Get("X-RateLimit-Remaining"))
+		if err != nil || remaining < 0 {
+			t.Errorf("invalid X-RateLimit-Remaining %q", recorder.Header().Get("X-RateLimit-Remaining"))
+		}
+
+		switch recorder.Code {
+		case http.StatusNoContent:
+			allowed++
+
+		case http.StatusTooManyRequests:
+			// One token refills every 12 seconds, and Retry-After is in whole seconds.
+			retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After"))
+			if err != nil || retryAfter < 1 || retryAfter > 12 {
+				t.Errorf("expected Retry-After in seconds between 1 and 12, got %q", recorder.Header().Get("Retry-After"))
+			}
+
+		default:
+			t.Errorf("unexpected status %d", recorder.Code)
+		}
+	}
+
+	if allowed != 5 {
+		t.Errorf("expected 5 requests to be allowed, got %d", allowed)
+	}
+}
@@ -0,0 +1,257 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/acl"
+	"arisu.land/tsubaki/prisma/db"
+	es "github.com/elastic/go-elasticsearch/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UsersIndex is the Elasticsearch index of pkg.IndexedUser documents.
+	UsersIndex = "tsubaki-users"
+
+	// ProjectsIndex is the Elasticsearch index of pkg.IndexedProject documents.
+	ProjectsIndex = "tsubaki-projects"
+)
+
+// ElasticBackend searches the documents in Elasticsearch, it supports fuzzy matching.
+type ElasticBackend struct {
+	client *es.Client
+	prisma *db.PrismaClient
+}
+
+// elasticResponse is the part of an Elasticsearch search response that is used.
+type elasticResponse struct {
+	Hits struct {
+		Total struct {
+			Value int `json:"value"`
+		} `json:"total"`
+
+		Hits []struct {
+			Index     string              `json:"_index"`
+			Score     float64             `json:"_score"`
+			Source    json.RawMessage     `json:"_source"`
+			Highlight map[string][]string `json:"highlight"`
+			Sort      []interface{}       `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// NewElasticBackend creates a Backend that searches with Elasticsearch. `prisma` is
+// used to look up which private projects the viewer can see.
+func NewElasticBackend(client *es.Client, prisma *db.PrismaClient) *ElasticBackend {
+	return &ElasticBackend{client, prisma}
+}
+
+func (b *ElasticBackend) Name() string {
+	return "elasticsearch"
+}
+
+func (b *ElasticBackend) Search(query Query) (*Results, error) {
+	var indices []string
+	switch query.Type {
+	case Users:
+		indices = []string{UsersIndex}
+
+	case Projects:
+		indices = []string{ProjectsIndex}
+
+	default:
+		indices = []string{UsersIndex, ProjectsIndex}
+	}
+
+	filter, err := b.visibility(query.Viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"size": query.Limit,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":     query.Text,
+						"fields":    []string{"username^3", "username.cjk^3", "name^2", "name.cjk^2", "description", "description.cjk"},
+						"fuzziness": "AUTO",
+					},
+				},
+				"filter": filter,
+			},
+		},
+		// The highlights are on the main fields, even if only their `cjk` sub-fields matched.
+		// They are rendered as HTML, so the text around the tags has to be escaped.
+		"highlight": map[string]interface{}{
+			"encoder":             "html",
+			"require_field_match": false,
+			"fields": map[string]interface{}{
+				"username":    map[string]interface{}{},
+				"name":        map[string]interface{}{},
+				"description": map[string]interface{}{},
+			},
+		},
+
+		// `id` breaks ties between documents with the same score, so pages don't overlap.
+		"sort": []interface{}{
+			map[string]interface{}{"_score": "desc"},
+			map[string]interface{}{"id": "asc"},
+		},
+	}
+
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		body["search_after"] = after
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, err
+	}
+
+	res, err := b.client.Search(
+		b.client.Search.WithContext(context.TODO()),
+		b.client.Search.WithIndex(indices...),
+		b.client.Search.WithBody(&buf),
+		b.client.Search.WithTrackTotalHits(true),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("unable to search %v: %s", indices, res.String())
+	}
+
+	var data elasticResponse
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	hits := make([]Hit, 0, len(data.Hits.Hits))
+	for _, h := range data.Hits.Hits {
+		hit := Hit{
+			Score:      h.Score,
+			Highlights: h.Highlight,
+		}
+
+		// Indices can have a version suffix, so they are matched by prefix.
+		if strings.HasPrefix(h.Index, UsersIndex) {
+			var user pkg.IndexedUser
+			err = json.Unmarshal(h.Source, &user)
+			hit.Type = "user"
+			hit.Document = user
+		} else {
+			var project pkg.IndexedProject
+			err = json.Unmarshal(h.Source, &project)
+			hit.Type = "project"
+			hit.Document = project
+		}
+
+		if err != nil {
+			logrus.Errorf("Unable to decode document from %s: %v", h.Index, err)
+			continue
+		}
+
+		if hit.Highlights == nil {
+			hit.Highlights = map[string][]string{}
+		}
+
+		hits = append(hits, hit)
+	}
+
+	results := &Results{
+		Hits:  hits,
+		Total: data.Hits.Total.Value,
+	}
+
+	if n := len(data.Hits.Hits); n == query.Limit {
+		next := encodeCursor(data.Hits.Hits[n-1].Sort)
+		results.NextCursor = &next
+	}
+
+	return results, nil
+}
+
+// visibility returns the filter that hides the projects the viewer can't see. Users
+// don't have a `private` field, so they always match.
+func (b *ElasticBackend) visibility(viewer acl.Viewer) (map[string]interface{}, error) {
+	if viewer.Admin {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+
+	should := []interface{}{
+		map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must_not": map[string]interface{}{"term": map[string]interface{}{"private": true}},
+			},
+		},
+	}
+
+	if viewer.ID != "" {
+		members, err := b.prisma.ProjectMember.FindMany(db.ProjectMember.UserID.Equals(viewer.ID)).Exec(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+
+		orgs, err := b.prisma.OrganizationMember.FindMany(db.OrganizationMember.UserID.Equals(viewer.ID)).Exec(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+
+		projectIDs := make([]string, 0, len(members))
+		for _, member := range members {
+			projectIDs = append(projectIDs, member.ProjectID)
+		}
+
+		orgIDs := make([]string, 0, len(orgs))
+		for _, org := range orgs {
+			orgIDs = append(orgIDs, org.OrganizationID)
+		}
+
+		should = append(should,
+			map[string]interface{}{"term": map[string]interface{}{"owner_id": viewer.ID}},
+			map[string]interface{}{"terms": map[string]interface{}{"id": projectIDs}},
+			map[string]interface{}{"terms": map[string]interface{}{"organization_id": orgIDs}},
+		)
+	}
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}, nil
+}
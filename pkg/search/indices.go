@@ -0,0 +1,67 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"embed"
+	"fmt"
+)
+
+//go:embed mappings/*.json
+var mappings embed.FS
+
+// Index is an Elasticsearch index that is searched through an alias. The alias points
+// to a physical index with the version of the mapping, i.e, `tsubaki-users-v2`, so the
+// mapping can be changed by reindexing into a new version and swapping the alias.
+type Index struct {
+	// Alias is the name the index is searched and written to with.
+	Alias string
+
+	// Version is the version of the mapping, it has to be bumped whenever
+	// the mapping file changes.
+	Version int
+
+	// file is the name of the mapping file in `mappings/`.
+	file string
+}
+
+// Indices are the indices Tsubaki searches.
+var Indices = []Index{
+	{Alias: UsersIndex, Version: 2, file: "users.json"},
+	{Alias: ProjectsIndex, Version: 2, file: "projects.json"},
+}
+
+// FindIndex returns the index with the alias.
+func FindIndex(alias string) (Index, bool) {
+	for _, index := range Indices {
+		if index.Alias == alias {
+			return index, true
+		}
+	}
+
+	return Index{}, false
+}
+
+// Name returns the name of the physical index for this version, i.e, `tsubaki-users-v2`.
+func (i Index) Name() string {
+	return fmt.Sprintf("%s-v%d", i.Alias, i.Version)
+}
+
+// Mapping returns the settings and mappings the index is created with.
+func (i Index) Mapping() ([]byte, error) {
+	return mappings.ReadFile("mappings/" + i.file)
+}
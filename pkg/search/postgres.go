@@ -0,0 +1,228 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/acl"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/prisma/db"
+)
+
+// termRegex matches the words of a query, everything else is dropped so it can't
+// be parsed as a tsquery operator.
+var termRegex = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+const (
+	// startSel and stopSel are what ts_headline wraps the matched words in. They are
+	// control characters, so they survive escaping and are turned into `<em>` tags after.
+	startSel = "\x02"
+	stopSel  = "\x03"
+)
+
+// htmlEncoder escapes highlights the same way Elasticsearch's `html` encoder does, so
+// both backends return the same highlights.
+var htmlEncoder = strings.NewReplacer(
+	`"`, "&quot;",
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"'", "&#x27;",
+	"/", "&#x2F;",
+)
+
+// PostgresBackend searches the `search_vector` columns of users and projects with
+// PostgreSQL's full-text search. It matches words by prefix instead of fuzzily.
+type PostgresBackend struct {
+	prisma *db.PrismaClient
+}
+
+// postgresHit is a user or project that was matched by the search query.
+type postgresHit struct {
+	Type                 string     `json:"type"`
+	ID                   string     `json:"id"`
+	Rank                 float64    `json:"rank"`
+	Username             *string    `json:"username"`
+	Name                 *string    `json:"name"`
+	Description          *string    `json:"description"`
+	CreatedAt            *time.Time `json:"created_at"`
+	OwnerID              *string    `json:"owner_id"`
+	OrganizationID       *string    `json:"organization_id"`
+	Private              bool       `json:"private"`
+	UsernameHighlight    *string    `json:"username_highlight"`
+	NameHighlight        *string    `json:"name_highlight"`
+	DescriptionHighlight *string    `json:"description_highlight"`
+	Total                int        `json:"total"`
+}
+
+// NewPostgresBackend creates a Backend that searches with PostgreSQL.
+func NewPostgresBackend(prisma *db.PrismaClient) *PostgresBackend {
+	return &PostgresBackend{prisma}
+}
+
+func (b *PostgresBackend) Name() string {
+	return "postgresql"
+}
+
+func (b *PostgresBackend) Search(query Query) (*Results, error) {
+	var after []interface{}
+	if query.Cursor != "" {
+		values, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := values[0].(float64); !ok {
+			return nil, ErrInvalidCursor
+		}
+
+		if _, ok := values[1].(string); !ok {
+			return nil, ErrInvalidCursor
+		}
+
+		after = values
+	}
+
+	terms := termRegex.FindAllString(query.Text, -1)
+	if len(terms) == 0 {
+		return &Results{Hits: []Hit{}}, nil
+	}
+
+	// Every word has to match, the last one can still be being typed.
+	for i, term := range terms {
+		terms[i] = term + ":*"
+	}
+
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	tsquery := `to_tsquery('simple', ` + arg(strings.Join(terms, " & ")) + `)`
+	fragment := arg(`StartSel="` + startSel + `", StopSel="` + stopSel + `"`)
+	whole := arg(`StartSel="` + startSel + `", StopSel="` + stopSel + `", HighlightAll=true`)
+
+	var selects []string
+	if query.Type == All || query.Type == Users {
+		selects = append(selects, `SELECT 'user' AS "type", "u"."id", ts_rank("u"."search_vector", "q")::float8 AS "rank",
+			"u"."username", "u"."name", "u"."description", NULL::timestamp AS "created_at",
+			NULL AS "owner_id", NULL AS "organization_id", FALSE AS "private",
+			ts_headline('simple', "u"."username", "q", `+whole+`) AS "username_highlight",
+			ts_headline('simple', "u"."name", "q", `+whole+`) AS "name_highlight",
+			ts_headline('simple', "u"."description", "q", `+fragment+`) AS "description_highlight"
+		FROM "users" "u", `+tsquery+` "q"
+		WHERE "u"."search_vector" @@ "q"`)
+	}
+
+	if query.Type == All || query.Type == Projects {
+		visibility := ""
+		if visible := acl.VisibleProjects(query.Viewer, arg); visible != "" {
+			visibility = ` AND ` + visible
+		}
+
+		selects = append(selects, `SELECT 'project' AS "type", "p"."id", ts_rank("p"."search_vector", "q")::float8 AS "rank",
+			NULL AS "username", "p"."name", "p"."description", "p"."created_at",
+			"p"."owner_id", "p"."organization_id", ("p"."flags" & `+arg(int(flags.Private))+`) <> 0 AS "private",
+			NULL AS "username_highlight",
+			ts_headline('simple', "p"."name", "q", `+whole+`) AS "name_highlight",
+			ts_headline('simple', "p"."description", "q", `+fragment+`) AS "description_highlight"
+		FROM "projects" "p", `+tsquery+` "q"
+		WHERE "p"."search_vector" @@ "q"`+visibility)
+	}
+
+	where := "TRUE"
+	if after != nil {
+		rank := arg(after[0])
+		where = `("rank" < ` + rank + `::float8 OR ("rank" = ` + rank + `::float8 AND "id" > ` + arg(after[1]) + `))`
+	}
+
+	// The total is counted before the cursor is applied, so it's the same on every page.
+	var rows []postgresHit
+	err := b.prisma.Prisma.QueryRaw(
+		`SELECT * FROM (SELECT *, COUNT(*) OVER ()::int AS "total" FROM (`+strings.Join(selects, " UNION ALL ")+`) "matches") "hits"
+		WHERE `+where+`
+		ORDER BY "rank" DESC, "id" ASC LIMIT `+arg(query.Limit),
+		args...,
+	).Exec(context.TODO(), &rows)
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := &Results{Hits: make([]Hit, 0, len(rows))}
+	for _, row := range rows {
+		results.Total = row.Total
+		hit := Hit{
+			Type:       row.Type,
+			Score:      row.Rank,
+			Highlights: map[string][]string{},
+		}
+
+		for field, highlight := range map[string]*string{
+			"username":    row.UsernameHighlight,
+			"name":        row.NameHighlight,
+			"description": row.DescriptionHighlight,
+		} {
+			// ts_headline returns the start of the text if nothing matched.
+			if highlight != nil && strings.Contains(*highlight, startSel) {
+				hit.Highlights[field] = []string{escapeHighlight(*highlight)}
+			}
+		}
+
+		if row.Type == "user" {
+			hit.Document = pkg.IndexedUser{
+				Description: row.Description,
+				Username:    *row.Username,
+				Name:        row.Name,
+				ID:          row.ID,
+			}
+		} else {
+			hit.Document = pkg.IndexedProject{
+				Description:    row.Description,
+				CreatedAt:      row.CreatedAt.Format(time.RFC3339),
+				OrganizationID: row.OrganizationID,
+				OwnerID:        row.OwnerID,
+				Private:        row.Private,
+				Name:           *row.Name,
+				ID:             row.ID,
+			}
+		}
+
+		results.Hits = append(results.Hits, hit)
+	}
+
+	if n := len(rows); n == query.Limit {
+		next := encodeCursor([]interface{}{rows[n-1].Rank, rows[n-1].ID})
+		results.NextCursor = &next
+	}
+
+	return results, nil
+}
+
+// escapeHighlight HTML escapes a ts_headline result, then wraps the matched words in
+// `<em>` tags.
+func escapeHighlight(highlight string) string {
+	escaped := htmlEncoder.Replace(highlight)
+	return strings.NewReplacer(startSel, "<em>", stopSel, "</em>").Replace(escaped)
+}
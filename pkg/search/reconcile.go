@@ -0,0 +1,284 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reconcileInterval is how often the indices are compared with PostgreSQL.
+	reconcileInterval = 10 * time.Minute
+
+	// reconcileLockKey makes sure only one replica reconciles at a time.
+	reconcileLockKey = "tsubaki:search:reconcile"
+
+	// reconcileBatchSize is how many documents are compared at once.
+	reconcileBatchSize = 500
+)
+
+// drift is how many documents of an index were out of sync.
+type drift struct {
+	// outdated is how many documents didn't match their row, or were missing.
+	outdated int
+
+	// stale is how many documents didn't have a row anymore.
+	stale int
+}
+
+func (s *Syncer) reconcileLoop() {
+	for {
+		time.Sleep(reconcileInterval)
+		if !s.lockReconcile() {
+			continue
+		}
+
+		for _, index := range []string{UsersIndex, ProjectsIndex} {
+			d, err := s.reconcile(index)
+			if err != nil {
+				logrus.Errorf("Unable to reconcile %s: %v", index, err)
+				continue
+			}
+
+			if d.outdated > 0 || d.stale > 0 {
+				logrus.Warnf("Reconciled %s: %d documents were out of date and %d were stale.", index, d.outdated, d.stale)
+			}
+		}
+	}
+}
+
+// lockReconcile returns if this replica should reconcile. The lock expires before the
+// next run, so a replica that stopped doesn't keep it.
+func (s *Syncer) lockReconcile() bool {
+	if s.redis == nil {
+		return true
+	}
+
+	ok, err := s.redis.SetNX(context.TODO(), reconcileLockKey, "1", reconcileInterval-time.Minute).Result()
+	if err != nil {
+		logrus.Errorf("Unable to acquire the search reconciliation lock: %v", err)
+		return false
+	}
+
+	return ok
+}
+
+// reconcile compares the index with PostgreSQL and queues a change for every document
+// that drifted: rows without an up-to-date document, and documents without a row.
+func (s *Syncer) reconcile(index string) (drift, error) {
+	var d drift
+	source, ok := s.source(index)
+	if !ok {
+		return d, fmt.Errorf("unknown index %s", index)
+	}
+
+	last := ""
+	for {
+		documents, ids, err := source.after(last, reconcileBatchSize)
+		if err != nil {
+			return d, err
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		indexed, err := s.mget(index, ids)
+		if err != nil {
+			return d, err
+		}
+
+		for _, id := range ids {
+			same, err := sameDocument(documents[id], indexed[id])
+			if err != nil {
+				return d, err
+			}
+
+			if !same {
+				d.outdated++
+				s.Emit(index, id)
+			}
+		}
+
+		last = ids[len(ids)-1]
+	}
+
+	var after []interface{}
+	for {
+		ids, next, err := s.indexedIDs(index, after)
+		if err != nil {
+			return d, err
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		found, err := source.existing(ids)
+		if err != nil {
+			return d, err
+		}
+
+		for _, id := range ids {
+			if !found[id] {
+				d.stale++
+				s.Emit(index, id)
+			}
+		}
+
+		after = next
+	}
+
+	return d, nil
+}
+
+// mget returns the indexed documents with the IDs, documents that aren't indexed are
+// left out.
+func (s *Syncer) mget(index string, ids []string) (map[string]json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"ids": ids}); err != nil {
+		return nil, err
+	}
+
+	res, err := s.client.Mget(&buf, s.client.Mget.WithContext(context.TODO()), s.client.Mget.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("unable to fetch documents from %s: %s", index, res.String())
+	}
+
+	var data struct {
+		Docs []struct {
+			ID     string          `json:"_id"`
+			Found  bool            `json:"found"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"docs"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	documents := make(map[string]json.RawMessage, len(data.Docs))
+	for _, doc := range data.Docs {
+		if doc.Found {
+			documents[doc.ID] = doc.Source
+		}
+	}
+
+	return documents, nil
+}
+
+// indexedIDs returns the next page of document IDs in the index, ordered by ID, and
+// the `search_after` of the page after it.
+func (s *Syncer) indexedIDs(index string, after []interface{}) ([]string, []interface{}, error) {
+	body := map[string]interface{}{
+		"size":    reconcileBatchSize,
+		"_source": false,
+		"query":   map[string]interface{}{"match_all": map[string]interface{}{}},
+		"sort":    []interface{}{map[string]interface{}{"id": "asc"}},
+	}
+
+	if after != nil {
+		body["search_after"] = after
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, nil, err
+	}
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(context.TODO()),
+		s.client.Search.WithIndex(index),
+		s.client.Search.WithBody(&buf),
+	)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.IsError() {
+		return nil, nil, fmt.Errorf("unable to list documents in %s: %s", index, res.String())
+	}
+
+	var data struct {
+		Hits struct {
+			Hits []struct {
+				ID   string        `json:"_id"`
+				Sort []interface{} `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, nil, err
+	}
+
+	hits := data.Hits.Hits
+	if len(hits) == 0 {
+		return nil, nil, nil
+	}
+
+	ids := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		ids = append(ids, hit.ID)
+	}
+
+	return ids, hits[len(hits)-1].Sort, nil
+}
+
+// sameDocument returns if the indexed document matches the one built from the row.
+// Both are compared as decoded JSON, so the order of the keys doesn't matter.
+func sameDocument(expected interface{}, indexed json.RawMessage) (bool, error) {
+	if indexed == nil {
+		return false, nil
+	}
+
+	data, err := json.Marshal(expected)
+	if err != nil {
+		return false, err
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(data, &want); err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(indexed, &got); err != nil {
+		return false, nil
+	}
+
+	return reflect.DeepEqual(want, got), nil
+}
@@ -0,0 +1,131 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"arisu.land/tsubaki/pkg/acl"
+	"arisu.land/tsubaki/prisma/db"
+	es "github.com/elastic/go-elasticsearch/v8"
+)
+
+// ErrInvalidCursor is returned when the cursor of a Query wasn't returned by the same Backend.
+var ErrInvalidCursor = errors.New("search: invalid cursor")
+
+// Type is what kind of documents are searched.
+type Type string
+
+var (
+	// All searches users and projects.
+	All Type = ""
+
+	// Users only searches users.
+	Users Type = "users"
+
+	// Projects only searches projects.
+	Projects Type = "projects"
+)
+
+// Query is what to search for.
+type Query struct {
+	// Text is what the user typed into the search bar.
+	Text string
+
+	// Type is what kind of documents are searched.
+	Type Type
+
+	// Viewer is who is searching.
+	Viewer acl.Viewer
+
+	// Cursor is the `next_cursor` of the previous page, or empty for the first page.
+	Cursor string
+
+	// Limit is how many hits are returned at most.
+	Limit int
+}
+
+// Hit is a user or project that matched the search query.
+type Hit struct {
+	// Returns the type of the document, which is `user` or `project`.
+	Type string `json:"type"`
+
+	// Returns how well the document matched the query, higher is better. Scores
+	// can only be compared between hits from the same backend.
+	Score float64 `json:"score"`
+
+	// Returns the parts of each field that matched, where the matched
+	// words are wrapped in `<em>` tags. The rest of the text is HTML escaped,
+	// so highlights can be rendered as HTML.
+	Highlights map[string][]string `json:"highlights"`
+
+	// Returns the document, which is a pkg.IndexedUser or pkg.IndexedProject.
+	Document interface{} `json:"document"`
+}
+
+// Results is a page of search hits, ordered by the best match first.
+type Results struct {
+	Hits []Hit `json:"hits"`
+
+	// Returns how many documents matched in total.
+	Total int `json:"total"`
+
+	// NextCursor is the `cursor` to request the next page with, it is `nil`
+	// if this is the last page.
+	NextCursor *string `json:"next_cursor"`
+}
+
+// Backend is a search engine that users and projects can be searched with.
+type Backend interface {
+	// Name returns the name of the backend, i.e, `elasticsearch`.
+	Name() string
+
+	// Search returns a page of the documents that match the query.
+	Search(query Query) (*Results, error)
+}
+
+// New returns the Elasticsearch backend if a client is available, otherwise
+// it falls back to PostgreSQL's full-text search.
+func New(client *es.Client, prisma *db.PrismaClient) Backend {
+	if client != nil {
+		return NewElasticBackend(client, prisma)
+	}
+
+	return NewPostgresBackend(prisma)
+}
+
+// encodeCursor encodes the sort values of the last hit of a page.
+func encodeCursor(values []interface{}) string {
+	data, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil || len(values) != 2 {
+		return nil, ErrInvalidCursor
+	}
+
+	return values, nil
+}
@@ -0,0 +1,493 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/prisma/db"
+	es "github.com/elastic/go-elasticsearch/v8"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// queueKey is the Redis list of changes that are waiting to be applied.
+	queueKey = "tsubaki:search:queue"
+
+	// processingKey is the Redis list of changes that a worker is applying. They are
+	// moved back to the queue when Tsubaki starts, so a crash doesn't lose them.
+	processingKey = "tsubaki:search:processing"
+
+	// retryKey is the Redis sorted set of failed changes, scored by when they are retried.
+	retryKey = "tsubaki:search:retry"
+
+	// DeadLetterKey is the Redis list of changes that failed maxAttempts times.
+	DeadLetterKey = "tsubaki:search:dead"
+
+	// maxAttempts is how many times a change is applied before it's dead-lettered.
+	maxAttempts = 5
+
+	// maxDeadLetters is how many dead-lettered changes are kept, newest first.
+	maxDeadLetters = 1000
+
+	// syncWorkers is how many changes are applied at once.
+	syncWorkers = 4
+
+	// localQueueSize is how many changes are buffered in memory when Redis isn't configured.
+	localQueueSize = 1024
+)
+
+// Changes keeps the Elasticsearch indices in sync with PostgreSQL. It's nil when
+// Elasticsearch isn't configured, which makes UserChanged and ProjectChanged no-ops.
+var Changes *Syncer
+
+// Change is a user or project that has to be updated in its index. Only the ID is
+// queued; the document is read from PostgreSQL when the change is applied, so a
+// change can be applied more than once and in any order.
+type Change struct {
+	// Index is the alias of the index the document is in.
+	Index string `json:"index"`
+
+	// ID is the ID of the user or project.
+	ID string `json:"id"`
+
+	// Attempts is how many times applying the change failed.
+	Attempts int `json:"attempts"`
+
+	// Error is why the last attempt failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Syncer applies the changes emitted by the controllers to Elasticsearch. The queue
+// is kept in Redis so it's shared between replicas and survives restarts; without
+// Redis, it's kept in memory.
+type Syncer struct {
+	client *es.Client
+	prisma *db.PrismaClient
+	redis  *redis.Client
+	local  chan Change
+}
+
+// NewSyncer creates a Syncer, `redis` can be nil.
+func NewSyncer(client *es.Client, prisma *db.PrismaClient, redis *redis.Client) *Syncer {
+	return &Syncer{
+		client: client,
+		prisma: prisma,
+		redis:  redis,
+		local:  make(chan Change, localQueueSize),
+	}
+}
+
+// UserChanged queues the user to be re-indexed, or removed if it was deleted.
+func UserChanged(id string) {
+	Changes.Emit(UsersIndex, id)
+}
+
+// ProjectChanged queues the project to be re-indexed, or removed if it was deleted.
+func ProjectChanged(id string) {
+	Changes.Emit(ProjectsIndex, id)
+}
+
+// Emit queues a change to the document `id` in `index`. It never fails the write that
+// emitted it, changes that couldn't be queued are picked up by the reconciliation.
+func (s *Syncer) Emit(index string, id string) {
+	if s == nil {
+		return
+	}
+
+	if err := s.push(Change{Index: index, ID: id}); err != nil {
+		logrus.Errorf("Unable to queue search change for %s/%s: %v", index, id, err)
+	}
+}
+
+// Start starts the workers that apply the queued changes and the reconciliation job.
+func (s *Syncer) Start() {
+	if s.redis != nil {
+		s.recover()
+		go s.promoteRetries()
+	}
+
+	for i := 0; i < syncWorkers; i++ {
+		go s.work()
+	}
+
+	go s.reconcileLoop()
+}
+
+// DeadLetters returns the changes that failed too many times, newest first.
+func (s *Syncer) DeadLetters() ([]Change, error) {
+	if s.redis == nil {
+		return []Change{}, nil
+	}
+
+	items, err := s.redis.LRange(context.TODO(), DeadLetterKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0, len(items))
+	for _, item := range items {
+		var change Change
+		if err := json.Unmarshal([]byte(item), &change); err == nil {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, nil
+}
+
+func (s *Syncer) push(change Change) error {
+	if s.redis == nil {
+		select {
+		case s.local <- change:
+			return nil
+
+		default:
+			return errors.New("the in-memory queue is full")
+		}
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.LPush(context.TODO(), queueKey, data).Err()
+}
+
+// recover moves the changes that were being applied when Tsubaki stopped back to the queue.
+func (s *Syncer) recover() {
+	moved := 0
+	for {
+		err := s.redis.RPopLPush(context.TODO(), processingKey, queueKey).Err()
+		if errors.Is(err, redis.Nil) {
+			break
+		}
+
+		if err != nil {
+			logrus.Errorf("Unable to recover unfinished search changes: %v", err)
+			break
+		}
+
+		moved++
+	}
+
+	if moved > 0 {
+		logrus.Infof("Recovered %d unfinished search changes.", moved)
+	}
+}
+
+// promoteRetries moves the failed changes back to the queue once their backoff is over.
+func (s *Syncer) promoteRetries() {
+	for {
+		time.Sleep(time.Second)
+
+		items, err := s.redis.ZRangeByScore(context.TODO(), retryKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: fmt.Sprintf("%d", time.Now().Unix()),
+		}).Result()
+
+		if err != nil {
+			logrus.Errorf("Unable to fetch search changes to retry: %v", err)
+			continue
+		}
+
+		for _, item := range items {
+			// Only the replica that removed the change queues it again.
+			removed, err := s.redis.ZRem(context.TODO(), retryKey, item).Result()
+			if err != nil || removed == 0 {
+				continue
+			}
+
+			if err := s.redis.LPush(context.TODO(), queueKey, item).Err(); err != nil {
+				logrus.Errorf("Unable to retry search change %s: %v", item, err)
+			}
+		}
+	}
+}
+
+func (s *Syncer) work() {
+	for {
+		change, raw, ok := s.next()
+		if !ok {
+			continue
+		}
+
+		if err := s.apply(change); err != nil {
+			s.fail(change, err)
+		}
+
+		if s.redis != nil {
+			if err := s.redis.LRem(context.TODO(), processingKey, 1, raw).Err(); err != nil {
+				logrus.Errorf("Unable to acknowledge search change %s: %v", raw, err)
+			}
+		}
+	}
+}
+
+// next waits for the next change. `raw` is how the change is stored in Redis.
+func (s *Syncer) next() (change Change, raw string, ok bool) {
+	if s.redis == nil {
+		return <-s.local, "", true
+	}
+
+	raw, err := s.redis.BRPopLPush(context.TODO(), queueKey, processingKey, 5*time.Second).Result()
+	if errors.Is(err, redis.Nil) {
+		return change, "", false
+	}
+
+	if err != nil {
+		logrus.Errorf("Unable to pop search change: %v", err)
+		time.Sleep(time.Second)
+		return change, "", false
+	}
+
+	if err := json.Unmarshal([]byte(raw), &change); err != nil {
+		logrus.Errorf("Dropping malformed search change %s: %v", raw, err)
+		_ = s.redis.LRem(context.TODO(), processingKey, 1, raw).Err()
+		return change, "", false
+	}
+
+	return change, raw, true
+}
+
+// fail retries the change with an exponential backoff, or dead-letters it after
+// maxAttempts attempts.
+func (s *Syncer) fail(change Change, err error) {
+	change.Attempts++
+	change.Error = err.Error()
+
+	if change.Attempts >= maxAttempts {
+		logrus.Errorf("Giving up on search change for %s/%s after %d attempts: %v", change.Index, change.ID, change.Attempts, err)
+		if s.redis == nil {
+			return
+		}
+
+		data, _ := json.Marshal(change)
+		_, err := s.redis.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+			pipe.LPush(context.TODO(), DeadLetterKey, data)
+			pipe.LTrim(context.TODO(), DeadLetterKey, 0, maxDeadLetters-1)
+			return nil
+		})
+
+		if err != nil {
+			logrus.Errorf("Unable to dead-letter search change for %s/%s: %v", change.Index, change.ID, err)
+		}
+
+		return
+	}
+
+	delay := time.Duration(math.Pow(2, float64(change.Attempts))) * time.Second
+	logrus.Warnf("Unable to apply search change for %s/%s (attempt %d), retrying in %s: %v", change.Index, change.ID, change.Attempts, delay, err)
+
+	if s.redis == nil {
+		time.AfterFunc(delay, func() {
+			if err := s.push(change); err != nil {
+				logrus.Errorf("Unable to retry search change for %s/%s: %v", change.Index, change.ID, err)
+			}
+		})
+
+		return
+	}
+
+	data, _ := json.Marshal(change)
+	err = s.redis.ZAdd(context.TODO(), retryKey, &redis.Z{
+		Score:  float64(time.Now().Add(delay).Unix()),
+		Member: data,
+	}).Err()
+
+	if err != nil {
+		logrus.Errorf("Unable to schedule retry of search change for %s/%s: %v", change.Index, change.ID, err)
+	}
+}
+
+// apply indexes the current version of the document, or deletes it if the row is gone.
+func (s *Syncer) apply(change Change) error {
+	source, ok := s.source(change.Index)
+	if !ok {
+		return fmt.Errorf("unknown index %s", change.Index)
+	}
+
+	document, err := source.get(change.ID)
+	if err != nil {
+		return err
+	}
+
+	if document == nil {
+		res, err := s.client.Delete(change.Index, change.ID, s.client.Delete.WithContext(context.TODO()))
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = res.Body.Close()
+		}()
+
+		if res.IsError() && res.StatusCode != 404 {
+			return fmt.Errorf("unable to delete document: %s", res.String())
+		}
+
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(document); err != nil {
+		return err
+	}
+
+	res, err := s.client.Index(
+		change.Index,
+		&buf,
+		s.client.Index.WithContext(context.TODO()),
+		s.client.Index.WithDocumentID(change.ID),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.IsError() {
+		return fmt.Errorf("unable to index document: %s", res.String())
+	}
+
+	return nil
+}
+
+// source reads the documents of one index from PostgreSQL.
+type source struct {
+	// get returns the document with the ID, or nil if the row doesn't exist.
+	get func(id string) (interface{}, error)
+
+	// after returns up to `limit` documents with an ID greater than `last`, ordered by ID.
+	after func(last string, limit int) (map[string]interface{}, []string, error)
+
+	// existing returns which of the IDs still have a row.
+	existing func(ids []string) (map[string]bool, error)
+}
+
+func (s *Syncer) source(index string) (source, bool) {
+	switch index {
+	case UsersIndex:
+		return source{
+			get: func(id string) (interface{}, error) {
+				user, err := s.prisma.User.FindUnique(db.User.ID.Equals(id)).Exec(context.TODO())
+				if errors.Is(err, db.ErrNotFound) {
+					return nil, nil
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				return pkg.FromDbUserModel(*user), nil
+			},
+			after: func(last string, limit int) (map[string]interface{}, []string, error) {
+				users, err := s.prisma.User.FindMany(db.User.ID.Gt(last)).OrderBy(
+					db.User.ID.Order(db.SortOrderAsc),
+				).Take(limit).Exec(context.TODO())
+
+				if err != nil {
+					return nil, nil, err
+				}
+
+				documents := make(map[string]interface{}, len(users))
+				ids := make([]string, 0, len(users))
+				for _, user := range users {
+					documents[user.ID] = pkg.FromDbUserModel(user)
+					ids = append(ids, user.ID)
+				}
+
+				return documents, ids, nil
+			},
+			existing: func(ids []string) (map[string]bool, error) {
+				users, err := s.prisma.User.FindMany(db.User.ID.In(ids)).Exec(context.TODO())
+				if err != nil {
+					return nil, err
+				}
+
+				found := make(map[string]bool, len(users))
+				for _, user := range users {
+					found[user.ID] = true
+				}
+
+				return found, nil
+			},
+		}, true
+
+	case ProjectsIndex:
+		return source{
+			get: func(id string) (interface{}, error) {
+				project, err := s.prisma.Project.FindUnique(db.Project.ID.Equals(id)).Exec(context.TODO())
+				if errors.Is(err, db.ErrNotFound) {
+					return nil, nil
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				return pkg.FromDbProjectModel(*project), nil
+			},
+			after: func(last string, limit int) (map[string]interface{}, []string, error) {
+				projects, err := s.prisma.Project.FindMany(db.Project.ID.Gt(last)).OrderBy(
+					db.Project.ID.Order(db.SortOrderAsc),
+				).Take(limit).Exec(context.TODO())
+
+				if err != nil {
+					return nil, nil, err
+				}
+
+				documents := make(map[string]interface{}, len(projects))
+				ids := make([]string, 0, len(projects))
+				for _, project := range projects {
+					documents[project.ID] = pkg.FromDbProjectModel(project)
+					ids = append(ids, project.ID)
+				}
+
+				return documents, ids, nil
+			},
+			existing: func(ids []string) (map[string]bool, error) {
+				projects, err := s.prisma.Project.FindMany(db.Project.ID.In(ids)).Exec(context.TODO())
+				if err != nil {
+					return nil, err
+				}
+
+				found := make(map[string]bool, len(projects))
+				for _, project := range projects {
+					found[project.ID] = true
+				}
+
+				return found, nil
+			},
+		}, true
+
+	default:
+		return source{}, false
+	}
+}
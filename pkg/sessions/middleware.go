@@ -19,15 +19,18 @@ package sessions
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/prisma/db"
 	"github.com/sirupsen/logrus"
 )
 
-func (m SessionManager) Middleware(next http.Handler) http.Handler {
+func (m *SessionManager) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		// If there is no Authorization header, skip it
 		if req.Header.Get("Authorization") == "" {
@@ -93,7 +96,56 @@ func (m SessionManager) Middleware(next http.Handler) http.Handler {
 				return
 			}
 
+			// Disabled users can't use the API anymore, even if their token is still valid.
+			user, err := m.prisma.User.FindUnique(db.User.ID.Equals(uid)).Exec(req.Context())
+			if err != nil {
+				if errors.Is(err, db.ErrNotFound) {
+					w.WriteHeader(401)
+					_ = json.NewEncoder(w).Encode(&errorResponse{
+						Message: "The user of this token doesn't exist anymore.",
+					})
+
+					return
+				}
+
+				logrus.Errorf("Unable to find user %s in database: %v", uid, err)
+				w.WriteHeader(500)
+				_ = json.NewEncoder(w).Encode(&errorResponse{
+					Message: "Unable to validate token!",
+				})
+
+				return
+			}
+
+			if user.Disabled {
+				w.WriteHeader(403)
+				_ = json.NewEncoder(w).Encode(&errorResponse{
+					Message: "This account has been disabled by the administrators.",
+				})
+
+				return
+			}
+
+			// Password resets and forced logouts bump the user's token version, which
+			// revokes every token that was handed out before that.
+			if pkg.TokenVersion(decoded) != user.TokenVersion {
+				w.WriteHeader(401)
+				_ = json.NewEncoder(w).Encode(&errorResponse{
+					Message: "This token was revoked, please log in again.",
+				})
+
+				return
+			}
+
 			ctx := context.WithValue(req.Context(), "userId", uid)
+			ctx = context.WithValue(ctx, "issuedAt", pkg.IssuedAt(decoded))
+			ctx = flags.NewContext(ctx, flags.UserFlags(user.Flags))
+
+			// Impersonation tokens also carry the administrator that is acting as the user.
+			if impersonator, ok := decoded["impersonator_id"].(string); ok {
+				ctx = context.WithValue(ctx, "impersonatorId", impersonator)
+			}
+
 			req = req.WithContext(ctx)
 			next.ServeHTTP(w, req)
 		} else {
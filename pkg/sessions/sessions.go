@@ -18,13 +18,13 @@ package sessions
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"sync"
 	"time"
 
 	"arisu.land/tsubaki/pkg"
 	"arisu.land/tsubaki/prisma/db"
-	"github.com/go-redis/redis/v8"
+	"github.com/prisma/prisma-client-go/runtime/transaction"
 	"github.com/sirupsen/logrus"
 )
 
@@ -53,7 +53,7 @@ func (s sessionType) String() string {
 }
 
 // Session represents the current session a user has. This is
-// cached in Redis.
+// cached in the session Store.
 //
 // IPs are not stored here, only for ratelimiting to determine
 // the root network.
@@ -89,44 +89,35 @@ func (s *Session) Expired() bool {
 type SessionManager struct {
 	sessions map[string]*Session
 	prisma   *db.PrismaClient
-	redis    *redis.Client
+	store    Store
+
+	// mutex guards `sessions`, since requests create and delete sessions concurrently.
+	mutex sync.RWMutex
 }
 
-func NewSessionManager(redis *redis.Client, prisma *db.PrismaClient) SessionManager {
+// NewSessionManager creates a new SessionManager that persists sessions in `store`.
+func NewSessionManager(store Store, prisma *db.PrismaClient) *SessionManager {
 	if Sessions != nil {
 		panic("tried to create new session manager while one was already constructed")
 	}
 
 	s := time.Now()
-	m := SessionManager{
+	m := &SessionManager{
 		sessions: make(map[string]*Session),
 		prisma:   prisma,
-		redis:    redis,
+		store:    store,
 	}
 
-	count := redis.HLen(context.TODO(), "tsubaki:sessions").Val()
-	logrus.Debugf("Retrieved %d documents in %s", count, time.Since(s).String())
-
-	s = time.Now()
-	result, err := redis.HGetAll(context.TODO(), "tsubaki:sessions").Result()
+	result, err := store.All(context.TODO())
 	if err != nil {
 		logrus.Warnf("Unable to retrieve all sessions!")
 	} else {
-		for key, value := range result {
-			var session Session
-			err := json.Unmarshal([]byte(value), &session)
-			if err != nil {
-				logrus.Warnf("Unable to unmarshal packet for %s:\n%v", key, err)
-				continue
-			}
-
-			m.sessions[key] = &session
-		}
+		m.sessions = result
 	}
 
-	logrus.Debugf("Took %s to re-implement all sessions (%d/%d sessions)", time.Since(s).String(), len(m.sessions), count)
+	logrus.Debugf("Took %s to re-implement all sessions (%d sessions)", time.Since(s).String(), len(m.sessions))
 
-	// Get all the expired ratelimits
+	// Get all the expired sessions
 	expired := make([]string, 0)
 	for uid, value := range m.sessions {
 		if value.Expired() {
@@ -134,29 +125,40 @@ func NewSessionManager(redis *redis.Client, prisma *db.PrismaClient) SessionMana
 		}
 	}
 
-	logrus.Debugf("Found %d ratelimits to expire!", len(expired))
+	logrus.Debugf("Found %d sessions to expire!", len(expired))
 	for _, r := range expired {
-		_, err := redis.HDel(context.TODO(), "tsubaki:sessions", r).Result()
-		if err != nil {
-			logrus.Warnf("Unable to delete expired ratelimit:\n%v", err)
+		if err := store.Delete(context.TODO(), r); err != nil {
+			logrus.Warnf("Unable to delete expired session:\n%v", err)
 		}
 
 		logrus.Infof("Deleted expired session for uid %s", r)
 	}
 
-	Sessions = &m
+	Sessions = m
 	go m.resetExpired()
 	return m
 }
 
-func (m SessionManager) resetExpired() {
-	for id, value := range m.sessions {
+// snapshot copies the in-memory sessions, so they can be iterated without holding the lock.
+func (m *SessionManager) snapshot() map[string]*Session {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	sessions := make(map[string]*Session, len(m.sessions))
+	for uid, session := range m.sessions {
+		sessions[uid] = session
+	}
+
+	return sessions
+}
+
+func (m *SessionManager) resetExpired() {
+	for id, value := range m.snapshot() {
 		select {
 		case <-time.After(time.Duration(value.ExpiresIn.UnixNano())):
 			{
 				logrus.Warnf("Session for user %s has expired.", id)
-				_, err := m.redis.HDel(context.TODO(), "tsubaki:sessions", id).Result()
-				if err != nil {
+				if err := m.store.Delete(context.TODO(), id); err != nil {
 					logrus.Errorf("Unable to delete sesion for user %s:\n%v", id, err)
 					continue
 				}
@@ -165,26 +167,20 @@ func (m SessionManager) resetExpired() {
 	}
 }
 
-func (m SessionManager) cache(uid string, session *Session) {
-	data, _ := json.Marshal(&session)
-	m.redis.HMSet(context.TODO(), "tsubaki:sessions", uid, string(data))
+func (m *SessionManager) cache(uid string, session *Session) {
+	if err := m.store.Set(context.TODO(), uid, session); err != nil {
+		logrus.Errorf("Unable to store session for uid %s:\n%v", uid, err)
+	}
 }
 
-func (m SessionManager) Get(uid string) *Session {
-	res, err := m.redis.HGet(context.TODO(), "tsubaki:sessions", uid).Result()
+func (m *SessionManager) Get(uid string) *Session {
+	session, err := m.store.Get(context.TODO(), uid)
 	if err != nil {
-		if err == redis.Nil {
-			return nil
-		}
-
-		logrus.Errorf("Unable to fetch session for uid %s.", uid)
+		logrus.Errorf("Unable to fetch session for uid %s:\n%v", uid, err)
 		return nil
 	}
 
-	var session *Session
-	err = json.Unmarshal([]byte(res), &session)
-	if err != nil {
-		logrus.Warnf("Unable to unmarshal session packet for uid %s:\n%v", uid, err)
+	if session == nil {
 		return nil
 	}
 
@@ -196,11 +192,8 @@ func (m SessionManager) Get(uid string) *Session {
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
 			logrus.Warnf("User %s doesn't exist in the database anymore but sessions still exists!", uid)
-
-			_, err := m.redis.HDel(context.TODO(), "tsubaki:sessions", uid).Result()
-			if err != nil {
-				logrus.Fatalf("I was unable to delete the session packet for you. Maybe try using `redis-cli`?\n> HDEL tsubaki:sessions %s", uid)
-				return nil
+			if err := m.store.Delete(context.TODO(), uid); err != nil {
+				logrus.Errorf("Unable to delete the session of user %s:\n%v", uid, err)
 			}
 
 			return nil
@@ -213,13 +206,8 @@ func (m SessionManager) Get(uid string) *Session {
 	return session
 }
 
-func (m SessionManager) New(uid string) *Session {
+func (m *SessionManager) New(uid string) *Session {
 	logrus.Infof("Creating session for user %s...", uid)
-	token, err := pkg.NewToken(uid)
-	if err != nil {
-		logrus.Errorf("Unable to create JWT token for uid %s:\n%v", uid, err)
-		return nil
-	}
 
 	// find the user in the database
 	user, err := m.prisma.User.FindUnique(db.User.ID.Equals(uid)).Exec(context.TODO())
@@ -228,40 +216,88 @@ func (m SessionManager) New(uid string) *Session {
 		return nil
 	}
 
+	token, err := pkg.NewToken(uid, user.TokenVersion)
+	if err != nil {
+		logrus.Errorf("Unable to create JWT token for uid %s:\n%v", uid, err)
+		return nil
+	}
+
 	sess := NewSession(user, token)
 	m.cache(uid, sess)
+
+	m.mutex.Lock()
 	m.sessions[uid] = sess
+	m.mutex.Unlock()
 
-	return nil
+	return sess
 }
 
-func (m SessionManager) Delete(uid string) {
-	logrus.Warnf("Deleting session for user %s...", uid)
-	_, err := m.redis.HDel(context.TODO(), "tsubaki:sessions", uid).Result()
+// Active returns how many sessions in the store haven't expired yet.
+func (m *SessionManager) Active() (int, error) {
+	all, err := m.store.All(context.TODO())
 	if err != nil {
-		if err == redis.Nil {
-			return
+		return 0, err
+	}
+
+	active := 0
+	for _, session := range all {
+		if !session.Expired() {
+			active++
 		}
+	}
+
+	return active, nil
+}
+
+func (m *SessionManager) Delete(uid string) {
+	logrus.Warnf("Deleting session for user %s...", uid)
+
+	// Close re-caches in-memory sessions that are missing from the store, so drop it here too.
+	m.mutex.Lock()
+	delete(m.sessions, uid)
+	m.mutex.Unlock()
+
+	if err := m.store.Delete(context.TODO(), uid); err != nil {
 		logrus.Errorf("Unable to delete session from user %s:\n%v", uid, err)
 	}
 }
 
-func (m SessionManager) Close() error {
-	logrus.Info("Storing cached sessions in Redis!")
+// Revoke bumps the token version of user `uid` so every token issued to them stops
+// working, and deletes their cached session. Queries in `with` are run in the same
+// transaction, so a password change is never committed without the revocation.
+func Revoke(ctx context.Context, prisma *db.PrismaClient, uid string, with ...transaction.Param) error {
+	bump := prisma.Prisma.ExecuteRaw(
+		`UPDATE "users" SET "token_version" = "token_version" + 1 WHERE "id" = $1`,
+		uid,
+	).Tx()
+
+	if err := prisma.Prisma.Transaction(append(with, bump)...).Exec(ctx); err != nil {
+		return err
+	}
+
+	if Sessions != nil {
+		Sessions.Delete(uid)
+	}
+
+	return nil
+}
+
+func (m *SessionManager) Close() error {
+	logrus.Info("Storing cached sessions!")
 
-	for ip, value := range m.sessions {
+	for uid, value := range m.snapshot() {
 		// Check if it exists
-		b, err := m.redis.HExists(context.TODO(), "tsubaki:ratelimits", ip).Result()
+		existing, err := m.store.Get(context.TODO(), uid)
 		if err != nil {
-			logrus.Fatalf("Unable to check if IP '%s' existed in ratelimit map: %v", ip, err)
+			logrus.Errorf("Unable to check if the session for uid %s exists: %v", uid, err)
 			continue
 		}
 
-		if !b {
-			m.cache(ip, value)
+		if existing == nil {
+			m.cache(uid, value)
 		}
 	}
 
-	logrus.Info("Cached in-memory sessions in Redis!")
+	logrus.Info("Cached in-memory sessions!")
 	return nil
 }
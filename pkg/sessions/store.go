@@ -0,0 +1,227 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is where sessions are persisted, sessions are keyed by the user's ID.
+type Store interface {
+	// Get returns the user's session, or nil if they don't have one.
+	Get(ctx context.Context, uid string) (*Session, error)
+
+	// All returns every session.
+	All(ctx context.Context) (map[string]*Session, error)
+
+	// Set stores the user's session.
+	Set(ctx context.Context, uid string, session *Session) error
+
+	// Delete deletes the user's session.
+	Delete(ctx context.Context, uid string) error
+}
+
+// RedisStore stores sessions in the `tsubaki:sessions` hash, so they are shared
+// between replicas.
+type RedisStore struct {
+	redis *redis.Client
+}
+
+// NewRedisStore creates a new RedisStore.
+func NewRedisStore(redis *redis.Client) *RedisStore {
+	return &RedisStore{redis: redis}
+}
+
+func (s *RedisStore) Get(ctx context.Context, uid string) (*Session, error) {
+	res, err := s.redis.HGet(ctx, "tsubaki:sessions", uid).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var session *Session
+	if err := json.Unmarshal([]byte(res), &session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (s *RedisStore) All(ctx context.Context) (map[string]*Session, error) {
+	res, err := s.redis.HGetAll(ctx, "tsubaki:sessions").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeAll(res), nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, uid string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.HSet(ctx, "tsubaki:sessions", uid, string(data)).Err()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, uid string) error {
+	return s.redis.HDel(ctx, "tsubaki:sessions", uid).Err()
+}
+
+// MemoryStore keeps sessions in memory, so they are lost when Tsubaki restarts. This
+// is only meant for single-node installs and tests.
+type MemoryStore struct {
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+}
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]*Session)}
+}
+
+func (s *MemoryStore) Get(_ context.Context, uid string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.sessions[uid], nil
+}
+
+func (s *MemoryStore) All(_ context.Context) (map[string]*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sessions := make(map[string]*Session, len(s.sessions))
+	for uid, session := range s.sessions {
+		sessions[uid] = session
+	}
+
+	return sessions, nil
+}
+
+func (s *MemoryStore) Set(_ context.Context, uid string, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[uid] = session
+	return nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, uid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, uid)
+	return nil
+}
+
+// boltBucket is the BoltDB bucket that sessions are stored in.
+var boltBucket = []byte("sessions")
+
+// BoltStore stores sessions in a BoltDB file, so they survive restarts on
+// single-node installs.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore creates a new BoltStore and creates the sessions bucket if it
+// doesn't exist.
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(_ context.Context, uid string) (*Session, error) {
+	var session *Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltBucket).Get([]byte(uid))
+		if data == nil {
+			return nil
+		}
+
+		return json.Unmarshal(data, &session)
+	})
+
+	return session, err
+}
+
+func (s *BoltStore) All(_ context.Context) (map[string]*Session, error) {
+	raw := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key, value []byte) error {
+			raw[string(key)] = string(value)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeAll(raw), nil
+}
+
+func (s *BoltStore) Set(_ context.Context, uid string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(uid), data)
+	})
+}
+
+func (s *BoltStore) Delete(_ context.Context, uid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(uid))
+	})
+}
+
+// decodeAll unmarshals the raw sessions, and skips the ones that can't be unmarshalled.
+func decodeAll(raw map[string]string) map[string]*Session {
+	sessions := make(map[string]*Session, len(raw))
+	for uid, value := range raw {
+		var session Session
+		if err := json.Unmarshal([]byte(value), &session); err != nil {
+			logrus.Warnf("Unable to unmarshal packet for %s:\n%v", uid, err)
+			continue
+		}
+
+		sessions[uid] = &session
+	}
+
+	return sessions
+}
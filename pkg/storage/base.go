@@ -16,6 +16,14 @@
 
 package storage
 
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by BaseStorageProvider.Open if the file doesn't exist.
+var ErrNotFound = errors.New("file was not found")
+
 // FormatVersion refers to the format version of the `metadata.lock` file.
 type FormatVersion int
 
@@ -48,6 +56,22 @@ type BaseStorageProvider interface {
 
 	// Name returns the name of this BaseStorageProvider.
 	Name() string
+
+	// Usage returns how many bytes are stored in this BaseStorageProvider.
+	Usage() (int64, error)
+
+	// Put stores `data` under `path`, relative to the root of this BaseStorageProvider.
+	Put(path string, contentType string, data []byte) error
+
+	// Open returns the contents of the file under `path`, or ErrNotFound if it doesn't exist.
+	Open(path string) (io.ReadCloser, error)
+
+	// Delete removes the file under `path`, or every file under it if it's a directory.
+	Delete(path string) error
+
+	// List returns the path of every file under the `path` directory, relative to the
+	// root of this BaseStorageProvider.
+	List(path string) ([]string, error)
 }
 
 // ProjectMetadata represents the metadata stored under `id/project/metadata.json`
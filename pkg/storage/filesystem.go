@@ -19,6 +19,7 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -101,6 +102,72 @@ func (fs FilesystemProvider) Name() string {
 	return "filesystem"
 }
 
+func (fs FilesystemProvider) Usage() (int64, error) {
+	var size int64
+	err := filepath.Walk(fs.Directory, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func (fs FilesystemProvider) Put(path string, _ string, data []byte) error {
+	path = filepath.Join(fs.Directory, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func (fs FilesystemProvider) Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(fs.Directory, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return file, err
+}
+
+func (fs FilesystemProvider) Delete(path string) error {
+	return os.RemoveAll(filepath.Join(fs.Directory, filepath.FromSlash(path)))
+}
+
+func (fs FilesystemProvider) List(path string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(filepath.Join(fs.Directory, filepath.FromSlash(path)), func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fs.Directory, file)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+
+	return files, err
+}
+
 func (fs FilesystemProvider) GetMetadata(id string, project string) (*ProjectMetadata, error) {
 	logrus.Debugf("Told to grab metadata for project %s/%s", id, project)
 
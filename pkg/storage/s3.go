@@ -17,11 +17,14 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -200,6 +203,95 @@ func (s *S3StorageProvider) Name() string {
 	return "s3"
 }
 
+func (s *S3StorageProvider) Usage() (int64, error) {
+	var size int64
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &s.config.Bucket,
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			size += aws.Int64Value(object.Size)
+		}
+
+		return true
+	})
+
+	return size, err
+}
+
+func (s *S3StorageProvider) Put(path string, contentType string, data []byte) error {
+	_, err := s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      &s.config.Bucket,
+		Key:         aws.String(path),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+
+	return err
+}
+
+func (s *S3StorageProvider) Open(path string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: &s.config.Bucket,
+		Key:    aws.String(path),
+	})
+
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (s *S3StorageProvider) Delete(path string) error {
+	var deleteErr error
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &s.config.Bucket,
+		Prefix: aws.String(path),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			// Only delete `path` itself, or the objects in the `path` directory.
+			if *object.Key != path && !strings.HasPrefix(*object.Key, strings.TrimSuffix(path, "/")+"/") {
+				continue
+			}
+
+			if _, deleteErr = s.client.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: &s.config.Bucket,
+				Key:    object.Key,
+			}); deleteErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return deleteErr
+}
+
+func (s *S3StorageProvider) List(path string) ([]string, error) {
+	files := make([]string, 0)
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &s.config.Bucket,
+		Prefix: aws.String(strings.TrimSuffix(path, "/") + "/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			files = append(files, *object.Key)
+		}
+
+		return true
+	})
+
+	return files, err
+}
+
 func (s *S3StorageProvider) GetMetadata(id string, project string) (*ProjectMetadata, error) {
 	logrus.Debugf("Told to grab project metadata for project %s/%s!", id, project)
 
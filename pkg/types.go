@@ -16,7 +16,11 @@
 
 package pkg
 
-import "arisu.land/tsubaki/prisma/db"
+import (
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/prisma/db"
+	"time"
+)
 
 type IndexedUser struct {
 	Description *string `json:"description"`
@@ -44,3 +48,41 @@ func FromDbUserModel(model db.UserModel) IndexedUser {
 		ID:          model.ID,
 	}
 }
+
+type IndexedProject struct {
+	Description    *string `json:"description"`
+	CreatedAt      string  `json:"created_at"`
+	OrganizationID *string `json:"organization_id"`
+	OwnerID        *string `json:"owner_id"`
+	Private        bool    `json:"private"`
+	Name           string  `json:"name"`
+	ID             string  `json:"id"`
+}
+
+func FromDbProjectModel(model db.ProjectModel) IndexedProject {
+	var desc *string
+	var ownerID *string
+	var orgID *string
+
+	if d, ok := model.Description(); ok {
+		desc = &d
+	}
+
+	if o, ok := model.OwnerID(); ok {
+		ownerID = &o
+	}
+
+	if o, ok := model.OrganizationID(); ok {
+		orgID = &o
+	}
+
+	return IndexedProject{
+		Description:    desc,
+		CreatedAt:      model.CreatedAt.Format(time.RFC3339),
+		OrganizationID: orgID,
+		OwnerID:        ownerID,
+		Private:        flags.ProjectFlags(model.Flags).Has(flags.Private),
+		Name:           model.Name,
+		ID:             model.ID,
+	}
+}
@@ -0,0 +1,16 @@
+-- CreateTable
+CREATE TABLE "identities" (
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "provider" TEXT NOT NULL,
+    "subject" TEXT NOT NULL,
+    "owner_id" TEXT NOT NULL,
+    "id" TEXT NOT NULL,
+
+    CONSTRAINT "identities_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "identities_provider_subject_key" ON "identities"("provider", "subject");
+
+-- AddForeignKey
+ALTER TABLE "identities" ADD CONSTRAINT "identities_owner_id_fkey" FOREIGN KEY ("owner_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
@@ -0,0 +1,39 @@
+-- CreateTable
+CREATE TABLE "invites" (
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "expires_at" TIMESTAMP(3),
+    "revoked_at" TIMESTAMP(3),
+    "inviter_id" TEXT NOT NULL,
+    "max_uses" INTEGER NOT NULL DEFAULT 1,
+    "email" TEXT,
+    "uses" INTEGER NOT NULL DEFAULT 0,
+    "code" TEXT NOT NULL,
+    "id" TEXT NOT NULL,
+
+    CONSTRAINT "invites_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateTable
+CREATE TABLE "invite_uses" (
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "invite_id" TEXT NOT NULL,
+    "user_id" TEXT NOT NULL,
+    "id" TEXT NOT NULL,
+
+    CONSTRAINT "invite_uses_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "invites_code_key" ON "invites"("code");
+
+-- CreateIndex
+CREATE UNIQUE INDEX "invite_uses_user_id_key" ON "invite_uses"("user_id");
+
+-- AddForeignKey
+ALTER TABLE "invites" ADD CONSTRAINT "invites_inviter_id_fkey" FOREIGN KEY ("inviter_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+
+-- AddForeignKey
+ALTER TABLE "invite_uses" ADD CONSTRAINT "invite_uses_invite_id_fkey" FOREIGN KEY ("invite_id") REFERENCES "invites"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+
+-- AddForeignKey
+ALTER TABLE "invite_uses" ADD CONSTRAINT "invite_uses_user_id_fkey" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
@@ -0,0 +1,19 @@
+-- CreateTable
+CREATE TABLE "audit_logs" (
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "actor_id" TEXT NOT NULL,
+    "target_id" TEXT,
+    "details" TEXT,
+    "action" TEXT NOT NULL,
+    "reason" TEXT,
+    "ip" TEXT,
+    "id" TEXT NOT NULL,
+
+    CONSTRAINT "audit_logs_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE INDEX "audit_logs_target_id_idx" ON "audit_logs"("target_id");
+
+-- CreateIndex
+CREATE INDEX "audit_logs_created_at_idx" ON "audit_logs"("created_at");
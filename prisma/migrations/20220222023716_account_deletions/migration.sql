@@ -0,0 +1,14 @@
+-- CreateTable
+CREATE TABLE "account_deletions" (
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "transfer_to" TEXT,
+    "last_error" TEXT,
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "user_id" TEXT NOT NULL,
+    "id" TEXT NOT NULL,
+
+    CONSTRAINT "account_deletions_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "account_deletions_user_id_key" ON "account_deletions"("user_id");
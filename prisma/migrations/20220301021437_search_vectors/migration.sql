@@ -0,0 +1,20 @@
+-- The `simple` configuration doesn't stem words, so names and descriptions in any language can be searched.
+
+-- AlterTable
+ALTER TABLE "users" ADD COLUMN "search_vector" tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce("username", '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce("name", '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce("description", '')), 'C')
+) STORED;
+
+-- AlterTable
+ALTER TABLE "projects" ADD COLUMN "search_vector" tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce("name", '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce("description", '')), 'C')
+) STORED;
+
+-- CreateIndex
+CREATE INDEX "users_search_vector_idx" ON "users" USING GIN ("search_vector");
+
+-- CreateIndex
+CREATE INDEX "projects_search_vector_idx" ON "projects" USING GIN ("search_vector");
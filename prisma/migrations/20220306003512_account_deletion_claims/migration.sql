@@ -0,0 +1,2 @@
+-- AlterTable
+ALTER TABLE "account_deletions" ADD COLUMN     "claimed_until" TIMESTAMP(3);
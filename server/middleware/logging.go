@@ -18,7 +18,7 @@ package middleware
 
 import (
 	"arisu.land/tsubaki/internal"
-	"arisu.land/tsubaki/pkg/ratelimit"
+	"arisu.land/tsubaki/pkg/clientip"
 	"arisu.land/tsubaki/util"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sirupsen/logrus"
@@ -34,7 +34,7 @@ func Logging(next http.Handler) http.Handler {
 
 		code := util.GetStatusCode(ww.Status())
 		logrus.Infof("[%s] %s %s (%s) => %d %s (%d bytes written | %s)",
-			ratelimit.RealIP(req),
+			clientip.FromRequest(req),
 			req.Method,
 			req.URL.Path,
 			req.Proto,
@@ -17,20 +17,230 @@
 package api
 
 import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/clientip"
+	"arisu.land/tsubaki/pkg/flags"
+	"arisu.land/tsubaki/pkg/result"
 	"arisu.land/tsubaki/util"
+	"encoding/json"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"net/http"
+	"strconv"
 )
 
-func newAdminRouter() chi.Router {
+func newAdminRouter(controller controllers.Controller) chi.Router {
 	r := chi.NewRouter()
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		util.WriteJson(w, 401, struct {
+
+	// Every route in the admin API requires an administrator, that isn't being impersonated.
+	r.Use(rejectImpersonation)
+	r.Use(flags.RequireFlag(flags.Admin))
+
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		util.WriteJson(w, 200, struct {
 			Message string `json:"message"`
 		}{
-			Message: "You're not supposed to be here, are you?",
+			Message: "Welcome to the Admin API! Read more here: https://docs.arisu.land/api/admin",
 		})
 	})
 
+	r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.Stats()
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/users", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		page, perPage, ok := pageParams(w, req)
+		if !ok {
+			return
+		}
+
+		var disabled *bool
+		if value := query.Get("disabled"); value != "" {
+			d, err := strconv.ParseBool(value)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_DISABLED", "`disabled` must be `true` or `false`."))
+				return
+			}
+
+			disabled = &d
+		}
+
+		res := controller.Admin.Users(query.Get("q"), disabled, page, perPage)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/users/{id}/disable", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.DisableUser(actor(req), clientip.FromRequest(req), chi.URLParam(req, "id"), reason(req))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/users/{id}/enable", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.EnableUser(actor(req), clientip.FromRequest(req), chi.URLParam(req, "id"), reason(req))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/users/{id}/password/reset", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.ForcePasswordReset(actor(req), clientip.FromRequest(req), chi.URLParam(req, "id"), reason(req))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Put("/users/{id}/flags", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		raw, ok := data["flags"]
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_FLAGS", "Missing the `flags` to set."))
+			return
+		}
+
+		// `flags` can be a list of names or the raw bitfield, so let UserFlags decode it.
+		var userFlags flags.UserFlags
+		encoded, _ := json.Marshal(raw)
+		if err := json.Unmarshal(encoded, &userFlags); err != nil {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_FLAGS", err.Error()))
+			return
+		}
+
+		why, _ := data["reason"].(string)
+		res := controller.Admin.SetUserFlags(actor(req), clientip.FromRequest(req), chi.URLParam(req, "id"), userFlags, why)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/users/{id}/impersonate", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.Impersonate(actor(req), clientip.FromRequest(req), chi.URLParam(req, "id"), reason(req))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/users/{id}", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.DeleteUser(actor(req), clientip.FromRequest(req), chi.URLParam(req, "id"), reason(req))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/audit-log", func(w http.ResponseWriter, req *http.Request) {
+		page, perPage, ok := pageParams(w, req)
+		if !ok {
+			return
+		}
+
+		res := controller.Admin.AuditLogs(req.URL.Query().Get("target"), page, perPage)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/lockouts", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.Lockouts()
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/lockouts/{kind}/{key}", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.ClearLockout(chi.URLParam(req, "kind"), chi.URLParam(req, "key"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/firewall", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.Firewall()
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/firewall/bans", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		ip, ok := data["ip"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_IP", "Missing the `ip` to ban."))
+			return
+		}
+
+		// JSON numbers are decoded as float64
+		duration := 0
+		if value, ok := data["duration"].(float64); ok {
+			duration = int(value)
+		}
+
+		reason, _ := data["reason"].(string)
+		res := controller.Admin.Ban(ip, duration, reason)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/firewall/bans/{ip}", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.Unban(chi.URLParam(req, "ip"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/firewall/{list}", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		cidr, ok := data["cidr"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_CIDR", "Missing the `cidr` to add."))
+			return
+		}
+
+		res := controller.Admin.AddFirewallRule(chi.URLParam(req, "list"), cidr)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	// CIDRs contain a slash, so they're passed in the query string instead.
+	r.Delete("/firewall/{list}", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Admin.RemoveFirewallRule(chi.URLParam(req, "list"), req.URL.Query().Get("cidr"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	return r
+}
+
+// actor returns the ID of the administrator that made the request.
+func actor(req *http.Request) string {
+	uid, _ := req.Context().Value("userId").(string)
+	return uid
+}
+
+// reason returns the optional `reason` from the request body, which is recorded
+// in the audit log.
+func reason(req *http.Request) string {
+	if req.ContentLength == 0 {
+		return ""
+	}
+
+	_, data, err := util.GetJsonBody(req)
+	if err != nil {
+		return ""
+	}
+
+	r, _ := data["reason"].(string)
 	return r
 }
+
+// pageParams parses the `page` and `per_page` query parameters, it writes an error
+// and returns false if they aren't numbers.
+func pageParams(w http.ResponseWriter, req *http.Request) (int, int, bool) {
+	query := req.URL.Query()
+	params := make([]int, 2)
+
+	for i, key := range []string{"page", "per_page"} {
+		if value := query.Get(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_PAGINATION", fmt.Sprintf("`%s` must be a number.", key)))
+				return 0, 0, false
+			}
+
+			params[i] = n
+		}
+	}
+
+	return params[0], params[1], true
+}
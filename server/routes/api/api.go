@@ -25,6 +25,7 @@ import (
 
 func NewApiV1Router(controller controllers.Controller) chi.Router {
 	r := chi.NewRouter()
+	r.Use(auditImpersonation(controller))
 
 	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
 		util.WriteJson(w, 200, struct {
@@ -41,12 +42,14 @@ func NewApiV1Router(controller controllers.Controller) chi.Router {
 	})
 
 	r.Mount("/users", newUserApiRouter(controller))
-	r.Mount("/admin", newAdminRouter())
-	r.Mount("/login", newLoginApiRouter())
-	r.Mount("/search", newSearchApiRouter())
+	r.Mount("/admin", newAdminRouter(controller))
+	r.Mount("/login", newLoginApiRouter(controller))
+	r.Mount("/invites", newInvitesApiRouter(controller))
+	r.Mount("/organizations", newOrganizationsApiRouter(controller))
+	r.Mount("/search", newSearchApiRouter(controller))
 	r.Mount("/storage", newStorageRouter())
-	r.Mount("/projects", newProjectsApiRouter())
-	r.Mount("/projects/acl", newProjectAclRouter())
+	r.Mount("/projects", newProjectsApiRouter(controller))
+	r.Mount("/projects/acl", newProjectAclRouter(controller))
 	r.Mount("/subprojects", newSubprojectsApiRouter())
 
 	return r
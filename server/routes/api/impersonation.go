@@ -0,0 +1,75 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/clientip"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/util"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// impersonator returns the ID of the administrator that is impersonating the user
+// of the request, if any.
+func impersonator(req *http.Request) (string, bool) {
+	id, ok := req.Context().Value("impersonatorId").(string)
+	return id, ok
+}
+
+// auditImpersonation records every request that changes data while an administrator
+// is impersonating a user, with the administrator as the actor. If it can't be
+// recorded, the request is rejected.
+func auditImpersonation(controller controllers.Controller) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			actorID, ok := impersonator(req)
+			if !ok {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			switch req.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			if err := controller.Admin.RecordImpersonatedWrite(actorID, clientip.FromRequest(req), actor(req), req.Method, req.URL.Path); err != nil {
+				logrus.Errorf("Unable to record request made while impersonating user %s: %v", actor(req), err)
+				util.WriteJson(w, 500, result.Err(500, "UNKNOWN_ERROR", "Unable to record the impersonated request, try again later."))
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// rejectImpersonation rejects impersonation tokens, so they can never be used on the
+// admin API even if the impersonated user is made an administrator afterwards.
+func rejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := impersonator(req); ok {
+			util.WriteJson(w, 403, result.Err(403, "IMPERSONATION_NOT_ALLOWED", "Impersonation tokens can't be used on the admin API."))
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
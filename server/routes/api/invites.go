@@ -0,0 +1,89 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/util"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+func newInvitesApiRouter(controller controllers.Controller) chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		// Check if we have the user token available
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Invites.List(uid.(string))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+		// Check if we have the user token available
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		var email *string
+		if value, ok := data["email"].(string); ok {
+			email = &value
+		}
+
+		// JSON numbers are decoded as float64
+		maxUses := 1
+		if value, ok := data["max_uses"].(float64); ok {
+			maxUses = int(value)
+		}
+
+		expiresIn := 0
+		if value, ok := data["expires_in"].(float64); ok {
+			expiresIn = int(value)
+		}
+
+		res := controller.Invites.Create(uid.(string), email, maxUses, expiresIn)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		// Check if we have the user token available
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Invites.Revoke(uid.(string), chi.URLParam(req, "id"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	return r
+}
@@ -16,10 +16,81 @@
 
 package api
 
-import "github.com/go-chi/chi/v5"
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/auth"
+	"arisu.land/tsubaki/pkg/clientip"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/util"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
 
-func newLoginApiRouter() chi.Router {
+func newLoginApiRouter(controller controllers.Controller) chi.Router {
 	r := chi.NewRouter()
 
+	r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		username, ok := data["username"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_USERNAME", "Missing `username` field in body or `username` was not a valid string."))
+			return
+		}
+
+		password, ok := data["password"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_PASSWORD", "Missing `password` field in body or `password` was not a valid string."))
+			return
+		}
+
+		res := controller.Login.Login(username, password, clientip.FromRequest(req))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/oidc/authorize", func(w http.ResponseWriter, req *http.Request) {
+		url, state, res := controller.Login.OIDCAuthorize(req.URL.Query().Get("invite"))
+		if res != nil {
+			util.WriteJson(w, res.StatusCode, res)
+			return
+		}
+
+		http.SetCookie(w, auth.StateCookie(state))
+		http.Redirect(w, req, url, http.StatusFound)
+	})
+
+	r.Get("/oidc/callback", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+
+		// The identity provider can redirect back with an error
+		// if the user declined the login.
+		if e := query.Get("error"); e != "" {
+			util.WriteJson(w, 401, result.Err(401, "OIDC_AUTHORIZATION_DENIED", query.Get("error_description")))
+			return
+		}
+
+		state := query.Get("state")
+		code := query.Get("code")
+		if state == "" || code == "" {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_OIDC_PARAMETERS", "Missing `state` or `code` query parameters."))
+			return
+		}
+
+		// The callback has to come back to the browser that started the flow,
+		// or anyone could log someone else in with their own callback URL.
+		if !auth.VerifyStateCookie(req, state) {
+			util.WriteJson(w, 400, result.Err(400, "INVALID_OIDC_STATE", "The login request wasn't started in this browser, try again."))
+			return
+		}
+
+		http.SetCookie(w, auth.ClearStateCookie())
+		res := controller.Login.OIDCCallback(state, code)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
 	return r
 }
@@ -0,0 +1,246 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/internal/types"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/prisma/db"
+	"arisu.land/tsubaki/util"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+)
+
+func newOrganizationsApiRouter(controller controllers.Controller) chi.Router {
+	r := chi.NewRouter()
+
+	r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		name, ok := data["name"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_NAME", "Missing `name` field in body or `name` was not a valid string."))
+			return
+		}
+
+		res := controller.Organizations.Create(viewer.ID, name, optionalBodyString(data, "display_name"), optionalBodyString(data, "description"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/{name}", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Organizations.Get(chi.URLParam(req, "name"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Patch("/{name}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		status, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		jb, err := json.Marshal(data)
+		if err != nil {
+			util.WriteJson(w, 406, result.Err(406, "CANNOT_MARSHAL_BODY", err.Error()))
+			return
+		}
+
+		var update types.UpdateQuery
+		if err := json.Unmarshal(jb, &update); err != nil {
+			util.WriteJson(w, 406, result.Err(406, "CANNOT_DESERIALIZE_BODY", err.Error()))
+			return
+		}
+
+		res := controller.Organizations.Update(viewer, chi.URLParam(req, "name"), update)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/{name}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Organizations.Delete(viewer, chi.URLParam(req, "name"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/{name}/projects", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+
+		limit := 0
+		if value := query.Get("limit"); value != "" {
+			l, err := strconv.Atoi(value)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_LIMIT", "`limit` must be a number."))
+				return
+			}
+
+			limit = l
+		}
+
+		res := controller.Organizations.Projects(viewerFromRequest(req), chi.URLParam(req, "name"), query.Get("cursor"), limit)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/{name}/members", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Organizations.Members(chi.URLParam(req, "name"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Put("/{name}/members/{user}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		role, ok := data["role"].(string)
+		if !ok {
+			role = string(db.OrganizationRoleMEMBER)
+		}
+
+		res := controller.Organizations.SetMember(viewer, chi.URLParam(req, "name"), chi.URLParam(req, "user"), db.OrganizationRole(role))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/{name}/members/{user}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Organizations.RemoveMember(viewer, chi.URLParam(req, "name"), chi.URLParam(req, "user"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/{name}/teams", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Organizations.Teams(chi.URLParam(req, "name"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/{name}/teams", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		name, ok := data["name"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_NAME", "Missing `name` field in body or `name` was not a valid string."))
+			return
+		}
+
+		res := controller.Organizations.CreateTeam(viewer, chi.URLParam(req, "name"), name, optionalBodyString(data, "description"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/{name}/teams/{team}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Organizations.DeleteTeam(viewer, chi.URLParam(req, "name"), chi.URLParam(req, "team"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/{name}/teams/{team}/members", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Organizations.TeamMembers(chi.URLParam(req, "name"), chi.URLParam(req, "team"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Put("/{name}/teams/{team}/members/{user}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		role, ok := data["role"].(string)
+		if !ok {
+			role = string(db.TeamRoleMEMBER)
+		}
+
+		res := controller.Organizations.SetTeamMember(viewer, chi.URLParam(req, "name"), chi.URLParam(req, "team"), chi.URLParam(req, "user"), db.TeamRole(role))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/{name}/teams/{team}/members/{user}", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Organizations.RemoveTeamMember(viewer, chi.URLParam(req, "name"), chi.URLParam(req, "team"), chi.URLParam(req, "user"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	return r
+}
+
+// optionalBodyString returns the `key` field of the body, or nil if it's missing or not a string.
+func optionalBodyString(data map[string]interface{}, key string) *string {
+	value, ok := data[key].(string)
+	if !ok {
+		return nil
+	}
+
+	return &value
+}
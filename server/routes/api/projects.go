@@ -1,10 +1,37 @@
 package api
 
-import "github.com/go-chi/chi/v5"
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/util"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
 
-func newProjectsApiRouter() chi.Router {
+func newProjectsApiRouter(controller controllers.Controller) chi.Router {
 	r := chi.NewRouter()
 
+	r.Post("/{id}/transfer", func(w http.ResponseWriter, req *http.Request) {
+		viewer := viewerFromRequest(req)
+		if viewer.ID == "" {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		// The project is given to either a user or an organization.
+		username, _ := data["user"].(string)
+		organization, _ := data["organization"].(string)
+
+		res := controller.Projects.Transfer(viewer, chi.URLParam(req, "id"), username, organization)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
 	return r
 }
 
@@ -14,8 +41,13 @@ func newSubprojectsApiRouter() chi.Router {
 	return r
 }
 
-func newProjectAclRouter() chi.Router {
+func newProjectAclRouter(controller controllers.Controller) chi.Router {
 	r := chi.NewRouter()
 
+	r.Get("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		res := controller.Projects.Permissions(viewerFromRequest(req), chi.URLParam(req, "id"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
 	return r
 }
@@ -16,10 +16,36 @@
 
 package api
 
-import "github.com/go-chi/chi/v5"
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/pkg/search"
+	"arisu.land/tsubaki/util"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+)
 
-func newSearchApiRouter() chi.Router {
+func newSearchApiRouter(controller controllers.Controller) chi.Router {
 	r := chi.NewRouter()
 
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+
+		limit := 0
+		if value := query.Get("limit"); value != "" {
+			l, err := strconv.Atoi(value)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_LIMIT", "`limit` must be a number."))
+				return
+			}
+
+			limit = l
+		}
+
+		res := controller.Search.Search(viewerFromRequest(req), query.Get("q"), search.Type(query.Get("type")), query.Get("cursor"), limit)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
 	return r
 }
@@ -19,11 +19,18 @@ package api
 import (
 	"arisu.land/tsubaki/internal/controllers"
 	"arisu.land/tsubaki/internal/types"
+	"arisu.land/tsubaki/pkg/avatars"
+	"arisu.land/tsubaki/pkg/flags"
 	"arisu.land/tsubaki/pkg/result"
 	"arisu.land/tsubaki/util"
 	"encoding/json"
+	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type userResponse struct {
@@ -62,9 +69,34 @@ func newUserApiRouter(controller controllers.Controller) chi.Router {
 		util.WriteJson(w, res.StatusCode, res)
 	})
 
-	//r.Get("/{id}/projects", func(w http.ResponseWriter, req *http.Request) {
-	//
-	//})
+	r.Get("/{id}/projects", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		viewer := viewerFromRequest(req)
+
+		id := chi.URLParam(req, "id")
+		if id == "@me" {
+			if viewer.ID == "" {
+				util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+				return
+			}
+
+			id = viewer.ID
+		}
+
+		limit := 0
+		if value := query.Get("limit"); value != "" {
+			l, err := strconv.Atoi(value)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_LIMIT", "`limit` must be a number."))
+				return
+			}
+
+			limit = l
+		}
+
+		res := controller.Users.Projects(viewer, id, controllers.ProjectFilter(query.Get("filter")), query.Get("cursor"), limit)
+		util.WriteJson(w, res.StatusCode, res)
+	})
 
 	r.Post("/", func(w http.ResponseWriter, req *http.Request) {
 		statusCode, data, err := util.GetJsonBody(req)
@@ -91,7 +123,157 @@ func newUserApiRouter(controller controllers.Controller) chi.Router {
 			return
 		}
 
-		res := controller.Users.Create(username, password, email)
+		// The invite code is only required on invite-only instances.
+		invite, _ := data["invite"].(string)
+
+		res := controller.Users.Create(username, password, email, invite)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/@me/verify", func(w http.ResponseWriter, req *http.Request) {
+		// Check if we have the user token available
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Users.SendVerificationEmail(uid.(string))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/verify", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		token, ok := data["token"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_TOKEN", "Missing `token` field in body or `token` was not a valid string."))
+			return
+		}
+
+		res := controller.Users.VerifyEmail(token)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/password/reset", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		email, ok := data["email"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_EMAIL", "Missing `email` field in body or `email` was not a valid string."))
+			return
+		}
+
+		res := controller.Users.RequestPasswordReset(email)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Post("/password/reset/confirm", func(w http.ResponseWriter, req *http.Request) {
+		statusCode, data, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+			return
+		}
+
+		token, ok := data["token"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_TOKEN", "Missing `token` field in body or `token` was not a valid string."))
+			return
+		}
+
+		password, ok := data["password"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "MISSING_PASSWORD", "Missing `password` field in body or `password` was not a valid string."))
+			return
+		}
+
+		res := controller.Users.ResetPassword(token, password)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/@me", func(w http.ResponseWriter, req *http.Request) {
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		// The current password, or a login right before, is required so a leaked token isn't
+		// enough to delete the account.
+		var password string
+		if req.ContentLength != 0 {
+			statusCode, data, err := util.GetJsonBody(req)
+			if err != nil {
+				util.WriteJson(w, statusCode, result.Err(statusCode, "INVALID_BODY_STRUCTURE", err.Error()))
+				return
+			}
+
+			password, _ = data["password"].(string)
+		}
+
+		loggedInAt, _ := req.Context().Value("issuedAt").(time.Time)
+
+		// Projects are deleted with the account, unless they should be given to someone else.
+		res := controller.Users.RequestDeletion(uid.(string), password, loggedInAt, req.URL.Query().Get("transfer_to"))
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Get("/@me/export", func(w http.ResponseWriter, req *http.Request) {
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		export, res := controller.Users.Export(uid.(string))
+		if res != nil {
+			util.WriteJson(w, res.StatusCode, res)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="arisu-export.zip"`)
+		w.WriteHeader(200)
+
+		// The headers were already sent, so all we can do is log it.
+		if err := export.WriteTo(w); err != nil {
+			logrus.Errorf("Unable to write data export of user %s: %v", uid, err)
+		}
+	})
+
+	r.Put("/@me/avatar", func(w http.ResponseWriter, req *http.Request) {
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, avatars.MaxFileSize))
+		if err != nil {
+			util.WriteJson(w, 413, result.Err(413, "AVATAR_TOO_LARGE", fmt.Sprintf("Avatars can't be bigger than %d MB.", avatars.MaxFileSize>>20)))
+			return
+		}
+
+		res := controller.Users.SetAvatar(uid.(string), data)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Delete("/@me/avatar", func(w http.ResponseWriter, req *http.Request) {
+		uid := req.Context().Value("userId")
+		if uid == nil {
+			util.WriteJson(w, 401, result.Err(401, "MISSING_AUTH_TOKEN", "Missing user token in request!"))
+			return
+		}
+
+		res := controller.Users.DeleteAvatar(uid.(string))
 		util.WriteJson(w, res.StatusCode, res)
 	})
 
@@ -128,9 +310,25 @@ func newUserApiRouter(controller controllers.Controller) chi.Router {
 			return
 		}
 
-		res := controller.Users.Update(uid.(string), update.Set)
+		// The current password is only required to change the password.
+		currentPassword, _ := data["current_password"].(string)
+		res := controller.Users.Update(uid.(string), update, currentPassword)
 		util.WriteJson(w, res.StatusCode, res)
 	})
 
 	return r
 }
+
+// viewerFromRequest returns who is making the request, so private projects can be hidden.
+func viewerFromRequest(req *http.Request) controllers.Viewer {
+	var viewer controllers.Viewer
+	if uid, ok := req.Context().Value("userId").(string); ok {
+		viewer.ID = uid
+	}
+
+	if f, ok := flags.FromRequest(req); ok {
+		viewer.Admin = f.Has(flags.Admin)
+	}
+
+	return viewer
+}
@@ -0,0 +1,72 @@
+// ☔ Arisu: Translation made with simplicity, yet robust.
+// Copyright (C) 2020-2022 Noelware
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"arisu.land/tsubaki/internal/controllers"
+	"arisu.land/tsubaki/pkg/avatars"
+	"arisu.land/tsubaki/pkg/result"
+	"arisu.land/tsubaki/util"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// NewAvatarsRouter serves the avatars users have uploaded. The hash in the path changes
+// whenever an avatar does, so they can be cached forever.
+func NewAvatarsRouter(controller controllers.Controller) chi.Router {
+	router := chi.NewRouter()
+	router.Get("/{id}/{hash}", func(w http.ResponseWriter, req *http.Request) {
+		size := avatars.DefaultSize
+		if value := req.URL.Query().Get("size"); value != "" {
+			s, err := strconv.Atoi(value)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_AVATAR_SIZE", "`size` must be a number."))
+				return
+			}
+
+			size = s
+		}
+
+		hash := chi.URLParam(req, "hash")
+		etag := fmt.Sprintf(`"%s-%d"`, hash, size)
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(304)
+			return
+		}
+
+		image, res := controller.Users.Avatar(chi.URLParam(req, "id"), hash, size)
+		if res != nil {
+			util.WriteJson(w, res.StatusCode, res)
+			return
+		}
+
+		defer func() {
+			_ = image.Close()
+		}()
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(200)
+		_, _ = io.Copy(w, image)
+	})
+
+	return router
+}
@@ -21,6 +21,7 @@ import (
 	"arisu.land/tsubaki/util"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -29,7 +30,10 @@ import (
 
 	"arisu.land/tsubaki/internal"
 	"arisu.land/tsubaki/pkg"
+	"arisu.land/tsubaki/pkg/clientip"
+	"arisu.land/tsubaki/pkg/events"
 	"arisu.land/tsubaki/pkg/ratelimit"
+	"arisu.land/tsubaki/pkg/search"
 	"arisu.land/tsubaki/pkg/sessions"
 	"arisu.land/tsubaki/server/middleware"
 	"arisu.land/tsubaki/server/routes"
@@ -57,11 +61,45 @@ func Start(path string) error {
 		return err
 	}
 
+	if pkg.GlobalContainer.Mailer != nil {
+		pkg.GlobalContainer.Mailer.Start()
+	}
+
 	logrus.Info("Starting up HTTP server!")
-	rl := ratelimit.NewRatelimiter(pkg.GlobalContainer.Redis)
+	resolver, err := clientip.NewResolver(pkg.GlobalContainer.Config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	sessionStore, ratelimitStore, err := newStores(pkg.GlobalContainer)
+	if err != nil {
+		return err
+	}
+
+	rl := ratelimit.NewRatelimiter(ratelimitStore, pkg.GlobalContainer.Config.Ratelimits)
 	router := chi.NewRouter()
-	sesh := sessions.NewSessionManager(pkg.GlobalContainer.Redis, pkg.GlobalContainer.Prisma)
+	sesh := sessions.NewSessionManager(sessionStore, pkg.GlobalContainer.Prisma)
 	controller := controllers.NewDbController()
+	controller.Admin.StartStatsCollector()
+	controller.Users.StartDeletionWorker()
+
+	if pkg.GlobalContainer.ElasticSearch != nil {
+		search.Changes = search.NewSyncer(pkg.GlobalContainer.ElasticSearch, pkg.GlobalContainer.Prisma, pkg.GlobalContainer.Redis)
+		search.Changes.Start()
+	}
+
+	events.NewRelay(pkg.GlobalContainer.Prisma, pkg.GlobalContainer.Kafka, pkg.GlobalContainer.Redis).Start()
+
+	var consumer *events.Consumer
+	if pkg.GlobalContainer.Config.Kafka != nil {
+		consumer = events.NewConsumer(pkg.GlobalContainer.Config.Kafka)
+		controller.Bot.Register(consumer)
+		if err := consumer.Start(); err != nil {
+			logrus.Errorf("Unable to consume GitHub bot requests: %v", err)
+			_ = consumer.Close()
+			consumer = nil
+		}
+	}
 
 	// Add global error handling for 404s and 405s!
 	router.NotFound(func(w http.ResponseWriter, req *http.Request) {
@@ -84,8 +122,16 @@ func Start(path string) error {
 		})
 	})
 
-	router.Use(rl.Middleware)
+	// The client IP and session need to be resolved first, so buckets can
+	// be keyed by them. The firewall has to run before the ratelimiter, so
+	// allowed IPs skip it and ratelimited responses count towards a ban.
+	router.Use(resolver.Middleware)
+	if pkg.GlobalContainer.Firewall != nil {
+		router.Use(pkg.GlobalContainer.Firewall.Middleware)
+	}
+
 	router.Use(sesh.Middleware)
+	router.Use(rl.Middleware)
 	router.Use(middleware.Headers)
 	router.Use(middleware.Logging)
 	router.Use(middleware.ErrorReporter)
@@ -93,6 +139,7 @@ func Start(path string) error {
 	router.Mount("/api", api.NewApiV1Router(controller))
 	router.Mount("/ping", routes.NewPingRouter(pkg.GlobalContainer))
 	router.Mount("/api/v1", api.NewApiV1Router(controller))
+	router.Mount("/avatars", routes.NewAvatarsRouter(controller))
 	router.Mount("/metrics", routes.NewMetricsRouter(pkg.GlobalContainer))
 	router.Mount("/version", routes.NewVersionRouter(pkg.GlobalContainer))
 	router.Mount("/integrations", integrations.NewIntegrationsRouter())
@@ -140,17 +187,26 @@ func Start(path string) error {
 	}()
 
 	defer func() {
-		// Cache all ratelimits + sessions
-		err = rl.Close()
-		if err != nil {
-			logrus.Errorf("Unable to cache all ratelimits: %v", err)
+		// Leave the consumer group, so its partitions are handed to the other replicas
+		if consumer != nil {
+			if err := consumer.Close(); err != nil {
+				logrus.Errorf("Unable to close the GitHub bot consumer: %v", err)
+			}
 		}
 
+		// Cache all sessions
 		err = sesh.Close()
 		if err != nil {
 			logrus.Errorf("Unable to cache all sessions: %v", err)
 		}
 
+		// Write the ratelimits that weren't flushed to disk yet
+		if closer, ok := ratelimitStore.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logrus.Errorf("Unable to save ratelimits: %v", err)
+			}
+		}
+
 		// Shutdown the container
 		err = pkg.GlobalContainer.Close()
 		if err != nil {
@@ -166,3 +222,28 @@ func Start(path string) error {
 
 	return nil
 }
+
+// newStores creates the session and ratelimit stores for the configured backend.
+func newStores(container *pkg.Container) (sessions.Store, ratelimit.Store, error) {
+	switch container.Config.Backend {
+	case pkg.MemoryBackend:
+		logrus.Warn("Sessions and ratelimits are kept in memory, so they will be lost when Tsubaki restarts!")
+		return sessions.NewMemoryStore(), ratelimit.NewMemoryStore(), nil
+
+	case pkg.BoltBackend:
+		sessionStore, err := sessions.NewBoltStore(container.Bolt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ratelimitStore, err := ratelimit.NewBoltStore(container.Bolt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return sessionStore, ratelimitStore, nil
+
+	default:
+		return sessions.NewRedisStore(container.Redis), ratelimit.NewRedisStore(container.Redis), nil
+	}
+}